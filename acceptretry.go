@@ -0,0 +1,70 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// acceptRestartMinDelay is the time waited before accepting again after the first recoverable error.
+	acceptRestartMinDelay = 5 * time.Millisecond
+	// acceptRestartMaxDelay is the time waited at most before accepting again. The delay doubles with each
+	// consecutive recoverable error until it reaches this.
+	acceptRestartMaxDelay = time.Second
+)
+
+// recoverableAccept reports if accepting may succeed again after err, like when the process or system ran out of
+// file descriptors or memory for a moment or a connection was aborted before it could be accepted.
+func recoverableAccept(err error) bool {
+	recoverable := []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED}
+
+	for _, errno := range recoverable {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// acceptBackoff is the delay before an accept loop is restarted after a recoverable error.
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// next returns the delay before the next restart and doubles it for the one after.
+func (b *acceptBackoff) next() time.Duration {
+	switch {
+	case b.delay == 0:
+		b.delay = acceptRestartMinDelay
+	case b.delay < acceptRestartMaxDelay:
+		b.delay *= 2
+		if b.delay > acceptRestartMaxDelay {
+			b.delay = acceptRestartMaxDelay
+		}
+	}
+
+	return b.delay
+}
+
+// reset starts the delay over after a connection was accepted.
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// accessEntry is the record written to the access log for each finished connection.
+type accessEntry struct {
+	Time          time.Time `json:"time"`
+	ID            uint64    `json:"id"`
+	Client        string    `json:"client"`
+	ClientName    string    `json:"clientName,omitempty"`
+	Local         string    `json:"local"`
+	Backend       string    `json:"backend,omitempty"`
+	ServerName    string    `json:"serverName,omitempty"`
+	JA3           string    `json:"ja3,omitempty"`
+	JA4           string    `json:"ja4,omitempty"`
+	Labels        Labels    `json:"labels,omitempty"`
+	Peer          *PeerCred `json:"peer,omitempty"`
+	DurationMS    int64     `json:"durationMs"`
+	BytesReceived int64     `json:"bytesReceived"`
+	BytesSent     int64     `json:"bytesSent"`
+	Error         string    `json:"error,omitempty"`
+	CloseReason   string    `json:"closeReason,omitempty"`
+	FailedPeer    string    `json:"failedPeer,omitempty"`
+}
+
+// accessLog writes accessEntry values as JSON lines to an io.Writer. Every entry is passed to the writer with a
+// single Write call.
+type accessLog struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// write encodes entry and writes it to the underlying writer.
+func (l *accessLog) write(entry accessEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encode access log entry: %w", err)
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write access log entry: %w", err)
+	}
+
+	return nil
+}
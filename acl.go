@@ -0,0 +1,63 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// clientACL decides which clients may connect by their IP address.
+type clientACL struct {
+	// allow are the networks clients must be in. Empty if all are allowed.
+	allow cidrList
+	// deny are the networks clients must not be in, even if allowed.
+	deny cidrList
+}
+
+// admits reports if the client at addr may connect. Clients without IP address, like those of unix sockets, always
+// may.
+func (a clientACL) admits(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+
+	if a.deny.containsIP(ip) {
+		return false
+	}
+
+	return len(a.allow) == 0 || a.allow.containsIP(ip)
+}
+
+// rejectClient closes src and reports true if the access control lists of the current generation do not admit its
+// client. This happens right after accepting, so denied clients take up no resources beyond the id that is logged for
+// them.
+func (p *proxy) rejectClient(src net.Conn) bool {
+	client := src.RemoteAddr()
+	if p.generation().cfg.clientACL.admits(client) {
+		return false
+	}
+
+	atomic.AddInt64(&p.stats.denied, 1)
+	p.metrics.denied.Add(1)
+	p.log.Info("client not admitted, closing accepted connection", "id", atomic.AddUint64(&p.lastID, 1),
+		"client", p.anonymizer.addr(client))
+
+	if err := src.Close(); err != nil {
+		p.log.Error(err, "couldn't close accepted connection")
+	}
+
+	return true
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"errors"
+	"io"
+)
+
+// copyBufferGrowth is the factor the copy buffer of adaptiveCopy grows by.
+const copyBufferGrowth = 2
+
+// adaptiveCopy copies from src to dst like io.Copy, but sizes its buffer by throughput. It starts with minSize bytes
+// and doubles the buffer up to maxSize whenever a read fills it. A read shorter than minSize means the stream is
+// trickling or about to go idle, so the buffer drops back to minSize before the next read blocks. This keeps idle
+// connections cheap while bulk transfers get large buffers.
+func adaptiveCopy(dst io.Writer, src io.Reader, minSize, maxSize int) (int64, error) {
+	var written int64
+
+	buf := make([]byte, minSize)
+
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			w, err := dst.Write(buf[:n])
+			written += int64(w)
+
+			switch {
+			case err != nil:
+				return written, err
+			case w != n:
+				return written, io.ErrShortWrite
+			}
+		}
+
+		switch {
+		case errors.Is(readErr, io.EOF):
+			return written, nil
+		case readErr != nil:
+			return written, readErr
+		case n == len(buf) && len(buf) < maxSize:
+			size := len(buf) * copyBufferGrowth
+			if size > maxSize {
+				size = maxSize
+			}
+
+			buf = make([]byte, size)
+		case n < minSize && len(buf) > minSize:
+			buf = make([]byte, minSize)
+		}
+	}
+}
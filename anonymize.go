@@ -0,0 +1,208 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// anonymizeKeySize is the size of the keys client addresses are hashed with.
+	anonymizeKeySize = 32
+	// anonymizeKeyLifetime is how long a hash key is used before it is replaced.
+	anonymizeKeyLifetime = 24 * time.Hour
+	// anonymizeHashLength is the number of hex digits of hashed addresses.
+	anonymizeHashLength = 16
+	// anonymizeIPv4Bits and anonymizeIPv6Bits are the prefix lengths truncated addresses keep.
+	anonymizeIPv4Bits, anonymizeIPv6Bits = 24, 48
+)
+
+// errUnknownAnonymizeMode is raised if an anonymizeMode can not be parsed.
+var errUnknownAnonymizeMode = errors.New("unknown anonymization mode")
+
+// anonymizeMode is how client addresses are shown in logs and on the control socket.
+type anonymizeMode int
+
+const (
+	// anonymizeOff shows client addresses as they are.
+	anonymizeOff anonymizeMode = iota
+	// anonymizeTruncate zeroes the last octet of IPv4 addresses and the last 80 bits of IPv6 addresses.
+	anonymizeTruncate
+	// anonymizeHash replaces addresses by a keyed hash. The key is random and replaced daily.
+	anonymizeHash
+)
+
+// parseAnonymizeMode returns the anonymizeMode called name. Valid names are off, truncate and hash.
+func parseAnonymizeMode(name string) (anonymizeMode, error) {
+	switch name {
+	case "off":
+		return anonymizeOff, nil
+	case "truncate":
+		return anonymizeTruncate, nil
+	case "hash":
+		return anonymizeHash, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", errUnknownAnonymizeMode, name)
+	}
+}
+
+// anonymizer turns client addresses into what is shown in logs and on the control socket. Connections keep the real
+// address for everything else, like hooks and limits.
+type anonymizer struct {
+	mode anonymizeMode
+	// clock tells when key is too old.
+	clock Clock
+	mtx   sync.Mutex
+	// key is the key of anonymizeHash. Nil for other modes.
+	key []byte
+	// keyCreated is the time key was generated.
+	keyCreated time.Time
+}
+
+// newAnonymizer creates an anonymizer that works as given by mode and ages its hash key on clock.
+func newAnonymizer(mode anonymizeMode, clock Clock) (*anonymizer, error) {
+	a := &anonymizer{mode: mode, clock: clock}
+
+	if mode == anonymizeHash {
+		if err := a.rotateKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// addr returns how addr is shown. Ports and addresses that are not IP addresses are kept.
+func (a *anonymizer) addr(addr net.Addr) string {
+	ip := addrIP(addr)
+	if a.mode == anonymizeOff || ip == nil {
+		return addr.String()
+	}
+
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return a.ip(ip)
+	}
+
+	return net.JoinHostPort(a.ip(ip), port)
+}
+
+// ip returns how ip is shown.
+func (a *anonymizer) ip(ip net.IP) string {
+	if a.mode == anonymizeTruncate {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(anonymizeIPv4Bits, net.IPv4len*8)).String()
+		}
+
+		return ip.Mask(net.CIDRMask(anonymizeIPv6Bits, net.IPv6len*8)).String()
+	}
+
+	mac := hmac.New(sha256.New, a.hashKey())
+	_, _ = mac.Write(ip.To16())
+
+	return hex.EncodeToString(mac.Sum(nil))[:anonymizeHashLength]
+}
+
+// hashKey returns the current hash key. It is replaced if it is too old. The old key stays in use if that fails.
+func (a *anonymizer) hashKey() []byte {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.clock.Now().Sub(a.keyCreated) > anonymizeKeyLifetime {
+		_ = a.rotateKey()
+	}
+
+	return a.key
+}
+
+// rotateKey replaces the hash key by a random one. Must be called with mtx held or before a is shared.
+func (a *anonymizer) rotateKey() error {
+	key := make([]byte, anonymizeKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("generate anonymization key: %w", err)
+	}
+
+	a.key, a.keyCreated = key, a.clock.Now()
+
+	return nil
+}
+
+// scrub replaces the IP address of addr in s, like the message of an error, by how it is shown.
+func (a *anonymizer) scrub(s string, addr net.Addr) string {
+	ip := addrIP(addr)
+	if a.mode == anonymizeOff || ip == nil {
+		return s
+	}
+
+	s = strings.ReplaceAll(s, addr.String(), a.addr(addr))
+
+	return strings.ReplaceAll(s, ip.String(), a.ip(ip))
+}
+
+// scrubErr returns err with the IP address of addr replaced by how it is shown. err is returned as is if nothing
+// needs to be replaced.
+func (a *anonymizer) scrubErr(err error, addr net.Addr) error {
+	if scrubbed := a.scrub(err.Error(), addr); scrubbed != err.Error() {
+		return errors.New(scrubbed)
+	}
+
+	return err
+}
+
+// logger returns log with the IP address of addr replaced by how it is shown in the errors it logs, like those of
+// failed reads and writes.
+func (a *anonymizer) logger(log logr.Logger, addr net.Addr) logr.Logger {
+	if a.mode == anonymizeOff || addrIP(addr) == nil {
+		return log
+	}
+
+	return logr.New(scrubSink{LogSink: log.GetSink(), anonymizer: a, addr: addr})
+}
+
+// scrubSink is a logr.LogSink that replaces the IP address of addr in logged errors by how it is shown.
+type scrubSink struct {
+	logr.LogSink
+	anonymizer *anonymizer
+	addr       net.Addr
+}
+
+// Error implements logr.LogSink.
+func (s scrubSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	if err != nil {
+		err = s.anonymizer.scrubErr(err, s.addr)
+	}
+
+	s.LogSink.Error(err, msg, keysAndValues...)
+}
+
+// WithValues implements logr.LogSink.
+func (s scrubSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return scrubSink{LogSink: s.LogSink.WithValues(keysAndValues...), anonymizer: s.anonymizer, addr: s.addr}
+}
+
+// WithName implements logr.LogSink.
+func (s scrubSink) WithName(name string) logr.LogSink {
+	return scrubSink{LogSink: s.LogSink.WithName(name), anonymizer: s.anonymizer, addr: s.addr}
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// priorityLabel is the label hooks set to put a connection into a priority class.
+	priorityLabel = "priority"
+	// bandwidthTick is the interval in which the bandwidth limiter hands out bytes to waiting writers.
+	bandwidthTick = 10 * time.Millisecond
+	// bandwidthBurstTicks is the number of ticks worth of bytes the limiter accumulates while nobody writes.
+	bandwidthBurstTicks = 10
+	// bandwidthMaxChunk is the largest number of bytes a writer requests from the limiter at once.
+	bandwidthMaxChunk = 16 * 1024
+	// priorityPortParts is the number of parts of a port=priority pair.
+	priorityPortParts = 2
+)
+
+// errPriorityPort is raised if a port=priority pair can not be parsed.
+var errPriorityPort = errors.New("invalid port priority, expected port=priority")
+
+// priorityPorts maps local ports to the priority class of connections accepted on them.
+type priorityPorts map[int]int
+
+// parsePriorityPorts parses whitespace separated port=priority pairs.
+func parsePriorityPorts(value string) (priorityPorts, error) {
+	ports := priorityPorts{}
+
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, "=", priorityPortParts)
+		if len(parts) != priorityPortParts {
+			return nil, fmt.Errorf("%w: %s", errPriorityPort, field)
+		}
+
+		port, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errPriorityPort, field)
+		}
+
+		priority, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errPriorityPort, field)
+		}
+
+		ports[port] = priority
+	}
+
+	return ports, nil
+}
+
+// priorityOf returns the priority class of conn. The label set by hooks wins over the class of the local port.
+// Connections that are not classified have priority 0.
+func (p priorityPorts) priorityOf(conn *connection) int {
+	if value, ok := conn.snapshot().labels[priorityLabel]; ok {
+		if priority, err := strconv.Atoi(value); err == nil {
+			return priority
+		}
+	}
+
+	if addr, ok := conn.local.(*net.TCPAddr); ok {
+		return p[addr.Port]
+	}
+
+	return 0
+}
+
+// bandwidthWaiter is a writer waiting for the limiter to hand out bytes.
+type bandwidthWaiter struct {
+	priority int
+	n        int
+	granted  chan struct{}
+}
+
+// bandwidthLimiter limits the bytes written by all bridged connections together to a rate. Under contention, writers
+// of connections with a higher priority class are served first; writers of the same class are served in order.
+type bandwidthLimiter struct {
+	mtx sync.Mutex
+	// rate is the number of bytes per second handed out.
+	rate int64
+	// available is the number of bytes that can be handed out right away.
+	available int64
+	// waiting holds the writers that wait for bytes, ordered by priority and arrival.
+	waiting []*bandwidthWaiter
+}
+
+// newBandwidthLimiter creates a bandwidthLimiter that hands out rate bytes per second.
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate}
+}
+
+// chunk is the largest number of bytes a writer may request at once. It is small enough for a single tick to cover,
+// so slow rates still make progress.
+func (l *bandwidthLimiter) chunk() int {
+	chunk := l.rate * int64(bandwidthTick) / int64(time.Second)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	if chunk > bandwidthMaxChunk {
+		chunk = bandwidthMaxChunk
+	}
+
+	return int(chunk)
+}
+
+// wait blocks until n bytes were handed out to a writer of the given priority class or done is closed. In the
+// latter case the bytes are not limited any more so connections can flush on shutdown.
+func (l *bandwidthLimiter) wait(done <-chan struct{}, priority, n int) {
+	l.mtx.Lock()
+
+	if len(l.waiting) == 0 && l.available >= int64(n) {
+		l.available -= int64(n)
+		l.mtx.Unlock()
+
+		return
+	}
+
+	waiter := &bandwidthWaiter{priority: priority, n: n, granted: make(chan struct{})}
+	index := sort.Search(len(l.waiting), func(i int) bool { return l.waiting[i].priority < priority })
+	l.waiting = append(l.waiting, nil)
+	copy(l.waiting[index+1:], l.waiting[index:])
+	l.waiting[index] = waiter
+	l.mtx.Unlock()
+
+	select {
+	case <-waiter.granted:
+	case <-done:
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+
+		for i, other := range l.waiting {
+			if other == waiter {
+				l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+
+				break
+			}
+		}
+	}
+}
+
+// run hands out bytes each tick of clock until ctx is canceled. Writers are served strictly by priority class: if the
+// first waiting writer can not be served yet, writers behind it have to wait as well.
+func (l *bandwidthLimiter) run(ctx context.Context, clock Clock) {
+	ticker := clock.NewTicker(bandwidthTick)
+	defer ticker.Stop()
+
+	perTick := l.rate * int64(bandwidthTick) / int64(time.Second)
+	if perTick < 1 {
+		perTick = 1
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		l.mtx.Lock()
+
+		l.available += perTick
+		if burst := perTick * bandwidthBurstTicks; l.available > burst {
+			l.available = burst
+		}
+
+		for len(l.waiting) != 0 && l.available >= int64(l.waiting[0].n) {
+			l.available -= int64(l.waiting[0].n)
+			close(l.waiting[0].granted)
+			l.waiting = l.waiting[1:]
+		}
+
+		l.mtx.Unlock()
+	}
+}
+
+// limitedStream is an io.ReadWriteCloser whose writes are limited by a bandwidthLimiter.
+type limitedStream struct {
+	io.ReadWriteCloser
+	// done is closed when writes should not wait for the limiter any more.
+	done     <-chan struct{}
+	limiter  *bandwidthLimiter
+	priority int
+}
+
+// Write passes p to the wrapped stream in chunks the limiter handed out.
+func (s limitedStream) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		chunk := len(p) - written
+		if limit := s.limiter.chunk(); chunk > limit {
+			chunk = limit
+		}
+
+		s.limiter.wait(s.done, s.priority, chunk)
+
+		n, err := s.ReadWriteCloser.Write(p[written : written+chunk])
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// CloseWrite shuts down the writing side of the wrapped stream if it supports that.
+func (s limitedStream) CloseWrite() error {
+	return closeWrite(s.ReadWriteCloser)
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// colorLabel is the label connections get with the name of the destination set they use.
+	colorLabel = "color"
+	// greenDestinationParts is the number of parts of a blue=green pair.
+	greenDestinationParts = 2
+	// switchUsage documents the arguments of the switch command.
+	switchUsage = "switch [blue|green]"
+)
+
+var (
+	// errUnknownColor is raised if a color can not be parsed.
+	errUnknownColor = errors.New("unknown color, expected blue or green")
+	// errGreenDestination is raised if a blue=green pair can not be parsed.
+	errGreenDestination = errors.New("invalid green destination, expected blue=green")
+	// errNoGreenDestinations is raised if green should be switched to without green destinations.
+	errNoGreenDestinations = errors.New("no green destinations configured")
+)
+
+// color names one of the two destination sets new connections can be sent to.
+type color int32
+
+const (
+	// colorBlue is the set of the configured destinations. It is active when tcp4to6 starts.
+	colorBlue color = iota
+	// colorGreen is the set of destinations the blue ones are mapped to by greenDestinations.
+	colorGreen
+)
+
+// String returns the name of the color.
+func (c color) String() string {
+	if c == colorGreen {
+		return "green"
+	}
+
+	return "blue"
+}
+
+// parseColor returns the color called name.
+func parseColor(name string) (color, error) {
+	switch name {
+	case "blue":
+		return colorBlue, nil
+	case "green":
+		return colorGreen, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", errUnknownColor, name)
+	}
+}
+
+// greenDestinations maps destinations of the blue set to their counterparts in the green set.
+type greenDestinations map[string]string
+
+// parseGreenDestinations parses whitespace separated blue=green pairs.
+func parseGreenDestinations(value string) (greenDestinations, error) {
+	greens := greenDestinations{}
+
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, "=", greenDestinationParts)
+		if len(parts) != greenDestinationParts || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%w: %s", errGreenDestination, field)
+		}
+
+		greens[parts[0]] = parts[1]
+	}
+
+	return greens, nil
+}
+
+// activeColor returns the color new connections are sent to.
+func (p *proxy) activeColor() color {
+	return color(atomic.LoadInt32(&p.color))
+}
+
+// colorStep returns the handshake step that labels connections with the active color and sends them to the green
+// counterpart of their destination if green is active. Destinations without counterpart are left alone.
+func (p *proxy) colorStep(greens greenDestinations) handshakeStep {
+	return func(_ context.Context, conn *connection, src net.Conn) (net.Conn, error) {
+		active := p.activeColor()
+		conn.addLabels(Labels{colorLabel: active.String()})
+
+		if green, ok := greens[conn.destination]; ok && active == colorGreen {
+			conn.destination = green
+		}
+
+		return src, nil
+	}
+}
+
+// switchCommand returns the control command that switches new connections to the blue or green destinations and
+// reports how many connections use each of them.
+func switchCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: switchUsage,
+		help:  "switch new connections to the blue or green destinations, show connections per color",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("%w: %s", errUsage, switchUsage)
+			}
+
+			if len(args) == 1 {
+				target, err := parseColor(args[0])
+				if err != nil {
+					return err
+				}
+
+				if target == colorGreen && len(p.generation().cfg.greenDestinations) == 0 {
+					return errNoGreenDestinations
+				}
+
+				if previous := color(atomic.SwapInt32(&p.color, int32(target))); previous != target {
+					p.log.Info("switched destinations", "from", previous.String(), "to", target.String())
+				}
+			}
+
+			counts := map[string]int{}
+			for _, snap := range p.conns.snapshot() {
+				counts[snap.labels[colorLabel]]++
+			}
+
+			if _, err := fmt.Fprintf(w, "active: %s\nblue connections: %d\ngreen connections: %d\n",
+				p.activeColor(), counts[colorBlue.String()], counts[colorGreen.String()]); err != nil {
+				return fmt.Errorf("write switch result: %w", err)
+			}
+
+			return nil
+		},
+	}
+}
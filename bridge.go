@@ -0,0 +1,485 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"dev.eqrx.net/rungroup"
+	"github.com/go-logr/logr"
+)
+
+// bridgeDirections is the number of directions data is copied in by BridgeStreams.
+const bridgeDirections = 2
+
+// closeWriter is implemented by streams that can be shut down for writing only, like *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing side of stream if it supports that. Other streams are left untouched.
+func closeWrite(stream io.ReadWriteCloser) error {
+	if closer, ok := stream.(closeWriter); ok {
+		return closer.CloseWrite()
+	}
+
+	return nil
+}
+
+// CloseOrder controls in which order BridgeStreams closes its streams.
+type CloseOrder int
+
+const (
+	// CloseConcurrently closes both streams at the same time.
+	CloseConcurrently CloseOrder = iota
+	// CloseBackendFirst closes the stream towards the backend before the one towards the client.
+	CloseBackendFirst
+	// CloseClientFirst closes the stream towards the client before the one towards the backend.
+	CloseClientFirst
+)
+
+// errUnknownCloseOrder is raised if a CloseOrder can not be parsed.
+var errUnknownCloseOrder = errors.New("unknown close order")
+
+// ParseCloseOrder returns the CloseOrder called name. Valid names are concurrent, backend-first and client-first.
+func ParseCloseOrder(name string) (CloseOrder, error) {
+	switch name {
+	case "concurrent":
+		return CloseConcurrently, nil
+	case "backend-first":
+		return CloseBackendFirst, nil
+	case "client-first":
+		return CloseClientFirst, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", errUnknownCloseOrder, name)
+	}
+}
+
+// bridgeOptions holds the settings of BridgeStreams.
+type bridgeOptions struct {
+	grace      time.Duration
+	closeOrder CloseOrder
+	readAhead  int
+	bufferMin  int
+	bufferMax  int
+	splice     bool
+	linger     time.Duration
+	clock      Clock
+	// client and backend are asked for the addresses of the streams when they are needed, so a stream whose
+	// connection is replaced while bridging tells the current ones. Nil if not known.
+	client  addrSource
+	backend addrSource
+	// bandwidthLimit is the rate in bytes per second both directions share. Zero if not limited.
+	bandwidthLimit int64
+	priority       int
+	// limiter is shared by the streams of a Bridge. Nil if BridgeStreams creates one for itself.
+	limiter      *bandwidthLimiter
+	counters     [bridgeDirections][]*int64
+	hooks        []BridgeHook
+	transformers [bridgeDirections][]Transformer
+	// latency is passed the copy latency of both directions. Nil if it is not measured.
+	latency CopyLatencyObserver
+}
+
+// BridgeOption changes the behavior of BridgeStreams.
+type BridgeOption func(*bridgeOptions)
+
+// WithShutdownGrace lets BridgeStreams give the streams up to grace to flush in-flight data when its context is
+// canceled. The default of zero closes the streams immediately.
+func WithShutdownGrace(grace time.Duration) BridgeOption {
+	return func(opts *bridgeOptions) { opts.grace = grace }
+}
+
+// WithCloseOrder sets the order in which BridgeStreams closes the streams. Defaults to CloseConcurrently.
+func WithCloseOrder(order CloseOrder) BridgeOption {
+	return func(opts *bridgeOptions) { opts.closeOrder = order }
+}
+
+// WithReadAhead lets BridgeStreams read up to size bytes from each stream ahead of what the other stream accepted, so
+// a peer that stalls briefly does not immediately slow down the other one. The default of zero copies directly.
+func WithReadAhead(size int) BridgeOption {
+	return func(opts *bridgeOptions) { opts.readAhead = size }
+}
+
+// WithBufferSizes lets BridgeStreams copy with buffers that start at minSize bytes and grow up to maxSize bytes for
+// connections with high throughput, shrinking again when they slow down. By default io.Copy is used, which allocates
+// 32 KiB per direction. WithReadAhead takes precedence.
+func WithBufferSizes(minSize, maxSize int) BridgeOption {
+	return func(opts *bridgeOptions) { opts.bufferMin, opts.bufferMax = minSize, maxSize }
+}
+
+// WithSplice lets BridgeStreams copy between TCP connections, also if wrapped by a Bridge with WithCounters, with
+// splice(2) on linux, so the data does not pass through user space. Each direction takes a pipe for that. Other
+// streams and platforms are copied as usual. Takes precedence over WithBufferSizes, but not over WithReadAhead.
+func WithSplice() BridgeOption {
+	return func(opts *bridgeOptions) { opts.splice = true }
+}
+
+// HalfCloseUntilDone is a half close linger without limit. Both streams are only closed once both directions ended or
+// the context of BridgeStreams is canceled.
+const HalfCloseUntilDone time.Duration = -1
+
+// halfCloseUntilDoneName is the name of HalfCloseUntilDone in the configuration.
+const halfCloseUntilDoneName = "until-done"
+
+// parseHalfCloseLinger parses value as a duration that is not negative or as halfCloseUntilDoneName.
+func parseHalfCloseLinger(value string) (time.Duration, error) {
+	if value == halfCloseUntilDoneName {
+		return HalfCloseUntilDone, nil
+	}
+
+	linger, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("parse duration: %w", err)
+	}
+
+	if linger < 0 {
+		return 0, errNegative
+	}
+
+	return linger, nil
+}
+
+// WithHalfClose lets BridgeStreams pass the end of one stream on to the other instead of closing both right away. When
+// a direction ends because its source closed, like a backend that sent its response and closed, the writing side of
+// its destination is shut down after everything read was written, so that peer sees the end of the stream after all
+// data. The other direction then gets up to linger to finish before both streams are closed, or as long as it takes
+// with HalfCloseUntilDone, the default. Zero closes both streams as soon as either direction ends.
+func WithHalfClose(linger time.Duration) BridgeOption {
+	return func(opts *bridgeOptions) { opts.linger = linger }
+}
+
+// WithBridgeClock makes BridgeStreams wait for the shutdown grace and the half close linger on clock instead of the
+// system clock.
+func WithBridgeClock(clock Clock) BridgeOption {
+	return func(opts *bridgeOptions) { opts.clock = clock }
+}
+
+// WithConns gives BridgeStreams the connections its streams dst and src wrap, so errors tell their addresses.
+func WithConns(dst, src net.Conn) BridgeOption {
+	return func(opts *bridgeOptions) {
+		opts.backend, opts.client = dst, src
+	}
+}
+
+// CopyDirection is the direction BridgeStreams copies data in.
+type CopyDirection int
+
+const (
+	// ToBackend is the direction from the client to the backend.
+	ToBackend CopyDirection = iota
+	// ToClient is the direction from the backend to the client.
+	ToClient
+)
+
+// String returns the name of the direction.
+func (d CopyDirection) String() string {
+	if d == ToBackend {
+		return "to backend"
+	}
+
+	return "to client"
+}
+
+// StreamAddrs are the local and remote address of a stream. Both are nil if not known.
+type StreamAddrs struct {
+	Local  net.Addr
+	Remote net.Addr
+}
+
+// String returns the remote address at the local one.
+func (a StreamAddrs) String() string {
+	if a.Local == nil || a.Remote == nil {
+		return "unknown"
+	}
+
+	return a.Remote.String() + " at " + a.Local.String()
+}
+
+// addrSource knows the addresses of a stream, like net.Conn does.
+type addrSource interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// addrSourceOf returns stream as addrSource if it knows its addresses, nil otherwise.
+func addrSourceOf(stream io.ReadWriteCloser) addrSource {
+	if source, ok := stream.(addrSource); ok {
+		return source
+	}
+
+	return nil
+}
+
+// addrsOf returns the current addresses of source. Both are nil if source is.
+func addrsOf(source addrSource) StreamAddrs {
+	if source == nil {
+		return StreamAddrs{}
+	}
+
+	return StreamAddrs{Local: source.LocalAddr(), Remote: source.RemoteAddr()}
+}
+
+// CopyError is returned by BridgeStreams if copying in one direction failed. It tells which peer was involved,
+// which an error like connection reset by peer does not on its own.
+type CopyError struct {
+	// Direction is the direction that failed.
+	Direction CopyDirection
+	// Client and Backend are the addresses of the streams towards the client and the backend.
+	Client  StreamAddrs
+	Backend StreamAddrs
+	// Copied is the number of bytes that were copied in Direction before it failed.
+	Copied int64
+	// Err is the error the copy failed with.
+	Err error
+}
+
+// Error implements error.
+func (e *CopyError) Error() string {
+	return fmt.Sprintf("copy %s failed after %d bytes (client %s, backend %s): %v",
+		e.Direction, e.Copied, e.Client, e.Backend, e.Err)
+}
+
+// Unwrap returns the error the copy failed with.
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+// BridgeStreams copies all data between the streams dst and src until an operation returns an error. This error is
+// then logged and both streams are closed in the order given by WithCloseOrder. dst is the stream towards the
+// backend, src the one towards the client. Once one direction ended, the other one keeps going until it ends as well
+// or for as long as WithHalfClose allows. The copies that failed, as *CopyError, and the streams that could not be
+// closed are returned joined in that order, nil if nothing failed. The addresses of the streams are taken from
+// WithConns or from the streams themselves if they are net.Conn.
+//
+// Hooks given by WithBridgeHook run before anything is copied and close both streams if one rejects them. Data passes
+// the transformers of WithTransformer, is then limited by WithBandwidthLimit and counted by WithCounters as it is
+// written.
+//
+// If ctx is canceled while both directions are still copying, the streams are not closed right away if
+// WithShutdownGrace is given. Instead their writing sides are shut down so the peers see the end of the stream, and
+// both directions get up to the grace period to flush what is still in flight before the streams are closed.
+func BridgeStreams(ctx context.Context, log logr.Logger, dst, src io.ReadWriteCloser, opts ...BridgeOption) error {
+	options := bridgeOptions{
+		backend: addrSourceOf(dst), client: addrSourceOf(src), clock: systemClock{}, linger: HalfCloseUntilDone,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	for _, hook := range options.hooks {
+		if err := hook(ctx, BridgeInfo{Client: addrsOf(options.client), Backend: addrsOf(options.backend)}); err != nil {
+			return errors.Join(fmt.Errorf("bridge hook: %w", err), closeStreams(log, options.closeOrder, dst, src))
+		}
+	}
+
+	if options.bandwidthLimit > 0 && options.limiter == nil {
+		limiterCtx, stopLimiter := context.WithCancel(context.Background())
+		defer stopLimiter()
+
+		options.limiter = newBandwidthLimiter(options.bandwidthLimit)
+		go options.limiter.run(limiterCtx, options.clock)
+	}
+
+	dst, src = options.writing(ctx, ToBackend, dst), options.writing(ctx, ToClient, src)
+
+	var closeErr error
+
+	group := rungroup.New(ctx)
+	copied := make(chan struct{}, bridgeDirections)
+	failed := make(chan error, bridgeDirections)
+	toDstDone, toSrcDone := make(chan struct{}), make(chan struct{})
+
+	bridge := func(direction CopyDirection, to, from io.ReadWriteCloser, done chan<- struct{}, other <-chan struct{},
+	) func(context.Context) error {
+		return func(groupCtx context.Context) error {
+			n, err := options.copy(options.measured(direction, to, options.transform(direction, from)))
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				err = &CopyError{
+					Direction: direction, Client: addrsOf(options.client), Backend: addrsOf(options.backend), Copied: n,
+					Err: err,
+				}
+				failed <- err
+
+				log.Error(err, "copy failed", "direction", direction.String(), "copied", n)
+			}
+
+			copied <- struct{}{}
+			close(done)
+
+			if err == nil {
+				options.halfClose(groupCtx, log, to, other)
+			}
+
+			return nil
+		}
+	}
+
+	group.Go(bridge(ToBackend, dst, src, toDstDone, toSrcDone))
+	group.Go(bridge(ToClient, src, dst, toSrcDone, toDstDone))
+	group.Go(func(groupCtx context.Context) error {
+		<-groupCtx.Done()
+
+		// The group is also canceled when a copy returns. Only drain if the caller wants us to stop.
+		if ctx.Err() != nil {
+			drainStreams(log, options.clock, options.grace, copied, dst, src)
+		}
+
+		closeErr = closeStreams(log, options.closeOrder, dst, src)
+
+		return nil
+	})
+
+	if err := group.Wait(); err != nil {
+		panic("did not expect errors")
+	}
+
+	close(failed)
+
+	errs := make([]error, 0, bridgeDirections+1)
+	for err := range failed {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(append(errs, closeErr)...)
+}
+
+// copy copies from src to dst, reading ahead, splicing or sizing buffers adaptively if configured, in that order of
+// precedence.
+func (o bridgeOptions) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if o.readAhead > 0 {
+		return readAheadCopy(dst, src, o.readAhead)
+	}
+
+	if o.splice {
+		if written, ok, err := spliceStreams(dst, src); ok {
+			return written, err
+		}
+	}
+
+	if o.bufferMin > 0 && o.bufferMax >= o.bufferMin {
+		return adaptiveCopy(dst, src, o.bufferMin, o.bufferMax)
+	}
+
+	return io.Copy(dst, src)
+}
+
+// halfClose shuts down the writing side of stream, whose source ended, and waits up to the linger time, or without
+// limit for HalfCloseUntilDone, for the other direction to finish, as signaled by other being closed. It returns right
+// away if half closing is disabled.
+func (o bridgeOptions) halfClose(ctx context.Context, log logr.Logger, stream io.ReadWriteCloser,
+	other <-chan struct{},
+) {
+	if o.linger == 0 {
+		return
+	}
+
+	if err := closeWrite(stream); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Error(err, "could not shut down stream for writing")
+
+		return
+	}
+
+	var expired <-chan time.Time
+
+	if o.linger > 0 {
+		timer := o.clock.NewTimer(o.linger)
+		defer timer.Stop()
+
+		expired = timer.C()
+	}
+
+	select {
+	case <-other:
+	case <-expired:
+	case <-ctx.Done():
+	}
+}
+
+// closeStreams closes dst and src in the given order. Failures are logged and returned joined, the one of dst first
+// regardless of the order. Streams that were closed already do not count as failed.
+func closeStreams(log logr.Logger, order CloseOrder, dst, src io.ReadWriteCloser) error {
+	var dstErr, srcErr error
+
+	closeDst := func() {
+		if err := dst.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error(err, "could not close from stream")
+
+			dstErr = fmt.Errorf("close stream to backend: %w", err)
+		}
+	}
+	closeSrc := func() {
+		if err := src.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error(err, "could not close to stream")
+
+			srcErr = fmt.Errorf("close stream to client: %w", err)
+		}
+	}
+
+	switch order {
+	case CloseBackendFirst:
+		closeDst()
+		closeSrc()
+	case CloseClientFirst:
+		closeSrc()
+		closeDst()
+	case CloseConcurrently:
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			closeDst()
+		}()
+
+		closeSrc()
+		wg.Wait()
+	}
+
+	return errors.Join(dstErr, srcErr)
+}
+
+// drainStreams shuts down the writing side of all streams and waits until one value for each stream was received
+// from copied or grace passed on clock.
+func drainStreams(log logr.Logger, clock Clock, grace time.Duration, copied <-chan struct{},
+	streams ...io.ReadWriteCloser,
+) {
+	if grace <= 0 {
+		return
+	}
+
+	for _, stream := range streams {
+		if err := closeWrite(stream); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error(err, "could not shut down stream for writing")
+		}
+	}
+
+	timer := clock.NewTimer(grace)
+	defer timer.Stop()
+
+	for pending := len(streams); pending > 0; pending-- {
+		select {
+		case <-copied:
+		case <-timer.C():
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"dev.eqrx.net/tcpto6"
+	"github.com/go-logr/logr"
+)
+
+func TestBridgeStreamsHalfClosesByDefault(t *testing.T) {
+	client, src := tcpPair(t)
+	dst, backend := tcpPair(t)
+
+	bridged := make(chan error, 1)
+
+	go func() { bridged <- tcpto6.BridgeStreams(context.Background(), logr.Discard(), dst, src) }()
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := io.ReadAll(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Write(append([]byte("response to "), request...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "response to request"; string(response) != want {
+		t.Fatalf("client read %q instead of %q", response, want)
+	}
+
+	<-bridged
+}
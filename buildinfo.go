@@ -0,0 +1,168 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// modulePath is the path of this module, which is looked up in the build info of the binary.
+const modulePath = "dev.eqrx.net/tcpto6"
+
+// buildInfo describes how the running binary was built. Version is the version of this module, (devel) if it was
+// built from a checkout. Revision is the commit the binary was built from, if known, with -dirty appended if the
+// checkout was modified. Features lists what the platform the binary was built for supports beyond the basics.
+type buildInfo struct {
+	Version   string   `json:"version"`
+	Revision  string   `json:"revision,omitempty"`
+	GoVersion string   `json:"goVersion"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features,omitempty"`
+}
+
+// readBuildInfo returns the buildInfo of the running binary.
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version: "unknown", GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		Features: platformFeatures(),
+	}
+
+	if launchdSupported {
+		info.Features = append(info.Features, "launchd")
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	if build.Main.Path == modulePath {
+		info.Version = build.Main.Version
+		info.Revision = vcsRevision(build.Settings)
+
+		return info
+	}
+
+	for _, dep := range build.Deps {
+		if dep.Path == modulePath {
+			info.Version = dep.Version
+
+			break
+		}
+	}
+
+	return info
+}
+
+// vcsRevision returns the commit the build settings name, with -dirty appended if the checkout was modified. Empty
+// if they do not name one.
+func vcsRevision(settings []debug.BuildSetting) string {
+	revision, modified := "", false
+
+	for _, setting := range settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+
+	if revision != "" && modified {
+		revision += "-dirty"
+	}
+
+	return revision
+}
+
+// enabledFeatures returns the optional features cfg turns on.
+func enabledFeatures(cfg Config) []string {
+	var features []string
+
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"tls-routing", len(cfg.tls.routes) != 0},
+		{"tls-termination", len(cfg.tls.certificates) != 0},
+		{"client-acl", len(cfg.clientACL.allow) != 0 || len(cfg.clientACL.deny) != 0},
+		{"access-log", cfg.accessLog.path != ""},
+		{"journal", cfg.journal.path != ""},
+		{"syslog", cfg.syslog.network != ""},
+		{"push", cfg.push.url != ""},
+		{"webhook", cfg.webhook.url != ""},
+		{"event-broker", cfg.broker.protocol != ""},
+		{"bandwidth-limit", cfg.bandwidthLimit > 0},
+		{"replay", cfg.replay.size > 0},
+		{"dns-register", cfg.dnsRegister.enabled()},
+		{"mdns", cfg.mdns.enabled()},
+		{"port-mapping", cfg.portMapping.enabled()},
+		{"control-socket", cfg.controlSocket != ""},
+		{"instance-lock", cfg.lockFile != ""},
+		{"leader-election", cfg.leader.enabled()},
+		{"metrics-endpoint", cfg.metricsAddr != ""},
+		{"proxy-protocol", cfg.dial.proxyProtocol != proxyProtocolOff},
+		{"splice", cfg.splice},
+		{"copy-latency", cfg.copyLatencySample > 0},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+
+	return features
+}
+
+// versionCommand returns the control command that shows how tcp4to6 was built and which configuration is applied.
+func versionCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: "version",
+		help:  "show the version, build and enabled features of tcp4to6 and the hash of the applied configuration",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("%w: version", errUsage)
+			}
+
+			gen := p.generation()
+
+			revision := p.build.Revision
+			if revision == "" {
+				revision = "unknown"
+			}
+
+			if _, err := fmt.Fprintf(w, "version: %s\nrevision: %s\ngo: %s\nplatform: %s\nfeatures: %s\n"+
+				"enabled: %s\nconfig: version %d hash %s\n", p.build.Version, revision, p.build.GoVersion,
+				p.build.Platform, joinFeatures(p.build.Features), joinFeatures(enabledFeatures(gen.cfg)),
+				gen.version, gen.hash); err != nil {
+				return fmt.Errorf("write version: %w", err)
+			}
+
+			return nil
+		},
+	}
+}
+
+// joinFeatures returns features separated by spaces, none if there are none.
+func joinFeatures(features []string) string {
+	if len(features) == 0 {
+		return "none"
+	}
+
+	return strings.Join(features, " ")
+}
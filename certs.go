@@ -0,0 +1,210 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// ocspRetryInterval is the time to wait before fetching an OCSP response again after it failed.
+	ocspRetryInterval = 5 * time.Minute
+	// ocspDefaultRefresh is the time after which an OCSP response without next update is refreshed.
+	ocspDefaultRefresh = time.Hour
+	// ocspRefreshDivisor determines when an OCSP response is refreshed: after its validity period divided by it.
+	ocspRefreshDivisor = 2
+)
+
+// storedCert is a certificate loaded from a pair of files.
+type storedCert struct {
+	// files are the certificate and key file the certificate was loaded from.
+	files [2]string
+	// modTime is the latest modification time of the files when they were loaded.
+	modTime time.Time
+	// cert is handed out to TLS handshakes. It is replaced instead of modified, so handshakes can keep using it.
+	cert *tls.Certificate
+	// issuer of the leaf certificate. Nil if the certificate file does not contain it.
+	issuer *x509.Certificate
+	// nextStaple is the time the OCSP response should be fetched again.
+	nextStaple time.Time
+	// stapleExpiry is the time the stapled OCSP response becomes outdated. Zero if there is none or it does not expire.
+	stapleExpiry time.Time
+}
+
+// certStore serves the certificates used to terminate TLS. It reloads them when their files change and staples OCSP
+// responses to them if asked to.
+type certStore struct {
+	log      logr.Logger
+	stapling bool
+	client   *http.Client
+	mtx      sync.RWMutex
+	certs    []*storedCert
+}
+
+// newCertStore loads the given pairs of certificate and key files.
+func newCertStore(log logr.Logger, files [][2]string, stapling bool) (*certStore, error) {
+	store := &certStore{log: log, stapling: stapling, client: &http.Client{Timeout: time.Minute}}
+
+	for _, pair := range files {
+		stored, err := loadStoredCert(pair)
+		if err != nil {
+			return nil, err
+		}
+
+		store.certs = append(store.certs, stored)
+	}
+
+	return store, nil
+}
+
+// loadStoredCert loads the certificate from the given pair of files.
+func loadStoredCert(files [2]string) (*storedCert, error) {
+	var modTime time.Time
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("stat certificate: %w", err)
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(files[0], files[1])
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+
+	stored := &storedCert{files: files, modTime: modTime, cert: &cert}
+
+	if len(cert.Certificate) > 1 {
+		if stored.issuer, err = x509.ParseCertificate(cert.Certificate[1]); err != nil {
+			return nil, fmt.Errorf("parse issuer certificate: %w", err)
+		}
+	}
+
+	return stored, nil
+}
+
+// getCertificate picks the certificate for a TLS handshake. It is meant to be used as tls.Config.GetCertificate.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, stored := range s.certs {
+		if hello.SupportsCertificate(stored.cert) == nil {
+			return stored.cert, nil
+		}
+	}
+
+	return s.certs[0].cert, nil
+}
+
+// updateAll checks the certificate files for changes and reloads them. If stapling is enabled, OCSP responses are
+// fetched when the certificates are loaded and refreshed before they expire. Certificates that fail to load are kept
+// as they are and tried again on the next call.
+func (s *certStore) updateAll(ctx context.Context) {
+	s.mtx.RLock()
+	certs := append([]*storedCert(nil), s.certs...)
+	s.mtx.RUnlock()
+
+	for i, stored := range certs {
+		if updated := s.update(ctx, stored); updated != stored {
+			s.mtx.Lock()
+			s.certs[i] = updated
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// update returns stored if it is still current. Otherwise it returns a replacement with reloaded files or a
+// refreshed OCSP response.
+func (s *certStore) update(ctx context.Context, stored *storedCert) *storedCert {
+	log := s.log.WithValues("certificate", stored.files[0])
+	updated := stored
+
+	if changed(stored) {
+		reloaded, err := loadStoredCert(stored.files)
+		if err != nil {
+			log.Error(err, "couldn't reload certificate, keeping the old one")
+		} else {
+			log.Info("reloaded certificate")
+
+			updated = reloaded
+		}
+	}
+
+	now := time.Now()
+
+	if !s.stapling || updated.issuer == nil || now.Before(updated.nextStaple) {
+		return updated
+	}
+
+	replacement := *updated
+
+	staple, err := fetchOCSPStaple(ctx, s.client, updated.cert.Leaf, updated.issuer)
+	if err != nil {
+		log.Error(err, "couldn't fetch OCSP response")
+
+		replacement.nextStaple = now.Add(ocspRetryInterval)
+
+		if !replacement.stapleExpiry.IsZero() && now.After(replacement.stapleExpiry) {
+			cert := *updated.cert
+			cert.OCSPStaple = nil
+			replacement.cert, replacement.stapleExpiry = &cert, time.Time{}
+		}
+
+		return &replacement
+	}
+
+	log.V(1).Info("fetched OCSP response", "nextUpdate", staple.nextUpdate)
+
+	refresh := ocspDefaultRefresh
+	if !staple.nextUpdate.IsZero() {
+		refresh = staple.nextUpdate.Sub(staple.thisUpdate) / ocspRefreshDivisor
+	}
+
+	cert := *updated.cert
+	cert.OCSPStaple = staple.raw
+	replacement.cert, replacement.stapleExpiry, replacement.nextStaple = &cert, staple.nextUpdate, now.Add(refresh)
+
+	return &replacement
+}
+
+// changed reports if any file of stored was modified since it was loaded.
+func changed(stored *storedCert) bool {
+	for _, file := range stored.files {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().After(stored.modTime) {
+			return err == nil
+		}
+	}
+
+	return false
+}
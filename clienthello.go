@@ -0,0 +1,280 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// tlsRecordHeaderLen is the length of the header of a TLS record.
+	tlsRecordHeaderLen = 5
+	// tlsRecordTypeHandshake is the content type of TLS records carrying handshake messages.
+	tlsRecordTypeHandshake = 22
+	// tlsHandshakeHeaderLen is the length of the header of a TLS handshake message.
+	tlsHandshakeHeaderLen = 4
+	// tlsHandshakeTypeClientHello is the type of the ClientHello handshake message.
+	tlsHandshakeTypeClientHello = 1
+	// tlsMaxClientHelloLen limits how large a ClientHello may be before it is rejected.
+	tlsMaxClientHelloLen = 1 << 16
+	// tlsRandomLen is the length of the random field of a ClientHello.
+	tlsRandomLen = 32
+	// tlsUint16Len is the length of a two byte integer.
+	tlsUint16Len = 2
+
+	// Extension types tcpto6 looks into.
+	tlsExtServerName          = 0
+	tlsExtSupportedGroups     = 10
+	tlsExtPointFormats        = 11
+	tlsExtSignatureAlgorithms = 13
+	tlsExtALPN                = 16
+	tlsExtSupportedVersions   = 43
+	// tlsServerNameTypeHost is the name type of host names in the server name extension.
+	tlsServerNameTypeHost = 0
+)
+
+var (
+	// errNotTLS is raised if a connection does not start with a TLS handshake record.
+	errNotTLS = errors.New("connection does not start with a TLS handshake")
+	// errMalformedHello is raised if a ClientHello can not be parsed.
+	errMalformedHello = errors.New("malformed TLS ClientHello")
+)
+
+// clientHello holds the parts of a TLS ClientHello message tcpto6 cares about.
+type clientHello struct {
+	// version is the legacy version field of the message.
+	version uint16
+	// cipherSuites offered by the client in the order sent.
+	cipherSuites []uint16
+	// extensions are the types of all extensions in the order sent.
+	extensions []uint16
+	// serverName is the host name requested via SNI. Empty if not sent.
+	serverName string
+	// alpn are the protocols offered via ALPN in the order sent.
+	alpn []string
+	// supportedGroups are the elliptic curves and groups offered by the client.
+	supportedGroups []uint16
+	// pointFormats are the elliptic curve point formats offered by the client.
+	pointFormats []uint8
+	// signatureAlgorithms are the signature algorithms offered by the client.
+	signatureAlgorithms []uint16
+	// supportedVersions are the versions offered via the supported_versions extension.
+	supportedVersions []uint16
+}
+
+// peekClientHello reads and parses the ClientHello from r. It returns all bytes it consumed from r, even if an error
+// is returned, so they can be replayed to whatever handles the connection next. errNotTLS is returned if the first
+// byte does not start a handshake record; only that single byte is read then.
+func peekClientHello(r io.Reader) (*clientHello, []byte, error) {
+	var consumed bytes.Buffer
+
+	tee := io.TeeReader(r, &consumed)
+	first := make([]byte, 1)
+
+	if _, err := io.ReadFull(tee, first); err != nil {
+		return nil, consumed.Bytes(), fmt.Errorf("read record type: %w", err)
+	}
+
+	if first[0] != tlsRecordTypeHandshake {
+		return nil, consumed.Bytes(), errNotTLS
+	}
+
+	var message []byte
+
+	for {
+		header := make([]byte, tlsRecordHeaderLen)
+		header[0] = first[0]
+
+		if _, err := io.ReadFull(tee, header[len(first):]); err != nil {
+			return nil, consumed.Bytes(), fmt.Errorf("read record header: %w", err)
+		}
+
+		fragment := make([]byte, int(header[3])<<8|int(header[4]))
+		if _, err := io.ReadFull(tee, fragment); err != nil {
+			return nil, consumed.Bytes(), fmt.Errorf("read record: %w", err)
+		}
+
+		message = append(message, fragment...)
+
+		if len(message) >= tlsHandshakeHeaderLen {
+			length := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if length > tlsMaxClientHelloLen {
+				return nil, consumed.Bytes(), fmt.Errorf("%w: too long", errMalformedHello)
+			}
+
+			if len(message) >= tlsHandshakeHeaderLen+length {
+				message = message[:tlsHandshakeHeaderLen+length]
+
+				break
+			}
+		}
+
+		// The message continues in the next record, which must be a handshake record as well.
+		if _, err := io.ReadFull(tee, first); err != nil {
+			return nil, consumed.Bytes(), fmt.Errorf("read record type: %w", err)
+		}
+
+		if first[0] != tlsRecordTypeHandshake {
+			return nil, consumed.Bytes(), fmt.Errorf("%w: interleaved record", errMalformedHello)
+		}
+	}
+
+	if message[0] != tlsHandshakeTypeClientHello {
+		return nil, consumed.Bytes(), fmt.Errorf("%w: not a ClientHello", errMalformedHello)
+	}
+
+	hello, err := parseClientHello(message[tlsHandshakeHeaderLen:])
+
+	return hello, consumed.Bytes(), err
+}
+
+// helloReader reads big endian values from a byte slice. Reading past the end sets failed and returns zero values.
+type helloReader struct {
+	data   []byte
+	failed bool
+}
+
+// next returns the next n bytes.
+func (r *helloReader) next(n int) []byte {
+	if r.failed || len(r.data) < n {
+		r.failed = true
+
+		return nil
+	}
+
+	data := r.data[:n]
+	r.data = r.data[n:]
+
+	return data
+}
+
+// u8 reads a single byte.
+func (r *helloReader) u8() int {
+	if data := r.next(1); data != nil {
+		return int(data[0])
+	}
+
+	return 0
+}
+
+// u16 reads a two byte integer.
+func (r *helloReader) u16() int {
+	if data := r.next(tlsUint16Len); data != nil {
+		return int(data[0])<<8 | int(data[1])
+	}
+
+	return 0
+}
+
+// sub returns a reader for the next n bytes.
+func (r *helloReader) sub(n int) *helloReader {
+	data := r.next(n)
+
+	return &helloReader{data: data, failed: r.failed}
+}
+
+// u16s reads two byte integers until the reader is exhausted.
+func (r *helloReader) u16s() []uint16 {
+	var values []uint16
+	for len(r.data) > 0 && !r.failed {
+		values = append(values, uint16(r.u16()))
+	}
+
+	return values
+}
+
+// parseClientHello parses the body of a ClientHello handshake message.
+func parseClientHello(body []byte) (*clientHello, error) {
+	reader := &helloReader{data: body}
+	hello := &clientHello{version: uint16(reader.u16())}
+
+	// Skip random and session ID, keep the cipher suites and skip the compression methods.
+	reader.next(tlsRandomLen)
+	reader.next(reader.u8())
+	hello.cipherSuites = reader.sub(reader.u16()).u16s()
+	reader.next(reader.u8())
+
+	if len(reader.data) == 0 && !reader.failed {
+		return hello, nil
+	}
+
+	extensions := reader.sub(reader.u16())
+
+	for len(extensions.data) > 0 && !extensions.failed {
+		extType := uint16(extensions.u16())
+		hello.extensions = append(hello.extensions, extType)
+		hello.parseExtension(extType, extensions.sub(extensions.u16()))
+	}
+
+	if reader.failed || extensions.failed {
+		return nil, errMalformedHello
+	}
+
+	return hello, nil
+}
+
+// parseExtension records the content of the extension with the given type.
+func (h *clientHello) parseExtension(extType uint16, data *helloReader) {
+	switch extType {
+	case tlsExtServerName:
+		names := data.sub(data.u16())
+		for len(names.data) > 0 && !names.failed {
+			nameType, name := names.u8(), names.next(names.u16())
+			if nameType == tlsServerNameTypeHost && h.serverName == "" {
+				h.serverName = string(name)
+			}
+		}
+	case tlsExtALPN:
+		protos := data.sub(data.u16())
+		for len(protos.data) > 0 && !protos.failed {
+			if proto := protos.next(protos.u8()); proto != nil {
+				h.alpn = append(h.alpn, string(proto))
+			}
+		}
+	case tlsExtSupportedGroups:
+		h.supportedGroups = data.sub(data.u16()).u16s()
+	case tlsExtPointFormats:
+		h.pointFormats = data.next(data.u8())
+	case tlsExtSignatureAlgorithms:
+		h.signatureAlgorithms = data.sub(data.u16()).u16s()
+	case tlsExtSupportedVersions:
+		h.supportedVersions = data.sub(data.u8()).u16s()
+	}
+}
+
+// replayConn is a net.Conn that returns prefix from Read before reading from the wrapped connection again. It is used
+// to hand connections to the next stage after bytes have been peeked from them.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// newReplayConn creates a replayConn that returns prefix before reading from conn.
+func newReplayConn(conn net.Conn, prefix []byte) *replayConn {
+	return &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(prefix), conn)}
+}
+
+// Read reads from the prefix until it is exhausted, then from the wrapped connection.
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection if it supports that.
+func (c *replayConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,258 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates the timers and tickers that timeouts, idle times, backoffs and periodic tasks wait
+// on. The default is the system clock. Tests may pass their own, like ManualClock, with WithClock and WithBridgeClock
+// to run instantly and deterministically. Socket deadlines are handled by the operating system and always follow the
+// system clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer that sends the current time on its channel once d passed.
+	NewTimer(d time.Duration) Timer
+	// NewTicker creates a ticker that sends the current time on its channel every time d passed. Ticks are dropped
+	// while the channel is full.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a single event created by Clock.NewTimer.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing and reports if it did so. The channel is not drained.
+	Stop() bool
+}
+
+// Ticker is a repeated event created by Clock.NewTicker.
+type Ticker interface {
+	// C returns the channel the time is sent on when the ticker ticks.
+	C() <-chan time.Time
+	// Stop prevents the ticker from ticking again. The channel is not drained.
+	Stop()
+}
+
+// WithClock makes Run and RunWithConfig take the time for dial timeouts, holding, backoffs, the age and idle times of
+// connections, the expiry of cached hook decisions and DNS results, the rotation of logs and keys and the intervals of
+// periodic tasks like the watchdog, health checks, summaries and pushes from clock instead of the system clock.
+func WithClock(clock Clock) Option {
+	return func(opts *options) {
+		opts.clock = clock
+	}
+}
+
+// systemClock is the Clock of the operating system.
+type systemClock struct{}
+
+// Now returns time.Now.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer wraps time.NewTimer.
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+// NewTicker wraps time.NewTicker.
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{ticker: time.NewTicker(d)}
+}
+
+// systemTimer is a time.Timer.
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// C returns the channel of the timer.
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+// Stop stops the timer.
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// systemTicker is a time.Ticker.
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+// C returns the channel of the ticker.
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+// Stop stops the ticker.
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// sleepUnlessDone waits on clock for delay to pass and reports if it did before ctx was canceled.
+func sleepUnlessDone(ctx context.Context, clock Clock, delay time.Duration) bool {
+	timer := clock.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C():
+		return true
+	}
+}
+
+// ManualClock is a Clock whose time only moves when Advance is called. Timers fire and tickers tick as soon as the
+// time reaches them. It is safe for concurrent use.
+type ManualClock struct {
+	mtx sync.Mutex
+	now time.Time
+	// timers are the timers that neither fired nor were stopped yet and the tickers that were not stopped.
+	timers []*manualTimer
+}
+
+// NewManualClock creates a ManualClock that starts at now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the time the clock was advanced to.
+func (c *ManualClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.now
+}
+
+// NewTimer creates a timer that fires once the clock was advanced by d. Timers with d of zero or less fire right away.
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	timer := &manualTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+
+	return timer
+}
+
+// NewTicker creates a ticker that ticks every time the clock was advanced by d. d must be greater than zero.
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for ManualClock.NewTicker")
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	timer := &manualTimer{clock: c, deadline: c.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+
+	return manualTicker{timer}
+}
+
+// Advance moves the time forward by d and fires all timers and ticks all tickers that are due, the earliest first.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.now = c.now.Add(d)
+
+	for {
+		next := -1
+
+		for i, timer := range c.timers {
+			if !timer.deadline.After(c.now) && (next == -1 || timer.deadline.Before(c.timers[next].deadline)) {
+				next = i
+			}
+		}
+
+		if next == -1 {
+			return
+		}
+
+		timer := c.timers[next]
+		if timer.period == 0 {
+			timer.c <- c.now
+			c.timers = append(c.timers[:next], c.timers[next+1:]...)
+
+			continue
+		}
+
+		select {
+		case timer.c <- c.now:
+		default:
+		}
+
+		timer.deadline = timer.deadline.Add(timer.period)
+	}
+}
+
+// Waiting returns the number of timers that neither fired nor were stopped and of tickers that were not stopped.
+// Tests use it to learn that the code under test started waiting before they advance the clock.
+func (c *ManualClock) Waiting() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return len(c.timers)
+}
+
+// manualTimer is a Timer of a ManualClock, or the ticker of a manualTicker if period is set.
+type manualTimer struct {
+	clock    *ManualClock
+	deadline time.Time
+	period   time.Duration
+	c        chan time.Time
+}
+
+// C returns the channel of the timer.
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop removes the timer from its clock.
+func (t *manualTimer) Stop() bool {
+	t.clock.mtx.Lock()
+	defer t.clock.mtx.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// manualTicker is a Ticker of a ManualClock.
+type manualTicker struct {
+	*manualTimer
+}
+
+// Stop removes the ticker from its clock.
+func (t manualTicker) Stop() {
+	t.manualTimer.Stop()
+}
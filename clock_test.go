@@ -0,0 +1,125 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// testTimeout bounds how long tests wait for something that should happen right away.
+const testTimeout = 5 * time.Second
+
+// closeRecorder is an io.Closer that closes closed when it is closed.
+type closeRecorder struct {
+	closed chan struct{}
+}
+
+// Close closes closed. It must only be called once.
+func (c closeRecorder) Close() error {
+	close(c.closed)
+
+	return nil
+}
+
+// waitForTimers waits until clock has count timers or tickers.
+func waitForTimers(t *testing.T, clock *ManualClock, count int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(testTimeout); clock.Waiting() != count; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers waiting instead of %d", clock.Waiting(), count)
+		}
+	}
+}
+
+func TestManualClockTicker(t *testing.T) {
+	clock := NewManualClock(time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC))
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(999 * time.Millisecond)
+
+	select {
+	case <-ticker.C():
+		t.Fatal("ticked before the interval passed")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+
+	select {
+	case now := <-ticker.C():
+		if want := time.Date(2021, 11, 2, 10, 0, 1, 0, time.UTC); !now.Equal(want) {
+			t.Fatalf("ticked at %s instead of %s", now, want)
+		}
+	default:
+		t.Fatal("did not tick once the interval passed")
+	}
+
+	clock.Advance(3 * time.Second)
+	<-ticker.C()
+
+	select {
+	case <-ticker.C():
+		t.Fatal("ticks were not dropped while the channel was full")
+	default:
+	}
+
+	ticker.Stop()
+
+	if waiting := clock.Waiting(); waiting != 0 {
+		t.Fatalf("%d timers waiting after the ticker was stopped", waiting)
+	}
+}
+
+func TestWatchStuckOnManualClock(t *testing.T) {
+	clock := NewManualClock(time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC))
+	prx := &proxy{log: logr.Discard(), clock: clock}
+	conn := &connection{id: 1, clock: clock}
+	dst, src := closeRecorder{closed: make(chan struct{})}, closeRecorder{closed: make(chan struct{})}
+
+	dstSocket, srcSocket := net.Pipe()
+	defer dstSocket.Close()
+	defer srcSocket.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	atomic.StoreInt64(&conn.writing[writingToBackend], clock.Now().UnixNano())
+
+	go prx.watchStuck(done, time.Second, conn, dst, src, dstSocket, srcSocket)
+
+	waitForTimers(t, clock, 1)
+	clock.Advance(750 * time.Millisecond)
+
+	select {
+	case <-dst.closed:
+		t.Fatal("closed the bridge before the write was stuck for the threshold")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(250 * time.Millisecond)
+
+	for _, closed := range []chan struct{}{dst.closed, src.closed} {
+		select {
+		case <-closed:
+		case <-time.After(testTimeout):
+			t.Fatal("did not close the bridge once the write was stuck for the threshold")
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	// closeReasonKeepalive is the close reason of connections whose peer timed out while being read from, which on an
+	// idle connection means it stopped answering keepalive probes.
+	closeReasonKeepalive = "keepalive-timeout"
+	// closeReasonRetransmit is the close reason of connections whose peer timed out while being written to because
+	// it stopped acknowledging data.
+	closeReasonRetransmit = "retransmit-timeout"
+	// closeReasonReset is the close reason of connections whose peer reset them.
+	closeReasonReset = "reset"
+	// closeReasonBrokenPipe is the close reason of connections that were written to after the peer closed them.
+	closeReasonBrokenPipe = "broken-pipe"
+	// closeReasonError is the close reason of connections that failed for any other reason.
+	closeReasonError = "error"
+)
+
+// closeReason classifies err, the reason a connection could not be bridged or the bridge failed, and tells which
+// peer, client or backend, failed if err is a *CopyError that tells. Both are empty if err is nil.
+func closeReason(err error) (string, string) {
+	if err == nil {
+		return "", ""
+	}
+
+	var copyErr *CopyError
+	if !errors.As(err, &copyErr) {
+		return closeReasonError, ""
+	}
+
+	peer := ""
+
+	var opErr *net.OpError
+	if errors.As(copyErr.Err, &opErr) {
+		// Copies towards the backend read from the client and write to the backend, the others the other way around.
+		reading := opErr.Op == "read"
+		if reading == (copyErr.Direction == ToBackend) {
+			peer = "client"
+		} else {
+			peer = "backend"
+		}
+	}
+
+	switch {
+	case errors.Is(copyErr.Err, syscall.ETIMEDOUT) && opErr != nil && opErr.Op == "write":
+		return closeReasonRetransmit, peer
+	case errors.Is(copyErr.Err, syscall.ETIMEDOUT):
+		return closeReasonKeepalive, peer
+	case errors.Is(copyErr.Err, syscall.ECONNRESET):
+		return closeReasonReset, peer
+	case errors.Is(copyErr.Err, syscall.EPIPE):
+		return closeReasonBrokenPipe, peer
+	default:
+		return closeReasonError, peer
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"dev.eqrx.net/tcpto6"
+)
+
+// errNoJournal is raised if the journal subcommand is not given any journal file.
+var errNoJournal = errors.New("no journal file given")
+
+// dumpJournal implements the journal subcommand. It writes the records of the journal files in args, oldest first,
+// and the connections that were in flight at the end of each process to stdout.
+func dumpJournal(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("journal: %w", errNoJournal)
+	}
+
+	readers := make([]io.Reader, 0, len(args))
+
+	for _, path := range args {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("journal: %w", err)
+		}
+
+		defer file.Close()
+
+		readers = append(readers, file)
+	}
+
+	if err := tcpto6.DumpJournal(os.Stdout, io.MultiReader(readers...)); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+
+	return nil
+}
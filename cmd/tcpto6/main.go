@@ -16,13 +16,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	stdlog "log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"dev.eqrx.net/tcpto6"
 	"github.com/go-logr/stdr"
-	"golang.org/x/sys/unix"
 )
 
 func main() {
@@ -35,12 +36,37 @@ func main() {
 	defer func() {
 		if err != nil {
 			log.Error(err, "program error")
+
+			if errors.Is(err, tcpto6.ErrUnhealthy) {
+				os.Exit(tcpto6.ExitCodeUnhealthy)
+			}
+
 			os.Exit(1)
 		}
 	}()
 
-	ctx, cancel := signal.NotifyContext(context.Background(), unix.SIGTERM, unix.SIGINT)
+	if len(os.Args) > 1 && os.Args[1] == "units" {
+		err = writeUnits(os.Args[2:])
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "journal" {
+		err = dumpJournal(os.Args[2:])
+
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
 
-	err = tcpto6.Run(ctx, log)
+	var opts []tcpto6.Option
+
+	// With -stdio, the single connection is made of stdin and stdout, for supervisors that start a process per
+	// connection. Logs go to stderr, so they do not mix with it.
+	if len(os.Args) > 1 && os.Args[1] == "-stdio" {
+		opts = append(opts, tcpto6.WithSocketProvider(tcpto6.Stdio{}))
+	}
+
+	err = tcpto6.Run(ctx, log, opts...)
 }
@@ -0,0 +1,65 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"dev.eqrx.net/tcpto6"
+)
+
+// unitFileMode is the mode generated unit files are written with.
+const unitFileMode = 0o644
+
+// writeUnits implements the units subcommand. It reads the configuration like Run does and writes a .socket and
+// .service unit for it into a directory. args are the command line arguments following the subcommand, flags and then
+// the addresses to listen on.
+func writeUnits(args []string) error {
+	flags := flag.NewFlagSet("units", flag.ContinueOnError)
+	name := flags.String("name", "tcp4to6", "name of the units without suffix")
+	dir := flags.String("dir", ".", "directory the units are written to")
+	binary := flags.String("binary", "", "path of the tcp4to6 binary")
+	envFile := flags.String("env-file", "", "file the service reads its environment variables from")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("units: %w", err)
+	}
+
+	cfg, err := tcpto6.LoadConfig(os.LookupEnv)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	units, err := tcpto6.GenerateUnits(cfg, tcpto6.UnitSpec{
+		Name:            *name,
+		Listen:          flags.Args(),
+		Binary:          *binary,
+		EnvironmentFile: *envFile,
+	})
+	if err != nil {
+		return fmt.Errorf("units: %w", err)
+	}
+
+	for suffix, content := range map[string]string{".socket": units.Socket, ".service": units.Service} {
+		path := filepath.Join(*dir, *name+suffix)
+		if err := os.WriteFile(path, []byte(content), unitFileMode); err != nil {
+			return fmt.Errorf("units: %w", err)
+		}
+	}
+
+	return nil
+}
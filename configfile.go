@@ -0,0 +1,293 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// includeDirective starts lines that include other config files.
+	includeDirective = "include:"
+	// maxIncludeDepth limits how deeply config files may include each other.
+	maxIncludeDepth = 16
+	// quotedMinLen is the minimum length of a quoted value: both quotes.
+	quotedMinLen = 2
+	// settingParts is the number of parts a setting consists of: name and value.
+	settingParts = 2
+)
+
+var (
+	// errConfigSyntax is raised if a line of a config file can not be parsed.
+	errConfigSyntax = errors.New("expected NAME=value or include: path")
+	// errIncludeCycle is raised if config files include each other.
+	errIncludeCycle = errors.New("include cycle")
+	// errIncludeDepth is raised if config files are nested deeper than maxIncludeDepth.
+	errIncludeDepth = errors.New("includes nested too deeply")
+	// errUndefinedVar is raised if a value references an environment variable that is not set and has no default.
+	errUndefinedVar = errors.New("undefined environment variable")
+	// errUnterminatedVar is raised if a value contains ${ without closing }.
+	errUnterminatedVar = errors.New("unterminated ${")
+	// errUnknownSetting is raised if a config file contains a setting tcpto6 does not know.
+	errUnknownSetting = errors.New("unknown setting")
+)
+
+// fileSetting is a value read from a config file.
+type fileSetting struct {
+	value string
+	// origin is the file and line the value was read from.
+	origin string
+	// path and line are the file and line of origin, which settings are ordered by.
+	path string
+	line int
+}
+
+// configFile holds the settings read from a config file and the files it includes. Settings use the names of the
+// environment variables, e.g. TCPTO6_DESTINATION_ADDR.
+type configFile map[string]fileSetting
+
+// readConfigFile reads the config file at path. Each line is either empty, a comment starting with #, a setting in
+// the form NAME=value or an include: directive followed by a path or glob pattern. Relative include paths are
+// resolved against the directory of the including file. Lines ending in a backslash continue on the next line.
+// Later settings override earlier ones, so included files can be overridden after the include: line.
+//
+// Values may be quoted with " or '. References in the form ${NAME} or ${NAME:-default} are replaced with the
+// environment variables returned by env, unless the value is quoted with '. $$ stands for a single $.
+func readConfigFile(path string, env lookupFunc) (configFile, error) {
+	file := configFile{}
+
+	return file, file.read(path, env, nil)
+}
+
+// read adds the settings of the config file at path to f. stack contains the absolute paths of the files that
+// include path.
+func (f configFile) read(path string, env lookupFunc, stack []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	for _, including := range stack {
+		if including == abs {
+			return fmt.Errorf("%w: %s", errIncludeCycle, strings.Join(append(stack, abs), " -> "))
+		}
+	}
+
+	if len(stack) >= maxIncludeDepth {
+		return fmt.Errorf("%w: %s", errIncludeDepth, path)
+	}
+
+	handle, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer handle.Close()
+
+	scanner := bufio.NewScanner(handle)
+	lineNo, start, line := 0, 0, ""
+
+	for scanner.Scan() {
+		lineNo++
+
+		if line == "" {
+			start = lineNo
+		}
+
+		line += scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			line = strings.TrimSuffix(line, "\\")
+
+			continue
+		}
+
+		if err := f.readLine(strings.TrimSpace(line), path, start, env, append(stack, abs)); err != nil {
+			return err
+		}
+
+		line = ""
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read config file %s: %w", path, err)
+	}
+
+	if line != "" {
+		return f.readLine(strings.TrimSpace(line), path, start, env, append(stack, abs))
+	}
+
+	return nil
+}
+
+// readLine adds the setting or included files of line, which starts at lineNo of the file at path, to f. Relative
+// includes are resolved against the directory of path.
+func (f configFile) readLine(line, path string, lineNo int, env lookupFunc, stack []string) error {
+	origin := fmt.Sprintf("%s:%d", path, lineNo)
+
+	switch {
+	case line == "" || strings.HasPrefix(line, "#"):
+		return nil
+	case strings.HasPrefix(line, includeDirective):
+		pattern := strings.TrimSpace(strings.TrimPrefix(line, includeDirective))
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+
+		paths := []string{pattern}
+
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			if paths, err = filepath.Glob(pattern); err != nil {
+				return fmt.Errorf("%s: %w", origin, err)
+			}
+
+			sort.Strings(paths)
+		}
+
+		for _, included := range paths {
+			if err := f.read(included, env, stack); err != nil {
+				return fmt.Errorf("%s: %w", origin, err)
+			}
+		}
+
+		return nil
+	}
+
+	parts := strings.SplitN(line, "=", settingParts)
+	name := strings.TrimSpace(parts[0])
+
+	if len(parts) != settingParts || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("%s: %w", origin, errConfigSyntax)
+	}
+
+	value, err := expandValue(strings.TrimSpace(parts[1]), env)
+	if err != nil {
+		return fmt.Errorf("%s: %s: %w", origin, name, err)
+	}
+
+	f[name] = fileSetting{value: value, origin: origin, path: path, line: lineNo}
+
+	return nil
+}
+
+// expandValue removes quotes from value and expands references to environment variables.
+func expandValue(value string, env lookupFunc) (string, error) {
+	if len(value) >= quotedMinLen {
+		switch first, last := value[0], value[len(value)-1]; {
+		case first == '\'' && last == '\'':
+			return value[1 : len(value)-1], nil
+		case first == '"' && last == '"':
+			value = value[1 : len(value)-1]
+		}
+	}
+
+	var expanded strings.Builder
+
+	for {
+		dollar := strings.IndexByte(value, '$')
+		if dollar < 0 || dollar == len(value)-1 {
+			expanded.WriteString(value)
+
+			return expanded.String(), nil
+		}
+
+		expanded.WriteString(value[:dollar])
+
+		switch value[dollar+1] {
+		case '$':
+			expanded.WriteByte('$')
+
+			value = value[dollar+2:]
+		case '{':
+			end := strings.IndexByte(value[dollar:], '}')
+			if end < 0 {
+				return "", errUnterminatedVar
+			}
+
+			reference := value[dollar+2 : dollar+end]
+			name, def, hasDefault := reference, "", false
+
+			if sep := strings.Index(reference, ":-"); sep >= 0 {
+				name, def, hasDefault = reference[:sep], reference[sep+2:], true
+			}
+
+			resolved, ok := env(name)
+
+			switch {
+			case ok:
+				expanded.WriteString(resolved)
+			case hasDefault:
+				expanded.WriteString(def)
+			default:
+				return "", fmt.Errorf("%w: %s", errUndefinedVar, name)
+			}
+
+			value = value[dollar+end+1:]
+		default:
+			expanded.WriteByte('$')
+
+			value = value[dollar+1:]
+		}
+	}
+}
+
+// overlay returns a lookupFunc that returns the value from primary if it is set and from f otherwise.
+func (f configFile) overlay(primary lookupFunc) lookupFunc {
+	return func(name string) (string, bool) {
+		if value, ok := primary(name); ok {
+			return value, true
+		}
+
+		setting, ok := f[name]
+
+		return setting.value, ok
+	}
+}
+
+// origin describes where name was read from. Empty if it is not set in f.
+func (f configFile) origin(name string) string {
+	return f[name].origin
+}
+
+// checkKnown returns an error for the first setting in f, in order of file and line, that is not in known.
+// Destinations of sockets are always known since a file may be shared by instances serving different sockets.
+func (f configFile) checkKnown(known map[string]bool) error {
+	var unknown []string
+
+	for name := range f {
+		if !known[name] && !strings.HasPrefix(name, SocketDestinationEnvPrefix) {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	sort.Slice(unknown, func(i, j int) bool {
+		a, b := f[unknown[i]], f[unknown[j]]
+		if a.path != b.path {
+			return a.path < b.path
+		}
+
+		return a.line < b.line
+	})
+
+	return fmt.Errorf("%s: %w: %s", f[unknown[0]].origin, errUnknownSetting, unknown[0])
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckKnownOrdersByLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcpto6.conf")
+	content := strings.Repeat("# comment\n", 8) + "TCPTO6_UNKNOWN_NINE=1\nTCPTO6_UNKNOWN_TEN=1\n"
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := readConfigFile(path, func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = file.checkKnown(map[string]bool{})
+	if !errors.Is(err, errUnknownSetting) || !strings.HasPrefix(err.Error(), path+":9: ") {
+		t.Fatalf("reported %v instead of the unknown setting on line 9", err)
+	}
+}
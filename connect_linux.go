@@ -0,0 +1,91 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// awaitConnect waits until the non-blocking connect started on the socket file completed or ctx is done.
+func awaitConnect(ctx context.Context, file *os.File) error {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("raw socket: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = file.SetWriteDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = file.SetWriteDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var connectErr error
+
+	err = raw.Write(func(fd uintptr) bool {
+		// Readiness signalled before Write was called is discarded, so the socket has to be checked before waiting.
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+		if n, err := unix.Poll(fds, 0); err == nil && n == 0 {
+			return false
+		}
+
+		value, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			connectErr = err
+
+			return true
+		}
+
+		switch errno := syscall.Errno(value); {
+		case errno == 0:
+			return true
+		case errors.Is(errno, unix.EINPROGRESS), errors.Is(errno, unix.EALREADY), errors.Is(errno, unix.EINTR):
+			return false
+		default:
+			connectErr = errno
+
+			return true
+		}
+	})
+
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("connect: %w", ctx.Err())
+	case err != nil:
+		return fmt.Errorf("connect: %w", err)
+	case connectErr != nil:
+		return fmt.Errorf("connect: %w", connectErr)
+	}
+
+	if err := file.SetWriteDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,389 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connState is the phase a connection is in.
+type connState int32
+
+const (
+	// connStateDialing is the state of connections whose backend is being dialed.
+	connStateDialing connState = iota
+	// connStateHandshaking is the state of connections that are inspected or terminated before being bridged.
+	connStateHandshaking
+	// connStateBridging is the state of connections whose streams are bridged.
+	connStateBridging
+	// connStateHolding is the state of connections that are parked until their backend is reachable again.
+	connStateHolding
+)
+
+// String returns the name of the state.
+func (s connState) String() string {
+	switch s {
+	case connStateDialing:
+		return "dialing"
+	case connStateHandshaking:
+		return "handshaking"
+	case connStateBridging:
+		return "bridging"
+	case connStateHolding:
+		return "holding"
+	default:
+		return "unknown"
+	}
+}
+
+// connection holds what is known about an accepted connection during its lifetime.
+type connection struct {
+	// received is the number of bytes read from the client and written to the backend. Accessed atomically.
+	received int64
+	// sent is the number of bytes read from the backend and written to the client. Accessed atomically.
+	sent int64
+	// writing holds the time in UnixNano the write in progress towards the backend and towards the client, indexed by
+	// writingToBackend and writingToClient, started. Zero if none is. Accessed atomically.
+	writing [bridgeDirections]int64
+	// state is the connState the connection is in. Accessed atomically.
+	state int32
+	// forceClosed is 1 once the accepted connection was closed to drain the proxy. Accessed atomically.
+	forceClosed int32
+	// id identifies the connection within a single run.
+	id uint64
+	// client is the remote address of the accepted connection.
+	client net.Addr
+	// shownClient is how client is shown in logs and on the control socket, which may be anonymized.
+	shownClient string
+	// local is the local address of the accepted connection.
+	local net.Addr
+	// started is the time the connection was accepted.
+	started time.Time
+	// clock tells the age of the connection and the time it ended.
+	clock Clock
+	// peer holds the credentials of the client if it connected via a unix socket. Nil otherwise.
+	peer *PeerCred
+	// mss is the MSS of the client connection. Zero if it is not a TCP connection.
+	mss int
+	// accepted is the connection as it was accepted. Closing it forces the connection down.
+	accepted net.Conn
+	// err is the reason the connection could not be bridged or the bridge failed, if any. Only accessed by the
+	// handling routine.
+	err error
+	// destination is the address that is dialed for the connection. Only accessed by the handling routine.
+	destination string
+	// backendTLS configures TLS towards the backend. Nil for plain connections. Only accessed by the handling routine.
+	backendTLS *tls.Config
+	// clientTLS is set if the client sent a TLS ClientHello. Only accessed by the handling routine.
+	clientTLS bool
+	// limitExempt is set if the client is exempt from limits. Only accessed by the handling routine.
+	limitExempt bool
+	// mtx guards the fields below since they are read by other routines.
+	mtx sync.Mutex
+	// backend is the remote address of the dialed connection. Empty until the dial succeeded.
+	backend string
+	// serverName is the server name the client requested via TLS SNI. Empty if not known.
+	serverName string
+	// ja3 and ja4 are fingerprints of the TLS ClientHello of the client. Empty if not known.
+	ja3, ja4 string
+	// labels are attached by handshake steps and hooks.
+	labels Labels
+}
+
+// newConnection creates a connection record for the accepted net.Conn conn that is forwarded to destination unless
+// decided otherwise later. Its times are taken from clock.
+func newConnection(id uint64, conn net.Conn, destination string, clock Clock) *connection {
+	return &connection{
+		id:          id,
+		client:      conn.RemoteAddr(),
+		shownClient: conn.RemoteAddr().String(),
+		local:       conn.LocalAddr(),
+		started:     clock.Now(),
+		clock:       clock,
+		destination: destination,
+		peer:        peerCredOf(conn),
+		mss:         tcpMSS(conn),
+		accepted:    conn,
+	}
+}
+
+// setBackend records the remote address of the dialed connection.
+func (c *connection) setBackend(addr string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.backend = addr
+}
+
+// setServerName records the server name the client requested via TLS SNI.
+func (c *connection) setServerName(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.serverName = name
+}
+
+// setFingerprints records the fingerprints of the TLS ClientHello of the client.
+func (c *connection) setFingerprints(ja3, ja4 string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.ja3, c.ja4 = ja3, ja4
+}
+
+// addLabels attaches labels to the connection, replacing values of labels that already exist.
+func (c *connection) addLabels(labels Labels) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for name, value := range labels {
+		if c.labels == nil {
+			c.labels = Labels{}
+		}
+
+		c.labels[name] = value
+	}
+}
+
+// setState records that the connection is now in state.
+func (c *connection) setState(state connState) {
+	atomic.StoreInt32(&c.state, int32(state))
+}
+
+// connSnapshot is a copy of the state of a connection at a point in time.
+type connSnapshot struct {
+	id         uint64
+	client     string
+	local      string
+	backend    string
+	serverName string
+	ja3, ja4   string
+	labels     Labels
+	state      connState
+	started    time.Time
+	age        time.Duration
+	received   int64
+	sent       int64
+}
+
+// total returns the number of bytes transferred in both directions.
+func (s connSnapshot) total() int64 {
+	return s.received + s.sent
+}
+
+// snapshot returns the current state of the connection. It may be called from any routine.
+func (c *connection) snapshot() connSnapshot {
+	c.mtx.Lock()
+	backend, serverName, ja3, ja4, labels := c.backend, c.serverName, c.ja3, c.ja4, c.labels.clone()
+	c.mtx.Unlock()
+
+	return connSnapshot{
+		id:         c.id,
+		client:     c.shownClient,
+		local:      c.local.String(),
+		backend:    backend,
+		serverName: serverName,
+		ja3:        ja3,
+		ja4:        ja4,
+		labels:     labels,
+		state:      connState(atomic.LoadInt32(&c.state)),
+		started:    c.started,
+		age:        c.clock.Now().Sub(c.started),
+		received:   atomic.LoadInt64(&c.received),
+		sent:       atomic.LoadInt64(&c.sent),
+	}
+}
+
+// accessEntry returns the access log entry for the connection, assuming it ended now.
+func (c *connection) accessEntry() accessEntry {
+	snap := c.snapshot()
+	entry := accessEntry{
+		Time:          c.clock.Now().UTC(),
+		ID:            snap.id,
+		Client:        snap.client,
+		Local:         snap.local,
+		Backend:       snap.backend,
+		ServerName:    snap.serverName,
+		JA3:           snap.ja3,
+		JA4:           snap.ja4,
+		Labels:        snap.labels,
+		Peer:          c.peer,
+		DurationMS:    snap.age.Milliseconds(),
+		BytesReceived: snap.received,
+		BytesSent:     snap.sent,
+	}
+
+	if c.err != nil {
+		entry.Error = c.err.Error()
+		entry.CloseReason, entry.FailedPeer = closeReason(c.err)
+	}
+
+	return entry
+}
+
+// countingStream is an io.ReadWriteCloser that adds the number of bytes written to it to all counters.
+type countingStream struct {
+	io.ReadWriteCloser
+	counters []*int64
+	// writing, if set, holds the time in UnixNano the write in progress started on clock. Zero if none is.
+	writing *int64
+	clock   Clock
+}
+
+// Write passes p to the wrapped stream and counts the bytes that were written.
+func (s countingStream) Write(p []byte) (int, error) {
+	if s.writing != nil {
+		atomic.StoreInt64(s.writing, s.clock.Now().UnixNano())
+		defer atomic.StoreInt64(s.writing, 0)
+	}
+
+	n, err := s.ReadWriteCloser.Write(p)
+	for _, counter := range s.counters {
+		atomic.AddInt64(counter, int64(n))
+	}
+
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the wrapped stream if it supports that.
+func (s countingStream) CloseWrite() error {
+	return closeWrite(s.ReadWriteCloser)
+}
+
+// connTable keeps track of all connections that are currently handled.
+type connTable struct {
+	mtx   sync.Mutex
+	conns map[uint64]*connection
+	// emptied is closed once the table becomes empty. Nil if nobody waits for that.
+	emptied chan struct{}
+}
+
+// newConnTable creates an empty connTable.
+func newConnTable() *connTable {
+	return &connTable{conns: map[uint64]*connection{}}
+}
+
+// add inserts conn into the table.
+func (t *connTable) add(conn *connection) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.conns[conn.id] = conn
+}
+
+// remove deletes conn from the table.
+func (t *connTable) remove(conn *connection) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.conns, conn.id)
+
+	if len(t.conns) == 0 && t.emptied != nil {
+		close(t.emptied)
+		t.emptied = nil
+	}
+}
+
+// waitEmpty waits until the table is empty or ctx is canceled and reports if it is empty.
+func (t *connTable) waitEmpty(ctx context.Context) bool {
+	t.mtx.Lock()
+	if len(t.conns) == 0 {
+		t.mtx.Unlock()
+
+		return true
+	}
+
+	if t.emptied == nil {
+		t.emptied = make(chan struct{})
+	}
+
+	emptied := t.emptied
+	t.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-emptied:
+		return true
+	}
+}
+
+// closeAll closes the accepted connections of all connections in the table and returns how many there were. Those
+// closed before are not counted again.
+func (t *connTable) closeAll() int {
+	return t.closeWhere(func(*connection) bool { return true })
+}
+
+// closeBulk closes the accepted connections of all connections in the table that transferred at least bytes in both
+// directions together and returns how many there were. Those closed before are not counted again.
+func (t *connTable) closeBulk(bytes int64) int {
+	return t.closeWhere(func(conn *connection) bool {
+		return atomic.LoadInt64(&conn.received)+atomic.LoadInt64(&conn.sent) >= bytes
+	})
+}
+
+// closeWhere closes the accepted connections of all connections in the table that match and were not closed by it
+// before and returns how many there were.
+func (t *connTable) closeWhere(match func(conn *connection) bool) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	closed := 0
+
+	for _, conn := range t.conns {
+		if !match(conn) || !atomic.CompareAndSwapInt32(&conn.forceClosed, 0, 1) {
+			continue
+		}
+
+		_ = conn.accepted.Close()
+		closed++
+	}
+
+	return closed
+}
+
+// len returns the number of connections in the table.
+func (t *connTable) len() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return len(t.conns)
+}
+
+// snapshot returns the state of all connections in the table, ordered by id.
+func (t *connTable) snapshot() []connSnapshot {
+	t.mtx.Lock()
+	conns := make([]*connection, 0, len(t.conns))
+
+	for _, conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mtx.Unlock()
+
+	snaps := make([]connSnapshot, len(conns))
+	for i, conn := range conns {
+		snaps[i] = conn.snapshot()
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].id < snaps[j].id })
+
+	return snaps
+}
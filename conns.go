@@ -0,0 +1,114 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// connsUsage documents the arguments of the conns command.
+const connsUsage = "conns [json|csv]"
+
+// connsEntry is a connection as exported by the conns command.
+type connsEntry struct {
+	ID            uint64    `json:"id"`
+	Client        string    `json:"client"`
+	Local         string    `json:"local"`
+	Backend       string    `json:"backend"`
+	ServerName    string    `json:"serverName"`
+	Labels        Labels    `json:"labels"`
+	State         string    `json:"state"`
+	Started       time.Time `json:"started"`
+	AgeMS         int64     `json:"ageMs"`
+	BytesReceived int64     `json:"bytesReceived"`
+	BytesSent     int64     `json:"bytesSent"`
+}
+
+// connsCommand returns the control command that dumps the connection table as JSON array or CSV for consumption
+// by other tools.
+func connsCommand(table *connTable) controlCommand {
+	return controlCommand{
+		usage: connsUsage,
+		help:  "dump all connections as JSON (default) or CSV",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			format := "json"
+			if len(args) > 0 {
+				format = args[0]
+			}
+
+			if len(args) > 1 || (format != "json" && format != "csv") {
+				return fmt.Errorf("%w: %s", errUsage, connsUsage)
+			}
+
+			snaps := table.snapshot()
+			entries := make([]connsEntry, len(snaps))
+
+			for i, snap := range snaps {
+				entries[i] = connsEntry{
+					ID:            snap.id,
+					Client:        snap.client,
+					Local:         snap.local,
+					Backend:       snap.backend,
+					ServerName:    snap.serverName,
+					Labels:        snap.labels,
+					State:         snap.state.String(),
+					Started:       snap.started.UTC(),
+					AgeMS:         snap.age.Milliseconds(),
+					BytesReceived: snap.received,
+					BytesSent:     snap.sent,
+				}
+			}
+
+			if format == "csv" {
+				return writeConnsCSV(w, entries)
+			}
+
+			if err := json.NewEncoder(w).Encode(entries); err != nil {
+				return fmt.Errorf("write conns: %w", err)
+			}
+
+			return nil
+		},
+	}
+}
+
+// writeConnsCSV writes entries as CSV with a header line to w.
+func writeConnsCSV(w io.Writer, entries []connsEntry) error {
+	writer := csv.NewWriter(w)
+
+	records := [][]string{{
+		"id", "client", "local", "backend", "serverName", "labels", "state", "started", "ageMs", "bytesReceived",
+		"bytesSent",
+	}}
+	for _, entry := range entries {
+		records = append(records, []string{
+			strconv.FormatUint(entry.ID, 10), entry.Client, entry.Local, entry.Backend, entry.ServerName, entry.Labels.key(),
+			entry.State,
+			entry.Started.Format(time.RFC3339Nano), strconv.FormatInt(entry.AgeMS, 10),
+			strconv.FormatInt(entry.BytesReceived, 10), strconv.FormatInt(entry.BytesSent, 10),
+		})
+	}
+
+	if err := writer.WriteAll(records); err != nil {
+		return fmt.Errorf("write conns: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"dev.eqrx.net/rungroup"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// controlTimeout limits how long a single control connection may take.
+	controlTimeout = 30 * time.Second
+	// controlSocketMode is the permission set on the control socket.
+	controlSocketMode = 0o600
+	// tablePadding is the number of spaces between the columns of tables written by control commands.
+	tablePadding = 2
+)
+
+var (
+	// errUnknownCommand is raised if a control client sends a command that does not exist.
+	errUnknownCommand = errors.New("unknown command")
+	// errUsage is raised if a control command is called with invalid arguments.
+	errUsage = errors.New("usage")
+)
+
+// controlCommand is something that can be requested via the control socket.
+type controlCommand struct {
+	// usage documents the arguments of the command.
+	usage string
+	// help is a one line description of what the command does.
+	help string
+	// run executes the command with the given whitespace separated arguments and writes the output to w.
+	run func(ctx context.Context, w io.Writer, args []string) error
+}
+
+// controlServer serves a line based protocol on a unix socket that lets operators inspect and change the running
+// proxy. A client sends a single line containing a command and its arguments, receives the output and the
+// connection is closed. Failed commands respond with a line starting with "error: ".
+type controlServer struct {
+	log      logr.Logger
+	commands map[string]controlCommand
+}
+
+// newControlServer creates a controlServer that only knows the help command.
+func newControlServer(log logr.Logger) *controlServer {
+	srv := &controlServer{log: log, commands: map[string]controlCommand{}}
+	srv.register("help", controlCommand{usage: "help", help: "list all commands", run: srv.help})
+
+	return srv
+}
+
+// register makes cmd available under name.
+func (s *controlServer) register(name string, cmd controlCommand) {
+	s.commands[name] = cmd
+}
+
+// help writes the usage of all commands to w.
+func (s *controlServer) help(_ context.Context, w io.Writer, _ []string) error {
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%-30s %s\n", s.commands[name].usage, s.commands[name].help); err != nil {
+			return fmt.Errorf("write help: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// listenControl creates the unix socket at path. A stale socket file left by an earlier run is removed before.
+func listenControl(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove stale control socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on control socket: %w", err)
+	}
+
+	if err := os.Chmod(path, controlSocketMode); err != nil {
+		_ = listener.Close()
+
+		return nil, fmt.Errorf("chmod control socket: %w", err)
+	}
+
+	return listener, nil
+}
+
+// serve accepts control connections from listener until it is closed and handles each of them in group.
+func (s *controlServer) serve(group *rungroup.Group, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+
+		switch {
+		case err == nil:
+		case errors.Is(err, net.ErrClosed):
+			return nil
+		default:
+			return fmt.Errorf("accept control connection: %w", err)
+		}
+
+		group.Go(func(ctx context.Context) error {
+			s.handle(ctx, conn)
+
+			return nil
+		}, rungroup.NoCancelOnSuccess)
+	}
+}
+
+// handle reads a single command from conn, executes it and closes conn.
+func (s *controlServer) handle(ctx context.Context, conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			s.log.Error(err, "couldn't close control connection")
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, controlTimeout)
+	defer cancel()
+
+	if err := conn.SetDeadline(time.Now().Add(controlTimeout)); err != nil {
+		s.log.Error(err, "couldn't set deadline on control connection")
+
+		return
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.log.Error(err, "couldn't read control command")
+
+		return
+	}
+
+	if err := s.execute(ctx, conn, strings.Fields(line)); err != nil {
+		if _, err := fmt.Fprintf(conn, "error: %v\n", err); err != nil {
+			s.log.Error(err, "couldn't write control error")
+		}
+	}
+}
+
+// execute runs the command described by fields and writes its output to w.
+func (s *controlServer) execute(ctx context.Context, w io.Writer, fields []string) error {
+	if len(fields) == 0 {
+		return s.help(ctx, w, nil)
+	}
+
+	cmd, ok := s.commands[fields[0]]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownCommand, fields[0])
+	}
+
+	s.log.V(1).Info("executing control command", "command", fields)
+
+	return cmd.run(ctx, w, fields[1:])
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// copyLatencyBuckets are the buckets of the copy latency histogram in seconds.
+var copyLatencyBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// CopyLatencyObserver is called by BridgeStreams with the time data took from being read from one stream to being
+// written to the other in direction.
+type CopyLatencyObserver func(direction CopyDirection, latency time.Duration)
+
+// WithCopyLatency lets BridgeStreams measure the latency it adds on top of the network and pass it to observe. For
+// each read that returns data while earlier data is written already, the time until the next write to the other
+// stream completes is measured. That includes waiting to be scheduled, for the bandwidth limit and for the other
+// stream to accept the data. The measured streams are copied through buffers, so WithSplice and the zero copy paths
+// of the standard library do not apply to them.
+func WithCopyLatency(observe CopyLatencyObserver) BridgeOption {
+	return func(opts *bridgeOptions) { opts.latency = observe }
+}
+
+// latencyProbe measures the copy latency of a direction. Reads and writes may happen on different goroutines when
+// reading ahead.
+type latencyProbe struct {
+	observe   CopyLatencyObserver
+	direction CopyDirection
+	clock     Clock
+	// read is the time in UnixNano the earliest read returned whose data was not written yet. Zero if there is
+	// none. Accessed atomically.
+	read int64
+}
+
+// latencyReader is an io.Reader that notes the time data was read to its probe.
+type latencyReader struct {
+	r     io.Reader
+	probe *latencyProbe
+}
+
+// Read reads from the underlying reader and starts a measurement if data was read and none is running.
+func (r latencyReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		atomic.CompareAndSwapInt64(&r.probe.read, 0, r.probe.clock.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// latencyWriter is an io.Writer that completes the measurement of its probe.
+type latencyWriter struct {
+	w     io.Writer
+	probe *latencyProbe
+}
+
+// Write writes to the underlying writer and passes the time since the read of the running measurement, if any, to
+// the observer of the probe.
+func (w latencyWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+
+	if read := atomic.SwapInt64(&w.probe.read, 0); read != 0 && n > 0 {
+		w.probe.observe(w.probe.direction, time.Duration(w.probe.clock.Now().UnixNano()-read))
+	}
+
+	return n, err
+}
+
+// measured returns dst and src wrapped so the copy latency from src to dst in direction is passed to the observer of
+// o. They are returned as they are if the latency is not measured.
+func (o bridgeOptions) measured(direction CopyDirection, dst io.Writer, src io.Reader) (io.Writer, io.Reader) {
+	if o.latency == nil {
+		return dst, src
+	}
+
+	probe := &latencyProbe{observe: o.latency, direction: direction, clock: o.clock}
+
+	return latencyWriter{w: dst, probe: probe}, latencyReader{r: src, probe: probe}
+}
+
+// sampleLatency reports if the copy latency of the connection with the given ID is measured, which is one of every
+// sample connections. Never if sample is zero.
+func sampleLatency(id uint64, sample int) bool {
+	return sample > 0 && id%uint64(sample) == 0
+}
+
+// observeCopyLatency is the CopyLatencyObserver of the proxy that reports to its copy latency histogram.
+func (m proxyMetrics) observeCopyLatency(direction CopyDirection, latency time.Duration) {
+	label := metricDirectionReceived
+	if direction == ToClient {
+		label = metricDirectionSent
+	}
+
+	m.copyLatency.Observe(latency.Seconds(), label)
+}
@@ -0,0 +1,429 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialFailureAction is what the client is told if its backend could not be reached.
+type dialFailureAction int
+
+const (
+	// dialFailureClose closes the client connection normally.
+	dialFailureClose dialFailureAction = iota
+	// dialFailureReset aborts the client connection with a TCP RST.
+	dialFailureReset
+	// dialFailureRespond sends an error matching the protocol of the client before closing the connection.
+	dialFailureRespond
+)
+
+// errUnknownDialFailureAction is raised if a dialFailureAction can not be parsed.
+var errUnknownDialFailureAction = errors.New("unknown dial failure action")
+
+// parseDialFailureAction returns the dialFailureAction called name. Valid names are close, reset and respond.
+func parseDialFailureAction(name string) (dialFailureAction, error) {
+	switch name {
+	case "close":
+		return dialFailureClose, nil
+	case "reset":
+		return dialFailureReset, nil
+	case "respond":
+		return dialFailureRespond, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", errUnknownDialFailureAction, name)
+	}
+}
+
+// dialConfig configures how backends are dialed and what happens if that fails.
+type dialConfig struct {
+	// attempts is the number of times the backend is dialed before giving up. At least 1.
+	attempts int
+	// retryDelay is the time waited between attempts, or before the second one if the delay grows.
+	retryDelay time.Duration
+	// retryMaxDelay is the time the delay between attempts doubles up to. Zero selects defaultDialRetryMaxDelay or
+	// retryDelay, whichever is longer.
+	retryMaxDelay time.Duration
+	// timeout limits how long a single attempt may take. Zero if it is up to the system.
+	timeout time.Duration
+	// holdTimeout is how long connections are parked after all attempts failed. Zero disables holding.
+	holdTimeout time.Duration
+	// queueTimeout is how long an attempt waits for a free slot if the dial concurrency limit is reached.
+	queueTimeout time.Duration
+	// failureAction is what the client is told if all attempts failed.
+	failureAction dialFailureAction
+	// failureResponse is sent to clients that do not speak TLS or HTTP by dialFailureRespond. Nothing is sent if empty.
+	failureResponse []byte
+	// network is the network destinations without prefix are dialed with, tcp, tcp4, tcp6 or unix.
+	network string
+	// fallbackDelay is the head start an alternative address of a destination gets before the next one is dialed.
+	fallbackDelay time.Duration
+	// flowLabel is how the IPv6 flow label of tcp6 connections is chosen.
+	flowLabel flowLabelMode
+	// dnsCacheTTL is how long the addresses of destinations given by host name are cached. Zero only coalesces
+	// concurrent lookups.
+	dnsCacheTTL time.Duration
+	// hopLimit is the unicast hop limit or TTL of TCP connections. The kernel default is used if zero.
+	hopLimit int
+	// mss is the MSS TCP connections are clamped to. The kernel chooses if zero.
+	mss int
+	// relayMSS clamps TCP connections to the MSS of the client connection instead of mss, if it is known.
+	relayMSS bool
+	// sourceInterface is the interface whose preferred address IPv6 connections are sent from. The kernel chooses if
+	// empty.
+	sourceInterface string
+	// proxyProtocol is the version of the PROXY protocol header sent to backends after connecting.
+	proxyProtocol proxyProtocolVersion
+	// proxyTLVs are sent with PROXY protocol headers of version 2.
+	proxyTLVs []proxyTLV
+}
+
+// parseFailureResponse sets failureResponse to value after interpreting escape sequences like \r\n in it.
+func (c *dialConfig) parseFailureResponse(value string) error {
+	response, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil {
+		return fmt.Errorf("unquote: %w", err)
+	}
+
+	c.failureResponse = []byte(response)
+
+	return nil
+}
+
+// DialAttempt describes a single try to connect to the backend of a connection.
+type DialAttempt struct {
+	// Address is the address that was dialed.
+	Address string
+	// Err is the reason the attempt failed.
+	Err error
+	// Duration is the time the attempt took.
+	Duration time.Duration
+}
+
+// DialFailure describes a connection whose backend could not be reached.
+type DialFailure struct {
+	ConnInfo
+	// Attempts lists all attempts that were made in order.
+	Attempts []DialAttempt
+}
+
+// DialFailedHook is called after all attempts to reach the backend of a connection failed and before the client is
+// told about it. It must not block for long since the client connection is held open while it runs.
+type DialFailedHook func(ctx context.Context, failure DialFailure)
+
+// tlsAlertInternalError is a TLS record with a fatal internal_error alert. It is sent to clients whose TLS stream was
+// to be passed through, since they wait for a ServerHello.
+const tlsAlertInternalError = "\x15\x03\x03\x00\x02\x02\x50"
+
+// httpBadGateway is sent to clients that negotiated HTTP/1.1 with a terminating route.
+const httpBadGateway = "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+// dialBackoff is the delay between the dial attempts of a connection.
+type dialBackoff struct {
+	delay, max time.Duration
+}
+
+// newDialBackoff returns the dialBackoff cfg configures.
+func newDialBackoff(cfg dialConfig) dialBackoff {
+	backoff := dialBackoff{delay: cfg.retryDelay, max: cfg.retryMaxDelay}
+	if backoff.max == 0 {
+		backoff.max = defaultDialRetryMaxDelay
+	}
+
+	if backoff.max < backoff.delay {
+		backoff.max = backoff.delay
+	}
+
+	return backoff
+}
+
+// next returns the delay before the next attempt, shortened by a random amount of up to half. The delay is doubled for
+// the attempt after, up to the maximum.
+func (b *dialBackoff) next() time.Duration {
+	delay := jitter(b.delay)
+
+	if b.delay *= 2; b.delay > b.max {
+		b.delay = b.max
+	}
+
+	return delay
+}
+
+// jitter returns delay shortened by a random amount of up to half of it. delay is returned as is if there is no
+// randomness available.
+func jitter(delay time.Duration) time.Duration {
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return delay
+	}
+
+	return delay - time.Duration(binary.BigEndian.Uint64(buf[:])%uint64(half+1))
+}
+
+// dial connects to the destination of conn, using TLS if conn asks for it. Failed attempts are repeated as configured
+// by cfg. If all of them failed and holding is enabled, conn is parked and dialing continues until the hold timeout
+// passes, right away once another connection reached the destination. All attempts are returned, the last one being
+// the successful one if no error is returned.
+func (p *proxy) dial(ctx context.Context, cfg dialConfig, conn *connection) (net.Conn, []DialAttempt, error) {
+	attempts := make([]DialAttempt, 0, cfg.attempts)
+	backoff := newDialBackoff(cfg)
+
+	var (
+		holdUntil time.Time
+		up        <-chan struct{}
+	)
+
+	defer func() {
+		if !holdUntil.IsZero() {
+			p.hold.unpark()
+		}
+	}()
+
+	for {
+		if !holdUntil.IsZero() {
+			up = p.hold.waitUp(conn.destination)
+		}
+
+		started := p.clock.Now()
+		dst, err := p.dialOnce(ctx, cfg, conn, conn.destination)
+		attempts = append(attempts, DialAttempt{Address: conn.destination, Err: err, Duration: p.clock.Now().Sub(started)})
+
+		if err == nil {
+			p.hold.reachable(conn.destination)
+
+			return dst, attempts, nil
+		}
+
+		delay := backoff.next()
+
+		if len(attempts) >= cfg.attempts {
+			if holdUntil.IsZero() && cfg.holdTimeout > 0 && p.hold.park() {
+				holdUntil = p.clock.Now().Add(cfg.holdTimeout)
+				conn.setState(connStateHolding)
+				p.log.V(1).Info("backend unreachable, holding connection", "id", conn.id, "destination", conn.destination)
+			}
+
+			remaining := holdUntil.Sub(p.clock.Now())
+			if remaining <= 0 {
+				if len(attempts) > 1 {
+					err = fmt.Errorf("after %d attempts: %w", len(attempts), err)
+				}
+
+				return nil, attempts, err
+			}
+
+			if remaining < delay {
+				delay = remaining
+			}
+		}
+
+		timer := p.clock.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil, attempts, fmt.Errorf("retry dial: %w", ctx.Err())
+		case <-up:
+			timer.Stop()
+		case <-timer.C():
+		}
+	}
+}
+
+// dialOnce makes a single attempt to connect to addr for conn, using TLS if conn asks for it. If the dial concurrency
+// is limited and conn is not exempt, the attempt waits for a free slot first. The dial timeout of cfg starts after
+// that.
+func (p *proxy) dialOnce(ctx context.Context, cfg dialConfig, conn *connection, addr string) (net.Conn, error) {
+	if p.dialLimiter != nil && !conn.limitExempt {
+		release, err := p.dialLimiter.acquire(ctx, addr, cfg.queueTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		defer release()
+	}
+
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	opts := socketOptions{hopLimit: cfg.hopLimit, flowLabel: cfg.flowLabel.label(conn.client)}
+	opts.mss4, opts.mss6 = cfg.mssFor(conn)
+
+	dst, err := p.dialDestination(ctx, cfg, addr, opts)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if err := p.sendProxyHeader(dst, cfg, conn); err != nil {
+		_ = dst.Close()
+
+		return nil, err
+	}
+
+	if conn.backendTLS == nil {
+		return dst, nil
+	}
+
+	client := tls.Client(dst, conn.backendTLS)
+	if err := client.HandshakeContext(ctx); err != nil {
+		_ = dst.Close()
+
+		return nil, fmt.Errorf("backend TLS handshake: %w", err)
+	}
+
+	return client, nil
+}
+
+// dialDestination connects to addr. Several alternative addresses separated by commas are raced against each other.
+// Addresses starting with vsock: are vsock addresses, those starting with sctp: are dialed via SCTP and those starting
+// with tcp:, tcp4:, tcp6: or unix: with that network. All others are dialed with the network of cfg. Host names of
+// TCP and SCTP addresses are resolved by the resolver of the proxy. TCP and unix addresses are dialed with the dialer
+// of the proxy if it has one. Otherwise opts are applied to TCP connections, the flow label only to tcp6 ones, and
+// IPv6 connections are sent from the address of the source interface of cfg, if set.
+func (p *proxy) dialDestination(ctx context.Context, cfg dialConfig, addr string,
+	opts socketOptions,
+) (net.Conn, error) {
+	switch {
+	case strings.HasPrefix(addr, vsockPrefix):
+		return dialVsock(ctx, strings.TrimPrefix(addr, vsockPrefix))
+	case strings.HasPrefix(addr, sctpPrefix):
+		return p.resolver.dial(ctx, "tcp", strings.TrimPrefix(addr, sctpPrefix), cfg.dnsCacheTTL, dialSCTP)
+	}
+
+	if alternatives := splitAlternatives(cfg.network, addr); len(alternatives) > 1 {
+		return p.raceAlternatives(ctx, cfg, alternatives, opts)
+	}
+
+	network, addr := splitNetwork(cfg.network, addr)
+
+	switch {
+	case p.opts.dialer != nil && network == "unix":
+		return p.opts.dialer.DialContext(ctx, network, addr)
+	case network == "unix":
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	case p.opts.dialer != nil:
+		return p.resolver.dial(ctx, network, addr, cfg.dnsCacheTTL, func(ctx context.Context, addr string) (net.Conn, error) {
+			return p.opts.dialer.DialContext(ctx, network, addr)
+		})
+	}
+
+	return p.resolver.dial(ctx, network, addr, cfg.dnsCacheTTL, func(ctx context.Context, addr string) (net.Conn, error) {
+		opts, err := p.withSource(cfg, addr, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if network == "tcp6" && opts.flowLabel != 0 {
+			return dialFlowLabel(ctx, addr, opts)
+		}
+
+		dialer := net.Dialer{Control: opts.control}
+		if opts.source != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: opts.source}
+		}
+
+		return dialer.DialContext(ctx, network, addr)
+	})
+}
+
+// dialFailed passes the failed attempts of conn to the dial failure hooks and tells the client about the failure as
+// configured by gen. accepted is the connection as it was accepted, src the one the handshake steps returned. The
+// caller still has to close src.
+func (p *proxy) dialFailed(ctx context.Context, gen *generation, conn *connection, accepted, src net.Conn,
+	attempts []DialAttempt,
+) {
+	if len(p.opts.dialFailedHooks) != 0 {
+		failure := DialFailure{ConnInfo: conn.info(), Attempts: attempts}
+		for _, hook := range p.opts.dialFailedHooks {
+			hook(ctx, failure)
+		}
+	}
+
+	switch gen.cfg.dial.failureAction {
+	case dialFailureClose:
+	case dialFailureReset:
+		if tcp, ok := accepted.(*net.TCPConn); ok {
+			if err := tcp.SetLinger(0); err != nil {
+				p.log.Error(err, "couldn't prepare reset of accepted connection")
+			}
+		}
+	case dialFailureRespond:
+		response := failureResponse(gen.cfg.dial, conn, src)
+		if len(response) == 0 {
+			return
+		}
+
+		if err := respond(src, response, gen.cfg.handshakeTimeout); err != nil {
+			p.log.Error(err, "couldn't send dial failure response")
+		}
+	}
+}
+
+// respond writes response to src and shuts down its writing side. What the client sent is read and dropped until it
+// closes the connection or timeout passes, since closing a connection with unread data makes the kernel reset it and
+// the client would likely miss the response.
+func respond(src net.Conn, response []byte, timeout time.Duration) error {
+	if err := src.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	if _, err := src.Write(response); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err := closeWrite(src); err != nil {
+		return fmt.Errorf("close write: %w", err)
+	}
+
+	_, _ = io.Copy(io.Discard, src)
+
+	return nil
+}
+
+// failureResponse returns what is sent to the client of conn by dialFailureRespond. src is the connection returned by
+// the handshake steps.
+func failureResponse(cfg dialConfig, conn *connection, src net.Conn) []byte {
+	if server, ok := src.(*tls.Conn); ok {
+		if server.ConnectionState().NegotiatedProtocol == "http/1.1" {
+			return []byte(httpBadGateway)
+		}
+
+		return cfg.failureResponse
+	}
+
+	if conn.clientTLS {
+		return []byte(tlsAlertInternalError)
+	}
+
+	return cfg.failureResponse
+}
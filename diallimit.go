@@ -0,0 +1,76 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errDialQueueTimeout is raised if a connection waited too long for its turn to dial.
+var errDialQueueTimeout = errors.New("timed out waiting for a dial slot")
+
+// dialLimiter bounds the number of dials that are in flight to each destination, so a backend with an expensive
+// accept path is not overrun by a burst of connections, e.g. after a restart of tcp4to6. Further dials are queued
+// until a slot becomes free.
+type dialLimiter struct {
+	// limit is the number of dials that may be in flight per destination.
+	limit int
+	mtx   sync.Mutex
+	// slots holds a semaphore per destination. A dial occupies a slot by sending to it.
+	slots map[string]chan struct{}
+	clock Clock
+}
+
+// newDialLimiter creates a dialLimiter that lets limit dials per destination be in flight. Queue timeouts are taken
+// from clock.
+func newDialLimiter(limit int, clock Clock) *dialLimiter {
+	return &dialLimiter{limit: limit, slots: map[string]chan struct{}{}, clock: clock}
+}
+
+// acquire waits until a dial to destination may start, but at most timeout. The returned function frees the slot
+// again and must be called once the dial finished.
+func (l *dialLimiter) acquire(ctx context.Context, destination string, timeout time.Duration) (func(), error) {
+	l.mtx.Lock()
+	slots, ok := l.slots[destination]
+
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[destination] = slots
+	}
+	l.mtx.Unlock()
+
+	release := func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := l.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timer.C():
+		return nil, fmt.Errorf("%w: %s", errDialQueueTimeout, destination)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait for dial slot: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// dnsPort is the port of the DNS server if none is given.
+	dnsPort = "53"
+	// dnsUpdateTimeout bounds each dynamic update, from connecting to the DNS server to reading its response.
+	dnsUpdateTimeout = 5 * time.Second
+	// dnsHeaderLen is the length of the header of DNS messages.
+	dnsHeaderLen = 12
+	// dnsOpcodeUpdate is the opcode of dynamic updates in the flags of the header.
+	dnsOpcodeUpdate = 5 << 11
+	// dnsFlagResponse marks responses in the flags of the header.
+	dnsFlagResponse = 1 << 15
+	// dnsRcodeMask selects the response code from the flags of the header.
+	dnsRcodeMask = 0xf
+	// dnsMaxLabel is the longest label of a domain name.
+	dnsMaxLabel = 63
+	// dnsTypeA, dnsTypeAAAA, dnsTypeSOA and dnsTypeTSIG are resource record types.
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSOA  = 6
+	dnsTypeTSIG = 250
+	// dnsClassIN, dnsClassNone and dnsClassAny are resource record classes. Updates delete single records with
+	// dnsClassNone.
+	dnsClassIN   = 1
+	dnsClassNone = 254
+	dnsClassAny  = 255
+	// tsigAlgorithm is the algorithm updates are signed with.
+	tsigAlgorithm = "hmac-sha256"
+	// tsigFudge is the clock skew in seconds the DNS server tolerates for signed updates.
+	tsigFudge = 300
+	// tsigTimeHigh is the shift that selects the upper 16 bits of the 48 bit signing time.
+	tsigTimeHigh = 32
+	// tsigKeyParts is the number of parts of a name:secret key.
+	tsigKeyParts = 2
+	// defaultDNSRegisterTTL is the TTL of registered records if not configured otherwise.
+	defaultDNSRegisterTTL = 5 * time.Minute
+)
+
+var (
+	// errDNSName is raised if a domain name can not be encoded.
+	errDNSName = errors.New("invalid domain name")
+	// errTSIGKey is raised if the key signing updates can not be parsed.
+	errTSIGKey = errors.New("invalid key, expected name:base64-secret")
+	// errDNSResponse is raised if the DNS server sends something that is not a response to the update.
+	errDNSResponse = errors.New("unexpected response from DNS server")
+	// errDNSRefused is raised if the DNS server did not apply the update.
+	errDNSRefused = errors.New("DNS server did not apply update")
+	// errInvalidIP is raised if an address is not an IP address.
+	errInvalidIP = errors.New("invalid IP address")
+	// errNoRegisterAddress is raised if there is no address to register.
+	errNoRegisterAddress = errors.New("no address to register")
+)
+
+// dnsRcodes names the response codes DNS servers answer updates with.
+var dnsRcodes = map[int]string{
+	1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+	6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+}
+
+// dnsRegisterConfig configures registering the addresses of tcp4to6 under a domain name with RFC 2136 dynamic
+// updates.
+type dnsRegisterConfig struct {
+	// name is the domain name the addresses are registered under. Empty if registering is disabled.
+	name string
+	// server is the host and port of the DNS server updates are sent to.
+	server string
+	// zone is the zone updated. Defaults to the parent of name.
+	zone string
+	// addrs are the addresses registered. The addresses of the listener are used if empty.
+	addrs []net.IP
+	// ttl is the TTL of the registered records.
+	ttl time.Duration
+	// keyName and secret sign updates with TSIG if keyName is not empty.
+	keyName string
+	secret  []byte
+}
+
+// enabled reports if addresses are registered.
+func (c dnsRegisterConfig) enabled() bool {
+	return c.name != ""
+}
+
+// parseServer parses value as host with optional port into c. The port defaults to 53.
+func (c *dnsRegisterConfig) parseServer(value string) error {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		value = net.JoinHostPort(value, dnsPort)
+	}
+
+	c.server = value
+
+	return nil
+}
+
+// parseAddresses parses whitespace separated IP addresses into c.
+func (c *dnsRegisterConfig) parseAddresses(value string) error {
+	for _, field := range strings.Fields(value) {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return fmt.Errorf("%w: %s", errInvalidIP, field)
+		}
+
+		c.addrs = append(c.addrs, ip)
+	}
+
+	return nil
+}
+
+// parseKey parses value in the form name:secret into c. The secret is base64 encoded.
+func (c *dnsRegisterConfig) parseKey(value string) error {
+	parts := strings.SplitN(value, ":", tsigKeyParts)
+	if len(parts) != tsigKeyParts || parts[0] == "" {
+		return errTSIGKey
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(secret) == 0 {
+		return errTSIGKey
+	}
+
+	c.keyName, c.secret = parts[0], secret
+
+	return nil
+}
+
+// registerDNS adds the addresses of cfg, or those listener is bound to, to the records of the configured name and
+// removes them again once ctx is canceled. Failures are logged. Records of other instances registered under the same
+// name are left alone.
+func (p *proxy) registerDNS(ctx context.Context, cfg dnsRegisterConfig, listener net.Listener) {
+	addrs := cfg.addrs
+	if len(addrs) == 0 {
+		addrs = listenerIPs(listener)
+	}
+
+	updateCtx, cancel := context.WithTimeout(ctx, dnsUpdateTimeout)
+	addrs, err := sendDNSUpdate(updateCtx, cfg, addrs, true)
+
+	cancel()
+
+	if err != nil {
+		p.log.Error(err, "couldn't register in DNS", "name", cfg.name, "server", cfg.server)
+
+		return
+	}
+
+	p.log.Info("registered in DNS", "name", cfg.name, "addresses", addrs)
+
+	<-ctx.Done()
+
+	updateCtx, cancel = context.WithTimeout(context.Background(), dnsUpdateTimeout)
+	defer cancel()
+
+	if _, err := sendDNSUpdate(updateCtx, cfg, addrs, false); err != nil {
+		p.log.Error(err, "couldn't deregister from DNS", "name", cfg.name, "server", cfg.server)
+
+		return
+	}
+
+	p.log.Info("deregistered from DNS", "name", cfg.name)
+}
+
+// listenerIPs returns the specific, globally routable addresses listener is bound to.
+func listenerIPs(listener net.Listener) []net.IP {
+	var ips []net.IP
+
+	for _, member := range listenerMembers(listener) {
+		if ip := addrIP(member.Addr()); ip != nil && ip.IsGlobalUnicast() {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+// sendDNSUpdate adds addrs to or deletes them from the records of the name of cfg. If addrs is empty, the local
+// address of the connection to the DNS server is used. It returns the addresses that were updated. The response of
+// the server is not verified.
+func sendDNSUpdate(ctx context.Context, cfg dnsRegisterConfig, addrs []net.IP, add bool) ([]net.IP, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.server)
+	if err != nil {
+		return nil, fmt.Errorf("dial DNS server: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if len(addrs) == 0 {
+		if ip := addrIP(conn.LocalAddr()); ip != nil && ip.IsGlobalUnicast() {
+			addrs = []net.IP{ip}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errNoRegisterAddress
+	}
+
+	id := make([]byte, 2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generate message id: %w", err)
+	}
+
+	msg, err := dnsUpdateMessage(cfg, binary.BigEndian.Uint16(id), addrs, add)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.keyName != "" {
+		if msg, err = signTSIG(msg, cfg.keyName, cfg.secret, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return nil, fmt.Errorf("send update: %w", err)
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if len(response) < dnsHeaderLen || binary.BigEndian.Uint16(response) != binary.BigEndian.Uint16(id) {
+		return nil, errDNSResponse
+	}
+
+	flags := binary.BigEndian.Uint16(response[2:])
+	if flags&dnsFlagResponse == 0 {
+		return nil, errDNSResponse
+	}
+
+	if rcode := int(flags & dnsRcodeMask); rcode != 0 {
+		name, ok := dnsRcodes[rcode]
+		if !ok {
+			name = fmt.Sprintf("rcode %d", rcode)
+		}
+
+		return nil, fmt.Errorf("%w: %s", errDNSRefused, name)
+	}
+
+	return addrs, nil
+}
+
+// dnsUpdateMessage returns an update message with id for the zone of cfg that adds A and AAAA records for addrs to
+// its name or deletes them.
+func dnsUpdateMessage(cfg dnsRegisterConfig, id uint16, addrs []net.IP, add bool) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], dnsOpcodeUpdate)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[8:], uint16(len(addrs)))
+
+	msg, err := appendDNSName(msg, cfg.zone)
+	if err != nil {
+		return nil, err
+	}
+
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	class, ttl := uint16(dnsClassNone), uint32(0)
+	if add {
+		class, ttl = dnsClassIN, uint32(cfg.ttl/time.Second)
+	}
+
+	for _, addr := range addrs {
+		rrType, data := uint16(dnsTypeAAAA), addr.To16()
+		if ip4 := addr.To4(); ip4 != nil {
+			rrType, data = dnsTypeA, ip4
+		}
+
+		if msg, err = appendDNSName(msg, cfg.name); err != nil {
+			return nil, err
+		}
+
+		msg = binary.BigEndian.AppendUint16(msg, rrType)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+	}
+
+	return msg, nil
+}
+
+// signTSIG appends a TSIG record signing msg with the HMAC-SHA256 key name and secret at now, as RFC 8945 describes.
+func signTSIG(msg []byte, name string, secret []byte, now time.Time) ([]byte, error) {
+	keyName, err := appendDNSName(nil, strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, _ := appendDNSName(nil, tsigAlgorithm)
+	signed := uint64(now.Unix())
+
+	timers := binary.BigEndian.AppendUint16(nil, uint16(signed>>tsigTimeHigh))
+	timers = binary.BigEndian.AppendUint32(timers, uint32(signed))
+	timers = binary.BigEndian.AppendUint16(timers, tsigFudge)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write(binary.BigEndian.AppendUint16(nil, dnsClassAny))
+	mac.Write(binary.BigEndian.AppendUint32(nil, 0))
+	mac.Write(algorithm)
+	mac.Write(timers)
+	// Error and other length, both zero.
+	mac.Write(make([]byte, 4))
+
+	sum := mac.Sum(nil)
+
+	data := append(append([]byte{}, algorithm...), timers...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(sum)))
+	data = append(data, sum...)
+	data = append(data, msg[:2]...)
+	data = append(data, make([]byte, 4)...)
+
+	signedMsg := append(append([]byte{}, msg...), keyName...)
+	signedMsg = binary.BigEndian.AppendUint16(signedMsg, dnsTypeTSIG)
+	signedMsg = binary.BigEndian.AppendUint16(signedMsg, dnsClassAny)
+	signedMsg = binary.BigEndian.AppendUint32(signedMsg, 0)
+	signedMsg = binary.BigEndian.AppendUint16(signedMsg, uint16(len(data)))
+	signedMsg = append(signedMsg, data...)
+
+	binary.BigEndian.PutUint16(signedMsg[10:], binary.BigEndian.Uint16(msg[10:])+1)
+
+	return signedMsg, nil
+}
+
+// appendDNSName appends name in wire format to buf. A trailing dot is optional.
+func appendDNSName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > dnsMaxLabel {
+				return nil, fmt.Errorf("%w: %s", errDNSName, name)
+			}
+
+			buf = append(append(buf, byte(len(label))), label...)
+		}
+	}
+
+	return append(buf, 0), nil
+}
+
+// parentZone returns name without its first label.
+func parentZone(name string) (string, error) {
+	_, parent, found := strings.Cut(strings.TrimSuffix(name, "."), ".")
+	if !found || parent == "" {
+		return "", fmt.Errorf("%w: %s has no parent zone", errDNSName, name)
+	}
+
+	return parent, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// bulkCheckInterval is how often Drain looks for connections that became bulk transfers once their grace passed.
+const bulkCheckInterval = time.Second
+
+// errProxyInUse is raised if a Proxy is passed to a run while it is attached to another one already.
+var errProxyInUse = errors.New("proxy is already attached to a run")
+
+// Proxy gives programs embedding tcp4to6 control over a run. Create it with NewProxy and either run it with Serve or
+// pass it to Run, RunWithConfig or RunWithListener with WithProxy. A Proxy can only be attached to a single run. Its
+// methods wait until the run has started.
+type Proxy struct {
+	// started is closed once prx is set.
+	started chan struct{}
+	// attached is 1 once the Proxy was passed to a run. Accessed atomically.
+	attached int32
+	prx      *proxy
+	// opts are the options Serve runs with.
+	opts []Option
+}
+
+// NewProxy creates a Proxy that is not attached to a run yet. opts are only used by Serve.
+func NewProxy(opts ...Option) *Proxy {
+	return &Proxy{started: make(chan struct{}), opts: opts}
+}
+
+// WithProxy attaches proxy to the run, so it can be controlled through it.
+func WithProxy(proxy *Proxy) Option {
+	return func(opts *options) {
+		opts.proxy = proxy
+	}
+}
+
+// attach makes p control prx.
+func (p *Proxy) attach(prx *proxy) error {
+	if !atomic.CompareAndSwapInt32(&p.attached, 0, 1) {
+		return errProxyInUse
+	}
+
+	p.prx = prx
+	close(p.started)
+
+	return nil
+}
+
+// running waits until the run p is attached to has started and returns its proxy.
+func (p *Proxy) running(ctx context.Context) (*proxy, error) {
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait for run: %w", ctx.Err())
+	case <-p.started:
+		return p.prx, nil
+	}
+}
+
+// DrainOption configures a single call of Proxy.Drain.
+type DrainOption func(*drainOptions)
+
+// drainOptions holds the configuration of a drain.
+type drainOptions struct {
+	// bulkBytes is the number of bytes after which a connection counts as bulk transfer. Zero if they are not closed
+	// early.
+	bulkBytes int64
+	// bulkGrace is how long bulk transfers may go on after draining started.
+	bulkGrace time.Duration
+}
+
+// WithBulkFirst makes Drain close bulk transfers, connections that transferred at least bytes in both directions
+// together, once grace passed since draining started, as well as connections that become bulk transfers later on.
+// Small transfers that are likely about to finish get the time left until the deadline of Drain instead of being cut
+// off together with long running downloads that would not have finished anyway.
+func WithBulkFirst(bytes int64, grace time.Duration) DrainOption {
+	return func(opts *drainOptions) {
+		opts.bulkBytes, opts.bulkGrace = bytes, grace
+	}
+}
+
+// Drain stops accepting new connections and waits until all active ones are done or ctx is canceled. Connections
+// still active then are closed. The number of connections Drain closed, including bulk transfers closed early as
+// configured by WithBulkFirst, is returned. The run keeps going until its context is canceled, so the caller can
+// decide when to stop it. With socket activation, connections arriving meanwhile queue up at the socket for the next
+// instance.
+func (p *Proxy) Drain(ctx context.Context, opts ...DrainOption) (int, error) {
+	prx, err := p.running(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var options drainOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return prx.drain(ctx, options)
+}
+
+// drain implements Proxy.Drain.
+func (p *proxy) drain(ctx context.Context, opts drainOptions) (int, error) {
+	if atomic.CompareAndSwapInt32(&p.draining, 0, 1) {
+		p.log.Info("draining, not accepting new connections", "event", "draining", "active", p.conns.len())
+		p.notifyStatus("draining")
+	}
+
+	if err := p.stopAccepting(); err != nil {
+		return 0, fmt.Errorf("stop accepting: %w", err)
+	}
+
+	empty := make(chan bool, 1)
+
+	go func() { empty <- p.conns.waitEmpty(ctx) }()
+
+	var (
+		closed    int
+		bulkTimer Timer
+		bulkCheck <-chan time.Time
+	)
+
+	if opts.bulkBytes > 0 {
+		bulkTimer = p.clock.NewTimer(opts.bulkGrace)
+		bulkCheck = bulkTimer.C()
+	}
+
+	defer func() {
+		if bulkTimer != nil {
+			bulkTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-bulkCheck:
+			if bulk := p.conns.closeBulk(opts.bulkBytes); bulk != 0 {
+				closed += bulk
+				p.log.Info("closed bulk transfers to drain the others", "event", "bulkClosed", "closed", bulk,
+					"active", p.conns.len())
+			}
+
+			bulkTimer = p.clock.NewTimer(bulkCheckInterval)
+			bulkCheck = bulkTimer.C()
+		case drained := <-empty:
+			if drained {
+				p.log.Info("drained all connections", "event", "drained", "closed", closed)
+
+				return closed, nil
+			}
+
+			remaining := p.conns.closeAll()
+			closed += remaining
+			p.log.Info("drain deadline passed, closed remaining connections", "event", "drained", "closed", remaining)
+
+			return closed, nil
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cidrList is a list of networks client addresses are matched against.
+type cidrList []*net.IPNet
+
+// parseCIDRs parses each of values as CIDR.
+func parseCIDRs(values []string) (cidrList, error) {
+	nets := make(cidrList, 0, len(values))
+
+	for _, value := range values {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse CIDR: %w", err)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// parseCIDRList parses whitespace separated CIDRs.
+func parseCIDRList(value string) (cidrList, error) {
+	return parseCIDRs(strings.Fields(value))
+}
+
+// containsIP reports if ip is within one of the networks. Nil is in none.
+func (l cidrList) containsIP(ip net.IP) bool {
+	for _, ipNet := range l {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contains reports if the IP of addr is within one of the networks. Addresses without IP are in none.
+func (l cidrList) contains(addr net.Addr) bool {
+	return l.containsIP(addrIP(addr))
+}
@@ -0,0 +1,376 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// metricsPath is the path the metrics endpoint serves the metrics at.
+	metricsPath = "/metrics"
+	// metricsContentType is the content type of the Prometheus text format.
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// metricsReadHeaderTimeout bounds the time scrapers get to send their request headers.
+	metricsReadHeaderTimeout = 10 * time.Second
+	// metricsShutdownTimeout bounds the time scrapes in progress get to finish when tcp4to6 stops.
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+// metricKind is the type of a metric family in the Prometheus text format.
+type metricKind string
+
+const (
+	metricCounter   metricKind = "counter"
+	metricGauge     metricKind = "gauge"
+	metricHistogram metricKind = "histogram"
+)
+
+// metricSeries are the values of a metric family for one set of label values.
+type metricSeries struct {
+	labelValues []string
+	// value is the value of counters and gauges and the sum of histograms.
+	value float64
+	// buckets are the cumulative counts of histograms by bucket, the last one counting all observations.
+	buckets []uint64
+}
+
+// metricFamily is a metric with all its series, which is the instrument the exposition hands out.
+type metricFamily struct {
+	name, help string
+	kind       metricKind
+	labelNames []string
+	// bounds are the upper bounds of the buckets of histograms, excluding +Inf.
+	bounds []float64
+	mtx    sync.Mutex
+	series map[string]*metricSeries
+}
+
+// seriesOf returns the series of labelValues, creating it if needed. The caller holds mtx.
+func (f *metricFamily) seriesOf(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+
+	series, ok := f.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == metricHistogram {
+			series.buckets = make([]uint64, len(f.bounds)+1)
+		}
+
+		f.series[key] = series
+	}
+
+	return series
+}
+
+// Add changes the value of the series of labelValues by delta.
+func (f *metricFamily) Add(delta float64, labelValues ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.seriesOf(labelValues).value += delta
+}
+
+// Observe counts value in all buckets of the series of labelValues it fits into.
+func (f *metricFamily) Observe(value float64, labelValues ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	series := f.seriesOf(labelValues)
+	series.value += value
+
+	for i := range series.buckets {
+		if i == len(f.bounds) || value <= f.bounds[i] {
+			series.buckets[i]++
+		}
+	}
+}
+
+// write writes the family in the Prometheus text format, its series sorted by their label values.
+func (f *metricFamily) write(w io.Writer) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind); err != nil {
+		return fmt.Errorf("write metric %s: %w", f.name, err)
+	}
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := f.writeSeries(w, f.series[key]); err != nil {
+			return fmt.Errorf("write metric %s: %w", f.name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeSeries writes the samples of series. The caller holds mtx.
+func (f *metricFamily) writeSeries(w io.Writer, series *metricSeries) error {
+	labels := formatLabels(f.labelNames, series.labelValues)
+
+	if f.kind != metricHistogram {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatSample(series.value)); err != nil {
+			return fmt.Errorf("write sample: %w", err)
+		}
+
+		return nil
+	}
+
+	for i, count := range series.buckets {
+		bound := math.Inf(1)
+		if i < len(f.bounds) {
+			bound = f.bounds[i]
+		}
+
+		bucketLabels := formatLabels(append(f.labelNames[:len(f.labelNames):len(f.labelNames)], "le"),
+			append(series.labelValues[:len(series.labelValues):len(series.labelValues)], formatSample(bound)))
+
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, bucketLabels, count); err != nil {
+			return fmt.Errorf("write bucket: %w", err)
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", f.name, labels, formatSample(series.value), f.name,
+		labels, series.buckets[len(series.buckets)-1]); err != nil {
+		return fmt.Errorf("write sum: %w", err)
+	}
+
+	return nil
+}
+
+// formatLabels returns names and values as label set of the text format, empty if there are no labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs[i] = name + `="` + escapeLabel(value) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatSample returns value as sample value of the text format.
+func formatSample(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// escapeHelp escapes backslashes and line feeds in help texts.
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// escapeLabel escapes backslashes, double quotes and line feeds in label values.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// exposition is the Metrics that keeps all measurements in memory and writes them in the Prometheus text format for
+// the metrics endpoint.
+type exposition struct {
+	mtx      sync.Mutex
+	families []*metricFamily
+}
+
+// family registers a family, which is written in the order families were registered.
+func (e *exposition) family(name, help string, kind metricKind, bounds []float64, labelNames []string,
+) *metricFamily {
+	family := &metricFamily{
+		name: name, help: help, kind: kind, labelNames: labelNames, bounds: bounds,
+		series: map[string]*metricSeries{},
+	}
+
+	// Series without labels are shown from the start, as with the Prometheus client.
+	if len(labelNames) == 0 {
+		family.seriesOf(nil)
+	}
+
+	e.mtx.Lock()
+	e.families = append(e.families, family)
+	e.mtx.Unlock()
+
+	return family
+}
+
+// Counter returns a counter that is exposed under name.
+func (e *exposition) Counter(name, help string, labelNames ...string) Counter {
+	return e.family(name, help, metricCounter, nil, labelNames)
+}
+
+// Gauge returns a gauge that is exposed under name.
+func (e *exposition) Gauge(name, help string, labelNames ...string) Gauge {
+	return e.family(name, help, metricGauge, nil, labelNames)
+}
+
+// Histogram returns a histogram that is exposed under name.
+func (e *exposition) Histogram(name, help string, buckets []float64, labelNames ...string) Histogram {
+	return e.family(name, help, metricHistogram, buckets, labelNames)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (e *exposition) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	e.mtx.Lock()
+	families := e.families
+	e.mtx.Unlock()
+
+	w.Header().Set("Content-Type", metricsContentType)
+
+	buffered := bufio.NewWriter(w)
+
+	for _, family := range families {
+		if err := family.write(buffered); err != nil {
+			return
+		}
+	}
+
+	_ = buffered.Flush()
+}
+
+// serve serves e at metricsPath on listener until ctx is canceled. Scrapes in progress then get
+// metricsShutdownTimeout to finish.
+func (e *exposition) serve(ctx context.Context, listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, e)
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: metricsReadHeaderTimeout}
+	served := make(chan error, 1)
+
+	go func() { served <- server.Serve(listener) }()
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("serve metrics: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("stop serving metrics: %w", err)
+	}
+
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve metrics: %w", err)
+	}
+
+	return nil
+}
+
+// listenMetrics binds the listener of the metrics endpoint to addr.
+func listenMetrics(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for metrics: %w", err)
+	}
+
+	return listener, nil
+}
+
+// teeMetrics is the Metrics that reports every measurement to all its members.
+type teeMetrics []Metrics
+
+// Counter returns a Counter that adds to the counters of all members.
+func (t teeMetrics) Counter(name, help string, labelNames ...string) Counter {
+	counters := make(teeCounter, len(t))
+	for i, metrics := range t {
+		counters[i] = metrics.Counter(name, help, labelNames...)
+	}
+
+	return counters
+}
+
+// Gauge returns a Gauge that adds to the gauges of all members.
+func (t teeMetrics) Gauge(name, help string, labelNames ...string) Gauge {
+	gauges := make(teeGauge, len(t))
+	for i, metrics := range t {
+		gauges[i] = metrics.Gauge(name, help, labelNames...)
+	}
+
+	return gauges
+}
+
+// Histogram returns a Histogram that observes with the histograms of all members.
+func (t teeMetrics) Histogram(name, help string, buckets []float64, labelNames ...string) Histogram {
+	histograms := make(teeHistogram, len(t))
+	for i, metrics := range t {
+		histograms[i] = metrics.Histogram(name, help, buckets, labelNames...)
+	}
+
+	return histograms
+}
+
+// teeCounter is the Counter of teeMetrics.
+type teeCounter []Counter
+
+// Add adds delta to all counters.
+func (t teeCounter) Add(delta float64, labelValues ...string) {
+	for _, counter := range t {
+		counter.Add(delta, labelValues...)
+	}
+}
+
+// teeGauge is the Gauge of teeMetrics.
+type teeGauge []Gauge
+
+// Add adds delta to all gauges.
+func (t teeGauge) Add(delta float64, labelValues ...string) {
+	for _, gauge := range t {
+		gauge.Add(delta, labelValues...)
+	}
+}
+
+// teeHistogram is the Histogram of teeMetrics.
+type teeHistogram []Histogram
+
+// Observe observes value with all histograms.
+func (t teeHistogram) Observe(value float64, labelValues ...string) {
+	for _, histogram := range t {
+		histogram.Observe(value, labelValues...)
+	}
+}
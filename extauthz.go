@@ -0,0 +1,160 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// defaultExtAuthzTimeout is the time the authorization endpoint gets to decide if not configured otherwise.
+	defaultExtAuthzTimeout = 2 * time.Second
+	// extAuthzMaxResponse is the number of bytes of a response of the authorization endpoint that are read at most.
+	extAuthzMaxResponse = 64 * 1024
+)
+
+var (
+	// errExtAuthzDenied is raised if the authorization endpoint denied a connection.
+	errExtAuthzDenied = errors.New("denied by authorization endpoint")
+	// errExtAuthzStatus is raised if the authorization endpoint responds with a non 2xx status.
+	errExtAuthzStatus = errors.New("authorization endpoint responded with unexpected status")
+	// errUnknownFailurePolicy is raised if a failure policy can not be parsed.
+	errUnknownFailurePolicy = errors.New("unknown failure policy, expected open or closed")
+)
+
+// extAuthzConfig configures asking an HTTP endpoint whether connections may pass.
+type extAuthzConfig struct {
+	// url is the endpoint connection metadata is POSTed to. Empty if disabled.
+	url string
+	// timeout bounds each request.
+	timeout time.Duration
+	// failOpen lets connections pass if the endpoint can not be asked. They are rejected otherwise.
+	failOpen bool
+}
+
+// parseFailurePolicy sets failOpen from value, open or closed.
+func (c *extAuthzConfig) parseFailurePolicy(value string) error {
+	switch value {
+	case "open":
+		c.failOpen = true
+	case "closed":
+		c.failOpen = false
+	default:
+		return fmt.Errorf("%w: %s", errUnknownFailurePolicy, value)
+	}
+
+	return nil
+}
+
+// extAuthzRequest is the JSON document POSTed to the authorization endpoint for each connection.
+type extAuthzRequest struct {
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	Local       string    `json:"local"`
+	ServerName  string    `json:"serverName,omitempty"`
+	Destination string    `json:"destination"`
+	Labels      Labels    `json:"labels,omitempty"`
+	Peer        *PeerCred `json:"peer,omitempty"`
+}
+
+// extAuthzResponse is the decision of the authorization endpoint. Destination routes the connection elsewhere if not
+// empty, labels are added to it and reason is logged if it is denied.
+type extAuthzResponse struct {
+	Allow       bool   `json:"allow"`
+	Destination string `json:"destination,omitempty"`
+	Labels      Labels `json:"labels,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// extAuthzStep returns the handshake step that asks the endpoint of cfg whether a connection may pass and where to.
+func extAuthzStep(log logr.Logger, cfg extAuthzConfig) handshakeStep {
+	client := &http.Client{Timeout: cfg.timeout}
+
+	return func(ctx context.Context, conn *connection, src net.Conn) (net.Conn, error) {
+		decision, err := askExtAuthz(ctx, client, cfg.url, conn.info())
+		if err != nil {
+			if !cfg.failOpen {
+				return src, fmt.Errorf("authorize: %w", err)
+			}
+
+			log.Error(err, "couldn't ask authorization endpoint, letting connection pass", "id", conn.id)
+
+			return src, nil
+		}
+
+		if !decision.Allow {
+			return src, fmt.Errorf("%w: %s", errExtAuthzDenied, decision.Reason)
+		}
+
+		if decision.Destination != "" {
+			conn.destination = decision.Destination
+		}
+
+		conn.addLabels(decision.Labels)
+
+		return src, nil
+	}
+}
+
+// askExtAuthz POSTs the metadata of the connection described by info to url and returns the decision.
+func askExtAuthz(ctx context.Context, client *http.Client, url string, info ConnInfo) (extAuthzResponse, error) {
+	encoded, err := json.Marshal(extAuthzRequest{
+		ID:          info.ID,
+		Client:      info.Client.String(),
+		Local:       info.Local.String(),
+		ServerName:  info.ServerName,
+		Destination: info.Destination,
+		Labels:      info.Labels,
+		Peer:        info.Peer,
+	})
+	if err != nil {
+		return extAuthzResponse{}, fmt.Errorf("encode authorization request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return extAuthzResponse{}, fmt.Errorf("create authorization request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return extAuthzResponse{}, fmt.Errorf("authorization request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, extAuthzMaxResponse))
+
+		return extAuthzResponse{}, fmt.Errorf("%w: %s", errExtAuthzStatus, resp.Status)
+	}
+
+	var decision extAuthzResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, extAuthzMaxResponse)).Decode(&decision); err != nil {
+		return extAuthzResponse{}, fmt.Errorf("decode authorization response: %w", err)
+	}
+
+	return decision, nil
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// alternativeSeparator separates alternative addresses of the same destination, like
+// tcp6:[2001:db8::1]:443,tcp4:192.0.2.1:443.
+const alternativeSeparator = ","
+
+// splitAlternatives returns the alternative addresses of the destination addr with those known to be IPv6 first.
+// Otherwise the order is kept. network is what addresses without prefix are dialed with.
+func splitAlternatives(network, addr string) []string {
+	alternatives := strings.Split(addr, alternativeSeparator)
+	if len(alternatives) == 1 {
+		return alternatives
+	}
+
+	ordered := make([]string, 0, len(alternatives))
+	rest := make([]string, 0, len(alternatives))
+
+	for _, alternative := range alternatives {
+		if isIPv6Destination(network, alternative) {
+			ordered = append(ordered, alternative)
+		} else {
+			rest = append(rest, alternative)
+		}
+	}
+
+	return append(ordered, rest...)
+}
+
+// isIPv6Destination reports if addr is dialed via IPv6 for sure, because its network is tcp6 or its host is an IPv6
+// address.
+func isIPv6Destination(network, addr string) bool {
+	network, addr = splitNetwork(network, addr)
+
+	switch network {
+	case "tcp6":
+		return true
+	case "tcp":
+		host, _, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+
+		return err == nil && ip != nil && ip.To4() == nil
+	default:
+		return false
+	}
+}
+
+// raceResult is the outcome of dialing one of several alternatives.
+type raceResult struct {
+	conn net.Conn
+	err  error
+}
+
+// raceAlternatives dials the alternative addresses addrs like happy eyeballs does: the first one gets a head start of
+// the fallback delay of cfg, then the next one is dialed as well, and so on. A failed dial starts the next one right
+// away. The first connection established is returned and the other dials are canceled. The error of the first failed
+// dial is returned if none succeeds.
+func (p *proxy) raceAlternatives(ctx context.Context, cfg dialConfig, addrs []string,
+	opts socketOptions,
+) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(addrs))
+	started, failed := 0, 0
+
+	var (
+		headStart Timer
+		next      <-chan time.Time
+		firstErr  error
+	)
+
+	start := func() {
+		addr := addrs[started]
+		started++
+
+		go func() {
+			conn, err := p.dialDestination(ctx, cfg, addr, opts)
+			results <- raceResult{conn: conn, err: err}
+		}()
+
+		if headStart != nil {
+			headStart.Stop()
+		}
+
+		next = nil
+
+		if started < len(addrs) {
+			headStart = p.clock.NewTimer(cfg.fallbackDelay)
+			next = headStart.C()
+		}
+	}
+
+	defer func() {
+		if headStart != nil {
+			headStart.Stop()
+		}
+	}()
+
+	start()
+
+	for {
+		select {
+		case <-next:
+			start()
+		case result := <-results:
+			if result.err == nil {
+				go closeLosers(results, started-failed-1)
+
+				return result.conn, nil
+			}
+
+			failed++
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+
+			switch {
+			case started < len(addrs):
+				start()
+			case failed == started:
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// closeLosers waits for pending dials that lost a race and closes the connections they established anyway.
+func closeLosers(results <-chan raceResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.conn != nil {
+			_ = result.conn.Close()
+		}
+	}
+}
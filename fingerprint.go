@@ -0,0 +1,199 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"crypto/md5" //nolint:gosec // JA3 is defined as MD5 hash.
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// greaseMask selects the bits that are the same for all GREASE values of RFC 8701.
+	greaseMask = 0x0f0f
+	// greasePattern is the value of the bits selected by greaseMask for GREASE values.
+	greasePattern = 0x0a0a
+	// ja4HashLen is the number of hex characters of the truncated hashes in a JA4 fingerprint.
+	ja4HashLen = 12
+	// ja4MaxCount is the largest count a JA4 fingerprint can hold.
+	ja4MaxCount = 99
+	// tlsVersionSSL30 is the version number of SSL 3.0, which crypto/tls only keeps as deprecated constant.
+	tlsVersionSSL30 = 0x0300
+)
+
+// isGREASE reports if value is one of the reserved values clients send to keep servers tolerant.
+func isGREASE(value uint16) bool {
+	return value&greaseMask == greasePattern && value>>8 == value&0xff
+}
+
+// withoutGREASE returns values without GREASE values.
+func withoutGREASE(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+
+	for _, value := range values {
+		if !isGREASE(value) {
+			filtered = append(filtered, value)
+		}
+	}
+
+	return filtered
+}
+
+// joinValues formats values with format and joins them with sep.
+func joinValues(values []uint16, format func(uint16) string, sep string) string {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = format(value)
+	}
+
+	return strings.Join(formatted, sep)
+}
+
+// decimal formats value as decimal number.
+func decimal(value uint16) string {
+	return strconv.Itoa(int(value))
+}
+
+// hex4 formats value as four digit hex number.
+func hex4(value uint16) string {
+	return fmt.Sprintf("%04x", value)
+}
+
+// ja3 returns the JA3 fingerprint of the ClientHello.
+func (h *clientHello) ja3() string {
+	pointFormats := make([]uint16, len(h.pointFormats))
+	for i, format := range h.pointFormats {
+		pointFormats[i] = uint16(format)
+	}
+
+	full := strings.Join([]string{
+		decimal(h.version),
+		joinValues(withoutGREASE(h.cipherSuites), decimal, "-"),
+		joinValues(withoutGREASE(h.extensions), decimal, "-"),
+		joinValues(withoutGREASE(h.supportedGroups), decimal, "-"),
+		joinValues(pointFormats, decimal, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(full)) //nolint:gosec // JA3 is defined as MD5 hash.
+
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello.
+func (h *clientHello) ja4() string {
+	version := h.version
+
+	if supported := withoutGREASE(h.supportedVersions); len(supported) != 0 {
+		version = 0
+
+		for _, candidate := range supported {
+			if candidate > version {
+				version = candidate
+			}
+		}
+	}
+
+	versionName := "00"
+
+	switch version {
+	case tls.VersionTLS13:
+		versionName = "13"
+	case tls.VersionTLS12:
+		versionName = "12"
+	case tls.VersionTLS11:
+		versionName = "11"
+	case tls.VersionTLS10:
+		versionName = "10"
+	case tlsVersionSSL30:
+		versionName = "s3"
+	}
+
+	destination := "i"
+	if h.serverName != "" {
+		destination = "d"
+	}
+
+	ciphers := withoutGREASE(h.cipherSuites)
+	extensions := withoutGREASE(h.extensions)
+
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s",
+		versionName, destination, min99(len(ciphers)), min99(len(extensions)), ja4ALPN(h.alpn))
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	sortedExtensions := make([]uint16, 0, len(extensions))
+
+	for _, ext := range extensions {
+		if ext != tlsExtServerName && ext != tlsExtALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+
+	extensionsPart := joinValues(sortedExtensions, hex4, ",")
+	if algorithms := withoutGREASE(h.signatureAlgorithms); len(algorithms) != 0 {
+		extensionsPart += "_" + joinValues(algorithms, hex4, ",")
+	}
+
+	return prefix + "_" + ja4Hash(len(sortedCiphers), joinValues(sortedCiphers, hex4, ",")) + "_" +
+		ja4Hash(len(sortedExtensions), extensionsPart)
+}
+
+// min99 caps count to what fits into the two digits of a JA4 fingerprint.
+func min99(count int) int {
+	if count > ja4MaxCount {
+		return ja4MaxCount
+	}
+
+	return count
+}
+
+// ja4ALPN returns the first and last character of the first ALPN protocol, 00 if there is none. Protocols that
+// start or end with a non alphanumeric character are represented by the first and last hex digit of their bytes.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+
+	first, last := protocols[0][0], protocols[0][len(protocols[0])-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		encoded := hex.EncodeToString([]byte(protocols[0]))
+
+		return encoded[:1] + encoded[len(encoded)-1:]
+	}
+
+	return string([]byte{first, last})
+}
+
+// isAlphanumeric reports if c is an ASCII letter or digit.
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ja4Hash returns the truncated SHA-256 hash of list, or zeros if list has no elements.
+func ja4Hash(elements int, list string) string {
+	if elements == 0 {
+		return strings.Repeat("0", ja4HashLen)
+	}
+
+	sum := sha256.Sum256([]byte(list))
+
+	return hex.EncodeToString(sum[:])[:ja4HashLen]
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import "testing"
+
+func TestJA4IgnoresGREASESignatureAlgorithms(t *testing.T) {
+	hello := clientHello{
+		version:             0x0303,
+		cipherSuites:        []uint16{0x1301, 0x1302},
+		extensions:          []uint16{0x000d, 0x002b},
+		signatureAlgorithms: []uint16{0x0403, 0x0804},
+		supportedVersions:   []uint16{0x0304},
+	}
+
+	greased := hello
+	greased.signatureAlgorithms = []uint16{0x1a1a, 0x0403, 0x0804}
+
+	if plain, withGREASE := hello.ja4(), greased.ja4(); plain != withGREASE {
+		t.Fatalf("GREASE signature algorithm changed fingerprint %s to %s", plain, withGREASE)
+	}
+}
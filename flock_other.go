@@ -0,0 +1,29 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !unix
+
+package tcpto6
+
+import (
+	"errors"
+	"os"
+)
+
+// errFlockUnsupported indicates that lock files can not be locked on this platform.
+var errFlockUnsupported = errors.New("lock files are only supported on unix")
+
+// flock fails since flock is only available on unix.
+func flock(*os.File) error {
+	return errFlockUnsupported
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+)
+
+// flowLabelMode is how the IPv6 flow label of dialed connections is chosen.
+type flowLabelMode int
+
+const (
+	// flowLabelOff leaves the flow label to the kernel.
+	flowLabelOff flowLabelMode = iota
+	// flowLabelRandom assigns a random flow label to each connection.
+	flowLabelRandom
+	// flowLabelClient derives the flow label from the address of the client.
+	flowLabelClient
+)
+
+// flowLabelMask covers the 20 bits of the IPv6 flow label.
+const flowLabelMask = 0xfffff
+
+var (
+	// errUnknownFlowLabelMode is raised if a flowLabelMode can not be parsed.
+	errUnknownFlowLabelMode = errors.New("unknown flow label mode")
+	// errFlowLabelUnsupported is raised if flow labels are assigned on a platform that does not support it.
+	errFlowLabelUnsupported = errors.New("flow labels are only supported on linux")
+)
+
+// parseFlowLabelMode returns the flowLabelMode called name. Valid names are off, random and client.
+func parseFlowLabelMode(name string) (flowLabelMode, error) {
+	switch name {
+	case "off":
+		return flowLabelOff, nil
+	case "random":
+		return flowLabelRandom, nil
+	case "client":
+		return flowLabelClient, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", errUnknownFlowLabelMode, name)
+	}
+}
+
+// label returns the flow label for a connection of client. Zero means that no label is assigned.
+func (m flowLabelMode) label(client net.Addr) uint32 {
+	var label uint32
+
+	switch m {
+	case flowLabelOff:
+		return 0
+	case flowLabelRandom:
+		var buf [4]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0
+		}
+
+		label = binary.BigEndian.Uint32(buf[:])
+	case flowLabelClient:
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(client.String()))
+		label = hash.Sum32()
+	}
+
+	// Zero is reserved for flows without a label.
+	if label &= flowLabelMask; label == 0 {
+		label = 1
+	}
+
+	return label
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ipv6FlowLabelMgr is the socket option that leases flow labels, IPV6_FLOWLABEL_MGR.
+	ipv6FlowLabelMgr = 32
+	// ipv6FlowInfoSend is the socket option that makes the kernel use the flow label passed to connect,
+	// IPV6_FLOWINFO_SEND.
+	ipv6FlowInfoSend = 33
+	// ipv6FlowLabelGet is the action of ipv6FlowLabelMgr that leases a label, IPV6_FL_A_GET.
+	ipv6FlowLabelGet = 0
+	// ipv6FlowLabelCreate is the flag of ipv6FlowLabelMgr that creates labels not leased yet, IPV6_FL_F_CREATE.
+	ipv6FlowLabelCreate = 1
+	// ipv6FlowLabelShareAny lets labels be leased by any socket, IPV6_FL_S_ANY.
+	ipv6FlowLabelShareAny = 255
+)
+
+// flowLabelRequest is struct in6_flowlabel_req that is passed to ipv6FlowLabelMgr.
+type flowLabelRequest struct {
+	dst     [16]byte
+	label   uint32
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+// dialFlowLabel connects to addr via tcp6 and sends the flow label of opts as IPv6 flow label. Linux only accepts
+// labels that were leased by the socket before, so the net package can not do this.
+func dialFlowLabel(ctx context.Context, addr string, opts socketOptions) (net.Conn, error) {
+	resolved, err := net.ResolveTCPAddr("tcp6", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve address: %w", err)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+
+	sa := unix.RawSockaddrInet6{Family: unix.AF_INET6, Scope_id: uint32(zoneIndex(resolved.Zone))}
+	copy(sa.Addr[:], resolved.IP.To16())
+	// Port and flow info are in network byte order.
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], uint16(resolved.Port))
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&sa.Flowinfo))[:], opts.flowLabel&flowLabelMask)
+
+	request := flowLabelRequest{
+		dst:    sa.Addr,
+		label:  sa.Flowinfo,
+		action: ipv6FlowLabelGet,
+		share:  ipv6FlowLabelShareAny,
+		flags:  ipv6FlowLabelCreate,
+	}
+
+	if err := setsockopt(fd, ipv6FlowLabelMgr, unsafe.Pointer(&request), unsafe.Sizeof(request)); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("lease flow label: %w", err)
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, ipv6FlowInfoSend, 1); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("send flow label: %w", err)
+	}
+
+	if err := opts.apply(fd, true); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, err
+	}
+
+	if opts.source != nil {
+		local := unix.SockaddrInet6{}
+		copy(local.Addr[:], opts.source.To16())
+
+		if err := unix.Bind(fd, &local); err != nil {
+			_ = unix.Close(fd)
+
+			return nil, fmt.Errorf("bind source address: %w", err)
+		}
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+	if errno != 0 && !errors.Is(errno, unix.EINPROGRESS) {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("connect: %w", errno)
+	}
+
+	file := os.NewFile(uintptr(fd), "tcp6")
+	defer file.Close()
+
+	if errno != 0 {
+		if err := awaitConnect(ctx, file); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("connection: %w", err)
+	}
+
+	return conn, nil
+}
+
+// setsockopt sets the IPv6 socket option name of fd to the value of size bytes at ptr.
+func setsockopt(fd, name int, ptr unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.IPPROTO_IPV6, uintptr(name), uintptr(ptr), size, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// zoneIndex returns the index of the interface called zone. Zero is returned if zone is empty or unknown.
+func zoneIndex(zone string) int {
+	if zone == "" {
+		return 0
+	}
+
+	iface, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0
+	}
+
+	return iface.Index
+}
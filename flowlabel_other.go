@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"net"
+)
+
+// dialFlowLabel fails since flow labels are only supported on linux.
+func dialFlowLabel(context.Context, string, socketOptions) (net.Conn, error) {
+	return nil, errFlowLabelUnsupported
+}
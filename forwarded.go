@@ -0,0 +1,101 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// ForwardedConn provides a single connection that was accepted by someone else, like a container runtime or
+// systemd with Accept=yes, and handed over as a connected socket. tcp4to6 stops once the connection is done.
+type ForwardedConn struct {
+	// File is the connected socket. It is closed by Listeners.
+	File *os.File
+}
+
+// Listeners returns a listener that hands out the forwarded connection once.
+func (f ForwardedConn) Listeners() ([]net.Listener, error) {
+	conn, err := net.FileConn(f.File)
+	_ = f.File.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("forwarded connection: %w", err)
+	}
+
+	return []net.Listener{newConnListener(conn)}, nil
+}
+
+// connListener is a net.Listener that returns a single connection from Accept. Further calls block until the
+// connection is finished or the listener is closed and then report the listener as closed, so everything serving the
+// listener ends with the connection.
+type connListener struct {
+	mtx  sync.Mutex
+	conn net.Conn
+	// local is the local address of the connection.
+	local net.Addr
+	// done is closed when the connection is finished or the listener was closed.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newConnListener creates a connListener that hands out conn.
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, local: conn.LocalAddr(), done: make(chan struct{})}
+}
+
+// Accept returns the connection on the first call.
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mtx.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mtx.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.done
+
+	return nil, fmt.Errorf("accept forwarded connection: %w", net.ErrClosed)
+}
+
+// Close makes pending and future calls of Accept return. The connection is closed as well if it was not handed out.
+func (l *connListener) Close() error {
+	l.mtx.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mtx.Unlock()
+
+	l.finished()
+
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			return fmt.Errorf("close forwarded connection: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// finished is called by the proxy when the connection handed out by Accept is done.
+func (l *connListener) finished() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
+
+// Addr returns the local address of the connection.
+func (l *connListener) Addr() net.Addr {
+	return l.local
+}
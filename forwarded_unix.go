@@ -0,0 +1,40 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package tcpto6
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// isListening tells if file is a listening socket as opposed to a connected one.
+func isListening(file *os.File) bool {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return true
+	}
+
+	accepting := 1
+
+	_ = raw.Control(func(fd uintptr) {
+		if value, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ACCEPTCONN); err == nil {
+			accepting = value
+		}
+	})
+
+	return accepting != 0
+}
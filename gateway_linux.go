@@ -0,0 +1,63 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// procNetRoute lists the IPv4 routes of the network namespace.
+const procNetRoute = "/proc/net/route"
+
+// errNoGateway is raised if there is no default route with a gateway.
+var errNoGateway = errors.New("no IPv4 default gateway")
+
+// defaultGateway returns the gateway of the IPv4 default route.
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open(procNetRoute)
+	if err != nil {
+		return nil, fmt.Errorf("read routes: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Destination and gateway are in the byte order of the host, which is little endian on all supported
+		// architectures.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != net.IPv4len || binary.LittleEndian.Uint32(gateway) == 0 {
+			continue
+		}
+
+		return net.IPv4(gateway[3], gateway[2], gateway[1], gateway[0]), nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read routes: %w", err)
+	}
+
+	return nil, errNoGateway
+}
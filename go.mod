@@ -1,6 +1,6 @@
 module dev.eqrx.net/tcpto6
 
-go 1.17
+go 1.20
 
 require (
 	dev.eqrx.net/rungroup v0.0.5
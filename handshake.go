@@ -0,0 +1,58 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// handshakeStep is run on an accepted connection before its backend is dialed. It may read from src, record what it
+// learned in conn and return a replacement for src, like a TLS server connection wrapping it. The returned net.Conn
+// must be usable in place of src, even if an error is returned.
+type handshakeStep func(ctx context.Context, conn *connection, src net.Conn) (net.Conn, error)
+
+// handshake runs all handshake steps of the generation on src and returns the connection that should be bridged. The
+// whole phase is bounded by the configured handshake timeout, applied to both the deadline of src and ctx, so a
+// client can not hold on to resources before it is bridged indefinitely. Without handshake steps src is returned
+// untouched. If an error is returned the returned net.Conn must still be closed by the caller.
+func (g *generation) handshake(ctx context.Context, conn *connection, src net.Conn) (net.Conn, error) {
+	if len(g.handshakeSteps) == 0 {
+		return src, nil
+	}
+
+	conn.setState(connStateHandshaking)
+
+	ctx, cancel := context.WithTimeout(ctx, g.cfg.handshakeTimeout)
+	defer cancel()
+
+	if err := src.SetDeadline(time.Now().Add(g.cfg.handshakeTimeout)); err != nil {
+		return src, fmt.Errorf("set handshake deadline: %w", err)
+	}
+
+	for _, step := range g.handshakeSteps {
+		var err error
+		if src, err = step(ctx, conn, src); err != nil {
+			return src, fmt.Errorf("handshake: %w", err)
+		}
+	}
+
+	if err := src.SetDeadline(time.Time{}); err != nil {
+		return src, fmt.Errorf("clear handshake deadline: %w", err)
+	}
+
+	return src, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// ExitCodeUnhealthy is the exit code the tcpto6 command uses if Run returned ErrUnhealthy, so a service manager
+	// can tell a violated health rule from other failures, e.g. with RestartForceExitStatus= of systemd.
+	ExitCodeUnhealthy = 3
+	// healthMinDials is the number of dials an interval needs before its dial failure rate is judged.
+	healthMinDials = 10
+	// percent converts ratios to percentages.
+	percent = 100
+)
+
+// ErrUnhealthy is returned by Run if a health rule was violated and HealthExitEnvName is set.
+var ErrUnhealthy = errors.New("health rule violated")
+
+// healthConfig configures the rules tcp4to6 checks its own health with. Rules with a zero threshold are disabled.
+type healthConfig struct {
+	// interval is the time between two checks.
+	interval time.Duration
+	// maxDialFailureRate is the percentage of failed dials within an interval that is tolerated.
+	maxDialFailureRate int
+	// minFDHeadroom is the number of file descriptors that must still be available below the limit.
+	minFDHeadroom int
+	// exit makes Run return ErrUnhealthy once a rule is violated.
+	exit bool
+}
+
+// enabled reports if any rule is configured.
+func (c healthConfig) enabled() bool {
+	return c.maxDialFailureRate > 0 || c.minFDHeadroom > 0
+}
+
+// watchHealth checks the health rules of cfg each interval until ctx is canceled. When rules start or stop being
+// violated, the change is logged and shown as unit status. ErrUnhealthy is returned on violation if cfg asks to exit.
+func (p *proxy) watchHealth(ctx context.Context, cfg healthConfig) error {
+	ticker := p.clock.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	last := p.stats.snapshot(p.clock.Now())
+	unhealthy := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		current := p.stats.snapshot(p.clock.Now())
+		violations := checkHealth(cfg, current, last)
+		last = current
+
+		switch {
+		case len(violations) != 0:
+			reason := strings.Join(violations, ", ")
+
+			p.log.Info("health rule violated", "event", "unhealthy", "violations", violations)
+			p.notifyStatus("unhealthy: " + reason)
+
+			if cfg.exit {
+				return fmt.Errorf("%w: %s", ErrUnhealthy, reason)
+			}
+
+			unhealthy = true
+		case unhealthy:
+			p.log.Info("health rules satisfied again", "event", "healthy")
+			p.notifyStatus(fmt.Sprintf("running version %d", p.generation().version))
+
+			unhealthy = false
+		}
+	}
+}
+
+// checkHealth returns descriptions of the rules of cfg that are violated by the interval between the stats snapshots
+// earlier and current.
+func checkHealth(cfg healthConfig, current, earlier statsSnapshot) []string {
+	var violations []string
+
+	dials := current.dials - earlier.dials
+	failures := current.dialFailures - earlier.dialFailures
+
+	if cfg.maxDialFailureRate > 0 && dials >= healthMinDials {
+		if rate := failures * percent / dials; rate > int64(cfg.maxDialFailureRate) {
+			violations = append(violations, fmt.Sprintf("%d%% of dials failed", rate))
+		}
+	}
+
+	if cfg.minFDHeadroom > 0 {
+		if headroom, err := fdHeadroom(); err == nil && headroom < cfg.minFDHeadroom {
+			violations = append(violations, fmt.Sprintf("only %d file descriptors left", headroom))
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"sync"
+)
+
+// holdQueue keeps track of connections that are parked while their backend is unreachable, e.g. during a restart.
+// Parked connections keep dialing and are woken up as soon as a dial to their destination succeeds.
+type holdQueue struct {
+	// limit is the number of connections that may be parked at once.
+	limit int
+	mtx   sync.Mutex
+	// parked is the number of connections that are currently parked.
+	parked int
+	// up maps destinations to a channel that is closed the next time a dial to it succeeds.
+	up map[string]chan struct{}
+}
+
+// newHoldQueue creates a holdQueue that parks up to limit connections.
+func newHoldQueue(limit int) *holdQueue {
+	return &holdQueue{limit: limit, up: map[string]chan struct{}{}}
+}
+
+// park reserves a place for a connection and returns if there was one. unpark must be called once the connection
+// is not parked anymore.
+func (q *holdQueue) park() bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.parked >= q.limit {
+		return false
+	}
+
+	q.parked++
+
+	return true
+}
+
+// unpark frees a place reserved by park.
+func (q *holdQueue) unpark() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.parked--
+}
+
+// len returns the number of parked connections.
+func (q *holdQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return q.parked
+}
+
+// waitUp returns a channel that is closed the next time a dial to destination succeeds.
+func (q *holdQueue) waitUp(destination string) <-chan struct{} {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	up, ok := q.up[destination]
+	if !ok {
+		up = make(chan struct{})
+		q.up[destination] = up
+	}
+
+	return up
+}
+
+// reachable wakes up all connections waiting for destination since a dial to it succeeded.
+func (q *holdQueue) reachable(destination string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if up, ok := q.up[destination]; ok {
+		close(up)
+		delete(q.up, destination)
+	}
+}
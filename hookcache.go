@@ -0,0 +1,101 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// hookCacheSize is the number of sources whose hook decisions are cached at most.
+const hookCacheSize = 4096
+
+// hookDecision is the cached outcome of a hook.
+type hookDecision struct {
+	labels  Labels
+	err     error
+	expires time.Time
+}
+
+// hookCache remembers the decisions of a hook per source address.
+type hookCache struct {
+	hook Hook
+	ttl  time.Duration
+	// clock tells when decisions expire. It is set to the clock of the proxy the cache is used by.
+	clock Clock
+	mtx   sync.Mutex
+	// decisions are keyed by the IP address of the client, or its whole address if it has none.
+	decisions map[string]hookDecision
+}
+
+// WithCachedHook is like WithHook, but the labels or error hook returns are remembered for ttl per IP address of the
+// client. Further connections from the same address get the same decision without calling hook, which saves
+// expensive lookups like GeoIP or external authorization during bursts. Only use it for hooks that decide by the
+// client address alone.
+func WithCachedHook(hook Hook, ttl time.Duration) Option {
+	return func(opts *options) {
+		cache := &hookCache{hook: hook, ttl: ttl, clock: systemClock{}, decisions: map[string]hookDecision{}}
+		opts.hooks = append(opts.hooks, cache.call)
+		opts.hookCaches = append(opts.hookCaches, cache)
+	}
+}
+
+// call returns the cached decision for the client of info or calls the hook and caches its decision. Decisions of
+// calls that were canceled are not cached.
+func (c *hookCache) call(ctx context.Context, info ConnInfo) (Labels, error) {
+	key := info.Client.String()
+	if ip := addrIP(info.Client); ip != nil {
+		key = ip.String()
+	}
+
+	c.mtx.Lock()
+	decision, ok := c.decisions[key]
+	c.mtx.Unlock()
+
+	if ok && c.clock.Now().Before(decision.expires) {
+		return decision.labels.clone(), decision.err
+	}
+
+	labels, err := c.hook(ctx, info)
+	if ctx.Err() != nil {
+		return labels, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if len(c.decisions) >= hookCacheSize {
+		c.evict()
+	}
+
+	c.decisions[key] = hookDecision{labels: labels.clone(), err: err, expires: c.clock.Now().Add(c.ttl)}
+
+	return labels, err
+}
+
+// evict drops expired decisions, or all of them if none expired. Must be called with mtx held.
+func (c *hookCache) evict() {
+	now := c.clock.Now()
+
+	for key, decision := range c.decisions {
+		if now.After(decision.expires) {
+			delete(c.decisions, key)
+		}
+	}
+
+	if len(c.decisions) >= hookCacheSize {
+		c.decisions = map[string]hookDecision{}
+	}
+}
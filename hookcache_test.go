@@ -0,0 +1,57 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCachedHookExpiresOnClock(t *testing.T) {
+	clock := NewManualClock(time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC))
+	calls := 0
+	hook := func(context.Context, ConnInfo) (Labels, error) {
+		calls++
+
+		return Labels{}, nil
+	}
+
+	var opts options
+
+	WithCachedHook(hook, time.Minute)(&opts)
+	opts.hookCaches[0].clock = clock
+
+	info := ConnInfo{Client: &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 51234}}
+
+	for _, step := range []struct {
+		advance time.Duration
+		calls   int
+	}{
+		{calls: 1},
+		{advance: time.Minute - time.Nanosecond, calls: 1},
+		{advance: time.Nanosecond, calls: 2},
+	} {
+		clock.Advance(step.advance)
+
+		if _, err := opts.hooks[0](context.Background(), info); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != step.calls {
+			t.Fatalf("hook called %d times instead of %d after %s", calls, step.calls, step.advance)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Labels are key value pairs attached to a connection, like the tenant or service it belongs to. They are written to
+// the access log and pushed metrics are broken down by them.
+type Labels map[string]string
+
+// key returns a string that is the same for all Labels with the same content.
+func (l Labels) key() string {
+	pairs := make([]string, 0, len(l))
+	for name, value := range l {
+		pairs = append(pairs, name+"="+value)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// clone returns a copy of l. Nil if l is empty.
+func (l Labels) clone() Labels {
+	if len(l) == 0 {
+		return nil
+	}
+
+	cloned := make(Labels, len(l))
+	for name, value := range l {
+		cloned[name] = value
+	}
+
+	return cloned
+}
+
+// ConnInfo describes an accepted connection to a Hook.
+type ConnInfo struct {
+	// ID identifies the connection in logs and the control socket.
+	ID uint64
+	// Client is the remote address of the accepted connection.
+	Client net.Addr
+	// Local is the local address of the accepted connection.
+	Local net.Addr
+	// ServerName is the server name the client requested via TLS SNI. Empty if not known.
+	ServerName string
+	// Destination is the address that is going to be dialed for the connection.
+	Destination string
+	// Labels are the labels attached to the connection so far.
+	Labels Labels
+	// Peer holds the credentials of the client process if it connected via a unix socket. Nil otherwise. Hooks may
+	// reject connections based on it.
+	Peer *PeerCred
+}
+
+// Hook is called for each accepted connection after the built in handshake steps like TLS routing and before the
+// backend is dialed. The returned labels are added to the labels of the connection. Returning an error rejects the
+// connection. Hooks are bound by the handshake timeout.
+type Hook func(ctx context.Context, info ConnInfo) (Labels, error)
+
+// info returns what hooks get to know about conn. Must be called by the handling routine.
+func (c *connection) info() ConnInfo {
+	snap := c.snapshot()
+
+	return ConnInfo{
+		ID:          c.id,
+		Client:      c.client,
+		Local:       c.local,
+		ServerName:  snap.serverName,
+		Destination: c.destination,
+		Labels:      snap.labels,
+		Peer:        c.peer,
+	}
+}
+
+// hookStep wraps hook as handshakeStep.
+func hookStep(hook Hook) handshakeStep {
+	return func(ctx context.Context, conn *connection, src net.Conn) (net.Conn, error) {
+		labels, err := hook(ctx, conn.info())
+		if err != nil {
+			return src, err
+		}
+
+		conn.addLabels(labels)
+
+		return src, nil
+	}
+}
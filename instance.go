@@ -0,0 +1,72 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// instanceLabel is the label connections get with the name of the unit instance.
+const instanceLabel = "instance"
+
+// systemdInstance returns the instance name of the templated systemd service tcp4to6 runs in, like web for
+// tcp4to6@web.service. It is taken from the cgroup of the process since systemd does not pass it otherwise. Empty if
+// tcp4to6 does not run in a templated service.
+func systemdInstance() string {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+
+	instance := ""
+
+	for _, line := range strings.Split(string(content), "\n") {
+		for _, unit := range strings.Split(line, "/") {
+			if !strings.HasSuffix(unit, ".service") {
+				continue
+			}
+
+			if at := strings.IndexByte(unit, '@'); at != -1 {
+				instance = unescapeUnitName(strings.TrimSuffix(unit[at+1:], ".service"))
+			}
+		}
+	}
+
+	return instance
+}
+
+// unitEscapeLength is the length of an escape sequence in a unit name like \x2d.
+const unitEscapeLength = len(`\x2d`)
+
+// unescapeUnitName reverses the escaping systemd applies to unit names, e.g. a\x2db becomes a-b.
+func unescapeUnitName(name string) string {
+	var unescaped strings.Builder
+
+	for i := 0; i < len(name); i++ {
+		if strings.HasPrefix(name[i:], `\x`) && i+unitEscapeLength <= len(name) {
+			if char, err := strconv.ParseUint(name[i+len(`\x`):i+unitEscapeLength], 16, 8); err == nil {
+				unescaped.WriteByte(byte(char))
+
+				i += unitEscapeLength - 1
+
+				continue
+			}
+		}
+
+		unescaped.WriteByte(name[i])
+	}
+
+	return unescaped.String()
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lockFileMode is the permission a lock file is created with.
+const lockFileMode = 0o644
+
+var (
+	// errAlreadyRunning indicates that another instance holds the instance lock.
+	errAlreadyRunning = errors.New("another instance is running")
+	// errLockLost indicates that a held lock file was removed, replaced or taken over by another process.
+	errLockLost = errors.New("lock file is no longer held")
+	// errLockHeld is internally raised if another process holds the flock on a file.
+	errLockHeld = errors.New("lock is held by another process")
+)
+
+// lockInstance takes the instance lock named by spec, which is the path of a lock file or, starting with @, the name
+// of an abstract unix socket. It fails with errAlreadyRunning naming the PID of the other instance if that one holds
+// the lock. The lock is released when the returned closer is closed or the process exits.
+func lockInstance(spec string) (io.Closer, error) {
+	if name := strings.TrimPrefix(spec, "@"); name != spec {
+		return lockAbstract(name)
+	}
+
+	lock, err := lockFile(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// fileLock is an instance lock held with flock on a file that contains the PID of the holder.
+type fileLock struct {
+	file *os.File
+}
+
+// lockFile takes an exclusive flock on the file at path, creating it if needed, and writes the PID of this process
+// into it.
+func lockFile(path string) (fileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, lockFileMode)
+	if err != nil {
+		return fileLock{}, fmt.Errorf("open lock file: %w", err)
+	}
+
+	if err := flock(file); err != nil {
+		defer file.Close()
+
+		if !errors.Is(err, errLockHeld) {
+			return fileLock{}, fmt.Errorf("lock %s: %w", path, err)
+		}
+
+		content, _ := io.ReadAll(io.LimitReader(file, 32))
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil {
+			return fileLock{}, fmt.Errorf("%w: pid %d holds lock file %s", errAlreadyRunning, pid, path)
+		}
+
+		return fileLock{}, fmt.Errorf("%w: lock file %s is held", errAlreadyRunning, path)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		_ = file.Close()
+
+		return fileLock{}, fmt.Errorf("truncate lock file: %w", err)
+	}
+
+	if _, err := file.WriteString(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		_ = file.Close()
+
+		return fileLock{}, fmt.Errorf("write lock file: %w", err)
+	}
+
+	return fileLock{file: file}, nil
+}
+
+// verify checks that the file at path is still the locked file and contains the PID of this process. It fails with
+// errLockLost if the file was removed or replaced, which makes a new holder possible, or was overwritten.
+func (l fileLock) verify(path string) error {
+	held, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat locked file: %w", err)
+	}
+
+	current, err := os.Stat(path)
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("%w: %s was removed", errLockLost, path)
+	case err != nil:
+		return fmt.Errorf("stat lock file: %w", err)
+	case !os.SameFile(held, current):
+		return fmt.Errorf("%w: %s was replaced", errLockLost, path)
+	}
+
+	content := make([]byte, 32)
+
+	n, err := l.file.ReadAt(content, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read lock file: %w", err)
+	}
+
+	if pid := strings.TrimSpace(string(content[:n])); pid != strconv.Itoa(os.Getpid()) {
+		return fmt.Errorf("%w: %s names pid %q", errLockLost, path, pid)
+	}
+
+	return nil
+}
+
+// Close empties the lock file and releases the lock. The file is kept since removing it would let another instance
+// lock a new file at the same path while a third one still holds the removed one.
+func (l fileLock) Close() error {
+	truncateErr := l.file.Truncate(0)
+
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("close lock file: %w", err)
+	}
+
+	if truncateErr != nil {
+		return fmt.Errorf("truncate lock file: %w", truncateErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockAbstract takes the instance lock by listening on the abstract unix socket name, which the kernel removes when
+// the process exits. If another instance listens on it already, its PID is asked for by connecting to it.
+func lockAbstract(name string) (io.Closer, error) {
+	listener, err := net.Listen("unix", "@"+name)
+	if err == nil {
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				_ = conn.Close()
+			}
+		}()
+
+		return listener, nil
+	}
+
+	if !errors.Is(err, unix.EADDRINUSE) {
+		return nil, fmt.Errorf("lock @%s: %w", name, err)
+	}
+
+	conn, dialErr := net.Dial("unix", "@"+name)
+	if dialErr != nil {
+		return nil, fmt.Errorf("%w: abstract socket @%s is held", errAlreadyRunning, name)
+	}
+
+	defer conn.Close()
+
+	if cred := peerCredOf(conn); cred != nil {
+		return nil, fmt.Errorf("%w: pid %d holds abstract socket @%s", errAlreadyRunning, cred.PID, name)
+	}
+
+	return nil, fmt.Errorf("%w: abstract socket @%s is held", errAlreadyRunning, name)
+}
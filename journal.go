@@ -0,0 +1,485 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// The journal is a sequence of records, each made of the length of its payload as uvarint, the payload and the
+// CRC-32 (IEEE) of the payload as 4 big endian bytes. A payload starts with the JournalRecordKind and the time as
+// varint of nanoseconds since the unix epoch, followed by the fields of its kind: the PID as uvarint and the instance
+// name for start records, the ID as uvarint and client, local and backend address for open records and the ID, the
+// backend address, the duration in milliseconds, bytes received and sent as uvarint, close reason and error for close
+// records. Strings are their length as uvarint followed by their bytes. Records are self-contained, so journals can
+// be rotated and concatenated.
+
+const (
+	// journalMaxRecordSize is the largest payload a journal reader accepts. Larger lengths mean the journal is corrupt.
+	journalMaxRecordSize = 64 << 10
+	// journalChecksumSize is the size of the checksum that follows each payload.
+	journalChecksumSize = 4
+	// journalBackups is the number of rotated journal files that are kept.
+	journalBackups = 1
+)
+
+// ErrJournalCorrupt is returned by JournalReader if a record does not match its checksum or can not be decoded.
+var ErrJournalCorrupt = errors.New("journal record is corrupt")
+
+// JournalRecordKind tells what a JournalRecord records.
+type JournalRecordKind uint8
+
+const (
+	// JournalStart records that a tcp4to6 process started. Connection IDs are only unique until the next one.
+	JournalStart JournalRecordKind = iota + 1
+	// JournalOpen records that a connection was accepted.
+	JournalOpen
+	// JournalClose records that a connection is done.
+	JournalClose
+)
+
+// String returns start, open or close.
+func (k JournalRecordKind) String() string {
+	switch k {
+	case JournalStart:
+		return "start"
+	case JournalOpen:
+		return "open"
+	case JournalClose:
+		return "close"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(k))
+	}
+}
+
+// JournalRecord is an entry of the connection journal. Which fields are set depends on Kind: PID and Instance for
+// JournalStart, ID, Client, Local and Backend for JournalOpen and ID, Backend, Duration, the byte counts, CloseReason
+// and Error for JournalClose. Addresses are anonymized the same way as in the access log.
+type JournalRecord struct {
+	Kind          JournalRecordKind
+	Time          time.Time
+	PID           int
+	Instance      string
+	ID            uint64
+	Client        string
+	Local         string
+	Backend       string
+	Duration      time.Duration
+	BytesReceived int64
+	BytesSent     int64
+	CloseReason   string
+	Error         string
+}
+
+// journalConfig configures the connection journal.
+type journalConfig struct {
+	// path is the file the journal is appended to. Empty if there is no journal.
+	path string
+	// syncInterval is the time between two syncs of the journal to the storage.
+	syncInterval time.Duration
+	// maxSize is the size in bytes after which the journal is rotated. Zero disables rotation.
+	maxSize int64
+}
+
+// journal appends JournalRecord values to a file. Every record is written with a single write, so records of a
+// crashed process are in the file unless the system went down as well. Syncing to the storage is batched by run.
+// Records are stamped with the time of clock.
+type journal struct {
+	file  *rotatingFile
+	clock Clock
+	mtx   sync.Mutex
+	// dirty is set if records were written since the last sync.
+	dirty bool
+}
+
+// openJournal opens the journal described by cfg and records the start of this process in it. Records are stamped and
+// synced on clock.
+func openJournal(log logr.Logger, cfg journalConfig, instance string, clock Clock) (*journal, error) {
+	rotate := rotateConfig{path: cfg.path, maxSize: cfg.maxSize, maxBackups: journalBackups}
+
+	file, err := openRotatingFile(log, rotate, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{file: file, clock: clock}
+
+	start := JournalRecord{Kind: JournalStart, Time: clock.Now(), PID: os.Getpid(), Instance: instance}
+	if err := j.write(start); err != nil {
+		_ = file.Close()
+
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// opened records that the connection of entry was accepted.
+func (j *journal) opened(entry accessEntry) error {
+	return j.write(JournalRecord{
+		Kind: JournalOpen, Time: j.clock.Now(), ID: entry.ID, Client: entry.Client, Local: entry.Local,
+		Backend: entry.Backend,
+	})
+}
+
+// closed records that the connection of entry is done.
+func (j *journal) closed(entry accessEntry) error {
+	return j.write(JournalRecord{
+		Kind: JournalClose, Time: j.clock.Now(), ID: entry.ID, Backend: entry.Backend,
+		Duration: time.Duration(entry.DurationMS) * time.Millisecond, BytesReceived: entry.BytesReceived,
+		BytesSent: entry.BytesSent, CloseReason: entry.CloseReason, Error: entry.Error,
+	})
+}
+
+// write appends rec to the journal.
+func (j *journal) write(rec JournalRecord) error {
+	record := encodeJournalRecord(rec)
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if _, err := j.file.Write(record); err != nil {
+		return fmt.Errorf("write journal record: %w", err)
+	}
+
+	j.dirty = true
+
+	return nil
+}
+
+// sync syncs the journal to the storage if records were written since the last time.
+func (j *journal) sync() error {
+	j.mtx.Lock()
+	dirty := j.dirty
+	j.dirty = false
+	j.mtx.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+
+	return nil
+}
+
+// run syncs the journal each interval on its clock until ctx is canceled. Failures are logged.
+func (j *journal) run(ctx context.Context, log logr.Logger, interval time.Duration) {
+	ticker := j.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		if err := j.sync(); err != nil {
+			log.Error(err, "couldn't sync journal")
+		}
+	}
+}
+
+// Close syncs and closes the journal.
+func (j *journal) Close() error {
+	syncErr := j.sync()
+
+	if err := j.file.Close(); err != nil {
+		return fmt.Errorf("close journal: %w", err)
+	}
+
+	return syncErr
+}
+
+// encodeJournalRecord returns rec framed as described at the top of this file.
+func encodeJournalRecord(rec JournalRecord) []byte {
+	payload := []byte{byte(rec.Kind)}
+	payload = binary.AppendVarint(payload, rec.Time.UnixNano())
+
+	switch rec.Kind {
+	case JournalStart:
+		payload = binary.AppendUvarint(payload, uint64(rec.PID))
+		payload = appendJournalString(payload, rec.Instance)
+	case JournalOpen:
+		payload = binary.AppendUvarint(payload, rec.ID)
+		payload = appendJournalString(payload, rec.Client)
+		payload = appendJournalString(payload, rec.Local)
+		payload = appendJournalString(payload, rec.Backend)
+	case JournalClose:
+		payload = binary.AppendUvarint(payload, rec.ID)
+		payload = appendJournalString(payload, rec.Backend)
+		payload = binary.AppendUvarint(payload, uint64(rec.Duration.Milliseconds()))
+		payload = binary.AppendUvarint(payload, uint64(rec.BytesReceived))
+		payload = binary.AppendUvarint(payload, uint64(rec.BytesSent))
+		payload = appendJournalString(payload, rec.CloseReason)
+		payload = appendJournalString(payload, rec.Error)
+	}
+
+	record := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(payload)+journalChecksumSize),
+		uint64(len(payload)))
+	record = append(record, payload...)
+
+	return binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload))
+}
+
+// appendJournalString appends s with its length in front to buf.
+func appendJournalString(buf []byte, s string) []byte {
+	return append(binary.AppendUvarint(buf, uint64(len(s))), s...)
+}
+
+// JournalReader reads the records of a connection journal written by tcp4to6 with JournalFileEnvName set.
+type JournalReader struct {
+	r *bufio.Reader
+}
+
+// NewJournalReader creates a JournalReader that reads the journal from r. Rotated journal files can be read as one by
+// passing them concatenated in the order they were written, oldest first.
+func NewJournalReader(r io.Reader) *JournalReader {
+	return &JournalReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record of the journal. It returns io.EOF at the end of the journal and an error wrapping
+// io.ErrUnexpectedEOF if the journal ends within a record, like the last one of a process that was killed while
+// writing it. Records that can not be decoded return an error wrapping ErrJournalCorrupt.
+func (r *JournalReader) Next() (JournalRecord, error) {
+	size, err := binary.ReadUvarint(r.r)
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return JournalRecord{}, io.EOF
+	case err != nil:
+		return JournalRecord{}, fmt.Errorf("read journal record length: %w", err)
+	case size == 0 || size > journalMaxRecordSize:
+		return JournalRecord{}, fmt.Errorf("%w: length %d", ErrJournalCorrupt, size)
+	}
+
+	record := make([]byte, size+journalChecksumSize)
+	if _, err := io.ReadFull(r.r, record); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return JournalRecord{}, fmt.Errorf("read journal record: %w", err)
+	}
+
+	payload := record[:size]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(record[size:]) {
+		return JournalRecord{}, fmt.Errorf("%w: checksum mismatch", ErrJournalCorrupt)
+	}
+
+	return decodeJournalRecord(payload)
+}
+
+// journalDecoder decodes the fields of a payload. The first failure sticks, later reads return zero values.
+type journalDecoder struct {
+	payload []byte
+	err     error
+}
+
+// uvarint returns the next uvarint of the payload.
+func (d *journalDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Uvarint(d.payload)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: bad uvarint", ErrJournalCorrupt)
+
+		return 0
+	}
+
+	d.payload = d.payload[n:]
+
+	return value
+}
+
+// varint returns the next varint of the payload.
+func (d *journalDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Varint(d.payload)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: bad varint", ErrJournalCorrupt)
+
+		return 0
+	}
+
+	d.payload = d.payload[n:]
+
+	return value
+}
+
+// string returns the next string of the payload.
+func (d *journalDecoder) string() string {
+	size := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+
+	if size > uint64(len(d.payload)) {
+		d.err = fmt.Errorf("%w: string exceeds record", ErrJournalCorrupt)
+
+		return ""
+	}
+
+	value := string(d.payload[:size])
+	d.payload = d.payload[size:]
+
+	return value
+}
+
+// decodeJournalRecord decodes the record in payload.
+func decodeJournalRecord(payload []byte) (JournalRecord, error) {
+	rec := JournalRecord{Kind: JournalRecordKind(payload[0])}
+	d := journalDecoder{payload: payload[1:]}
+	rec.Time = time.Unix(0, d.varint())
+
+	switch rec.Kind {
+	case JournalStart:
+		rec.PID = int(d.uvarint())
+		rec.Instance = d.string()
+	case JournalOpen:
+		rec.ID = d.uvarint()
+		rec.Client = d.string()
+		rec.Local = d.string()
+		rec.Backend = d.string()
+	case JournalClose:
+		rec.ID = d.uvarint()
+		rec.Backend = d.string()
+		rec.Duration = time.Duration(d.uvarint()) * time.Millisecond
+		rec.BytesReceived = int64(d.uvarint())
+		rec.BytesSent = int64(d.uvarint())
+		rec.CloseReason = d.string()
+		rec.Error = d.string()
+	default:
+		return JournalRecord{}, fmt.Errorf("%w: unknown kind %d", ErrJournalCorrupt, payload[0])
+	}
+
+	if d.err != nil {
+		return JournalRecord{}, d.err
+	}
+
+	return rec, nil
+}
+
+// DumpJournal writes the records of the journal read from r to w, one line each. After the records of each process,
+// it lists the connections that were still open when the next process started or the journal ended, which are the
+// ones that were in flight if that process crashed. A journal that ends within a record is noted, but not an error.
+func DumpJournal(w io.Writer, r io.Reader) error {
+	reader := NewJournalReader(r)
+	open := map[uint64]JournalRecord{}
+
+	for {
+		rec, err := reader.Next()
+
+		switch {
+		case errors.Is(err, io.EOF):
+			return writeInFlight(w, open)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			if _, err := fmt.Fprintln(w, "journal ends within a record"); err != nil {
+				return fmt.Errorf("write journal dump: %w", err)
+			}
+
+			return writeInFlight(w, open)
+		case err != nil:
+			return err
+		}
+
+		if rec.Kind == JournalStart {
+			if err := writeInFlight(w, open); err != nil {
+				return err
+			}
+
+			open = map[uint64]JournalRecord{}
+		}
+
+		switch rec.Kind {
+		case JournalOpen:
+			open[rec.ID] = rec
+		case JournalClose:
+			delete(open, rec.ID)
+		}
+
+		if _, err := fmt.Fprintln(w, formatJournalRecord(rec)); err != nil {
+			return fmt.Errorf("write journal dump: %w", err)
+		}
+	}
+}
+
+// writeInFlight writes the connections in open, which were opened but not closed, to w, ordered by ID.
+func writeInFlight(w io.Writer, open map[uint64]JournalRecord) error {
+	recs := make([]JournalRecord, 0, len(open))
+	for _, rec := range open {
+		recs = append(recs, rec)
+	}
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ID < recs[j].ID })
+
+	for _, rec := range recs {
+		if _, err := fmt.Fprintf(w, "in flight: id %d client %s local %s since %s\n", rec.ID, rec.Client, rec.Local,
+			rec.Time.UTC().Format(time.RFC3339Nano)); err != nil {
+			return fmt.Errorf("write journal dump: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// formatJournalRecord returns rec as a line of text.
+func formatJournalRecord(rec JournalRecord) string {
+	line := rec.Time.UTC().Format(time.RFC3339Nano) + " " + rec.Kind.String()
+
+	switch rec.Kind {
+	case JournalStart:
+		line += fmt.Sprintf(" pid %d", rec.PID)
+		if rec.Instance != "" {
+			line += " instance " + rec.Instance
+		}
+	case JournalOpen:
+		line += fmt.Sprintf(" id %d client %s local %s", rec.ID, rec.Client, rec.Local)
+		if rec.Backend != "" {
+			line += " backend " + rec.Backend
+		}
+	case JournalClose:
+		line += fmt.Sprintf(" id %d backend %s duration %s received %d sent %d", rec.ID, rec.Backend, rec.Duration,
+			rec.BytesReceived, rec.BytesSent)
+		if rec.CloseReason != "" {
+			line += " reason " + rec.CloseReason
+		}
+
+		if rec.Error != "" {
+			line += fmt.Sprintf(" error %q", rec.Error)
+		}
+	}
+
+	return line
+}
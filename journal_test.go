@@ -0,0 +1,107 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// isDirty reports if j has records that were not synced yet.
+func (j *journal) isDirty() bool {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	return j.dirty
+}
+
+func TestJournalOnManualClock(t *testing.T) {
+	started := time.Date(2021, 11, 2, 10, 14, 3, 0, time.UTC)
+	clock := NewManualClock(started)
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := openJournal(logr.Discard(), journalConfig{path: path}, "test", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Minute)
+
+	if err := j.opened(accessEntry{ID: 1, Client: "192.0.2.7:51234", Local: "192.0.2.1:443"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	synced := make(chan struct{})
+
+	go func() {
+		defer close(synced)
+
+		j.run(ctx, logr.Discard(), time.Second)
+	}()
+
+	waitForTimers(t, clock, 1)
+
+	if !j.isDirty() {
+		t.Fatal("record was synced before the sync interval passed")
+	}
+
+	clock.Advance(time.Second)
+
+	for deadline := time.Now().Add(testTimeout); j.isDirty(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("record was not synced once the sync interval passed")
+		}
+	}
+
+	cancel()
+	<-synced
+
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader := NewJournalReader(file)
+
+	for _, want := range []JournalRecord{
+		{Kind: JournalStart, Time: started},
+		{Kind: JournalOpen, Time: started.Add(time.Minute)},
+	} {
+		rec, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Kind != want.Kind || !rec.Time.Equal(want.Time) {
+			t.Fatalf("read %s record at %s instead of %s record at %s", rec.Kind, rec.Time, want.Kind, want.Time)
+		}
+	}
+
+	if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("read %v instead of the end of the journal", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// leaderConfig configures the election of the instance that accepts connections among several sharing an address.
+type leaderConfig struct {
+	// lockFile is the lock file on shared storage whose holder is the leader. Empty if there is no election.
+	lockFile string
+	// interval is the time between two attempts of a standby instance to take the lock.
+	interval time.Duration
+}
+
+// enabled reports if c configures an election.
+func (c leaderConfig) enabled() bool {
+	return c.lockFile != ""
+}
+
+// elect stands by with accepting paused until the lock file of cfg is taken. The instance is the leader then and
+// accepts connections while it verifies each interval that it still holds the lock. Once that fails, because the file
+// was removed or replaced and another instance could lock the new one, it stands by again and retries to take the lock.
+// Canceling ctx releases the lock so a standby instance can take over. Changes are logged and shown as unit status.
+func (p *proxy) elect(ctx context.Context, cfg leaderConfig) {
+	for {
+		lock, ok := p.takeLeaderLock(ctx, cfg)
+		if !ok {
+			return
+		}
+
+		p.extendLeaderLease(cfg)
+		p.standby.resume()
+		p.log.Info("took leader lock, accepting new connections", "event", "leader", "lock", cfg.lockFile)
+		p.notifyStatus(fmt.Sprintf("leader, running version %d", p.generation().version))
+
+		err := p.holdLeaderLock(ctx, cfg, lock)
+		if err == nil {
+			_ = lock.Close()
+
+			return
+		}
+
+		p.standby.pause()
+		p.log.Error(err, "lost leader lock, standing by", "event", "leader", "lock", cfg.lockFile)
+		p.notifyStatus("standing by, lost leader lock: " + err.Error())
+
+		// The file is not emptied like Close does since it may name another holder by now.
+		_ = lock.file.Close()
+	}
+}
+
+// holdLeaderLock verifies each interval of cfg that lock is still held and extends the leader lease each time. If
+// accepting was fenced because the lease expired meanwhile it is resumed. Returns the error of the failed
+// verification or nil once ctx is canceled.
+func (p *proxy) holdLeaderLock(ctx context.Context, cfg leaderConfig, lock fileLock) error {
+	for sleepUnlessDone(ctx, p.clock, cfg.interval) {
+		if err := lock.verify(cfg.lockFile); err != nil {
+			return err
+		}
+
+		p.extendLeaderLease(cfg)
+
+		if p.standby.resume() {
+			p.log.Info("verified leader lock again, accepting new connections", "event", "leader", "lock", cfg.lockFile)
+		}
+	}
+
+	return nil
+}
+
+// extendLeaderLease lets the leader accept connections for two intervals of cfg from now without verifying its lock.
+func (p *proxy) extendLeaderLease(cfg leaderConfig) {
+	atomic.StoreInt64(&p.leaderUntil, p.clock.Now().Add(2*cfg.interval).UnixNano())
+}
+
+// fenceLeader pauses accepting if an election is configured and the leader lease expired, which happens if the
+// process was suspended or the lock could not be verified in time. Connections wait until elect verified the lock
+// again, so a leader that lost its lock while suspended does not accept them next to the new one.
+func (p *proxy) fenceLeader() {
+	if !p.cfg.leader.enabled() || p.clock.Now().UnixNano() <= atomic.LoadInt64(&p.leaderUntil) {
+		return
+	}
+
+	if p.standby.pause() {
+		p.log.Info("leader lease expired, waiting for the leader lock to be verified", "event", "leader")
+	}
+}
+
+// takeLeaderLock tries to take the lock file of cfg each interval until it succeeds and returns the lock. Reports
+// false if ctx was canceled before. Failures other than the lock being held are logged once until an attempt fails
+// because it is held again.
+func (p *proxy) takeLeaderLock(ctx context.Context, cfg leaderConfig) (fileLock, bool) {
+	failing := false
+
+	for {
+		lock, err := lockFile(cfg.lockFile)
+
+		switch {
+		case err == nil:
+			return lock, true
+		case errors.Is(err, errAlreadyRunning):
+			failing = false
+		case !failing:
+			p.log.Error(err, "couldn't try to take leader lock, retrying", "interval", cfg.interval.String())
+
+			failing = true
+		}
+
+		if !sleepUnlessDone(ctx, p.clock, cfg.interval) {
+			return fileLock{}, false
+		}
+	}
+}
+
+// leaderCommand returns the control command that shows if this instance is the leader.
+func leaderCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: "leader",
+		help:  "show if this instance holds the leader lock and accepts connections or stands by",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("%w: leader", errUsage)
+			}
+
+			state := "leader, holding " + p.cfg.leader.lockFile
+
+			switch {
+			case !p.cfg.leader.enabled():
+				state = "no leader election"
+			case p.standby.paused():
+				state = "standing by for " + p.cfg.leader.lockFile
+			}
+
+			if _, err := fmt.Fprintln(w, state); err != nil {
+				return fmt.Errorf("write leader state: %w", err)
+			}
+
+			return nil
+		},
+	}
+}
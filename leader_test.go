@@ -0,0 +1,159 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestFileLockVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+
+	lock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	if err := lock.verify(path); err != nil {
+		t.Fatalf("held lock not verified: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lock.verify(path); !errors.Is(err, errLockLost) {
+		t.Fatalf("removed lock verified with %v", err)
+	}
+
+	other, err := lockFile(path)
+	if err != nil {
+		t.Fatalf("lock file at the path of a removed one not taken: %v", err)
+	}
+	defer other.Close()
+
+	if err := lock.verify(path); !errors.Is(err, errLockLost) {
+		t.Fatalf("replaced lock verified with %v", err)
+	}
+}
+
+func TestLeaderLockMustDifferFromInstanceLock(t *testing.T) {
+	env := map[string]string{
+		ToAddrEnvName:     "[::1]:80",
+		LockFileEnvName:   "/run/tcpto6/instance.lock",
+		LeaderLockEnvName: "/run/tcpto6/../tcpto6/instance.lock",
+	}
+
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+
+		return value, ok
+	}
+
+	if _, err := loadConfig(lookup); !errors.Is(err, errEnvInvalid) || !strings.Contains(err.Error(), LeaderLockEnvName) {
+		t.Fatalf("loaded config with the same leader and instance lock with %v", err)
+	}
+
+	env[LeaderLockEnvName] = "/srv/shared/leader.lock"
+
+	if _, err := loadConfig(lookup); err != nil {
+		t.Fatalf("config with different leader and instance locks not loaded: %v", err)
+	}
+}
+
+// waitForStandby waits until accepting of p is paused by the election if paused is true or resumed otherwise.
+func waitForStandby(t *testing.T, p *proxy, paused bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(testTimeout); p.standby.paused() != paused; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("standing by is %t instead of %t", !paused, paused)
+		}
+	}
+}
+
+func TestElectStandsByOnceLockIsLost(t *testing.T) {
+	clock := NewManualClock(time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC))
+	cfg := leaderConfig{lockFile: filepath.Join(t.TempDir(), "leader.lock"), interval: time.Second}
+	prx := &proxy{log: logr.Discard(), clock: clock, cfg: Config{leader: cfg}}
+	prx.gen.Store(&generation{})
+	prx.standby.pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	elected := make(chan struct{})
+
+	go func() {
+		defer close(elected)
+
+		prx.elect(ctx, cfg)
+	}()
+
+	defer func() {
+		cancel()
+		<-elected
+	}()
+
+	waitForTimers(t, clock, 1)
+	waitForStandby(t, prx, false)
+
+	if err := os.Remove(cfg.lockFile); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := lockFile(cfg.lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(cfg.interval)
+	waitForStandby(t, prx, true)
+	waitForTimers(t, clock, 1)
+
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(cfg.interval)
+	waitForStandby(t, prx, false)
+}
+
+func TestFenceLeader(t *testing.T) {
+	clock := NewManualClock(time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC))
+	cfg := leaderConfig{lockFile: "leader.lock", interval: time.Second}
+	prx := &proxy{log: logr.Discard(), clock: clock, cfg: Config{leader: cfg}}
+
+	prx.extendLeaderLease(cfg)
+	clock.Advance(2 * cfg.interval)
+	prx.fenceLeader()
+
+	if prx.standby.paused() {
+		t.Fatal("fenced while the lease lasted")
+	}
+
+	clock.Advance(time.Nanosecond)
+	prx.fenceLeader()
+
+	if !prx.standby.paused() {
+		t.Fatal("not fenced once the lease expired")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+var (
+	// errListenMismatch is raised if the socket tcp4to6 got is not the one it expects.
+	errListenMismatch = errors.New("socket does not match the expected one")
+	// errUnknownListenFamily is raised if an expected listen family can not be parsed.
+	errUnknownListenFamily = errors.New("unknown listen family, expected tcp4, tcp6, unix or vsock")
+	// errListenHost is raised if the host of an expected listen address is not an IP address.
+	errListenHost = errors.New("host of the expected listen address must be an IP address")
+)
+
+// listenExpectation describes the socket tcp4to6 expects to be passed, so a misconfigured unit does not silently
+// forward the wrong port. Empty fields are not checked.
+type listenExpectation struct {
+	// family is tcp4, tcp6, unix or vsock.
+	family string
+	// addr is the address the socket must be bound to. Either host:port, where host or port may be empty to only
+	// check the other, or the path of a unix socket.
+	addr string
+}
+
+// parseFamily sets family from value.
+func (e *listenExpectation) parseFamily(value string) error {
+	switch value {
+	case "tcp4", "tcp6", "unix", vsockNetwork:
+		e.family = value
+
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", errUnknownListenFamily, value)
+	}
+}
+
+// parseAddr sets addr from value.
+func (e *listenExpectation) parseAddr(value string) error {
+	if host, _, err := net.SplitHostPort(value); err == nil && host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("%w: %s", errListenHost, value)
+	}
+
+	e.addr = value
+
+	return nil
+}
+
+// check returns an error describing how addr, the address of the socket tcp4to6 got, differs from the expected one.
+func (e listenExpectation) check(addr net.Addr) error {
+	if family := listenFamily(addr); e.family != "" && family != e.family {
+		return fmt.Errorf("%w: socket %s is %s, expected %s", errListenMismatch, addr, family, e.family)
+	}
+
+	if e.addr == "" {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(e.addr)
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || err != nil {
+		if addr.String() != e.addr {
+			return fmt.Errorf("%w: socket is %s, expected %s", errListenMismatch, addr, e.addr)
+		}
+
+		return nil
+	}
+
+	if (port != "" && port != strconv.Itoa(tcpAddr.Port)) || (host != "" && !net.ParseIP(host).Equal(tcpAddr.IP)) {
+		return fmt.Errorf("%w: socket is %s, expected %s", errListenMismatch, addr, e.addr)
+	}
+
+	return nil
+}
+
+// listenFamily returns the family of the socket bound to addr as it is named by listenExpectation. TCP sockets bound
+// to IPv4 addresses are tcp4, others tcp6.
+func listenFamily(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if tcpAddr.IP.To4() != nil {
+			return "tcp4"
+		}
+
+		return "tcp6"
+	}
+
+	return addr.Network()
+}
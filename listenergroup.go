@@ -0,0 +1,193 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// acceptResult is what a member of a listenerGroup returned from Accept.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// listenerGroup accepts from several listeners as if they were one, like the IPv4 and IPv6 sockets systemd passes for a
+// socket unit listening on 0.0.0.0:443 and [::]:443 with BindIPv6Only=ipv6-only, or sockets of several ports whose
+// connections are routed by port or by the socket they were accepted on.
+type listenerGroup struct {
+	members  []net.Listener
+	accepted chan acceptResult
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newListenerGroup starts accepting from all members.
+func newListenerGroup(members []net.Listener) *listenerGroup {
+	group := &listenerGroup{members: members, accepted: make(chan acceptResult), done: make(chan struct{})}
+
+	for _, member := range members {
+		go group.acceptFrom(member)
+	}
+
+	return group
+}
+
+// acceptFrom passes connections accepted from member to Accept until member fails with an error that is not
+// recoverable or the group is closed. Errors are passed as well, the delay before the next attempt is up to Accept.
+func (g *listenerGroup) acceptFrom(member net.Listener) {
+	for {
+		conn, err := member.Accept()
+
+		select {
+		case g.accepted <- acceptResult{conn: conn, err: err}:
+		case <-g.done:
+			if conn != nil {
+				_ = conn.Close()
+			}
+
+			return
+		}
+
+		if err != nil && !recoverableAccept(err) {
+			return
+		}
+	}
+}
+
+// Accept returns the next connection accepted by any member. The first error of a member is returned as well.
+func (g *listenerGroup) Accept() (net.Conn, error) {
+	select {
+	case result := <-g.accepted:
+		return result.conn, result.err
+	case <-g.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes all members in order. The errors of all members that failed are joined.
+func (g *listenerGroup) Close() error {
+	var errs []error
+
+	g.once.Do(func() {
+		close(g.done)
+
+		for _, member := range g.members {
+			if err := member.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("close listener group: %w", err)
+	}
+
+	return nil
+}
+
+// Addr returns the address of the first member.
+func (g *listenerGroup) Addr() net.Addr {
+	return g.members[0].Addr()
+}
+
+// groupListeners returns the single listener tcp4to6 serves from listeners. Several TCP listeners bound to the same
+// port are served as a listenerGroup, where listeners bound to an address that is already taken by another one are
+// closed. A warning is logged either way. If mixed is set, because connections are routed by their local port or the
+// socket they were accepted on, listeners of different ports are grouped as well. Listeners of different ports
+// otherwise, of other networks or no listeners at all can not be served and are all closed.
+func groupListeners(log logr.Logger, listeners []net.Listener, mixed bool) (net.Listener, error) {
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+
+	ports, ok := listenerPorts(listeners)
+	if !ok || (!mixed && len(ports) > 1) {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+
+		return nil, fmt.Errorf("%w: %v", errUnexpectedSocketAmount, listeners)
+	}
+
+	seen := map[string]bool{}
+	members := make([]net.Listener, 0, len(listeners))
+
+	for _, listener := range listeners {
+		addr := listener.Addr().String()
+		if seen[addr] {
+			log.Info("closing socket passed twice", "addr", addr)
+
+			_ = listener.Close()
+
+			continue
+		}
+
+		seen[addr] = true
+		members = append(members, listener)
+	}
+
+	if len(members) == 1 {
+		return members[0], nil
+	}
+
+	addrs := make([]string, len(members))
+	for i, member := range members {
+		addrs[i] = member.Addr().String()
+	}
+
+	log.Info("got several sockets, serving them as one", "ports", ports, "addrs", addrs)
+
+	return newListenerGroup(members), nil
+}
+
+// listenerPorts returns the distinct ports listeners are bound to, in the order they first appear, and if they are
+// all TCP listeners.
+func listenerPorts(listeners []net.Listener) ([]int, bool) {
+	if len(listeners) == 0 {
+		return nil, false
+	}
+
+	var ports []int
+
+	seen := map[int]bool{}
+
+	for _, listener := range listeners {
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			return nil, false
+		}
+
+		if !seen[addr.Port] {
+			seen[addr.Port] = true
+			ports = append(ports, addr.Port)
+		}
+	}
+
+	return ports, true
+}
+
+// listenerMembers returns the listeners listener accepts from, its members if it is a group and itself otherwise.
+func listenerMembers(listener net.Listener) []net.Listener {
+	if group, ok := listener.(*listenerGroup); ok {
+		return group.members
+	}
+
+	return []net.Listener{listener}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// errListenQueueUnsupported is raised if the listen queue of a listener can not be inspected.
+var errListenQueueUnsupported = errors.New("listen queue can not be inspected on this platform or listener")
+
+// listenQueue describes the queue of connections a listening socket has accepted in the kernel but that have not
+// been accepted by tcp4to6 yet.
+type listenQueue struct {
+	// length is the number of connections in the queue.
+	length uint32
+	// capacity is the number of connections the queue can hold. SYNs are dropped once it is full.
+	capacity uint32
+}
+
+// listenOverflows are the kernel counters of connections that were dropped by all listening sockets of the network
+// namespace because their queues were full.
+type listenOverflows struct {
+	// overflows counts connections that were dropped because the accept queue was full.
+	overflows int64
+	// drops counts connections that were dropped for any reason, including overflows.
+	drops int64
+}
+
+// tcpListener reports if all members of listener are listening TCP sockets. Others, like unix sockets or a single
+// forwarded connection as served with -stdio, have no listen queue that could be sampled.
+func tcpListener(listener net.Listener) bool {
+	for _, member := range listenerMembers(listener) {
+		if _, ok := member.(*connListener); ok {
+			return false
+		}
+
+		if _, ok := member.Addr().(*net.TCPAddr); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// watchListenQueue samples the listen queue of listener and the listen overflow counters of the kernel each interval
+// until ctx is canceled and records them in the stats of p. A warning is logged if connections were dropped since
+// the last sample or the queue is full. It returns right away if the queue can not be inspected.
+func (p *proxy) watchListenQueue(ctx context.Context, listener net.Listener, interval time.Duration) {
+	if _, err := readListenQueues(listener); err != nil {
+		p.log.Info("not watching the listen queue", "reason", err.Error())
+
+		return
+	}
+
+	baseline, overflowsErr := readListenOverflows()
+	if overflowsErr != nil {
+		p.log.Info("not watching listen overflows", "reason", overflowsErr.Error())
+	}
+
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last listenOverflows
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		queue, err := readListenQueues(listener)
+		if err != nil {
+			p.log.Error(err, "couldn't read listen queue")
+
+			continue
+		}
+
+		atomic.StoreInt64(&p.stats.listenQueueLength, int64(queue.length))
+		atomic.StoreInt64(&p.stats.listenQueueCapacity, int64(queue.capacity))
+
+		var current listenOverflows
+
+		if overflowsErr == nil {
+			kernel, err := readListenOverflows()
+			if err != nil {
+				p.log.Error(err, "couldn't read listen overflows")
+
+				continue
+			}
+
+			current = listenOverflows{overflows: kernel.overflows - baseline.overflows, drops: kernel.drops - baseline.drops}
+			atomic.StoreInt64(&p.stats.listenOverflows, current.overflows)
+			atomic.StoreInt64(&p.stats.listenDrops, current.drops)
+		}
+
+		if current.drops > last.drops || (queue.capacity != 0 && queue.length >= queue.capacity) {
+			p.log.Info("listen queue is overflowing, connections are dropped before they can be accepted",
+				"queueLength", queue.length, "queueCapacity", queue.capacity,
+				"overflows", current.overflows-last.overflows, "drops", current.drops-last.drops)
+		}
+
+		last = current
+	}
+}
+
+// readListenQueues returns the combined state of the listen queues of the listeners listener accepts from.
+func readListenQueues(listener net.Listener) (listenQueue, error) {
+	var total listenQueue
+
+	for _, member := range listenerMembers(listener) {
+		queue, err := readListenQueue(member)
+		if err != nil {
+			return listenQueue{}, err
+		}
+
+		total.length += queue.length
+		total.capacity += queue.capacity
+	}
+
+	return total, nil
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readListenQueue returns the state of the listen queue of listener. For listening sockets the kernel reports the
+// length of the queue as unacked and its capacity as sacked segments in TCP_INFO.
+func readListenQueue(listener net.Listener) (listenQueue, error) {
+	conn, ok := listener.(syscall.Conn)
+	if !ok {
+		return listenQueue{}, errListenQueueUnsupported
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return listenQueue{}, fmt.Errorf("raw listener: %w", err)
+	}
+
+	var (
+		info    *unix.TCPInfo
+		infoErr error
+	)
+
+	if err := raw.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil {
+		return listenQueue{}, fmt.Errorf("control listener: %w", err)
+	}
+
+	if infoErr != nil {
+		return listenQueue{}, fmt.Errorf("TCP_INFO: %w", infoErr)
+	}
+
+	return listenQueue{length: info.Unacked, capacity: info.Sacked}, nil
+}
+
+// readListenOverflows returns the ListenOverflows and ListenDrops counters of the network namespace from
+// /proc/net/netstat. The file consists of pairs of lines, the first with the names of the counters of a group and
+// the second with their values.
+func readListenOverflows() (listenOverflows, error) {
+	file, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return listenOverflows{}, fmt.Errorf("open netstat: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		names := strings.Fields(scanner.Text())
+		if !scanner.Scan() {
+			break
+		}
+
+		values := strings.Fields(scanner.Text())
+		if len(names) == 0 || names[0] != "TcpExt:" || len(values) != len(names) {
+			continue
+		}
+
+		var counters listenOverflows
+
+		for i, name := range names {
+			switch name {
+			case "ListenOverflows":
+				counters.overflows, err = strconv.ParseInt(values[i], 10, 64)
+			case "ListenDrops":
+				counters.drops, err = strconv.ParseInt(values[i], 10, 64)
+			}
+
+			if err != nil {
+				return listenOverflows{}, fmt.Errorf("parse netstat %s: %w", name, err)
+			}
+		}
+
+		return counters, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return listenOverflows{}, fmt.Errorf("read netstat: %w", err)
+	}
+
+	return listenOverflows{}, errListenQueueUnsupported
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import "net"
+
+// readListenQueue fails since the listen queue can only be inspected on linux.
+func readListenQueue(net.Listener) (listenQueue, error) {
+	return listenQueue{}, errListenQueueUnsupported
+}
+
+// readListenOverflows fails since listen overflows can only be read on linux.
+func readListenOverflows() (listenOverflows, error) {
+	return listenOverflows{}, errListenQueueUnsupported
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestTCPListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, c := range []struct {
+		name     string
+		listener net.Listener
+		want     bool
+	}{
+		{name: "tcp", listener: tcp, want: true},
+		{name: "unix", listener: unix},
+		{name: "connection", listener: newConnListener(conn)},
+	} {
+		if got := tcpListener(c.listener); got != c.want {
+			t.Errorf("%s listener reported as TCP listener %t instead of %t", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import "github.com/go-logr/logr"
+
+// teeSink is a logr.LogSink that passes everything to all of its sinks.
+type teeSink []logr.LogSink
+
+// Init implements logr.LogSink.
+func (t teeSink) Init(info logr.RuntimeInfo) {
+	for _, sink := range t {
+		sink.Init(info)
+	}
+}
+
+// Enabled implements logr.LogSink. It reports true if any sink is enabled.
+func (t teeSink) Enabled(level int) bool {
+	for _, sink := range t {
+		if sink.Enabled(level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Info implements logr.LogSink. Only sinks that are enabled for level receive the message.
+func (t teeSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	for _, sink := range t {
+		if sink.Enabled(level) {
+			sink.Info(level, msg, keysAndValues...)
+		}
+	}
+}
+
+// Error implements logr.LogSink.
+func (t teeSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	for _, sink := range t {
+		sink.Error(err, msg, keysAndValues...)
+	}
+}
+
+// WithValues implements logr.LogSink.
+func (t teeSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	sinks := make(teeSink, len(t))
+	for i, sink := range t {
+		sinks[i] = sink.WithValues(keysAndValues...)
+	}
+
+	return sinks
+}
+
+// WithName implements logr.LogSink.
+func (t teeSink) WithName(name string) logr.LogSink {
+	sinks := make(teeSink, len(t))
+	for i, sink := range t {
+		sinks[i] = sink.WithName(name)
+	}
+
+	return sinks
+}
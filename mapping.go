@@ -0,0 +1,193 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPort is the highest TCP port.
+const maxPort = 65535
+
+var (
+	// errMappingDisabled is raised for connections accepted on a local port whose mapping is disabled.
+	errMappingDisabled = errors.New("mapping of local port is disabled")
+	// errPortNumber is raised if a port number can not be parsed.
+	errPortNumber = errors.New("invalid port number")
+)
+
+// mappingConfig configures which mappings from a local port to a destination are disabled.
+type mappingConfig struct {
+	// disabled are the local ports whose connections are rejected.
+	disabled map[int]bool
+	// response is sent to clients of disabled mappings before their connection is closed. Nothing is sent if empty.
+	response []byte
+}
+
+// parseDisabled sets disabled to the whitespace separated ports in value.
+func (c *mappingConfig) parseDisabled(value string) error {
+	c.disabled = map[int]bool{}
+
+	for _, field := range strings.Fields(value) {
+		port, err := parsePort(field)
+		if err != nil {
+			return err
+		}
+
+		c.disabled[port] = true
+	}
+
+	return nil
+}
+
+// parseResponse sets response to value after interpreting escape sequences like \r\n in it.
+func (c *mappingConfig) parseResponse(value string) error {
+	response, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil {
+		return fmt.Errorf("unquote: %w", err)
+	}
+
+	c.response = []byte(response)
+
+	return nil
+}
+
+// parsePort parses value as TCP port.
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > maxPort {
+		return 0, fmt.Errorf("%w: %s", errPortNumber, value)
+	}
+
+	return port, nil
+}
+
+// mappingSwitch holds the mappings enabled or disabled on the control socket. They override the configuration and
+// survive reloads.
+type mappingSwitch struct {
+	mtx sync.Mutex
+	// overrides maps local ports to whether their mapping is disabled.
+	overrides map[int]bool
+}
+
+// set enables or disables the mapping of port.
+func (s *mappingSwitch) set(port int, disabled bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.overrides == nil {
+		s.overrides = map[int]bool{}
+	}
+
+	s.overrides[port] = disabled
+}
+
+// disabled reports if the mapping of port is disabled by s or, if s does not decide, by cfg.
+func (s *mappingSwitch) disabled(cfg mappingConfig, port int) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if disabled, ok := s.overrides[port]; ok {
+		return disabled
+	}
+
+	return cfg.disabled[port]
+}
+
+// list returns the ports whose mapping is disabled, ordered.
+func (s *mappingSwitch) list(cfg mappingConfig) []int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var ports []int
+
+	for port := range cfg.disabled {
+		if disabled, ok := s.overrides[port]; !ok || disabled {
+			ports = append(ports, port)
+		}
+	}
+
+	for port, disabled := range s.overrides {
+		if disabled && !cfg.disabled[port] {
+			ports = append(ports, port)
+		}
+	}
+
+	sort.Ints(ports)
+
+	return ports
+}
+
+// rejectDisabled rejects conn if the mapping of its local port is disabled and reports if it did. The client is sent
+// the configured response first. src is the accepted connection.
+func (p *proxy) rejectDisabled(gen *generation, conn *connection, src net.Conn) bool {
+	local, ok := conn.local.(*net.TCPAddr)
+	if !ok || !p.mappings.disabled(gen.cfg.mappings, local.Port) {
+		return false
+	}
+
+	if len(gen.cfg.mappings.response) != 0 {
+		if err := respond(src, gen.cfg.mappings.response, gen.cfg.handshakeTimeout); err != nil {
+			p.log.Error(err, "couldn't send response of disabled mapping")
+		}
+	}
+
+	p.reject(conn, src, fmt.Errorf("%w: %d", errMappingDisabled, local.Port),
+		"mapping disabled. closing accepted connection")
+
+	return true
+}
+
+// mappingCommand returns the control command called name that enables or disables the mapping of a local port.
+func mappingCommand(p *proxy, name string, disable bool) controlCommand {
+	usage := name + " <port>"
+	help := "accept connections on the local port again"
+
+	if disable {
+		help = "reject connections on the local port until it is enabled again"
+	}
+
+	return controlCommand{
+		usage: usage,
+		help:  help,
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%w: %s", errUsage, usage)
+			}
+
+			port, err := parsePort(args[0])
+			if err != nil {
+				return err
+			}
+
+			p.mappings.set(port, disable)
+			p.log.Info("changed mapping", "port", port, "disabled", disable)
+
+			disabled := p.mappings.list(p.generation().cfg.mappings)
+			if _, err := fmt.Fprintf(w, "disabled ports: %v\n", disabled); err != nil {
+				return fmt.Errorf("write mappings: %w", err)
+			}
+
+			return nil
+		},
+	}
+}
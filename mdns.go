@@ -0,0 +1,484 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// mdnsPort is the port multicast DNS is spoken on.
+	mdnsPort = 5353
+	// mdnsDomain is the domain of names resolved with multicast DNS.
+	mdnsDomain = "local"
+	// mdnsServices is the name DNS-SD browsers query to enumerate all service types on the link.
+	mdnsServices = "_services._dns-sd._udp.local"
+	// mdnsFlags are the header flags of responses, marking them as authoritative answers.
+	mdnsFlags = 0x8400
+	// mdnsUnicast is the bit of the class of questions that asks for a unicast response.
+	mdnsUnicast = 0x8000
+	// mdnsCacheFlush is the bit of the class of records that are unique to this host.
+	mdnsCacheFlush = 0x8000
+	// mdnsHostTTL is the TTL of the address and SRV records, mdnsServiceTTL the one of the PTR and TXT records, as
+	// recommended by RFC 6762.
+	mdnsHostTTL    = 120
+	mdnsServiceTTL = 4500
+	// mdnsAnnouncements is the number of unsolicited announcements sent on startup.
+	mdnsAnnouncements = 2
+	// mdnsAnnounceInterval is the time between two announcements.
+	mdnsAnnounceInterval = time.Second
+	// mdnsMaxMessage is the size of the buffer queries are read into.
+	mdnsMaxMessage = 9000
+	// mdnsMaxPointers is the number of compression pointers followed in a name before it counts as malformed.
+	mdnsMaxPointers = 16
+	// mdnsPointer marks a length byte as start of a compression pointer.
+	mdnsPointer = 0xc0
+	// mdnsMaxTXTEntry is the longest entry of a TXT record.
+	mdnsMaxTXTEntry = 255
+	// mdnsServiceLabels is the number of labels of a service type like _http._tcp.
+	mdnsServiceLabels = 2
+	// dnsTypePTR, dnsTypeTXT, dnsTypeSRV and dnsTypeANY are resource record types.
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+)
+
+var (
+	// errMDNSService is raised if the advertised service type is not of the form _service._tcp.
+	errMDNSService = errors.New("service type must have the form _service._tcp")
+	// errMDNSTXT is raised if a TXT entry is not of the form key=value or too long.
+	errMDNSTXT = errors.New("TXT entries must have the form key=value and be at most 255 bytes")
+	// errMDNSName is raised if a query contains a malformed name.
+	errMDNSName = errors.New("malformed name in query")
+	// errNoMDNSPort is raised if the listener has no TCP port to advertise.
+	errNoMDNSPort = errors.New("listener has no TCP port")
+	// errNoMDNSAddress is raised if there is no IPv4 address to advertise.
+	errNoMDNSAddress = errors.New("no IPv4 address to advertise")
+)
+
+// mdnsGroup is the IPv4 multicast group of multicast DNS.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// mdnsConfig configures advertising the forwarded service with multicast DNS and DNS-SD on the local IPv4 network.
+type mdnsConfig struct {
+	// service is the service type, like _http._tcp. Empty if advertising is disabled.
+	service string
+	// name is the name of the service instance. Defaults to the name of the tcp4to6 instance or the host name.
+	name string
+	// txt are the key=value entries of the TXT record.
+	txt []string
+}
+
+// enabled reports if the service is advertised.
+func (c mdnsConfig) enabled() bool {
+	return c.service != ""
+}
+
+// parseService parses value as service type like _http._tcp into c.
+func (c *mdnsConfig) parseService(value string) error {
+	labels := strings.Split(strings.TrimSuffix(value, "."), ".")
+	if len(labels) != mdnsServiceLabels || len(labels[0]) < 2 || labels[0][0] != '_' || labels[1] != "_tcp" {
+		return fmt.Errorf("%w: %s", errMDNSService, value)
+	}
+
+	c.service = strings.Join(labels, ".")
+
+	return nil
+}
+
+// parseTXT parses whitespace separated key=value entries into c.
+func (c *mdnsConfig) parseTXT(value string) error {
+	for _, field := range strings.Fields(value) {
+		if key, _, _ := strings.Cut(field, "="); key == "" || len(field) > mdnsMaxTXTEntry {
+			return fmt.Errorf("%w: %s", errMDNSTXT, field)
+		}
+
+		c.txt = append(c.txt, field)
+	}
+
+	return nil
+}
+
+// mdnsRecords are the records that advertise the service.
+type mdnsRecords struct {
+	// service, instance and host are the fully qualified names of the service type, the service instance and the
+	// host within .local.
+	service  string
+	instance string
+	host     string
+	// label is the first label of instance, which may contain dots.
+	label string
+	port  int
+	addrs []net.IP
+	txt   []string
+}
+
+// newMDNSRecords returns the records for cfg that point to the port and IPv4 addresses of listener. If the listener
+// is bound to a wildcard address, the IPv4 addresses of all interfaces are advertised. instance is the name of the
+// tcp4to6 instance, if known.
+func newMDNSRecords(cfg mdnsConfig, listener net.Listener, instance string) (mdnsRecords, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return mdnsRecords{}, fmt.Errorf("get host name: %w", err)
+	}
+
+	hostname, _, _ = strings.Cut(hostname, ".")
+
+	records := mdnsRecords{
+		service: cfg.service + "." + mdnsDomain,
+		host:    hostname + "." + mdnsDomain,
+		label:   cfg.name,
+		txt:     cfg.txt,
+	}
+
+	switch {
+	case records.label != "":
+	case instance != "":
+		records.label = instance
+	default:
+		records.label = hostname
+	}
+
+	records.instance = records.label + "." + records.service
+
+	wildcard := false
+
+	for _, member := range listenerMembers(listener) {
+		addr, ok := member.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+
+		if records.port == 0 {
+			records.port = addr.Port
+		}
+
+		switch ip4 := addr.IP.To4(); {
+		case addr.IP.IsUnspecified():
+			wildcard = true
+		case ip4 != nil && !ip4.IsLoopback():
+			records.addrs = append(records.addrs, ip4)
+		}
+	}
+
+	if records.port == 0 {
+		return records, errNoMDNSPort
+	}
+
+	if len(records.addrs) == 0 && wildcard {
+		if records.addrs, err = interfaceIPv4s(); err != nil {
+			return records, err
+		}
+	}
+
+	if len(records.addrs) == 0 {
+		return records, errNoMDNSAddress
+	}
+
+	return records, nil
+}
+
+// interfaceIPv4s returns the IPv4 addresses of all interfaces except loopback.
+func interfaceIPv4s() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("list interface addresses: %w", err)
+	}
+
+	var ips []net.IP
+
+	for _, addr := range addrs {
+		if prefix, ok := addr.(*net.IPNet); ok && prefix.IP.To4() != nil && !prefix.IP.IsLoopback() {
+			ips = append(ips, prefix.IP.To4())
+		}
+	}
+
+	return ips, nil
+}
+
+// matches reports if name, as asked for in a question, is one of the records.
+func (r mdnsRecords) matches(name string) bool {
+	for _, own := range []string{mdnsServices, r.service, r.instance, r.host} {
+		if strings.EqualFold(name, own) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// response returns a response with id that carries all records. A goodbye carries them with a TTL of zero, which
+// withdraws them from the caches of the receivers.
+func (r mdnsRecords) response(id uint16, goodbye bool) []byte {
+	hostTTL, serviceTTL := uint32(mdnsHostTTL), uint32(mdnsServiceTTL)
+	if goodbye {
+		hostTTL, serviceTTL = 0, 0
+	}
+
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], mdnsFlags)
+
+	count := 0
+	record := func(name string, rrType, class uint16, ttl uint32, data []byte) {
+		// Own names were checked when the records were created, so encoding them can not fail.
+		msg, _ = appendDNSName(msg, name)
+		msg = binary.BigEndian.AppendUint16(msg, rrType)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+		count++
+	}
+
+	instance := r.appendInstance(nil)
+	service, _ := appendDNSName(nil, r.service)
+	host, _ := appendDNSName(nil, r.host)
+
+	record(mdnsServices, dnsTypePTR, dnsClassIN, serviceTTL, service)
+	record(r.service, dnsTypePTR, dnsClassIN, serviceTTL, instance)
+
+	srv := binary.BigEndian.AppendUint16(nil, 0)
+	srv = binary.BigEndian.AppendUint16(srv, 0)
+	srv = binary.BigEndian.AppendUint16(srv, uint16(r.port))
+	srv = append(srv, host...)
+
+	txt := []byte{}
+	for _, entry := range r.txt {
+		txt = append(append(txt, byte(len(entry))), entry...)
+	}
+
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+
+	// The instance name is written by hand since its first label may contain dots.
+	for _, rr := range []struct {
+		rrType uint16
+		data   []byte
+	}{{dnsTypeSRV, srv}, {dnsTypeTXT, txt}} {
+		msg = r.appendInstance(msg)
+		msg = binary.BigEndian.AppendUint16(msg, rr.rrType)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN|mdnsCacheFlush)
+		msg = binary.BigEndian.AppendUint32(msg, hostTTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.data)))
+		msg = append(msg, rr.data...)
+		count++
+	}
+
+	for _, addr := range r.addrs {
+		record(r.host, dnsTypeA, dnsClassIN|mdnsCacheFlush, hostTTL, addr)
+	}
+
+	binary.BigEndian.PutUint16(msg[6:], uint16(count))
+
+	return msg
+}
+
+// appendInstance appends the name of the service instance in wire format to buf.
+func (r mdnsRecords) appendInstance(buf []byte) []byte {
+	buf = append(append(buf, byte(len(r.label))), r.label...)
+	buf, _ = appendDNSName(buf, r.service)
+
+	return buf
+}
+
+// advertiseMDNS announces the service described by cfg on the local IPv4 network and answers queries for it until
+// ctx is canceled. Then the records are withdrawn with a goodbye. Failures are logged.
+func (p *proxy) advertiseMDNS(ctx context.Context, cfg mdnsConfig, listener net.Listener) {
+	records, err := newMDNSRecords(cfg, listener, p.cfg.instance)
+	if err != nil {
+		p.log.Error(err, "couldn't advertise service with mDNS")
+
+		return
+	}
+
+	if _, err := appendDNSName(nil, records.host); err != nil || len(records.label) > dnsMaxLabel {
+		p.log.Error(errDNSName, "couldn't advertise service with mDNS", "instance", records.instance)
+
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		p.log.Error(err, "couldn't advertise service with mDNS")
+
+		return
+	}
+
+	answered := make(chan struct{})
+
+	go func() {
+		defer close(answered)
+		p.answerMDNS(conn, records)
+	}()
+
+	p.log.Info("advertising service with mDNS", "instance", records.instance, "port", records.port,
+		"addresses", records.addrs)
+
+	for i := 0; i < mdnsAnnouncements && ctx.Err() == nil; i++ {
+		if _, err := conn.WriteToUDP(records.response(0, false), mdnsGroup); err != nil {
+			p.log.Error(err, "couldn't announce service with mDNS")
+		}
+
+		if i+1 < mdnsAnnouncements {
+			sleepUnlessDone(ctx, p.clock, mdnsAnnounceInterval)
+		}
+	}
+
+	<-ctx.Done()
+
+	if _, err := conn.WriteToUDP(records.response(0, true), mdnsGroup); err != nil {
+		p.log.Error(err, "couldn't withdraw service from mDNS")
+	}
+
+	_ = conn.Close()
+
+	<-answered
+}
+
+// answerMDNS responds to the queries received on conn that ask for one of records until conn is closed. Questions
+// asking for a unicast response and queries not sent from the mDNS port get one, all others are answered to the
+// multicast group.
+func (p *proxy) answerMDNS(conn *net.UDPConn, records mdnsRecords) {
+	buf := make([]byte, mdnsMaxMessage)
+
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		id, questions, err := parseMDNSQuery(buf[:n])
+		if err != nil {
+			p.log.V(1).Info("ignoring malformed mDNS query", "from", from.String(), "error", err.Error())
+
+			continue
+		}
+
+		matched, unicast := false, true
+
+		for _, question := range questions {
+			if (question.rrType == dnsTypeANY || question.rrType == dnsTypePTR || question.rrType == dnsTypeSRV ||
+				question.rrType == dnsTypeTXT || question.rrType == dnsTypeA) && records.matches(question.name) {
+				matched, unicast = true, unicast && question.unicast
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		to := mdnsGroup
+		if unicast || from.Port != mdnsPort {
+			to = from
+		} else {
+			id = 0
+		}
+
+		if _, err := conn.WriteToUDP(records.response(id, false), to); err != nil {
+			p.log.V(1).Info("couldn't answer mDNS query", "from", from.String(), "error", err.Error())
+		}
+	}
+}
+
+// mdnsQuestion is a question of a query.
+type mdnsQuestion struct {
+	name    string
+	rrType  uint16
+	unicast bool
+}
+
+// parseMDNSQuery returns the id and questions of msg. Responses have no questions.
+func parseMDNSQuery(msg []byte) (uint16, []mdnsQuestion, error) {
+	if len(msg) < dnsHeaderLen {
+		return 0, nil, errMDNSName
+	}
+
+	if binary.BigEndian.Uint16(msg[2:])&dnsFlagResponse != 0 {
+		return 0, nil, nil
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	questions := make([]mdnsQuestion, 0, count)
+
+	for offset := dnsHeaderLen; len(questions) < count; {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if next+4 > len(msg) {
+			return 0, nil, errMDNSName
+		}
+
+		questions = append(questions, mdnsQuestion{
+			name:    name,
+			rrType:  binary.BigEndian.Uint16(msg[next:]),
+			unicast: binary.BigEndian.Uint16(msg[next+2:])&mdnsUnicast != 0,
+		})
+		offset = next + 4
+	}
+
+	return binary.BigEndian.Uint16(msg), questions, nil
+}
+
+// readDNSName reads the name starting at offset of msg, following compression pointers. It returns the name with
+// dots between its labels and the offset behind it.
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+
+	next, pointers := -1, 0
+
+	for {
+		if offset >= len(msg) {
+			return "", 0, errMDNSName
+		}
+
+		length := int(msg[offset])
+
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+
+			return strings.Join(labels, "."), next, nil
+		case length&mdnsPointer == mdnsPointer:
+			if offset+1 >= len(msg) || pointers == mdnsMaxPointers {
+				return "", 0, errMDNSName
+			}
+
+			if next == -1 {
+				next = offset + 2
+			}
+
+			pointers++
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) &^ (mdnsPointer << 8))
+		case length > dnsMaxLabel || offset+1+length > len(msg):
+			return "", 0, errMDNSName
+		default:
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"sync/atomic"
+)
+
+// Metrics creates the instruments a proxy reports its measurements with. It keeps the package free of any telemetry
+// library; embedders pass an adapter for the one they use with WithMetrics. The modules
+// dev.eqrx.net/tcpto6/prommetrics and dev.eqrx.net/tcpto6/otelmetrics contain adapters for Prometheus and
+// OpenTelemetry. Each instrument is created once per proxy with the names of its labels, which are then given in the
+// same order with every measurement. Instruments must be safe for concurrent use.
+type Metrics interface {
+	// Counter returns a counter named name that is described by help.
+	Counter(name, help string, labelNames ...string) Counter
+	// Gauge returns a gauge named name that is described by help.
+	Gauge(name, help string, labelNames ...string) Gauge
+	// Histogram returns a histogram named name that is described by help and sorts observations into buckets, given
+	// by their inclusive upper bounds.
+	Histogram(name, help string, buckets []float64, labelNames ...string) Histogram
+}
+
+// Counter is a value that only goes up.
+type Counter interface {
+	// Add increases the counter by delta, which is not negative, for the given label values.
+	Add(delta float64, labelValues ...string)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge interface {
+	// Add changes the gauge by delta, which may be negative, for the given label values.
+	Add(delta float64, labelValues ...string)
+}
+
+// Histogram counts observations sorted into buckets.
+type Histogram interface {
+	// Observe adds value to the histogram for the given label values.
+	Observe(value float64, labelValues ...string)
+}
+
+// WithMetrics makes Run and RunWithConfig report their measurements to metrics. Nothing is reported by default.
+func WithMetrics(metrics Metrics) Option {
+	return func(opts *options) {
+		opts.metrics = metrics
+	}
+}
+
+const (
+	// metricDirectionReceived is the direction label of bytes read from clients and written to backends.
+	metricDirectionReceived = "received"
+	// metricDirectionSent is the direction label of bytes read from backends and written to clients.
+	metricDirectionSent = "sent"
+	// metricReasonClosed is the reason label of connections that were closed without error.
+	metricReasonClosed = "closed"
+	// metricResultReached is the result label of dials that reached the backend.
+	metricResultReached = "reached"
+	// metricResultFailed is the result label of dials that did not reach the backend.
+	metricResultFailed = "failed"
+)
+
+// dialDurationBuckets are the buckets of the dial duration histogram in seconds.
+var dialDurationBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30}
+
+// connDurationBuckets are the buckets of the connection duration histogram in seconds.
+var connDurationBuckets = []float64{.1, 1, 10, 60, 300, 1800, 3600, 6 * 3600, 24 * 3600}
+
+// proxyMetrics are the instruments of a proxy.
+type proxyMetrics struct {
+	accepted          Counter
+	active            Gauge
+	closed            Counter
+	handshakeFailures Counter
+	dialFailures      Counter
+	shed              Counter
+	denied            Counter
+	acceptRestarts    Counter
+	probes            Counter
+	bytes             Counter
+	mappingBytes      Counter
+	backendBytes      Counter
+	dialDuration      Histogram
+	connDuration      Histogram
+	copyLatency       Histogram
+}
+
+// newProxyMetrics creates the instruments of a proxy with metrics, discarding all measurements if metrics is nil.
+func newProxyMetrics(metrics Metrics) proxyMetrics {
+	if metrics == nil {
+		metrics = discardMetrics{}
+	}
+
+	return proxyMetrics{
+		accepted: metrics.Counter("tcpto6_connections_accepted_total",
+			"Number of accepted connections, including health probes."),
+		active: metrics.Gauge("tcpto6_connections_active", "Number of connections that are currently handled."),
+		closed: metrics.Counter("tcpto6_connections_closed_total",
+			"Number of finished connections that are no health probes by the reason they were closed.", "reason"),
+		handshakeFailures: metrics.Counter("tcpto6_handshake_failures_total",
+			"Number of connections that failed or timed out before they could be bridged."),
+		dialFailures: metrics.Counter("tcpto6_dial_failures_total",
+			"Number of connections that could not be bridged because dialing the backend failed."),
+		shed: metrics.Counter("tcpto6_shed_total",
+			"Number of connections that were closed right after accepting because of resource pressure."),
+		denied: metrics.Counter("tcpto6_denied_total",
+			"Number of connections that were closed right after accepting because their client is not admitted."),
+		acceptRestarts: metrics.Counter("tcpto6_accept_restarts_total",
+			"Number of times accepting was restarted after a recoverable error."),
+		probes: metrics.Counter("tcpto6_probes_total", "Number of connections recognized as health probes."),
+		bytes: metrics.Counter("tcpto6_bytes_total",
+			"Number of bytes bridged by finished connections that are no health probes, received from clients or "+
+				"sent to them.", "direction"),
+		mappingBytes: metrics.Counter("tcpto6_mapping_bytes_total",
+			"Number of bytes bridged by finished connections, including health probes, by the local port they were "+
+				"accepted on.", "mapping", "direction"),
+		backendBytes: metrics.Counter("tcpto6_backend_bytes_total",
+			"Number of bytes bridged by finished connections, including health probes, by the backend they were "+
+				"bridged to.", "backend", "direction"),
+		dialDuration: metrics.Histogram("tcpto6_dial_duration_seconds",
+			"Time it took to reach the backend, including retries, by whether it was reached.", dialDurationBuckets,
+			"result"),
+		connDuration: metrics.Histogram("tcpto6_connection_duration_seconds",
+			"Time finished connections that are no health probes were open.", connDurationBuckets),
+		copyLatency: metrics.Histogram("tcpto6_copy_latency_seconds",
+			"Time data of sampled connections took from being read to being written by tcp4to6, by whether it was "+
+				"received from clients or sent to them.", copyLatencyBuckets, "direction"),
+	}
+}
+
+// finished reports the traffic of conn, which finished with the reason closeReason gives, by mapping and backend.
+// Otherwise, health probes are only counted as such.
+func (m proxyMetrics) finished(conn *connection, probe bool) {
+	m.active.Add(-1)
+
+	received, sent := float64(atomic.LoadInt64(&conn.received)), float64(atomic.LoadInt64(&conn.sent))
+	mapping := mappingOf(conn.local)
+	m.mappingBytes.Add(received, mapping, metricDirectionReceived)
+	m.mappingBytes.Add(sent, mapping, metricDirectionSent)
+
+	if backend := conn.snapshot().backend; backend != "" {
+		m.backendBytes.Add(received, backend, metricDirectionReceived)
+		m.backendBytes.Add(sent, backend, metricDirectionSent)
+	}
+
+	if probe {
+		m.probes.Add(1)
+
+		return
+	}
+
+	reason, _ := closeReason(conn.err)
+	if reason == "" {
+		reason = metricReasonClosed
+	}
+
+	m.closed.Add(1, reason)
+	m.bytes.Add(received, metricDirectionReceived)
+	m.bytes.Add(sent, metricDirectionSent)
+	m.connDuration.Observe(conn.clock.Now().Sub(conn.started).Seconds())
+}
+
+// discardMetrics is the Metrics that discards all measurements.
+type discardMetrics struct{}
+
+// Counter returns a Counter that discards all measurements.
+func (discardMetrics) Counter(string, string, ...string) Counter { return discardInstrument{} }
+
+// Gauge returns a Gauge that discards all measurements.
+func (discardMetrics) Gauge(string, string, ...string) Gauge { return discardInstrument{} }
+
+// Histogram returns a Histogram that discards all measurements.
+func (discardMetrics) Histogram(string, string, []float64, ...string) Histogram {
+	return discardInstrument{}
+}
+
+// discardInstrument is the Counter, Gauge and Histogram that discards all measurements.
+type discardInstrument struct{}
+
+// Add does nothing.
+func (discardInstrument) Add(float64, ...string) {}
+
+// Observe does nothing.
+func (discardInstrument) Observe(float64, ...string) {}
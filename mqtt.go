@@ -0,0 +1,203 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// mqttConnect is the fixed header byte of CONNECT packets.
+	mqttConnect = 0x10
+	// mqttConnAck is the fixed header byte of CONNACK packets.
+	mqttConnAck = 0x20
+	// mqttPublish is the fixed header byte of PUBLISH packets with QoS 0.
+	mqttPublish = 0x30
+	// mqttPingReq is the fixed header byte of PINGREQ packets.
+	mqttPingReq = 0xc0
+	// mqttLevel is the protocol level of MQTT 3.1.1.
+	mqttLevel = 4
+	// mqttCleanSession, mqttPasswordFlag and mqttUserFlag are flags of CONNECT packets.
+	mqttCleanSession = 0x02
+	mqttPasswordFlag = 0x40
+	mqttUserFlag     = 0x80
+	// mqttKeepAlive is the keep alive in seconds announced to the broker. Twice brokerPingInterval.
+	mqttKeepAlive = 60
+	// mqttConnAckLength is the remaining length of CONNACK packets.
+	mqttConnAckLength = 2
+	// mqttClientIDBytes is the number of random bytes in the client identifier.
+	mqttClientIDBytes = 4
+	// mqttLengthDigit is the value of each digit of the remaining length, which is encoded in base 128.
+	mqttLengthDigit = 128
+	// mqttMaxLengthBytes is the number of bytes the remaining length is encoded in at most.
+	mqttMaxLengthBytes = 4
+)
+
+var (
+	// errMQTTProtocol is raised if the MQTT broker sends something that is not expected.
+	errMQTTProtocol = errors.New("unexpected packet from MQTT broker")
+	// errMQTTRefused is raised if the MQTT broker refuses the connection.
+	errMQTTRefused = errors.New("MQTT broker refused connection")
+)
+
+// mqttProtocol speaks MQTT 3.1.1. Events are published with QoS 0 to the topic base/event.
+type mqttProtocol struct{}
+
+// handshake sends CONNECT with a random client identifier and a clean session and waits for CONNACK.
+func (mqttProtocol) handshake(conn net.Conn, r *bufio.Reader, cfg brokerConfig) error {
+	id := make([]byte, mqttClientIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("generate client identifier: %w", err)
+	}
+
+	var connect bytes.Buffer
+
+	writeMQTTString(&connect, "MQTT")
+
+	// MQTT 3.1.1 only allows a password together with a user name.
+	password := cfg.user != "" && cfg.password != ""
+
+	flags := byte(mqttCleanSession)
+	if cfg.user != "" {
+		flags |= mqttUserFlag
+	}
+
+	if password {
+		flags |= mqttPasswordFlag
+	}
+
+	connect.Write([]byte{mqttLevel, flags})
+	_ = binary.Write(&connect, binary.BigEndian, uint16(mqttKeepAlive))
+	writeMQTTString(&connect, "tcp4to6-"+hex.EncodeToString(id))
+
+	if cfg.user != "" {
+		writeMQTTString(&connect, cfg.user)
+	}
+
+	if password {
+		writeMQTTString(&connect, cfg.password)
+	}
+
+	if _, err := conn.Write(mqttPacket(mqttConnect, connect.Bytes())); err != nil {
+		return fmt.Errorf("send CONNECT: %w", err)
+	}
+
+	header, ack, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+
+	if header != mqttConnAck || len(ack) != mqttConnAckLength {
+		return fmt.Errorf("%w: %#x", errMQTTProtocol, header)
+	}
+
+	if code := ack[1]; code != 0 {
+		return fmt.Errorf("%w: return code %d", errMQTTRefused, code)
+	}
+
+	return nil
+}
+
+// publish returns a PUBLISH packet with QoS 0.
+func (mqttProtocol) publish(base, event string, payload []byte) []byte {
+	var body bytes.Buffer
+
+	writeMQTTString(&body, base+"/"+event)
+	body.Write(payload)
+
+	return mqttPacket(mqttPublish, body.Bytes())
+}
+
+// ping returns a PINGREQ packet.
+func (mqttProtocol) ping() []byte {
+	return mqttPacket(mqttPingReq, nil)
+}
+
+// serve discards the packets the broker sends, which are only PINGRESP since nothing is subscribed.
+func (mqttProtocol) serve(r *bufio.Reader, _ func([]byte) error) error {
+	for {
+		if _, _, err := readMQTTPacket(r); err != nil {
+			return err
+		}
+	}
+}
+
+// mqttPacket returns a packet with the fixed header byte header and body.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+
+	for length := len(body); ; {
+		digit := byte(length % mqttLengthDigit)
+		if length /= mqttLengthDigit; length > 0 {
+			digit |= mqttLengthDigit
+		}
+
+		packet = append(packet, digit)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+// readMQTTPacket reads a packet and returns its fixed header byte and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, fmt.Errorf("read from MQTT broker: %w", err)
+	}
+
+	length, multiplier := 0, 1
+
+	for i := 0; ; i++ {
+		if i == mqttMaxLengthBytes {
+			return 0, nil, fmt.Errorf("%w: remaining length too long", errMQTTProtocol)
+		}
+
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, fmt.Errorf("read from MQTT broker: %w", err)
+		}
+
+		length += int(digit&(mqttLengthDigit-1)) * multiplier
+		multiplier *= mqttLengthDigit
+
+		if digit&mqttLengthDigit == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, fmt.Errorf("read from MQTT broker: %w", err)
+	}
+
+	return header, body, nil
+}
+
+// writeMQTTString writes s prefixed by its length to buf.
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+const (
+	// mssFromClient is the value of MSSEnvName that relays the MSS of the client connection.
+	mssFromClient = "client"
+	// minMSS and maxMSS are the bounds of TCP_MAXSEG that linux accepts.
+	minMSS, maxMSS = 88, 65535
+	// ipv6HeaderOverhead is the number of bytes an IPv6 header is larger than an IPv4 one.
+	ipv6HeaderOverhead = 20
+)
+
+// errMSS is raised if a MSS is out of range.
+var errMSS = errors.New("must be client or between 88 and 65535")
+
+// parseMSS sets the MSS configuration to value, either a number of bytes or mssFromClient.
+func (c *dialConfig) parseMSS(value string) error {
+	if value == mssFromClient {
+		c.relayMSS = true
+
+		return nil
+	}
+
+	mss, err := strconv.Atoi(value)
+	if err != nil || mss < minMSS || mss > maxMSS {
+		return errMSS
+	}
+
+	c.mss = mss
+
+	return nil
+}
+
+// mssFor returns the MSS that the backend connection of conn is clamped to if it is an IPv4 and an IPv6 one. Zero means
+// that the kernel chooses. A MSS relayed from a client of one IP version is adjusted by the difference in header size
+// for backends of the other one so that both legs fit the same MTU.
+func (c dialConfig) mssFor(conn *connection) (int, int) {
+	if !c.relayMSS || conn.mss == 0 {
+		return c.mss, c.mss
+	}
+
+	mss4, mss6 := conn.mss, conn.mss
+
+	if addr, ok := conn.client.(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		mss6 -= ipv6HeaderOverhead
+	} else {
+		mss4 += ipv6HeaderOverhead
+	}
+
+	return clampMSS(mss4), clampMSS(mss6)
+}
+
+// clampMSS returns mss limited to the range linux accepts.
+func clampMSS(mss int) int {
+	switch {
+	case mss < minMSS:
+		return minMSS
+	case mss > maxMSS:
+		return maxMSS
+	default:
+		return mss
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !unix
+
+package tcpto6
+
+import (
+	"errors"
+	"net"
+)
+
+// errMSSUnsupported indicates that the MSS can not be set on this platform.
+var errMSSUnsupported = errors.New("setting the MSS is only supported on unix")
+
+// tcpMSS returns zero since the MSS can only be read on unix.
+func tcpMSS(net.Conn) int {
+	return 0
+}
+
+// setMSS fails unless mss is zero since the MSS can only be set on unix.
+func setMSS(_, mss int) error {
+	if mss == 0 {
+		return nil
+	}
+
+	return errMSSUnsupported
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package tcpto6
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpMSS returns the MSS the kernel uses for conn. Zero if conn is not a TCP connection or the MSS can not be read.
+func tcpMSS(conn net.Conn) int {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+
+	var mss int
+
+	_ = raw.Control(func(fd uintptr) {
+		if value, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG); err == nil {
+			mss = value
+		}
+	})
+
+	return mss
+}
+
+// setMSS clamps the MSS of the socket fd to mss unless it is zero.
+func setMSS(fd, mss int) error {
+	if mss == 0 {
+		return nil
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss); err != nil {
+		return fmt.Errorf("set MSS: %w", err)
+	}
+
+	return nil
+}
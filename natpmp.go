@@ -0,0 +1,158 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// natPMPPort is the port NAT-PMP gateways listen on.
+	natPMPPort = 5351
+	// natPMPOpAddress and natPMPOpMapTCP are the opcodes of NAT-PMP requests. Responses carry them plus
+	// natPMPOpResponse.
+	natPMPOpAddress  = 0
+	natPMPOpMapTCP   = 2
+	natPMPOpResponse = 128
+	// natPMPAddressLen and natPMPMapLen are the lengths of the responses to address and mapping requests.
+	natPMPAddressLen = 12
+	natPMPMapLen     = 16
+	// natPMPFirstTimeout is the time waited for the first response. It doubles with each of the natPMPAttempts.
+	natPMPFirstTimeout = 250 * time.Millisecond
+	natPMPAttempts     = 6
+)
+
+var (
+	// errNATPMPResponse is raised if the gateway sends something that is not a response to the request.
+	errNATPMPResponse = errors.New("unexpected NAT-PMP response")
+	// errNATPMPRefused is raised if the gateway did not grant the request.
+	errNATPMPRefused = errors.New("NAT-PMP gateway refused request")
+)
+
+// natPMPResults names the result codes of NAT-PMP.
+var natPMPResults = map[uint16]string{
+	1: "unsupported version", 2: "not authorized", 3: "network failure", 4: "out of resources", 5: "unsupported opcode",
+}
+
+// natPMPMapper requests port mappings with NAT-PMP as described by RFC 6886.
+type natPMPMapper struct {
+	// gateway is the address of the gateway. The gateway of the default route is used if nil.
+	gateway net.IP
+}
+
+// mapPort requests the mapping and the external address of the gateway.
+func (m *natPMPMapper) mapPort(ctx context.Context, internal, external int, lifetime time.Duration,
+) (string, time.Duration, error) {
+	request := []byte{0, natPMPOpMapTCP, 0, 0}
+	request = binary.BigEndian.AppendUint16(request, uint16(internal))
+	request = binary.BigEndian.AppendUint16(request, uint16(external))
+	request = binary.BigEndian.AppendUint32(request, uint32(lifetime/time.Second))
+
+	response, err := m.request(ctx, request, natPMPMapLen)
+	if err != nil {
+		return "", 0, err
+	}
+
+	mappedPort := int(binary.BigEndian.Uint16(response[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(response[12:])) * time.Second
+
+	response, err = m.request(ctx, []byte{0, natPMPOpAddress}, natPMPAddressLen)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return joinExternal(net.IP(response[8:12]), mappedPort), granted, nil
+}
+
+// unmapPort requests the mapping with a lifetime of zero, which removes it.
+func (m *natPMPMapper) unmapPort(ctx context.Context, internal, _ int) error {
+	request := []byte{0, natPMPOpMapTCP, 0, 0}
+	request = binary.BigEndian.AppendUint16(request, uint16(internal))
+	request = append(request, make([]byte, 6)...)
+
+	_, err := m.request(ctx, request, natPMPMapLen)
+
+	return err
+}
+
+// request sends request to the gateway until a response of size bytes arrives, waiting longer after each attempt as
+// RFC 6886 asks, and checks its result code.
+func (m *natPMPMapper) request(ctx context.Context, request []byte, size int) ([]byte, error) {
+	gateway := m.gateway
+	if gateway == nil {
+		var err error
+		if gateway, err = defaultGateway(); err != nil {
+			return nil, err
+		}
+	}
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp4", net.JoinHostPort(gateway.String(), strconv.Itoa(natPMPPort)))
+	if err != nil {
+		return nil, fmt.Errorf("dial NAT-PMP gateway: %w", err)
+	}
+	defer conn.Close()
+
+	response := make([]byte, size)
+	timeout := natPMPFirstTimeout
+
+	for attempt := 0; ; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, fmt.Errorf("send NAT-PMP request: %w", err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+
+		_ = conn.SetReadDeadline(deadline)
+
+		n, err := conn.Read(response)
+
+		var netErr net.Error
+
+		switch {
+		case err == nil:
+		case errors.As(err, &netErr) && netErr.Timeout() && attempt+1 < natPMPAttempts && ctx.Err() == nil:
+			timeout *= 2
+
+			continue
+		default:
+			return nil, fmt.Errorf("read NAT-PMP response: %w", err)
+		}
+
+		if n != size || response[1] != request[1]+natPMPOpResponse {
+			return nil, errNATPMPResponse
+		}
+
+		if result := binary.BigEndian.Uint16(response[2:]); result != 0 {
+			name, ok := natPMPResults[result]
+			if !ok {
+				name = fmt.Sprintf("result %d", result)
+			}
+
+			return nil, fmt.Errorf("%w: %s", errNATPMPRefused, name)
+		}
+
+		return response, nil
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	// errNATSProtocol is raised if the NATS server sends something that is not expected.
+	errNATSProtocol = errors.New("unexpected message from NATS server")
+	// errNATSServer is raised if the NATS server reports an error.
+	errNATSServer = errors.New("NATS server error")
+)
+
+// natsConnect is the JSON document sent with CONNECT.
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+}
+
+// natsProtocol speaks the client protocol of NATS. Events are published to the subject base.event.
+type natsProtocol struct{}
+
+// handshake waits for the INFO of the server, sends CONNECT and uses a PING to learn if the server accepted it.
+func (natsProtocol) handshake(conn net.Conn, r *bufio.Reader, cfg brokerConfig) error {
+	line, err := readNATSLine(r)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("%w: %s", errNATSProtocol, line)
+	}
+
+	connect, err := json.Marshal(natsConnect{Name: "tcp4to6", Lang: "go", User: cfg.user, Pass: cfg.password})
+	if err != nil {
+		return fmt.Errorf("encode CONNECT: %w", err)
+	}
+
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		return fmt.Errorf("send CONNECT: %w", err)
+	}
+
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("%w: %s", errNATSServer, strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// publish returns a PUB message.
+func (natsProtocol) publish(base, event string, payload []byte) []byte {
+	var frame bytes.Buffer
+
+	fmt.Fprintf(&frame, "PUB %s.%s %d\r\n", base, event, len(payload))
+	frame.Write(payload)
+	frame.WriteString("\r\n")
+
+	return frame.Bytes()
+}
+
+// ping returns a PING message.
+func (natsProtocol) ping() []byte {
+	return []byte("PING\r\n")
+}
+
+// serve answers the PINGs of the server and returns its errors.
+func (natsProtocol) serve(r *bufio.Reader, reply func([]byte) error) error {
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "PING":
+			if err := reply([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("send PONG: %w", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("%w: %s", errNATSServer, strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// readNATSLine reads a line sent by the server without its line ending.
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("read from NATS server: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // OCSP identifies certificates by SHA-1 hashes.
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// ocspMaxResponseSize limits how large an OCSP response may be.
+const ocspMaxResponseSize = 1 << 20
+
+var (
+	// errNoOCSPServer is raised if a certificate does not name an OCSP responder.
+	errNoOCSPServer = errors.New("certificate has no OCSP server")
+	// errNoIssuer is raised if a certificate file does not contain the issuer certificate needed for OCSP.
+	errNoIssuer = errors.New("certificate file does not contain the issuer certificate")
+	// errOCSPStatus is raised if an OCSP responder does not respond with a usable response.
+	errOCSPStatus = errors.New("unexpected OCSP response")
+	// errCertificateNotGood is raised if an OCSP responder does not report a certificate as good.
+	errCertificateNotGood = errors.New("OCSP responder does not report certificate as good")
+)
+
+// The types below mirror the ASN.1 structures of RFC 6960 as far as tcpto6 needs them.
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			Cert ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Version            int `asn1:"optional,default:0,explicit,tag:0"`
+		RawResponderID     asn1.RawValue
+		ProducedAt         time.Time `asn1:"generalized"`
+		Responses          []ocspSingleResponse
+		ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag     `asn1:"tag:0,optional"`
+	Revoked asn1.RawValue `asn1:"tag:1,optional"`
+	Unknown asn1.Flag     `asn1:"tag:2,optional"`
+	// ThisUpdate is the time the status was known to be correct.
+	ThisUpdate time.Time `asn1:"generalized"`
+	// NextUpdate is the time newer information will be available. Zero if the responder did not say.
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// ocspStaple is an OCSP response ready to be stapled to TLS handshakes.
+type ocspStaple struct {
+	// raw is the DER encoded response.
+	raw []byte
+	// thisUpdate is the time the status was known to be correct.
+	thisUpdate time.Time
+	// nextUpdate is the time newer information will be available. Zero if the responder did not say.
+	nextUpdate time.Time
+}
+
+// fetchOCSPStaple asks the OCSP responder of leaf for the status of leaf. Only responses reporting the certificate as
+// good are returned. The signature of the response is not checked since that is up to the clients receiving it.
+func fetchOCSPStaple(ctx context.Context, client *http.Client, leaf, issuer *x509.Certificate) (*ocspStaple, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errNoOCSPServer
+	}
+
+	certID, err := newOCSPCertID(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	var request ocspRequest
+
+	request.TBSRequest.RequestList = append(request.TBSRequest.RequestList, struct{ Cert ocspCertID }{certID})
+
+	encoded, err := asn1.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("encode OCSP request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("create OCSP request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OCSP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP status %s", errOCSPStatus, resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("read OCSP response: %w", err)
+	}
+
+	return parseOCSPStaple(raw, certID.SerialNumber)
+}
+
+// newOCSPCertID identifies leaf towards an OCSP responder.
+func newOCSPCertID(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return ocspCertID{}, fmt.Errorf("decode issuer public key: %w", err)
+	}
+
+	nameHash := sha1.Sum(issuer.RawSubject)                   //nolint:gosec // Mandated by OCSP.
+	keyHash := sha1.Sum(publicKeyInfo.PublicKey.RightAlign()) //nolint:gosec // Mandated by OCSP.
+
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, // SHA-1
+			Parameters: asn1.NullRawValue,
+		},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  leaf.SerialNumber,
+	}, nil
+}
+
+// parseOCSPStaple checks that raw is a successful basic OCSP response reporting the certificate with the given
+// serial as good.
+func parseOCSPStaple(raw []byte, serial *big.Int) (*ocspStaple, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("decode OCSP response: %w", err)
+	}
+
+	basicType := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	if resp.Status != 0 || !resp.Response.ResponseType.Equal(basicType) {
+		return nil, fmt.Errorf("%w: status %d", errOCSPStatus, resp.Status)
+	}
+
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, fmt.Errorf("decode basic OCSP response: %w", err)
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		if single.CertID.SerialNumber.Cmp(serial) != 0 {
+			continue
+		}
+
+		if !single.Good {
+			return nil, errCertificateNotGood
+		}
+
+		return &ocspStaple{raw: raw, thisUpdate: single.ThisUpdate, nextUpdate: single.NextUpdate}, nil
+	}
+
+	return nil, fmt.Errorf("%w: certificate not covered", errOCSPStatus)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"github.com/go-logr/logr"
+)
+
+// Option changes how Run operates.
+type Option func(*options)
+
+// options collects the values set by Option functions.
+type options struct {
+	hooks []Hook
+	// hookCaches are the caches of WithCachedHook, which tell the time with the clock of the proxy.
+	hookCaches []*hookCache
+	// dialFailedHooks are called when the backend of a connection could not be reached.
+	dialFailedHooks []DialFailedHook
+	// sockets provides the listener. Nil selects SystemdSockets.
+	sockets SocketProvider
+	// socketAddrs names the sockets the listener accepts from. Set by RunWithConfig if sockets names them.
+	socketAddrs socketAddrs
+	// proxy is attached to the run if not nil.
+	proxy *Proxy
+	// clock tells the time for timeouts and backoffs. Nil selects the system clock.
+	clock Clock
+	// metrics creates the instruments measurements are reported with. Nil discards them.
+	metrics Metrics
+	// resolver looks up names. Nil selects net.DefaultResolver.
+	resolver Resolver
+	// dialer connects to TCP and unix destinations. Nil selects the built-in dialer.
+	dialer Dialer
+	// settings are the values of settings by the name of their environment variable. Proxy.Serve reads its
+	// configuration only from them, Run lets them override the environment.
+	settings map[string]string
+	// log is the logger of Proxy.Serve. The zero value discards.
+	log logr.Logger
+}
+
+// WithHook adds hook to the hooks called for each connection. Hooks are called in the order they were added.
+func WithHook(hook Hook) Option {
+	return func(opts *options) {
+		opts.hooks = append(opts.hooks, hook)
+	}
+}
+
+// OnDialFailed adds hook to the hooks called when the backend of a connection could not be reached. Hooks are called
+// in the order they were added.
+func OnDialFailed(hook DialFailedHook) Option {
+	return func(opts *options) {
+		opts.dialFailedHooks = append(opts.dialFailedHooks, hook)
+	}
+}
+
+// WithSocketProvider makes Run and RunWithConfig take their listener from provider instead of systemd.
+func WithSocketProvider(provider SocketProvider) Option {
+	return func(opts *options) {
+		opts.sockets = provider
+	}
+}
+
+// collectOptions applies opts to a fresh options value.
+func collectOptions(opts []Option) options {
+	var collected options
+	for _, opt := range opts {
+		opt(&collected)
+	}
+
+	return collected
+}
@@ -0,0 +1,20 @@
+module dev.eqrx.net/tcpto6/otelmetrics
+
+go 1.20
+
+require (
+	dev.eqrx.net/tcpto6 v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.21.0
+	go.opentelemetry.io/otel/metric v1.21.0
+)
+
+require (
+	dev.eqrx.net/rungroup v0.0.5 // indirect
+	github.com/coreos/go-systemd/v22 v22.3.2 // indirect
+	github.com/go-logr/logr v1.3.0 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/trace v1.21.0 // indirect
+	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
+)
+
+replace dev.eqrx.net/tcpto6 => ../
@@ -0,0 +1,129 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package otelmetrics reports the measurements of tcpto6 to OpenTelemetry. It is a module of its own so tcpto6 does
+// not depend on the OpenTelemetry API.
+package otelmetrics
+
+import (
+	"context"
+
+	"dev.eqrx.net/tcpto6"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metrics is the tcpto6.Metrics that creates the instruments with a metric.Meter. Counters become Float64Counter,
+// gauges Float64UpDownCounter and histograms Float64Histogram with explicit bucket boundaries. Label names become the
+// keys of attributes. Instruments the meter refuses to create are reported to otel.Handle and discard their
+// measurements.
+type Metrics struct {
+	meter metric.Meter
+}
+
+// New returns Metrics that creates its instruments with meter.
+func New(meter metric.Meter) *Metrics {
+	return &Metrics{meter: meter}
+}
+
+// Counter returns a tcpto6.Counter backed by a metric.Float64Counter.
+func (m *Metrics) Counter(name, help string, labelNames ...string) tcpto6.Counter {
+	instrument, err := m.meter.Float64Counter(name, metric.WithDescription(help))
+	if err != nil {
+		otel.Handle(err)
+
+		return discard{}
+	}
+
+	return counter{instrument: instrument, labelNames: labelNames}
+}
+
+// Gauge returns a tcpto6.Gauge backed by a metric.Float64UpDownCounter.
+func (m *Metrics) Gauge(name, help string, labelNames ...string) tcpto6.Gauge {
+	instrument, err := m.meter.Float64UpDownCounter(name, metric.WithDescription(help))
+	if err != nil {
+		otel.Handle(err)
+
+		return discard{}
+	}
+
+	return gauge{instrument: instrument, labelNames: labelNames}
+}
+
+// Histogram returns a tcpto6.Histogram backed by a metric.Float64Histogram.
+func (m *Metrics) Histogram(name, help string, buckets []float64, labelNames ...string) tcpto6.Histogram {
+	instrument, err := m.meter.Float64Histogram(name, metric.WithDescription(help),
+		metric.WithExplicitBucketBoundaries(buckets...))
+	if err != nil {
+		otel.Handle(err)
+
+		return discard{}
+	}
+
+	return histogram{instrument: instrument, labelNames: labelNames}
+}
+
+// attributes returns the option that sets the attributes named by labelNames to labelValues.
+func attributes(labelNames, labelValues []string) metric.MeasurementOption {
+	attrs := make([]attribute.KeyValue, 0, len(labelNames))
+	for i, name := range labelNames {
+		if i < len(labelValues) {
+			attrs = append(attrs, attribute.String(name, labelValues[i]))
+		}
+	}
+
+	return metric.WithAttributes(attrs...)
+}
+
+// counter adapts a metric.Float64Counter to tcpto6.Counter.
+type counter struct {
+	instrument metric.Float64Counter
+	labelNames []string
+}
+
+// Add increases the counter with labelValues by delta.
+func (c counter) Add(delta float64, labelValues ...string) {
+	c.instrument.Add(context.Background(), delta, attributes(c.labelNames, labelValues))
+}
+
+// gauge adapts a metric.Float64UpDownCounter to tcpto6.Gauge.
+type gauge struct {
+	instrument metric.Float64UpDownCounter
+	labelNames []string
+}
+
+// Add changes the gauge with labelValues by delta.
+func (g gauge) Add(delta float64, labelValues ...string) {
+	g.instrument.Add(context.Background(), delta, attributes(g.labelNames, labelValues))
+}
+
+// histogram adapts a metric.Float64Histogram to tcpto6.Histogram.
+type histogram struct {
+	instrument metric.Float64Histogram
+	labelNames []string
+}
+
+// Observe adds value to the histogram with labelValues.
+func (h histogram) Observe(value float64, labelValues ...string) {
+	h.instrument.Record(context.Background(), value, attributes(h.labelNames, labelValues))
+}
+
+// discard is the instrument that discards all measurements.
+type discard struct{}
+
+// Add does nothing.
+func (discard) Add(float64, ...string) {}
+
+// Observe does nothing.
+func (discard) Observe(float64, ...string) {}
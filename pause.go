@@ -0,0 +1,180 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errNotStarted is raised if a Proxy is used before the run it is attached to started.
+var errNotStarted = errors.New("run has not started yet")
+
+// acceptGate pauses accepting new connections. The zero value is not paused.
+type acceptGate struct {
+	mtx sync.Mutex
+	// resumed is closed when accepting resumes. Nil while not paused.
+	resumed chan struct{}
+}
+
+// pause pauses accepting and reports if it was not paused before.
+func (g *acceptGate) pause() bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.resumed != nil {
+		return false
+	}
+
+	g.resumed = make(chan struct{})
+
+	return true
+}
+
+// resume resumes accepting and reports if it was paused before.
+func (g *acceptGate) resume() bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.resumed == nil {
+		return false
+	}
+
+	close(g.resumed)
+	g.resumed = nil
+
+	return true
+}
+
+// paused reports if accepting is paused.
+func (g *acceptGate) paused() bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	return g.resumed != nil
+}
+
+// wait waits until accepting is not paused and reports false if ctx was canceled before.
+func (g *acceptGate) wait(ctx context.Context) bool {
+	g.mtx.Lock()
+	resumed := g.resumed
+	g.mtx.Unlock()
+
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+// Pause stops accepting new connections until Resume is called. The listener stays open, so connections arriving
+// meanwhile queue up at the socket and are accepted once accepting resumes. Active connections are not affected.
+func (p *Proxy) Pause() error {
+	select {
+	case <-p.started:
+		p.prx.pause()
+
+		return nil
+	default:
+		return errNotStarted
+	}
+}
+
+// Resume accepts new connections again after Pause.
+func (p *Proxy) Resume() error {
+	select {
+	case <-p.started:
+		p.prx.resume()
+
+		return nil
+	default:
+		return errNotStarted
+	}
+}
+
+// pause pauses accepting and logs and shows that as unit status.
+func (p *proxy) pause() {
+	if p.gate.pause() {
+		p.log.Info("paused accepting new connections", "event", "paused", "active", p.conns.len())
+		p.notifyStatus("accepting paused")
+	}
+}
+
+// resume resumes accepting and logs and shows that as unit status.
+func (p *proxy) resume() {
+	if p.gate.resume() {
+		p.log.Info("resumed accepting new connections", "event", "resumed")
+		p.notifyStatus(fmt.Sprintf("running version %d", p.generation().version))
+	}
+}
+
+// pauseCommand returns the control command that pauses accepting.
+func pauseCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: "pause",
+		help:  "stop accepting new connections until resume, keeping the socket open",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("%w: pause", errUsage)
+			}
+
+			p.pause()
+
+			return writeAcceptState(w, p)
+		},
+	}
+}
+
+// resumeCommand returns the control command that resumes accepting.
+func resumeCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: "resume",
+		help:  "accept new connections again after pause",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("%w: resume", errUsage)
+			}
+
+			p.resume()
+
+			return writeAcceptState(w, p)
+		},
+	}
+}
+
+// writeAcceptState writes if p accepts new connections and how many connections are active to w.
+func writeAcceptState(w io.Writer, p *proxy) error {
+	state := "accepting"
+
+	switch {
+	case p.gate.paused():
+		state = "paused"
+	case p.standby.paused():
+		state = "standing by for leader lock"
+	}
+
+	if _, err := fmt.Fprintf(w, "%s, %d active connections\n", state, p.conns.len()); err != nil {
+		return fmt.Errorf("write accept state: %w", err)
+	}
+
+	return nil
+}
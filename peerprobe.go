@@ -0,0 +1,91 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// peerProbeCount is the number of keepalive probes a probed peer may leave unanswered before its connection is
+// considered dead.
+const peerProbeCount = 3
+
+// probeQuietPeers watches the client and backend of conn and, once nothing was read from one of them for interval,
+// has the kernel probe that peer with keepalive every interval. Peers that vanished, like on a download where the
+// client only acknowledges, are found that way instead of keeping the bridge up until the default keepalive of two
+// hours or more gives up. dstSocket and srcSocket are the connections towards the backend and client. probeQuietPeers
+// returns when done is closed or both peers are probed.
+func (p *proxy) probeQuietPeers(done <-chan struct{}, interval time.Duration, conn *connection,
+	dstSocket, srcSocket net.Conn,
+) {
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	peers := [...]struct {
+		name   string
+		read   *int64
+		socket net.Conn
+		last   int64
+		probed bool
+	}{
+		{name: "client", read: &conn.received, socket: srcSocket},
+		{name: "backend", read: &conn.sent, socket: dstSocket},
+	}
+
+	for probing := 0; probing < len(peers); {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+
+		for i := range peers {
+			peer := &peers[i]
+			read := atomic.LoadInt64(peer.read)
+
+			if peer.probed || read != peer.last {
+				peer.last = read
+
+				continue
+			}
+
+			peer.probed = true
+			probing++
+
+			if err := probePeer(peer.socket, interval); err != nil {
+				p.log.Error(err, "couldn't probe quiet peer", "id", conn.id, "peer", peer.name)
+
+				continue
+			}
+
+			p.log.V(1).Info("probing quiet peer", "id", conn.id, "peer", peer.name)
+		}
+	}
+}
+
+// tcpSocket returns the TCP connection below conn, which may be a TLS connection. False if there is none.
+func tcpSocket(conn net.Conn) (*net.TCPConn, bool) {
+	conn = currentSocket(conn)
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+
+	return tcpConn, ok
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// probePeer enables keepalive on the TCP connection below conn, starting after interval of idleness and repeated every
+// interval. The connection fails after peerProbeCount unanswered probes. TCP_USER_TIMEOUT bounds the time data may
+// stay unacknowledged the same way, since keepalive is not sent while data is in flight. Other connections are left
+// alone.
+func probePeer(conn net.Conn, interval time.Duration) error {
+	tcpConn, ok := tcpSocket(conn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("raw socket: %w", err)
+	}
+
+	seconds := int(interval / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	userTimeout := (peerProbeCount + 1) * seconds * int(time.Second/time.Millisecond)
+
+	options := [...]struct {
+		level, name, value int
+	}{
+		{unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, seconds},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPCNT, peerProbeCount},
+		{unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, userTimeout},
+	}
+
+	var setErr error
+
+	if err := raw.Control(func(fd uintptr) {
+		for _, option := range options {
+			if setErr = unix.SetsockoptInt(int(fd), option.level, option.name, option.value); setErr != nil {
+				return
+			}
+		}
+	}); err != nil {
+		return fmt.Errorf("raw socket: %w", err)
+	}
+
+	if setErr != nil {
+		return fmt.Errorf("set keepalive: %w", setErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+// +build !linux
+
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// probePeer enables keepalive every interval on the TCP connection below conn. How many probes may go unanswered is
+// up to the platform. Other connections are left alone.
+func probePeer(conn net.Conn, interval time.Duration) error {
+	tcpConn, ok := tcpSocket(conn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return fmt.Errorf("set keepalive: %w", err)
+	}
+
+	if err := tcpConn.SetKeepAlivePeriod(interval); err != nil {
+		return fmt.Errorf("set keepalive period: %w", err)
+	}
+
+	return nil
+}
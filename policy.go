@@ -0,0 +1,391 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// policyLabel is the label connections get with the number of the policy rule that decided about them.
+	policyLabel = "policy"
+	// policyCacheTTL is how long the decision for a client, server name and port is remembered at most.
+	policyCacheTTL = time.Minute
+	// policyCacheSize is the number of decisions that are remembered at most.
+	policyCacheSize = 4096
+	// policyRuleParts is the number of parts of a rule separated by =>.
+	policyRuleParts = 2
+	// policyConditionFields is the number of fields of a condition like client in 192.0.2.0/24.
+	policyConditionFields = 3
+	// policyRangeParts is the number of parts of a range like 8-18.
+	policyRangeParts = 2
+	// policyNoRule is the index of the matching rule if none matched.
+	policyNoRule = -1
+	// policyHours is the number of hours of a day, after which hour ranges wrap around.
+	policyHours = 24
+)
+
+var (
+	// errPolicyRule is raised if a policy rule can not be parsed.
+	errPolicyRule = errors.New("policy rule must have the form conditions => action")
+	// errPolicyCondition is raised if a condition of a policy rule can not be parsed.
+	errPolicyCondition = errors.New("invalid policy condition")
+	// errPolicyAction is raised if the action of a policy rule can not be parsed.
+	errPolicyAction = errors.New("policy action must be allow, deny or route address")
+	// errPolicyDenied is raised if a policy rule denied a connection.
+	errPolicyDenied = errors.New("denied by policy rule")
+	// errPolicyEmptyRange is raised if a range of a policy condition ends where it starts or, unless it wraps around,
+	// before.
+	errPolicyEmptyRange = errors.New("range is empty")
+)
+
+// policyInput is what policy conditions are evaluated against.
+type policyInput struct {
+	// client is the IP address of the client. Nil if it has none.
+	client net.IP
+	// serverName is the server name the client requested via TLS SNI. Empty if not known.
+	serverName string
+	// port is the local port the connection was accepted on. Zero if not known.
+	port int
+	// now is the local time the connection is evaluated at.
+	now time.Time
+}
+
+// policyCondition is a single condition of a policy rule.
+type policyCondition struct {
+	// negate inverts the outcome of match.
+	negate bool
+	// match reports if the condition applies to an input.
+	match func(in policyInput) bool
+}
+
+// policyAction is what happens to connections a policy rule matches.
+type policyAction int
+
+const (
+	// policyAllow lets the connection pass to its destination.
+	policyAllow policyAction = iota
+	// policyDeny rejects the connection.
+	policyDeny
+	// policyRoute sends the connection to the destination of the rule.
+	policyRoute
+)
+
+// policyRule is a list of conditions that all have to match for the action to apply.
+type policyRule struct {
+	conditions  []policyCondition
+	action      policyAction
+	destination string
+}
+
+// policyDecision is the remembered index of the rule that matched an input. policyNoRule if none did.
+type policyDecision struct {
+	rule    int
+	expires time.Time
+}
+
+// policy is an ordered list of rules that decide about connections by their client address, requested server name,
+// local port and the time. The first rule whose conditions all match decides; connections no rule matches pass
+// unchanged. Decisions are remembered per client, server name and port for a short time.
+type policy struct {
+	rules []policyRule
+	mtx   sync.Mutex
+	cache map[string]policyDecision
+}
+
+// parsePolicy parses rules separated by semicolons or newlines. A rule has the form conditions => action, where
+// conditions are joined by and. A condition is any, which always matches, or key in values with key being client,
+// sni, port, hour or weekday, optionally preceded by not. Values are comma separated CIDRs for client, host names or
+// wildcards for sni, numbers or ranges like 8000-8099 for port and hour, where hour ranges exclude their end, and
+// three letter day names for weekday. The action is allow, deny or route followed by an address.
+func parsePolicy(value string) (*policy, error) {
+	pol := &policy{cache: map[string]policyDecision{}}
+
+	for _, line := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, err
+		}
+
+		pol.rules = append(pol.rules, rule)
+	}
+
+	return pol, nil
+}
+
+// parsePolicyRule parses a single rule of the form conditions => action.
+func parsePolicyRule(line string) (policyRule, error) {
+	parts := strings.SplitN(line, "=>", policyRuleParts)
+	if len(parts) != policyRuleParts {
+		return policyRule{}, fmt.Errorf("%w: %s", errPolicyRule, strings.TrimSpace(line))
+	}
+
+	var rule policyRule
+
+	for _, condition := range strings.Split(parts[0], " and ") {
+		parsed, err := parsePolicyCondition(strings.Fields(condition))
+		if err != nil {
+			return policyRule{}, err
+		}
+
+		if parsed.match != nil {
+			rule.conditions = append(rule.conditions, parsed)
+		}
+	}
+
+	switch action := strings.Fields(parts[1]); {
+	case len(action) == 1 && action[0] == "allow":
+		rule.action = policyAllow
+	case len(action) == 1 && action[0] == "deny":
+		rule.action = policyDeny
+	case len(action) == 2 && action[0] == "route":
+		rule.action, rule.destination = policyRoute, action[1]
+	default:
+		return policyRule{}, fmt.Errorf("%w: %s", errPolicyAction, strings.TrimSpace(parts[1]))
+	}
+
+	return rule, nil
+}
+
+// parsePolicyCondition parses the fields of a condition. The returned condition has no match function if it is any.
+func parsePolicyCondition(fields []string) (policyCondition, error) {
+	var condition policyCondition
+
+	text := strings.Join(fields, " ")
+
+	if len(fields) == 1 && fields[0] == "any" {
+		return condition, nil
+	}
+
+	if len(fields) != 0 && fields[0] == "not" {
+		condition.negate, fields = true, fields[1:]
+	}
+
+	if len(fields) != policyConditionFields || fields[1] != "in" {
+		return condition, fmt.Errorf("%w: %s", errPolicyCondition, text)
+	}
+
+	values := strings.Split(fields[2], ",")
+
+	var err error
+
+	switch fields[0] {
+	case "client":
+		condition.match, err = matchClient(values)
+	case "sni":
+		condition.match = matchServerName(values)
+	case "port":
+		condition.match, err = matchRanges(values, 0, func(in policyInput) int { return in.port })
+	case "hour":
+		condition.match, err = matchRanges(values, policyHours, func(in policyInput) int { return in.now.Hour() })
+	case "weekday":
+		condition.match, err = matchWeekday(values)
+	default:
+		err = errPolicyCondition
+	}
+
+	if err != nil {
+		return condition, fmt.Errorf("%w: %s: %v", errPolicyCondition, text, err)
+	}
+
+	return condition, nil
+}
+
+// matchClient returns a match function for client addresses within one of the CIDRs.
+func matchClient(values []string) (func(policyInput) bool, error) {
+	nets, err := parseCIDRs(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(in policyInput) bool { return nets.containsIP(in.client) }, nil
+}
+
+// matchServerName returns a match function for server names matching one of the patterns, which work like those of
+// SNI routes.
+func matchServerName(patterns []string) func(policyInput) bool {
+	routes := make([]sniRoute, len(patterns))
+	for i, pattern := range patterns {
+		routes[i] = sniRoute{pattern: strings.ToLower(pattern)}
+	}
+
+	return func(in policyInput) bool {
+		for _, route := range routes {
+			if route.matches(in.serverName) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// matchRanges returns a match function for inputs whose value, as returned by of, is one of the numbers or within one
+// of the ranges. Ranges like 8-18 include their start and exclude their end. If wrap is not zero, values wrap around
+// after it and ranges that end before they start, like 22-6, cover the wrap. Ranges that end where they start, or
+// before without wrap, are refused since they would never match.
+func matchRanges(values []string, wrap int, of func(policyInput) int) (func(policyInput) bool, error) {
+	type span struct{ from, to int }
+
+	spans := make([]span, 0, len(values))
+
+	for _, value := range values {
+		bounds := strings.SplitN(value, "-", policyRangeParts)
+
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse number: %w", err)
+		}
+
+		to := from + 1
+
+		if len(bounds) == policyRangeParts {
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("parse number: %w", err)
+			}
+		}
+
+		if to == from || (to < from && wrap == 0) {
+			return nil, fmt.Errorf("%w: %s", errPolicyEmptyRange, value)
+		}
+
+		spans = append(spans, span{from: from, to: to})
+	}
+
+	return func(in policyInput) bool {
+		value := of(in)
+
+		for _, s := range spans {
+			if s.to < s.from && (value >= s.from || value < s.to) {
+				return true
+			}
+
+			if value >= s.from && value < s.to {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// matchWeekday returns a match function for inputs evaluated on one of the days, given by their first three letters.
+func matchWeekday(values []string) (func(policyInput) bool, error) {
+	days := map[time.Weekday]bool{}
+
+	for _, value := range values {
+		found := false
+
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if strings.EqualFold(value, day.String()[:3]) {
+				days[day], found = true, true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("%w: unknown weekday %s", errPolicyCondition, value)
+		}
+	}
+
+	return func(in policyInput) bool { return days[in.now.Weekday()] }, nil
+}
+
+// decide returns the index of the first rule matching in, policyNoRule if none does. Decisions are remembered until
+// policyCacheTTL passed or the hour changes, whichever comes first, so rules on the time stay exact.
+func (p *policy) decide(in policyInput) int {
+	key := fmt.Sprintf("%s|%s|%d", in.client, in.serverName, in.port)
+
+	p.mtx.Lock()
+	decision, ok := p.cache[key]
+	p.mtx.Unlock()
+
+	if ok && in.now.Before(decision.expires) {
+		return decision.rule
+	}
+
+	decision = policyDecision{rule: policyNoRule, expires: in.now.Add(policyCacheTTL)}
+	nextHour := time.Date(in.now.Year(), in.now.Month(), in.now.Day(), in.now.Hour()+1, 0, 0, 0, in.now.Location())
+	if nextHour.Before(decision.expires) {
+		decision.expires = nextHour
+	}
+
+	for i, rule := range p.rules {
+		if rule.matches(in) {
+			decision.rule = i
+
+			break
+		}
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if len(p.cache) >= policyCacheSize {
+		p.cache = map[string]policyDecision{}
+	}
+
+	p.cache[key] = decision
+
+	return decision.rule
+}
+
+// matches reports if all conditions of the rule match in.
+func (r policyRule) matches(in policyInput) bool {
+	for _, condition := range r.conditions {
+		if condition.match(in) == condition.negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// step returns the handshake step that applies the policy to connections. Connections get the label policy set to the
+// number of the rule that decided about them, counting from 1.
+func (p *policy) step() handshakeStep {
+	return func(_ context.Context, conn *connection, src net.Conn) (net.Conn, error) {
+		in := policyInput{client: addrIP(conn.client), serverName: conn.snapshot().serverName, now: conn.clock.Now()}
+		if addr, ok := conn.local.(*net.TCPAddr); ok {
+			in.port = addr.Port
+		}
+
+		index := p.decide(in)
+		if index == policyNoRule {
+			return src, nil
+		}
+
+		conn.addLabels(Labels{policyLabel: strconv.Itoa(index + 1)})
+
+		switch rule := p.rules[index]; rule.action {
+		case policyAllow:
+		case policyDeny:
+			return src, fmt.Errorf("%w %d", errPolicyDenied, index+1)
+		case policyRoute:
+			conn.destination = rule.destination
+		}
+
+		return src, nil
+	}
+}
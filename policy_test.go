@@ -0,0 +1,56 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPolicyHourRanges(t *testing.T) {
+	pol, err := parsePolicy("hour in 22-6 => deny; hour in 8-18 => allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		hour int
+		rule int
+	}{
+		{hour: 21, rule: policyNoRule},
+		{hour: 22, rule: 0},
+		{hour: 0, rule: 0},
+		{hour: 5, rule: 0},
+		{hour: 6, rule: policyNoRule},
+		{hour: 8, rule: 1},
+		{hour: 17, rule: 1},
+		{hour: 18, rule: policyNoRule},
+	} {
+		// Each hour gets its own port so decisions cached for other hours do not apply.
+		in := policyInput{port: c.hour + 1, now: time.Date(2021, 11, 2, c.hour, 30, 0, 0, time.UTC)}
+
+		if rule := pol.decide(in); rule != c.rule {
+			t.Errorf("rule %d decided at %d:30 instead of %d", rule, c.hour, c.rule)
+		}
+	}
+}
+
+func TestPolicyEmptyRanges(t *testing.T) {
+	for _, value := range []string{"hour in 8-8 => deny", "port in 9000-8000 => deny"} {
+		if _, err := parsePolicy(value); !errors.Is(err, errPolicyCondition) {
+			t.Errorf("parsed %q with %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// portMappingNATPMP and portMappingUPnP are the protocols port mappings can be requested with.
+	portMappingNATPMP = "natpmp"
+	portMappingUPnP   = "upnp"
+	// portMappingTimeout bounds each request to the gateway.
+	portMappingTimeout = 10 * time.Second
+	// portMappingRetryDelay is the time waited before requesting a mapping again after the gateway refused it or
+	// could not be reached.
+	portMappingRetryDelay = 30 * time.Second
+	// defaultPortMappingLifetime is the lifetime of port mappings if not configured otherwise.
+	defaultPortMappingLifetime = time.Hour
+)
+
+var (
+	// errPortMappingProtocol is raised if the port mapping protocol is not known.
+	errPortMappingProtocol = errors.New("port mapping protocol must be natpmp or upnp")
+	// errNoMappingPort is raised if the listener has no TCP port to map.
+	errNoMappingPort = errors.New("listener has no TCP port")
+)
+
+// portMappingConfig configures requesting a mapping of the listening port from the NAT gateway.
+type portMappingConfig struct {
+	// protocol is portMappingNATPMP or portMappingUPnP. Empty if disabled.
+	protocol string
+	// gateway is the address of the NAT-PMP gateway. The gateway of the default route is used if nil.
+	gateway net.IP
+	// externalPort is the port requested on the gateway. Zero requests the port of the listener.
+	externalPort int
+	// lifetime is how long mappings are requested for. They are renewed after half of it.
+	lifetime time.Duration
+}
+
+// enabled reports if a port mapping is requested.
+func (c portMappingConfig) enabled() bool {
+	return c.protocol != ""
+}
+
+// parseProtocol parses value as port mapping protocol into c.
+func (c *portMappingConfig) parseProtocol(value string) error {
+	if value != portMappingNATPMP && value != portMappingUPnP {
+		return fmt.Errorf("%w: %s", errPortMappingProtocol, value)
+	}
+
+	c.protocol = value
+
+	return nil
+}
+
+// parseGateway parses value as IPv4 address of the gateway into c.
+func (c *portMappingConfig) parseGateway(value string) error {
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return fmt.Errorf("%w: %s", errInvalidIP, value)
+	}
+
+	c.gateway = ip
+
+	return nil
+}
+
+// portMapper requests port mappings from a NAT gateway.
+type portMapper interface {
+	// mapPort maps TCP port external of the gateway to internal of this host for lifetime. It returns the external
+	// address of the mapping and the lifetime the gateway granted, which may be shorter.
+	mapPort(ctx context.Context, internal, external int, lifetime time.Duration) (string, time.Duration, error)
+	// unmapPort removes the mapping of external to internal.
+	unmapPort(ctx context.Context, internal, external int) error
+}
+
+// mapPorts keeps the port of listener mapped on the NAT gateway until ctx is canceled and removes the mapping then.
+// The external address is logged and kept in p.externalAddr while the mapping holds. Failures are logged and the
+// mapping requested again after portMappingRetryDelay.
+func (p *proxy) mapPorts(ctx context.Context, cfg portMappingConfig, listener net.Listener) {
+	internal := 0
+
+	for _, member := range listenerMembers(listener) {
+		if addr, ok := member.Addr().(*net.TCPAddr); ok {
+			internal = addr.Port
+
+			break
+		}
+	}
+
+	if internal == 0 {
+		p.log.Error(errNoMappingPort, "couldn't map port on NAT gateway")
+
+		return
+	}
+
+	external := cfg.externalPort
+	if external == 0 {
+		external = internal
+	}
+
+	var mapper portMapper
+
+	switch cfg.protocol {
+	case portMappingNATPMP:
+		mapper = &natPMPMapper{gateway: cfg.gateway}
+	case portMappingUPnP:
+		mapper = &upnpMapper{}
+	}
+
+	mapped := false
+
+	for {
+		requestCtx, cancel := context.WithTimeout(ctx, portMappingTimeout)
+		addr, granted, err := mapper.mapPort(requestCtx, internal, external, cfg.lifetime)
+
+		cancel()
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		delay := granted / 2
+
+		switch {
+		case err != nil:
+			p.log.Error(err, "couldn't map port on NAT gateway", "protocol", cfg.protocol, "port", external,
+				"retryIn", portMappingRetryDelay.String())
+			p.externalAddr.Store("")
+
+			delay = portMappingRetryDelay
+		default:
+			if !mapped || p.externalAddress() != addr {
+				p.log.Info("port mapped on NAT gateway", "protocol", cfg.protocol, "externalAddress", addr,
+					"lifetime", granted.String())
+			}
+
+			mapped = true
+			p.externalAddr.Store(addr)
+
+			if delay <= 0 {
+				delay = portMappingRetryDelay
+			}
+		}
+
+		if !sleepUnlessDone(ctx, p.clock, delay) {
+			break
+		}
+	}
+
+	if !mapped {
+		return
+	}
+
+	requestCtx, cancel := context.WithTimeout(context.Background(), portMappingTimeout)
+	defer cancel()
+
+	if err := mapper.unmapPort(requestCtx, internal, external); err != nil {
+		p.log.Error(err, "couldn't remove port mapping from NAT gateway", "protocol", cfg.protocol)
+
+		return
+	}
+
+	p.log.Info("port mapping removed from NAT gateway", "protocol", cfg.protocol)
+}
+
+// externalAddress returns the address the listener is reachable at through the port mapping of the NAT gateway.
+// Empty if there is none.
+func (p *proxy) externalAddress() string {
+	addr, _ := p.externalAddr.Load().(string)
+
+	return addr
+}
+
+// joinExternal returns ip and port as external address.
+func joinExternal(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
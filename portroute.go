@@ -0,0 +1,73 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portDestinationParts is the number of parts of a port=destination pair.
+const portDestinationParts = 2
+
+var (
+	// errPortDestination is raised if a port=destination pair can not be parsed.
+	errPortDestination = errors.New("invalid port destination, expected port=address")
+	// errNoDestination is raised if a connection was accepted on a port without destination.
+	errNoDestination = errors.New("no destination for local port")
+)
+
+// portDestinations maps local ports to the destination of connections accepted on them.
+type portDestinations map[int]string
+
+// parsePortDestinations parses whitespace separated port=destination pairs.
+func parsePortDestinations(value string) (portDestinations, error) {
+	destinations := portDestinations{}
+
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, "=", portDestinationParts)
+		if len(parts) != portDestinationParts || parts[1] == "" {
+			return nil, fmt.Errorf("%w: %s", errPortDestination, field)
+		}
+
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port <= 0 {
+			return nil, fmt.Errorf("%w: %s", errPortDestination, field)
+		}
+
+		destinations[port] = parts[1]
+	}
+
+	return destinations, nil
+}
+
+// destinationOf returns the destination of connections accepted on local of the socket named socket. This is the one
+// of the socket if it has one, otherwise the one of its port if it has one and the configured destination otherwise,
+// which is empty if there is none.
+func (c Config) destinationOf(local net.Addr, socket string) string {
+	if destination, ok := c.socketDestinations[socket]; ok {
+		return destination
+	}
+
+	if addr, ok := local.(*net.TCPAddr); ok {
+		if destination, ok := c.portDestinations[addr.Port]; ok {
+			return destination
+		}
+	}
+
+	return c.toAddr
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"sync/atomic"
+)
+
+// probeLabel is the label that marks connections recognized as health probes.
+const probeLabel = "probe"
+
+// isProbe reports if conn, which is finished, looks like a health probe of a load balancer in probeClients: it was
+// bridged without error, but the client closed it without sending anything.
+func isProbe(probeClients cidrList, conn *connection) bool {
+	if len(probeClients) == 0 || conn.err != nil || atomic.LoadInt64(&conn.received) != 0 {
+		return false
+	}
+
+	return conn.snapshot().backend != "" && probeClients.contains(conn.client)
+}
+
+// countProbe tags conn as probe and takes it out of the connection counters again, so they are not dominated by
+// health checks.
+func (p *proxy) countProbe(conn *connection) {
+	conn.addLabels(Labels{probeLabel: "true"})
+
+	atomic.AddInt64(&p.stats.probes, 1)
+	atomic.AddInt64(&p.stats.accepted, -1)
+	atomic.AddInt64(&p.stats.dials, -1)
+	atomic.AddInt64(&p.stats.sent, -atomic.LoadInt64(&conn.sent))
+}
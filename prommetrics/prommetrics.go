@@ -0,0 +1,105 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package prommetrics reports the measurements of tcpto6 to Prometheus. It is a module of its own so tcpto6 does not
+// depend on the Prometheus client.
+package prommetrics
+
+import (
+	"errors"
+
+	"dev.eqrx.net/tcpto6"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is the tcpto6.Metrics that registers the instruments as collectors with a prometheus.Registerer. Collectors
+// that are already registered under the same name and labels, e.g. by another proxy of the same process, are shared.
+type Metrics struct {
+	registerer prometheus.Registerer
+}
+
+// New returns Metrics that registers its collectors with registerer, prometheus.DefaultRegisterer if nil.
+func New(registerer prometheus.Registerer) *Metrics {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	return &Metrics{registerer: registerer}
+}
+
+// Counter returns a tcpto6.Counter backed by a prometheus.CounterVec.
+func (m *Metrics) Counter(name, help string, labelNames ...string) tcpto6.Counter {
+	return counter{register(m.registerer,
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames))}
+}
+
+// Gauge returns a tcpto6.Gauge backed by a prometheus.GaugeVec.
+func (m *Metrics) Gauge(name, help string, labelNames ...string) tcpto6.Gauge {
+	return gauge{register(m.registerer,
+		prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames))}
+}
+
+// Histogram returns a tcpto6.Histogram backed by a prometheus.HistogramVec.
+func (m *Metrics) Histogram(name, help string, buckets []float64, labelNames ...string) tcpto6.Histogram {
+	return histogram{register(m.registerer,
+		prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames))}
+}
+
+// register registers collector with registerer and returns it, or the collector that is registered already in its
+// place. It panics if registering fails for other reasons, like prometheus.MustRegister, since that is a programming
+// error.
+func register[C prometheus.Collector](registerer prometheus.Registerer, collector C) C {
+	err := registerer.Register(collector)
+	if err == nil {
+		return collector
+	}
+
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(C); ok {
+			return existing
+		}
+	}
+
+	panic(err)
+}
+
+// counter adapts a prometheus.CounterVec to tcpto6.Counter.
+type counter struct {
+	vec *prometheus.CounterVec
+}
+
+// Add increases the counter with labelValues by delta.
+func (c counter) Add(delta float64, labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Add(delta)
+}
+
+// gauge adapts a prometheus.GaugeVec to tcpto6.Gauge.
+type gauge struct {
+	vec *prometheus.GaugeVec
+}
+
+// Add changes the gauge with labelValues by delta.
+func (g gauge) Add(delta float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Add(delta)
+}
+
+// histogram adapts a prometheus.HistogramVec to tcpto6.Histogram.
+type histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+// Observe adds value to the histogram with labelValues.
+func (h histogram) Observe(value float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(value)
+}
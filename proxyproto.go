@@ -0,0 +1,234 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// proxyProtocolVersion is the version of the PROXY protocol header sent to backends.
+type proxyProtocolVersion int
+
+const (
+	// proxyProtocolOff sends no header.
+	proxyProtocolOff proxyProtocolVersion = iota
+	// proxyProtocolV1 sends the human readable header of version 1.
+	proxyProtocolV1
+	// proxyProtocolV2 sends the binary header of version 2.
+	proxyProtocolV2
+)
+
+const (
+	// proxyV2VersionCommand is the version 2 with the PROXY command, meaning the connection was relayed for a client.
+	proxyV2VersionCommand = 0x21
+	// proxyV2TCP4 is the address family and protocol byte of TCP over IPv4.
+	proxyV2TCP4 = 0x11
+	// proxyV2TCP6 is the address family and protocol byte of TCP over IPv6.
+	proxyV2TCP6 = 0x21
+	// proxyV2Unspec is the address family and protocol byte of connections without IP addresses.
+	proxyV2Unspec = 0x00
+	// proxyTLVCustomMin is the lowest TLV type the PROXY protocol reserves for custom use.
+	proxyTLVCustomMin = 0xe0
+	// proxyTLVCustomMax is the highest TLV type the PROXY protocol reserves for custom use.
+	proxyTLVCustomMax = 0xef
+)
+
+// proxyTLVField is what a TLV sent with version 2 headers carries.
+type proxyTLVField int
+
+const (
+	// proxyTLVInstance carries the name of the tcp4to6 instance, or the host name if it has none.
+	proxyTLVInstance proxyTLVField = iota
+	// proxyTLVConn carries the ID of the connection in decimal, as in the access log.
+	proxyTLVConn
+)
+
+// proxyTLV is a TLV sent with version 2 headers.
+type proxyTLV struct {
+	// typ is the type of the TLV, in the range reserved for custom use.
+	typ byte
+	// field is what the TLV carries.
+	field proxyTLVField
+}
+
+// proxyV2Signature starts every version 2 header.
+var proxyV2Signature = [...]byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+var (
+	// errUnknownProxyProtocol is raised if a proxyProtocolVersion can not be parsed.
+	errUnknownProxyProtocol = errors.New("unknown PROXY protocol version")
+	// errProxyTLV is raised if a TLV to send with PROXY protocol headers can not be parsed.
+	errProxyTLV = errors.New("invalid PROXY protocol TLV, must be instance=type or conn=type with type 0xe0 to 0xef")
+	// errProxyTLVVersion is raised if TLVs are configured without PROXY protocol version 2.
+	errProxyTLVVersion = errors.New("PROXY protocol TLVs need version v2")
+)
+
+// parseProxyProtocolVersion returns the proxyProtocolVersion called name. Valid names are off, v1 and v2.
+func parseProxyProtocolVersion(name string) (proxyProtocolVersion, error) {
+	switch name {
+	case "off":
+		return proxyProtocolOff, nil
+	case "v1":
+		return proxyProtocolV1, nil
+	case "v2":
+		return proxyProtocolV2, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", errUnknownProxyProtocol, name)
+	}
+}
+
+// parseProxyTLVs parses value as whitespace separated pairs of the field a TLV carries, instance or conn, and its type
+// in the range reserved for custom use, like instance=0xe0 conn=0xe1.
+func parseProxyTLVs(value string) ([]proxyTLV, error) {
+	var tlvs []proxyTLV
+
+	for _, pair := range strings.Fields(value) {
+		name, typ, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errProxyTLV, pair)
+		}
+
+		var tlv proxyTLV
+
+		switch name {
+		case "instance":
+			tlv.field = proxyTLVInstance
+		case "conn":
+			tlv.field = proxyTLVConn
+		default:
+			return nil, fmt.Errorf("%w: %s", errProxyTLV, pair)
+		}
+
+		number, err := strconv.ParseUint(typ, 0, 8)
+		if err != nil || number < proxyTLVCustomMin || number > proxyTLVCustomMax {
+			return nil, fmt.Errorf("%w: %s", errProxyTLV, pair)
+		}
+
+		tlv.typ = byte(number)
+		tlvs = append(tlvs, tlv)
+	}
+
+	return tlvs, nil
+}
+
+// proxyAddrs returns the IP addresses and ports of client and local, both as 4 byte addresses if both are IPv4
+// addresses and as 16 byte addresses otherwise. ok is false if one of them is no TCP address.
+func proxyAddrs(client, local net.Addr) (clientIP, localIP net.IP, clientPort, localPort int, ok bool) {
+	clientTCP, clientOK := client.(*net.TCPAddr)
+	localTCP, localOK := local.(*net.TCPAddr)
+
+	if !clientOK || !localOK {
+		return nil, nil, 0, 0, false
+	}
+
+	clientIP, localIP = clientTCP.IP.To4(), localTCP.IP.To4()
+	if clientIP == nil || localIP == nil {
+		clientIP, localIP = clientTCP.IP.To16(), localTCP.IP.To16()
+	}
+
+	return clientIP, localIP, clientTCP.Port, localTCP.Port, clientIP != nil && localIP != nil
+}
+
+// proxyHeader returns the header of version that tells a backend the connection was accepted from client on local.
+// The addresses are left out if they are no TCP addresses, like for unix sockets. Version 2 headers carry values,
+// keyed by their TLV type, as TLVs after the addresses.
+func proxyHeader(version proxyProtocolVersion, client, local net.Addr, values map[byte][]byte) []byte {
+	clientIP, localIP, clientPort, localPort, ok := proxyAddrs(client, local)
+
+	if version == proxyProtocolV1 {
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+
+		family := "TCP4"
+		if len(clientIP) == net.IPv6len {
+			family = "TCP6"
+		}
+
+		return []byte("PROXY " + family + " " + clientIP.String() + " " + localIP.String() + " " +
+			strconv.Itoa(clientPort) + " " + strconv.Itoa(localPort) + "\r\n")
+	}
+
+	var body []byte
+
+	family := byte(proxyV2Unspec)
+
+	if ok {
+		family = proxyV2TCP4
+		if len(clientIP) == net.IPv6len {
+			family = proxyV2TCP6
+		}
+
+		body = append(body, clientIP...)
+		body = append(body, localIP...)
+		body = binary.BigEndian.AppendUint16(body, uint16(clientPort))
+		body = binary.BigEndian.AppendUint16(body, uint16(localPort))
+	}
+
+	types := make([]int, 0, len(values))
+	for typ := range values {
+		types = append(types, int(typ))
+	}
+
+	sort.Ints(types)
+
+	for _, typ := range types {
+		body = append(body, byte(typ))
+		body = binary.BigEndian.AppendUint16(body, uint16(len(values[byte(typ)])))
+		body = append(body, values[byte(typ)]...)
+	}
+
+	header := append([]byte{}, proxyV2Signature[:]...)
+	header = append(header, proxyV2VersionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+
+	return append(header, body...)
+}
+
+// sendProxyHeader writes the header of the PROXY protocol version of cfg for conn to dst, which was just dialed,
+// with the TLVs of cfg. Nothing is written if the version is proxyProtocolOff.
+func (p *proxy) sendProxyHeader(dst net.Conn, cfg dialConfig, conn *connection) error {
+	if cfg.proxyProtocol == proxyProtocolOff {
+		return nil
+	}
+
+	values := make(map[byte][]byte, len(cfg.proxyTLVs))
+
+	for _, tlv := range cfg.proxyTLVs {
+		switch tlv.field {
+		case proxyTLVInstance:
+			instance := p.cfg.instance
+			if instance == "" {
+				instance, _ = os.Hostname()
+			}
+
+			values[tlv.typ] = []byte(instance)
+		case proxyTLVConn:
+			values[tlv.typ] = []byte(strconv.FormatUint(conn.id, 10))
+		}
+	}
+
+	if _, err := dst.Write(proxyHeader(cfg.proxyProtocol, conn.client, conn.local, values)); err != nil {
+		return fmt.Errorf("send PROXY protocol header: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// errPushStatus is raised if the push endpoint responds with a non 2xx status.
+var errPushStatus = errors.New("push endpoint responded with unexpected status")
+
+// pushConfig describes where and how often metric deltas are pushed.
+type pushConfig struct {
+	// url is the HTTP endpoint deltas are POSTed to. Empty if pushing is disabled.
+	url string
+	// interval is the time between two pushes.
+	interval time.Duration
+	// token is sent as bearer token if not empty.
+	token string
+}
+
+// pushBody is the JSON document pushed to the collector. All counters are the difference to the values of the last
+// successful push, so the collector only has to add them up. Labeled holds the traffic of connections with labels
+// that finished in the interval, per set of labels. The listen queue values are gauges, listen overflows and drops
+// cover all listeners of the network namespace. Instance is the name of the tcp4to6 instance, if known.
+// ExternalAddress is where the listener is reachable through the port mapping of the NAT gateway, if any. Build tells
+// how the binary was built and ConfigHash which configuration is applied, so a fleet of differently built and
+// configured instances can be told apart.
+type pushBody struct {
+	Instance          string            `json:"instance,omitempty"`
+	Build             buildInfo         `json:"build"`
+	ConfigHash        string            `json:"configHash"`
+	Start             time.Time         `json:"start"`
+	End               time.Time         `json:"end"`
+	Active            int               `json:"active"`
+	Accepted          int64             `json:"accepted"`
+	HandshakeFailures int64             `json:"handshakeFailures"`
+	AcceptRestarts    int64             `json:"acceptRestarts"`
+	Shed              int64             `json:"shed"`
+	Denied            int64             `json:"denied"`
+	Probes            int64             `json:"probes"`
+	DialFailures      int64             `json:"dialFailures"`
+	BytesReceived     int64             `json:"bytesReceived"`
+	BytesSent         int64             `json:"bytesSent"`
+	ListenQueue       uint32            `json:"listenQueue"`
+	ListenQueueCap    uint32            `json:"listenQueueCapacity"`
+	ListenOverflows   int64             `json:"listenOverflows"`
+	ListenDrops       int64             `json:"listenDrops"`
+	Labeled           []labeledCounters `json:"labeled,omitempty"`
+	ExternalAddress   string            `json:"externalAddress,omitempty"`
+}
+
+// pushMetrics pushes metric deltas to the configured endpoint each interval until ctx is canceled. If a push fails,
+// the error is logged and the next push covers both intervals.
+func (p *proxy) pushMetrics(ctx context.Context, cfg pushConfig) {
+	client := &http.Client{Timeout: cfg.interval}
+	ticker := p.clock.NewTicker(cfg.interval)
+
+	defer ticker.Stop()
+
+	last := p.stats.snapshot(p.clock.Now())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		current := p.stats.snapshot(p.clock.Now())
+		body := pushBody{
+			Instance:          p.cfg.instance,
+			Build:             p.build,
+			ConfigHash:        p.generation().hash,
+			Start:             last.taken.UTC(),
+			End:               current.taken.UTC(),
+			Active:            p.conns.len(),
+			Accepted:          current.accepted - last.accepted,
+			HandshakeFailures: current.handshakeFailures - last.handshakeFailures,
+			AcceptRestarts:    current.acceptRestarts - last.acceptRestarts,
+			Shed:              current.shed - last.shed,
+			Denied:            current.denied - last.denied,
+			Probes:            current.probes - last.probes,
+			DialFailures:      current.dialFailures - last.dialFailures,
+			BytesReceived:     current.received - last.received,
+			BytesSent:         current.sent - last.sent,
+			ListenQueue:       current.listenQueue.length,
+			ListenQueueCap:    current.listenQueue.capacity,
+			ListenOverflows:   current.listenOverflows.overflows - last.listenOverflows.overflows,
+			ListenDrops:       current.listenOverflows.drops - last.listenOverflows.drops,
+			Labeled:           current.labeledDeltas(last),
+			ExternalAddress:   p.externalAddress(),
+		}
+
+		if err := push(ctx, client, cfg, body); err != nil {
+			p.log.Error(err, "couldn't push metrics")
+
+			continue
+		}
+
+		last = current
+	}
+}
+
+// push sends body to the endpoint described by cfg.
+func push(ctx context.Context, client *http.Client, cfg pushConfig, body pushBody) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode push body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.url, bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("create push request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if cfg.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("push: %w", err)
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", errPushStatus, resp.Status)
+	}
+
+	return nil
+}
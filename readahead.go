@@ -0,0 +1,132 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// readAhead is a ring buffer that decouples reading from a source from writing to a destination. A fill routine
+// reads into the free part of the buffer while the drain routine writes out the used part, so a destination that
+// stalls briefly does not stop the source from being read until the buffer is full.
+type readAhead struct {
+	mtx  sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// start is the index of the first used byte in buf.
+	start int
+	// length is the number of used bytes in buf.
+	length int
+	// readErr is the error that ended filling, io.EOF if the source ended.
+	readErr error
+	// drained is set if the drain routine gave up and filling should stop.
+	drained bool
+}
+
+// readAheadCopy copies from src to dst like io.Copy, but reads up to size bytes ahead of what was written to dst.
+// It returns once src ended and everything was written, or writing failed. A routine reading from src may be left
+// behind in the latter case; it ends once src is closed.
+func readAheadCopy(dst io.Writer, src io.Reader, size int) (int64, error) {
+	buffer := &readAhead{buf: make([]byte, size)}
+	buffer.cond = sync.NewCond(&buffer.mtx)
+
+	go buffer.fill(src)
+
+	return buffer.drain(dst)
+}
+
+// fill reads from src into the free part of the buffer until reading fails or drain gave up.
+func (b *readAhead) fill(src io.Reader) {
+	for {
+		b.mtx.Lock()
+
+		for b.length == len(b.buf) && !b.drained {
+			b.cond.Wait()
+		}
+
+		if b.drained {
+			b.mtx.Unlock()
+
+			return
+		}
+
+		end := (b.start + b.length) % len(b.buf)
+		free := len(b.buf) - b.length
+
+		if end+free > len(b.buf) {
+			free = len(b.buf) - end
+		}
+
+		b.mtx.Unlock()
+
+		n, err := src.Read(b.buf[end : end+free])
+
+		b.mtx.Lock()
+		b.length += n
+		b.readErr = err
+		b.cond.Broadcast()
+		b.mtx.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// drain writes the used part of the buffer to dst until fill ended and the buffer is empty or writing fails. It
+// returns the number of bytes written and the error that ended copying. The end of the source is not an error.
+func (b *readAhead) drain(dst io.Writer) (int64, error) {
+	var written int64
+
+	for {
+		b.mtx.Lock()
+
+		for b.length == 0 && b.readErr == nil {
+			b.cond.Wait()
+		}
+
+		if b.length == 0 {
+			err := b.readErr
+			b.mtx.Unlock()
+
+			if errors.Is(err, io.EOF) {
+				return written, nil
+			}
+
+			return written, err
+		}
+
+		start, used := b.start, b.length
+		if start+used > len(b.buf) {
+			used = len(b.buf) - start
+		}
+
+		b.mtx.Unlock()
+
+		n, err := dst.Write(b.buf[start : start+used])
+		written += int64(n)
+
+		b.mtx.Lock()
+		b.start = (b.start + n) % len(b.buf)
+		b.length -= n
+		b.drained = err != nil
+		b.cond.Broadcast()
+		b.mtx.Unlock()
+
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// errRebindUnsupported is raised if StaticBind.Rebind is used on a platform that does not support it.
+var errRebindUnsupported = errors.New("rebinding on address changes is only supported on linux")
+
+// addressWatch signals changes to the addresses assigned to the interfaces of the host.
+type addressWatch struct {
+	file *os.File
+	// changed receives a value after one or more addresses were added or removed. It is closed when the watch ends.
+	changed chan struct{}
+	// err is why the watch ended before it was closed. Only read after changed is closed.
+	err error
+}
+
+// Close ends the watch.
+func (w *addressWatch) Close() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("close address watch: %w", err)
+	}
+
+	return nil
+}
+
+// rebindingListener listens on a TCP address that may come and go with its interface, like one assigned by DHCP or
+// a PPPoE session. While the address is not assigned, Accept waits for it. When it is removed the socket is closed and
+// it is bound again once the address is back.
+type rebindingListener struct {
+	network  string
+	addr     *net.TCPAddr
+	watch    *addressWatch
+	accepted chan acceptResult
+	done     chan struct{}
+	once     sync.Once
+	// mu guards bound and stopBound, the socket bound to addr and the channel that is closed before it is. Nil while
+	// addr is not assigned.
+	mu        sync.Mutex
+	bound     net.Listener
+	stopBound chan struct{}
+}
+
+// listenRebinding binds to address on network like listenStatic, but follows the address as it is assigned and
+// removed. Addresses that are not TCP or not of a single host are bound by listenStatic.
+func listenRebinding(network, address string) (net.Listener, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return listenStatic(network, address)
+	}
+
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("bind: %w", err)
+	}
+
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return listenStatic(network, address)
+	}
+
+	watch, err := watchAddresses()
+	if err != nil {
+		return nil, fmt.Errorf("bind: %w", err)
+	}
+
+	listener := &rebindingListener{
+		network: network, addr: addr, watch: watch, accepted: make(chan acceptResult), done: make(chan struct{}),
+	}
+
+	if err := listener.reconcile(); err != nil {
+		_ = watch.Close()
+
+		return nil, err
+	}
+
+	go listener.follow()
+
+	return listener, nil
+}
+
+// follow reconciles the socket with the addresses of the host after each change until l is closed. If binding fails
+// for another reason than the address missing, or the watch fails, the error is returned by Accept.
+func (l *rebindingListener) follow() {
+	for range l.watch.changed {
+		if err := l.reconcile(); err != nil {
+			l.fail(err)
+
+			return
+		}
+	}
+
+	if l.watch.err != nil {
+		l.fail(fmt.Errorf("watch addresses: %w", l.watch.err))
+	}
+}
+
+// fail passes err to Accept unless l is closed.
+func (l *rebindingListener) fail(err error) {
+	select {
+	case l.accepted <- acceptResult{err: err}:
+	case <-l.done:
+	}
+}
+
+// reconcile binds the socket if the address is assigned and closes it if not. An address that is assigned but can
+// not be bound to yet, like an IPv6 address during duplicate address detection, is tried again on the next change.
+func (l *rebindingListener) reconcile() error {
+	assigned, err := addressAssigned(l.addr.IP)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return nil
+	default:
+	}
+
+	switch {
+	case assigned && l.bound == nil:
+		listener, err := net.ListenTCP(l.network, l.addr)
+		if errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("bind: %w", err)
+		}
+
+		l.bound, l.stopBound = listener, make(chan struct{})
+
+		go l.acceptFrom(listener, l.stopBound)
+	case !assigned && l.bound != nil:
+		close(l.stopBound)
+
+		_ = l.bound.Close()
+		l.bound, l.stopBound = nil, nil
+	}
+
+	return nil
+}
+
+// acceptFrom passes connections accepted from listener to Accept until stop or l is closed or listener fails with an
+// error that is not recoverable.
+func (l *rebindingListener) acceptFrom(listener net.Listener, stop chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+
+		select {
+		case <-stop:
+		case l.accepted <- acceptResult{conn: conn, err: err}:
+			if err != nil && !recoverableAccept(err) {
+				return
+			}
+
+			continue
+		case <-l.done:
+		}
+
+		if conn != nil {
+			_ = conn.Close()
+		}
+
+		return
+	}
+}
+
+// Accept returns the next connection, waiting for the address to be assigned if it is not.
+func (l *rebindingListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.accepted:
+		return result.conn, result.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close ends the watch and closes the socket if it is bound.
+func (l *rebindingListener) Close() error {
+	var err error
+
+	l.once.Do(func() {
+		close(l.done)
+
+		_ = l.watch.Close()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if l.bound != nil {
+			close(l.stopBound)
+
+			err = l.bound.Close()
+		}
+	})
+
+	if err != nil {
+		return fmt.Errorf("close rebinding listener: %w", err)
+	}
+
+	return nil
+}
+
+// Addr returns the address l binds to, even while it is not assigned.
+func (l *rebindingListener) Addr() net.Addr {
+	return l.addr
+}
+
+// addressAssigned reports if ip is assigned to an interface of the host.
+func addressAssigned(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, fmt.Errorf("list interface addresses: %w", err)
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
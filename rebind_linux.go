@@ -0,0 +1,70 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchAddresses subscribes to the netlink groups announcing added and removed IPv4 and IPv6 addresses.
+func watchAddresses() (*addressWatch, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("create netlink socket: %w", err)
+	}
+
+	groups := uint32(unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("bind netlink socket: %w", err)
+	}
+
+	watch := &addressWatch{file: os.NewFile(uintptr(fd), "netlink"), changed: make(chan struct{}, 1)}
+
+	go watch.read()
+
+	return watch, nil
+}
+
+// read signals a change for each message received until the watch is closed. The content of messages does not
+// matter since the addresses are listed anew anyway. Messages lost because the socket buffer ran full are signaled as
+// a change as well.
+func (w *addressWatch) read() {
+	defer close(w.changed)
+
+	buf := make([]byte, os.Getpagesize())
+
+	for {
+		_, err := w.file.Read(buf)
+
+		switch {
+		case errors.Is(err, os.ErrClosed):
+			return
+		case err != nil && !errors.Is(err, unix.ENOBUFS):
+			w.err = err
+
+			return
+		}
+
+		select {
+		case w.changed <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// generation is a version of the configuration that has been validated and applied. Connections use the generation
+// that was current when they were accepted until they finish.
+type generation struct {
+	// version counts the applied generations, starting at 1.
+	version int
+	// applied is the time the generation became current.
+	applied time.Time
+	// hash tells the settings of the generation apart from others without showing them.
+	hash string
+	// cfg is the configuration of the generation.
+	cfg Config
+	// handshakeSteps are run on each accepted connection before its backend is dialed.
+	handshakeSteps []handshakeStep
+	// tls routes TLS connections. Nil if SNI routing is disabled.
+	tls *tlsRouter
+}
+
+// newGeneration validates cfg by building everything connections need from it. previous is the current generation,
+// nil for the first one. State that should survive reloads, like generated session ticket keys, is taken from it.
+func newGeneration(p *proxy, cfg Config, previous *generation) (*generation, error) {
+	gen := &generation{version: 1, applied: p.clock.Now(), cfg: cfg, hash: cfg.hash()}
+
+	var previousTLS *tlsRouter
+
+	if previous != nil {
+		gen.version = previous.version + 1
+		previousTLS = previous.tls
+	}
+
+	if len(cfg.tls.routes) != 0 {
+		router, err := newTLSRouter(p.log.WithName("tls"), cfg.tls, previousTLS, p.clock)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+
+		gen.handshakeSteps = append(gen.handshakeSteps, router.handshake)
+		gen.tls = router
+	}
+
+	if cfg.policy != nil && len(cfg.policy.rules) != 0 {
+		gen.handshakeSteps = append(gen.handshakeSteps, cfg.policy.step())
+	}
+
+	if cfg.extAuthz.url != "" {
+		gen.handshakeSteps = append(gen.handshakeSteps, extAuthzStep(p.log.WithName("authz"), cfg.extAuthz))
+	}
+
+	if len(cfg.greenDestinations) != 0 {
+		gen.handshakeSteps = append(gen.handshakeSteps, p.colorStep(cfg.greenDestinations))
+	}
+
+	for _, hook := range p.opts.hooks {
+		gen.handshakeSteps = append(gen.handshakeSteps, hookStep(hook))
+	}
+
+	return gen, nil
+}
+
+// restartSettings are the parts of the configuration that are only applied when tcpto6 starts.
+type restartSettings struct {
+	accessLog           rotateConfig
+	reverseDNS          bool
+	journal             journalConfig
+	anonymize           anonymizeMode
+	syslog              syslogConfig
+	controlSocket       string
+	lockFile            string
+	leader              leaderConfig
+	metricsAddr         string
+	summaryInterval     time.Duration
+	push                pushConfig
+	webhook             webhookConfig
+	broker              brokerConfig
+	reloadInterval      time.Duration
+	listenCheckInterval time.Duration
+	instance            string
+	bandwidthLimit      int64
+	dialConcurrency     int
+	health              healthConfig
+	shed                shedConfig
+	holdQueueSize       int
+	expectListen        listenExpectation
+	listenAddrs         string
+}
+
+// restartSettingsOf returns the parts of cfg that are only applied when tcpto6 starts.
+func restartSettingsOf(cfg Config) restartSettings {
+	return restartSettings{
+		accessLog:           cfg.accessLog,
+		reverseDNS:          cfg.reverseDNS,
+		journal:             cfg.journal,
+		anonymize:           cfg.anonymize,
+		syslog:              cfg.syslog,
+		controlSocket:       cfg.controlSocket,
+		lockFile:            cfg.lockFile,
+		leader:              cfg.leader,
+		metricsAddr:         cfg.metricsAddr,
+		summaryInterval:     cfg.summaryInterval,
+		push:                cfg.push,
+		webhook:             cfg.webhook,
+		broker:              cfg.broker,
+		reloadInterval:      cfg.tls.reloadInterval,
+		listenCheckInterval: cfg.listenCheckInterval,
+		instance:            cfg.instance,
+		bandwidthLimit:      cfg.bandwidthLimit,
+		dialConcurrency:     cfg.dialConcurrency,
+		health:              cfg.health,
+		shed:                cfg.shed,
+		holdQueueSize:       cfg.holdQueueSize,
+		expectListen:        cfg.expectListen,
+		listenAddrs:         fmt.Sprint(cfg.listenAddrs),
+	}
+}
+
+// reloadStatus describes the outcome of the last reload.
+type reloadStatus struct {
+	mtx sync.Mutex
+	// attempted is the time of the last reload. Zero if there was none.
+	attempted time.Time
+	// err is the reason the last reload failed. Nil if it succeeded.
+	err error
+	// restartNeeded is set if an applied configuration contains changes that are only applied on restart.
+	restartNeeded bool
+}
+
+// generation returns the current generation.
+func (p *proxy) generation() *generation {
+	gen, _ := p.gen.Load().(*generation)
+
+	return gen
+}
+
+// reload reads and validates the configuration again and makes it the current generation if it is valid.
+// Configurations that were not read from anywhere are validated again as they are, which reloads certificates. The
+// current generation stays in place otherwise. Either way the outcome is logged, reported to systemd and kept for
+// the config control command. It must only be called by the maintain routine.
+func (p *proxy) reload() error {
+	_, _ = daemon.SdNotify(false, daemon.SdNotifyReloading)
+
+	defer func() { _, _ = daemon.SdNotify(false, daemon.SdNotifyReady) }()
+
+	current := p.generation()
+
+	err := func() error {
+		cfg := current.cfg
+
+		if cfg.lookup != nil {
+			var err error
+			if cfg, err = loadConfig(cfg.lookup); err != nil {
+				return fmt.Errorf("config: %w", err)
+			}
+		}
+
+		gen, err := newGeneration(p, cfg, current)
+		if err != nil {
+			return err
+		}
+
+		p.gen.Store(gen)
+
+		return nil
+	}()
+
+	p.status.mtx.Lock()
+	defer p.status.mtx.Unlock()
+
+	p.status.attempted, p.status.err = p.clock.Now(), err
+
+	if err != nil {
+		p.log.Error(err, "reload failed, keeping the current configuration", "version", current.version)
+		p.notifyStatus(fmt.Sprintf("reload failed, running version %d: %v", current.version, err))
+
+		return err
+	}
+
+	gen := p.generation()
+	p.status.restartNeeded = restartSettingsOf(gen.cfg) != restartSettingsOf(p.cfg)
+
+	if p.status.restartNeeded {
+		p.log.Info("applied configuration contains changes that need a restart to take effect", "version", gen.version)
+	}
+
+	p.log.Info("reloaded configuration", "version", gen.version)
+	p.notifyStatus(fmt.Sprintf("running version %d", gen.version))
+
+	return nil
+}
+
+// notifyStatus sets status as the status of the systemd unit, prefixed with the name of the instance if known.
+func (p *proxy) notifyStatus(status string) {
+	if p.cfg.instance != "" {
+		status = p.cfg.instance + ": " + status
+	}
+
+	_, _ = daemon.SdNotify(false, "STATUS="+status)
+}
+
+// maintain keeps the current generation in shape until ctx is canceled. Certificates and session ticket keys are
+// checked each reload interval. Signals received from signals as well as requests from the reload control command
+// reload the configuration.
+func (p *proxy) maintain(ctx context.Context, signals <-chan os.Signal) {
+	for delay := time.Duration(0); ; delay = p.cfg.tls.reloadInterval {
+		if !p.maintainOnce(ctx, signals, delay) {
+			return
+		}
+	}
+}
+
+// maintainOnce waits on the clock of p for delay to pass, a signal from signals or a request from the reload control
+// command and checks the current generation afterwards. It reports false if ctx was canceled instead.
+func (p *proxy) maintainOnce(ctx context.Context, signals <-chan os.Signal, delay time.Duration) bool {
+	timer := p.clock.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C():
+	case <-signals:
+		p.log.Info("reload requested")
+		_ = p.reload()
+	case result := <-p.reloads:
+		result <- p.reload()
+	}
+
+	if gen := p.generation(); gen.tls != nil {
+		gen.tls.update(ctx)
+	}
+
+	return true
+}
+
+// reloadCommand returns the control command that reloads the configuration and reports the outcome.
+func reloadCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: "reload",
+		help:  "reload the configuration, keeping the current one if the new one is invalid",
+		run: func(ctx context.Context, w io.Writer, _ []string) error {
+			result := make(chan error, 1)
+
+			select {
+			case p.reloads <- result:
+			case <-ctx.Done():
+				return fmt.Errorf("request reload: %w", ctx.Err())
+			}
+
+			select {
+			case err := <-result:
+				if err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return fmt.Errorf("wait for reload: %w", ctx.Err())
+			}
+
+			if _, err := fmt.Fprintf(w, "applied version %d\n", p.generation().version); err != nil {
+				return fmt.Errorf("write reload result: %w", err)
+			}
+
+			return nil
+		},
+	}
+}
+
+// configCommand returns the control command that shows which configuration is applied. With show, it lists the
+// settings of the applied configuration instead.
+func configCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: "config [show]",
+		help:  "show the applied configuration version and the outcome of the last reload, or its settings with show",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			gen := p.generation()
+
+			switch {
+			case len(args) == 1 && args[0] == "show":
+				return writeSettings(w, gen)
+			case len(args) != 0:
+				return fmt.Errorf("%w: config [show]", errUsage)
+			}
+
+			p.status.mtx.Lock()
+			attempted, reloadErr, restartNeeded := p.status.attempted, p.status.err, p.status.restartNeeded
+			p.status.mtx.Unlock()
+
+			lastReload := "never"
+
+			switch {
+			case attempted.IsZero():
+			case reloadErr != nil:
+				lastReload = fmt.Sprintf("failed at %s: %v", attempted.UTC().Format(time.RFC3339), reloadErr)
+			default:
+				lastReload = "succeeded at " + attempted.UTC().Format(time.RFC3339)
+			}
+
+			if _, err := fmt.Fprintf(w, "version: %d\nhash: %s\napplied: %s\nlast reload: %s\nrestart needed: %t\n",
+				gen.version, gen.hash, gen.applied.UTC().Format(time.RFC3339), lastReload, restartNeeded); err != nil {
+				return fmt.Errorf("write config: %w", err)
+			}
+
+			return nil
+		},
+	}
+}
+
+// redacted replaces secrets in settings that are shown, like url.URL.Redacted does for passwords.
+const redacted = "xxxxx"
+
+// writeSettings writes the version and hash of gen followed by its settings in the form NAME=value, sorted by name,
+// with secrets redacted.
+func writeSettings(w io.Writer, gen *generation) error {
+	names := make([]string, 0, len(gen.cfg.settings))
+	for name := range gen.cfg.settings {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "# version %d hash %s\n", gen.version, gen.hash)
+
+	for _, name := range names {
+		fmt.Fprintf(&out, "%s=%s\n", name, redactSetting(name, gen.cfg.settings[name]))
+	}
+
+	if _, err := io.WriteString(w, out.String()); err != nil {
+		return fmt.Errorf("write settings: %w", err)
+	}
+
+	return nil
+}
+
+// redactSetting returns value of the setting called name as it may be shown. Tokens and keys are replaced as a whole,
+// passwords and the values of query parameters in URLs like that of an event broker are replaced with xxxxx. So is a
+// user name without password, which is how tokens are passed in URLs like nats://token@host.
+func redactSetting(name, value string) string {
+	switch name {
+	case PushTokenEnvName, WebhookTokenEnvName, DNSRegisterKeyEnvName:
+		return redacted
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" {
+		return value
+	}
+
+	if parsed.User == nil && parsed.RawQuery == "" {
+		return value
+	}
+
+	if parsed.User != nil {
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+		} else {
+			parsed.User = url.User(redacted)
+		}
+	}
+
+	if parsed.RawQuery != "" {
+		params := strings.Split(parsed.RawQuery, "&")
+		for i, param := range params {
+			if key, _, ok := strings.Cut(param, "="); ok {
+				params[i] = key + "=" + redacted
+			}
+		}
+
+		parsed.RawQuery = strings.Join(params, "&")
+	}
+
+	return parsed.String()
+}
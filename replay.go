@@ -0,0 +1,325 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errReplayExhausted is raised if the backend died before responding and no other backend could take over.
+var errReplayExhausted = errors.New("no backend left to replay to")
+
+// replayConfig configures replaying the first bytes of a client to another backend if its backend dies before
+// responding.
+type replayConfig struct {
+	// size is the number of bytes sent by the client that are kept for replay. Zero disables replaying.
+	size int
+	// destinations are tried in order if the backend dies before responding. If empty, retryDestinations are tried.
+	destinations []string
+}
+
+// parseDestinations sets destinations to the whitespace separated addresses in value.
+func (c *replayConfig) parseDestinations(value string) error {
+	c.destinations = strings.Fields(value)
+
+	return nil
+}
+
+// replayStream is the stream towards the backend of a connection that keeps what the client sent until the backend
+// responds. If the backend dies before, the next replay or retry destination is dialed and the kept bytes are sent
+// there, so the client does not notice. This is only safe for protocols whose first request is idempotent and
+// self-contained, like length-prefixed request/response protocols. Once the backend responded or the client sent more
+// than fits into the buffer, errors are passed on as usual. It is a net.Conn whose addresses and deadlines are those
+// of the current backend, and it counts the traffic of the current backend.
+type replayStream struct {
+	// ctx bounds dialing replacements.
+	ctx  context.Context
+	prx  *proxy
+	cfg  dialConfig
+	conn *connection
+	// mtx guards all fields below. It is held while a replacement is dialed.
+	mtx sync.Mutex
+	// backend is the current connection to the backend.
+	backend net.Conn
+	// counters count the traffic of the current backend.
+	counters *trafficCounters
+	// version counts the replacements of backend, so concurrent failures only dial one replacement.
+	version int
+	// kept holds what the client sent so far. Nil once replaying is not possible anymore.
+	kept []byte
+	// limit is the number of bytes kept at most.
+	limit int
+	// next are the destinations that have not been tried yet.
+	next []string
+	// writeClosed is set if the client shut down its writing side, so replacements get shut down as well.
+	writeClosed bool
+	// closed is set once the stream was closed.
+	closed bool
+}
+
+// newReplayStream wraps backend, the dialed backend of conn whose traffic counters is, in a replayStream configured by
+// cfg.
+func (p *proxy) newReplayStream(ctx context.Context, dialCfg dialConfig, cfg replayConfig, conn *connection,
+	backend net.Conn, counters *trafficCounters,
+) *replayStream {
+	next := cfg.destinations
+	if len(next) == 0 {
+		next = retryDestinations(dialCfg.network, conn.destination, backend.RemoteAddr())
+	}
+
+	return &replayStream{
+		ctx:      ctx,
+		prx:      p,
+		cfg:      dialCfg,
+		conn:     conn,
+		backend:  backend,
+		counters: counters,
+		kept:     make([]byte, 0, cfg.size),
+		limit:    cfg.size,
+		next:     next,
+	}
+}
+
+// retryDestinations returns the destinations tried if failed, the backend dialed for destination, dies before
+// responding and no replay destinations are configured: the alternatives of destination in the other address family
+// than failed, followed by destination itself. network is what addresses without prefix are dialed with.
+func retryDestinations(network, destination string, failed net.Addr) []string {
+	var retries []string
+
+	if addr, ok := failed.(*net.TCPAddr); ok {
+		failedIPv6 := addr.IP.To4() == nil
+
+		for _, alternative := range splitAlternatives(network, destination) {
+			if alternative != destination && isIPv6Destination(network, alternative) != failedIPv6 {
+				retries = append(retries, alternative)
+			}
+		}
+	}
+
+	return append(retries, destination)
+}
+
+// current returns the current backend, its version, its traffic counters and if replaying is still possible.
+func (s *replayStream) current() (net.Conn, int, *trafficCounters, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.backend, s.version, s.counters, s.kept != nil && !s.closed
+}
+
+// socket returns the current connection to the backend.
+func (s *replayStream) socket() net.Conn {
+	backend, _, _, _ := s.current()
+
+	return backend
+}
+
+// currentSocket returns the connection to the backend conn currently wraps if it is a replayStream, conn otherwise.
+func currentSocket(conn net.Conn) net.Conn {
+	if replay, ok := conn.(*replayStream); ok {
+		return replay.socket()
+	}
+
+	return conn
+}
+
+// Read reads from the backend. If the backend fails before sending anything, the kept bytes are replayed to the next
+// destination and reading continues there. A backend that closes the connection without sending anything answered
+// that way, so it is not replayed.
+func (s *replayStream) Read(p []byte) (int, error) {
+	for {
+		backend, version, counters, replayable := s.current()
+
+		n, err := backend.Read(p)
+		atomic.AddInt64(&counters.sent, int64(n))
+
+		if n > 0 || errors.Is(err, io.EOF) {
+			s.mtx.Lock()
+			s.kept = nil
+			s.mtx.Unlock()
+
+			return n, err
+		}
+
+		if err == nil || !replayable {
+			return n, err
+		}
+
+		if replayErr := s.replace(version, err); replayErr != nil {
+			return 0, replayErr
+		}
+	}
+}
+
+// Write writes p to the backend and keeps it for replaying if it fits. If the backend fails, the kept bytes are
+// replayed to the next destination and the write is retried there.
+func (s *replayStream) Write(p []byte) (int, error) {
+	s.mtx.Lock()
+	if s.kept != nil {
+		if len(s.kept)+len(p) > s.limit {
+			s.kept = nil
+		} else {
+			s.kept = append(s.kept, p...)
+		}
+	}
+	s.mtx.Unlock()
+
+	backend, version, counters, replayable := s.current()
+
+	n, err := backend.Write(p)
+	atomic.AddInt64(&counters.received, int64(n))
+
+	if err == nil || !replayable {
+		return n, err
+	}
+
+	// p is part of the kept bytes, so the replacement got it already.
+	if err := s.replace(version, err); err != nil {
+		return n, err
+	}
+
+	return len(p), nil
+}
+
+// replace dials the next destination after backend version failed with cause and replays the kept bytes to it. Nothing
+// happens if backend was replaced already. If no destination is left, cause is returned.
+func (s *replayStream) replace(version int, cause error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.version != version {
+		return nil
+	}
+
+	if s.closed || s.kept == nil {
+		return cause
+	}
+
+	_ = s.backend.Close()
+
+	for len(s.next) != 0 {
+		addr := s.next[0]
+		s.next = s.next[1:]
+
+		backend, err := s.prx.dialOnce(s.ctx, s.cfg, s.conn, addr)
+		if err != nil {
+			s.prx.log.Error(err, "couldn't dial replay destination", "id", s.conn.id, "destination", addr)
+
+			continue
+		}
+
+		if err := s.replay(backend); err != nil {
+			_ = backend.Close()
+			s.prx.log.Error(err, "couldn't replay to destination", "id", s.conn.id, "destination", addr)
+
+			continue
+		}
+
+		s.prx.log.Info("backend failed before responding, replayed connection", "id", s.conn.id, "destination", addr,
+			"reason", cause.Error())
+
+		s.backend = backend
+		s.version++
+		s.conn.setBackend(backend.RemoteAddr().String())
+		s.counters = s.prx.backendTraffic.get(backend.RemoteAddr().String())
+		atomic.AddInt64(&s.counters.connections, 1)
+		atomic.AddInt64(&s.counters.received, int64(len(s.kept)))
+
+		return nil
+	}
+
+	s.kept = nil
+
+	return fmt.Errorf("%w: %v", errReplayExhausted, cause)
+}
+
+// replay sends the kept bytes to backend and shuts down its writing side if the client did so already.
+func (s *replayStream) replay(backend net.Conn) error {
+	if _, err := backend.Write(s.kept); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if s.writeClosed {
+		if err := closeWrite(backend); err != nil {
+			return fmt.Errorf("close write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the backend.
+func (s *replayStream) CloseWrite() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.writeClosed = true
+
+	return closeWrite(s.backend)
+}
+
+// Close closes the backend. It is not replaced anymore afterwards.
+func (s *replayStream) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.closed = true
+
+	return s.backend.Close()
+}
+
+// LocalAddr returns the local address of the current backend connection.
+func (s *replayStream) LocalAddr() net.Addr {
+	return s.socket().LocalAddr()
+}
+
+// RemoteAddr returns the address of the current backend.
+func (s *replayStream) RemoteAddr() net.Addr {
+	return s.socket().RemoteAddr()
+}
+
+// SetDeadline sets the deadline of the current backend connection. Replacements do not inherit deadlines.
+func (s *replayStream) SetDeadline(t time.Time) error {
+	if err := s.socket().SetDeadline(t); err != nil {
+		return fmt.Errorf("set backend deadline: %w", err)
+	}
+
+	return nil
+}
+
+// SetReadDeadline sets the read deadline of the current backend connection.
+func (s *replayStream) SetReadDeadline(t time.Time) error {
+	if err := s.socket().SetReadDeadline(t); err != nil {
+		return fmt.Errorf("set backend read deadline: %w", err)
+	}
+
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the current backend connection.
+func (s *replayStream) SetWriteDeadline(t time.Time) error {
+	if err := s.socket().SetWriteDeadline(t); err != nil {
+		return fmt.Errorf("set backend write deadline: %w", err)
+	}
+
+	return nil
+}
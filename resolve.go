@@ -0,0 +1,167 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lookupTimeout limits how long a single host name lookup may take. Lookups are shared by several connections, so
+// they do not use the context of any of them.
+const lookupTimeout = 10 * time.Second
+
+// errNoAddresses is raised if a host name has no addresses.
+var errNoAddresses = errors.New("no addresses")
+
+// Resolver resolves host names of destinations and the names of client addresses for the access log. *net.Resolver
+// implements it. Embedders can pass their own with WithResolver, like one that caches, synthesizes DNS64 addresses
+// or asks a service discovery, or one that answers from a table in tests.
+type Resolver interface {
+	// LookupIP returns the addresses of host for network, which is ip, ip4 or ip6.
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	// LookupAddr returns the names of the IP address addr.
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// WithResolver makes Run and RunWithConfig resolve names with resolver instead of net.DefaultResolver. Results are
+// still coalesced and cached as configured.
+func WithResolver(resolver Resolver) Option {
+	return func(opts *options) {
+		opts.resolver = resolver
+	}
+}
+
+// lookup is a host name lookup that is in flight or whose result is still cached.
+type lookup struct {
+	// done is closed once ips and err are set.
+	done chan struct{}
+	ips  []net.IP
+	err  error
+	// expires is the time the result may be used until. Only accessed with the mutex of the resolver held.
+	expires time.Time
+}
+
+// resolver resolves host names of destinations. Concurrent lookups of the same name are coalesced, so a burst of
+// accepted connections causes a single query, and results may be cached for a short time.
+type resolver struct {
+	// upstream does the lookups.
+	upstream Resolver
+	// clock tells when cached results expire.
+	clock   Clock
+	mtx     sync.Mutex
+	lookups map[string]*lookup
+}
+
+// newResolver creates a resolver without cached results that looks up names with upstream, net.DefaultResolver if
+// nil, and expires them on clock.
+func newResolver(upstream Resolver, clock Clock) *resolver {
+	if upstream == nil {
+		upstream = net.DefaultResolver
+	}
+
+	return &resolver{upstream: upstream, clock: clock, lookups: map[string]*lookup{}}
+}
+
+// lookupIP returns the addresses of host for network, ip, ip4 or ip6. The result is cached for ttl, which may be zero.
+func (r *resolver) lookupIP(ctx context.Context, network, host string, ttl time.Duration) ([]net.IP, error) {
+	key := network + " " + host
+
+	r.mtx.Lock()
+	entry, ok := r.lookups[key]
+
+	if !ok || (!entry.expires.IsZero() && r.clock.Now().After(entry.expires)) {
+		entry = &lookup{done: make(chan struct{})}
+		r.lookups[key] = entry
+
+		go r.resolve(key, entry, network, host, ttl)
+	}
+	r.mtx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("lookup %s: %w", host, ctx.Err())
+	case <-entry.done:
+		return entry.ips, entry.err
+	}
+}
+
+// resolve looks up host for network and stores the result in entry, which is cached under key for ttl if the lookup
+// succeeded.
+func (r *resolver) resolve(key string, entry *lookup, network, host string, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	entry.ips, entry.err = r.upstream.LookupIP(ctx, network, host)
+	if entry.err != nil {
+		entry.err = fmt.Errorf("lookup %s: %w", host, entry.err)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if entry.err != nil || ttl <= 0 {
+		if r.lookups[key] == entry {
+			delete(r.lookups, key)
+		}
+	} else {
+		entry.expires = r.clock.Now().Add(ttl)
+	}
+
+	close(entry.done)
+}
+
+// dial connects to addr, a host:port address, with network, tcp, tcp4 or tcp6. If the host is a name, it is resolved
+// with r and the addresses are dialed in order until one succeeds.
+func (r *resolver) dial(ctx context.Context, network, addr string, ttl time.Duration,
+	dial func(ctx context.Context, addr string) (net.Conn, error),
+) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, addr)
+	}
+
+	ips, err := r.lookupIP(ctx, strings.Replace(network, "tcp", "ip", 1), host, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+
+	for _, ip := range ips {
+		conn, err := dial(ctx, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = fmt.Errorf("lookup %s: %w", host, errNoAddresses)
+	}
+
+	return nil, firstErr
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reverseLookupTimeout limits how long a single PTR lookup may take.
+	reverseLookupTimeout = 2 * time.Second
+	// reverseCacheTTL is how long results of PTR lookups, including failed ones, are kept.
+	reverseCacheTTL = 10 * time.Minute
+	// reverseCacheSize is the number of addresses whose results are kept at most.
+	reverseCacheSize = 4096
+	// reverseLookupConcurrency is the number of PTR lookups that may be in flight at once. Further lookups are
+	// skipped.
+	reverseLookupConcurrency = 16
+)
+
+// reverseEntry is the result of a PTR lookup, or a lookup in flight.
+type reverseEntry struct {
+	// name is the first name the address resolved to. Empty if the lookup failed or is in flight.
+	name string
+	// expires is the time the entry is dropped. Zero while the lookup is in flight.
+	expires time.Time
+}
+
+// reverseResolver looks up the names of client addresses for the access log. Lookups happen in the background and
+// never delay connections; an entry only gets a name if it was known by the time it is written. The number of
+// lookups in flight and cached results are bounded, so a flood of clients can not exhaust resources.
+type reverseResolver struct {
+	// upstream does the lookups.
+	upstream Resolver
+	// clock tells when cached names expire.
+	clock   Clock
+	mtx     sync.Mutex
+	entries map[string]reverseEntry
+	// slots bounds the lookups in flight.
+	slots chan struct{}
+}
+
+// newReverseResolver creates a reverseResolver with an empty cache that looks up names with upstream,
+// net.DefaultResolver if nil, and expires names on clock.
+func newReverseResolver(upstream Resolver, clock Clock) *reverseResolver {
+	if upstream == nil {
+		upstream = net.DefaultResolver
+	}
+
+	return &reverseResolver{
+		upstream: upstream,
+		clock:    clock,
+		entries:  map[string]reverseEntry{},
+		slots:    make(chan struct{}, reverseLookupConcurrency),
+	}
+}
+
+// prefetch starts looking up the name of the IP address of addr unless it is known, being looked up or too many
+// lookups are in flight. Addresses that are not IP addresses are ignored.
+func (r *reverseResolver) prefetch(addr net.Addr) {
+	ip := addrIP(addr)
+	if ip == nil {
+		return
+	}
+
+	key := ip.String()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if entry, ok := r.entries[key]; ok && (entry.expires.IsZero() || r.clock.Now().Before(entry.expires)) {
+		return
+	}
+
+	if len(r.entries) >= reverseCacheSize && !r.evict() {
+		return
+	}
+
+	select {
+	case r.slots <- struct{}{}:
+	default:
+		return
+	}
+
+	r.entries[key] = reverseEntry{}
+
+	go r.lookup(key)
+}
+
+// lookup resolves the name of the IP address key and stores the result.
+func (r *reverseResolver) lookup(key string) {
+	defer func() { <-r.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+	defer cancel()
+
+	var name string
+	if names, err := r.upstream.LookupAddr(ctx, key); err == nil && len(names) != 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.entries[key] = reverseEntry{name: name, expires: r.clock.Now().Add(reverseCacheTTL)}
+}
+
+// evict drops expired entries and returns if that made room for another one. Must be called with mtx held.
+func (r *reverseResolver) evict() bool {
+	now := r.clock.Now()
+
+	for key, entry := range r.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(r.entries, key)
+		}
+	}
+
+	return len(r.entries) < reverseCacheSize
+}
+
+// name returns the name of the IP address of addr if it is known already. It never waits for a lookup.
+func (r *reverseResolver) name(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.entries[ip.String()].name
+}
+
+// addrIP returns the IP address of addr. Nil if addr is no TCP or UDP address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
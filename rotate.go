@@ -0,0 +1,259 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// rotatedTimeFormat is appended to the path of rotated files. It sorts lexically in chronological order.
+	rotatedTimeFormat = "20060102T150405.000000000"
+	// compressedSuffix is appended to rotated files after they have been compressed.
+	compressedSuffix = ".gz"
+	// rotateFileMode is the permission set for newly created files.
+	rotateFileMode = 0o600
+)
+
+// rotateConfig describes when a rotatingFile is rotated and what happens to the rotated files.
+type rotateConfig struct {
+	// path of the file that is currently written to.
+	path string
+	// maxSize is the size in bytes after which the file is rotated. Zero disables size based rotation.
+	maxSize int64
+	// maxAge is the duration after which the file is rotated. Zero disables time based rotation.
+	maxAge time.Duration
+	// maxBackups is the number of rotated files that are kept. Zero keeps all of them.
+	maxBackups int
+	// compress enables gzip compression of rotated files.
+	compress bool
+}
+
+// rotatingFile is an io.WriteCloser that appends to a file and rotates it according to its rotateConfig. Rotated
+// files get the time of rotation appended to their name. Compression and removal of old files happens in the
+// background. Errors of these background jobs are logged since there is nobody to return them to.
+type rotatingFile struct {
+	cfg    rotateConfig
+	log    logr.Logger
+	clock  Clock
+	mtx    sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	jobs   sync.WaitGroup
+}
+
+// openRotatingFile opens the file described by cfg for appending. Its age and the names of rotated files are taken
+// from clock.
+func openRotatingFile(log logr.Logger, cfg rotateConfig, clock Clock) (*rotatingFile, error) {
+	file := &rotatingFile{cfg: cfg, log: log, clock: clock}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// open (re)opens the file at the configured path and resets the rotation state.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.cfg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, rotateFileMode)
+	if err != nil {
+		return fmt.Errorf("open rotating file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return fmt.Errorf("stat rotating file: %w", err)
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), f.clock.Now()
+
+	return nil
+}
+
+// Write appends p to the file. The file is rotated before if writing p would exceed the configured size or if the
+// file is older than the configured age.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooLarge := f.cfg.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.cfg.maxSize
+	tooOld := f.cfg.maxAge > 0 && f.clock.Now().Sub(f.opened) >= f.cfg.maxAge
+
+	if tooLarge || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	if err != nil {
+		return n, fmt.Errorf("write rotating file: %w", err)
+	}
+
+	return n, nil
+}
+
+// rotate renames the current file, opens a new one and dispatches the cleanup of rotated files.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("close rotating file: %w", err)
+	}
+
+	f.file = nil
+	rotated := f.cfg.path + "." + f.clock.Now().UTC().Format(rotatedTimeFormat)
+
+	if err := os.Rename(f.cfg.path, rotated); err != nil {
+		return fmt.Errorf("rename rotating file: %w", err)
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.jobs.Add(1)
+
+	go func() {
+		defer f.jobs.Done()
+
+		if f.cfg.compress {
+			if err := compressFile(rotated); err != nil {
+				f.log.Error(err, "could not compress rotated file", "path", rotated)
+			}
+		}
+
+		if err := f.prune(); err != nil {
+			f.log.Error(err, "could not remove old rotated files")
+		}
+	}()
+
+	return nil
+}
+
+// prune removes the oldest rotated files until only the configured amount is left.
+func (f *rotatingFile) prune() error {
+	if f.cfg.maxBackups <= 0 {
+		return nil
+	}
+
+	rotated, err := filepath.Glob(f.cfg.path + ".*")
+	if err != nil {
+		return fmt.Errorf("list rotated files: %w", err)
+	}
+
+	sort.Strings(rotated)
+
+	for len(rotated) > f.cfg.maxBackups {
+		if err := os.Remove(rotated[0]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove rotated file: %w", err)
+		}
+
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+// Sync commits the content of the current file to the storage.
+func (f *rotatingFile) Sync() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("sync rotating file: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the file and waits for background jobs to finish.
+func (f *rotatingFile) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.jobs.Wait()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	if err != nil {
+		return fmt.Errorf("close rotating file: %w", err)
+	}
+
+	return nil
+}
+
+// compressFile writes the gzip compressed content of the file at path to path with compressedSuffix appended
+// and removes the original afterwards.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+compressedSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, rotateFileMode)
+	if err != nil {
+		return fmt.Errorf("create compressed file: %w", err)
+	}
+
+	writer := gzip.NewWriter(dst)
+
+	if _, err := io.Copy(writer, src); err != nil {
+		_ = dst.Close()
+
+		return fmt.Errorf("compress file: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		_ = dst.Close()
+
+		return fmt.Errorf("flush compressed file: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("close compressed file: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove uncompressed file: %w", err)
+	}
+
+	return nil
+}
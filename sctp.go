@@ -0,0 +1,26 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import "errors"
+
+const (
+	// sctpPrefix starts addresses of SCTP destinations like sctp:[2001:db8::1]:3868.
+	sctpPrefix = "sctp:"
+	// sctpNetwork is the network name StaticBind takes for SCTP. sctp4 and sctp6 restrict the address family.
+	sctpNetwork = "sctp"
+)
+
+// errSCTPUnsupported is raised if SCTP is used on a platform that does not support it.
+var errSCTPUnsupported = errors.New("SCTP is only supported on linux")
@@ -0,0 +1,129 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sctpSocket creates a non-blocking one-to-one SCTP socket for the family of ip and returns it with the socket address
+// of ip and port.
+func sctpSocket(ip net.IP, port int) (int, unix.Sockaddr, error) {
+	inet6 := &unix.SockaddrInet6{Port: port}
+	copy(inet6.Addr[:], ip.To16())
+
+	family, sa := unix.AF_INET6, unix.Sockaddr(inet6)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		inet4 := &unix.SockaddrInet4{Port: port}
+		copy(inet4.Addr[:], ip4)
+		family, sa = unix.AF_INET, inet4
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		return 0, nil, fmt.Errorf("SCTP socket: %w", err)
+	}
+
+	return fd, sa, nil
+}
+
+// dialSCTP connects to addr, a host:port address, via SCTP. The returned connection is a *net.TCPConn since one-to-one
+// SCTP sockets behave like TCP ones as far as the net package is concerned.
+func dialSCTP(ctx context.Context, addr string) (net.Conn, error) {
+	resolved, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve SCTP address: %w", err)
+	}
+
+	fd, sa, err := sctpSocket(resolved.IP, resolved.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Connect(fd, sa)
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("SCTP connect: %w", err)
+	}
+
+	file := os.NewFile(uintptr(fd), sctpNetwork)
+	defer file.Close()
+
+	if err != nil {
+		if err := awaitConnect(ctx, file); err != nil {
+			return nil, fmt.Errorf("SCTP %w", err)
+		}
+	}
+
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("SCTP connection: %w", err)
+	}
+
+	return conn, nil
+}
+
+// listenSCTP binds to addr, a host:port address, and listens on it via SCTP. network is sctp, sctp4 or sctp6 and
+// restricts the address family like tcp4 and tcp6 do for net.Listen.
+func listenSCTP(network, addr string) (net.Listener, error) {
+	resolved, err := net.ResolveTCPAddr(strings.Replace(network, sctpNetwork, "tcp", 1), addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve SCTP address: %w", err)
+	}
+
+	ip := resolved.IP
+	if ip == nil {
+		ip = net.IPv6unspecified
+
+		if network == sctpNetwork+"4" {
+			ip = net.IPv4zero
+		}
+	}
+
+	fd, sa, err := sctpSocket(ip, resolved.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(fd), sctpNetwork)
+	defer file.Close()
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return nil, fmt.Errorf("SCTP reuse address: %w", err)
+	}
+
+	if err := unix.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("SCTP bind: %w", err)
+	}
+
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		return nil, fmt.Errorf("SCTP listen: %w", err)
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("SCTP listener: %w", err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// errNoListener is raised if Proxy.Serve is not told where to accept connections from.
+var errNoListener = errors.New("no listener, pass one with WithListener or WithSocketProvider or set listen addresses")
+
+// Dialer connects to destinations, like *net.Dialer or a dialer that tunnels through another network.
+type Dialer interface {
+	// DialContext connects to address on network, which is tcp, tcp4, tcp6 or unix. TCP addresses are IP addresses
+	// with port since host names are resolved beforehand.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// WithDialer makes tcp4to6 connect to TCP and unix destinations with dialer instead of its own dialer. Socket options
+// for backend connections like the flow label, MSS, hop limit and source interface are not applied then. vsock and
+// SCTP destinations are dialed as usual.
+func WithDialer(dialer Dialer) Option {
+	return func(opts *options) {
+		opts.dialer = dialer
+	}
+}
+
+// WithSetting sets the setting with the environment variable name to value, e.g. WithSetting(MSSEnvName, "1400").
+// Proxy.Serve reads its configuration only from these settings. Run lets them override the environment. Config files
+// named by ConfigFileEnvName are read either way. RunWithConfig and RunWithListener ignore them since they are given
+// their configuration.
+func WithSetting(name, value string) Option {
+	return func(opts *options) {
+		if opts.settings == nil {
+			opts.settings = map[string]string{}
+		}
+
+		opts.settings[name] = value
+	}
+}
+
+// WithDestination sets the address accepted connections are forwarded to, see ToAddrEnvName.
+func WithDestination(addr string) Option {
+	return WithSetting(ToAddrEnvName, addr)
+}
+
+// WithHandshakeTimeout sets the time accepted connections get until they are bridged, see HandshakeTimeoutEnvName.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return WithSetting(HandshakeTimeoutEnvName, timeout.String())
+}
+
+// WithListener makes Proxy.Serve and Run accept connections from listener. It is closed when they return.
+func WithListener(listener net.Listener) Option {
+	return WithSocketProvider(FixedListeners{listener})
+}
+
+// WithLogger sets the logger of Proxy.Serve. Run and its variants take theirs as argument instead.
+func WithLogger(log logr.Logger) Option {
+	return func(opts *options) {
+		opts.log = log
+	}
+}
+
+// settingsLookup returns a lookupFunc that returns the values of settings and those of fallback for all others.
+// fallback may be nil.
+func settingsLookup(settings map[string]string, fallback lookupFunc) lookupFunc {
+	return func(name string) (string, bool) {
+		if value, ok := settings[name]; ok {
+			return value, true
+		}
+
+		if fallback == nil {
+			return "", false
+		}
+
+		return fallback(name)
+	}
+}
+
+// Serve runs p with the options it was created with until ctx is canceled, like Run but without reading the
+// environment or taking sockets from systemd:
+//
+//	proxy := tcpto6.NewProxy(tcpto6.WithListener(listener), tcpto6.WithDestination("[::1]:8080"),
+//		tcpto6.WithHandshakeTimeout(5*time.Second), tcpto6.WithLogger(log))
+//	err := proxy.Serve(ctx)
+//
+// The configuration is read from the settings given by WithSetting and its shorthands, which need at least a
+// destination. The listener is the one of WithListener or WithSocketProvider, or bound to the addresses of
+// ListenAddrEnvName. The methods of p control the run as usual. Serve can only be called once.
+func (p *Proxy) Serve(ctx context.Context) error {
+	opts := collectOptions(p.opts)
+
+	cfg, err := LoadConfig(settingsLookup(opts.settings, nil))
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	if opts.sockets == nil && len(cfg.listenAddrs) == 0 && cfg.forwardedFD == noForwardedFD {
+		return errNoListener
+	}
+
+	log := opts.log
+	if log.GetSink() == nil {
+		log = logr.Discard()
+	}
+
+	return RunWithConfig(ctx, log, cfg, append(p.opts[:len(p.opts):len(p.opts)], WithProxy(p))...)
+}
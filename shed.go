@@ -0,0 +1,252 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cgroupRoot is where the unified cgroup hierarchy is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+	// procSelfCgroup lists the cgroups of the process.
+	procSelfCgroup = "/proc/self/cgroup"
+	// unknownLoad is the value of cgroupLoad fields that could not be read.
+	unknownLoad = -1
+)
+
+var (
+	// errNoUnifiedCgroup is raised if the process is not part of a cgroup v2 hierarchy.
+	errNoUnifiedCgroup = errors.New("process is not in a cgroup v2 hierarchy")
+	// errPressureFormat is raised if a pressure stall information file can not be parsed.
+	errPressureFormat = errors.New("pressure stall information has no some line")
+)
+
+// shedConfig configures when new connections are shed because the cgroup of tcp4to6 or one of its parents, like the
+// slice it runs in, is under resource pressure. Thresholds of zero are disabled.
+type shedConfig struct {
+	// interval is the time between two checks of the cgroups.
+	interval time.Duration
+	// memoryPressure is the percentage of time some tasks stalled on memory within the last ten seconds at which
+	// connections are shed.
+	memoryPressure int
+	// pidsUsage is the percentage of the task limit in use at which connections are shed.
+	pidsUsage int
+}
+
+// enabled reports if any threshold is configured.
+func (c shedConfig) enabled() bool {
+	return c.memoryPressure > 0 || c.pidsUsage > 0
+}
+
+// cgroupLoad is the resource pressure of a single cgroup.
+type cgroupLoad struct {
+	// path is the path of the cgroup within the hierarchy, like /system.slice.
+	path string
+	// memoryPressure is the percentage of time some tasks stalled on memory within the last ten seconds.
+	// unknownLoad if the memory controller is not enabled.
+	memoryPressure float64
+	// pidsUsage is the percentage of the task limit in use. unknownLoad if there is no limit.
+	pidsUsage int64
+}
+
+// watchShed checks the cgroups against the thresholds of cfg each interval until ctx is canceled and sets
+// p.shedding while one is exceeded. When shedding starts or stops, the change is logged and shown as unit status.
+// Connections are not shed while the cgroups can not be read.
+func (p *proxy) watchShed(ctx context.Context, cfg shedConfig) {
+	ticker := p.clock.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	shedding, failing := false, false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		loads, err := readCgroupLoads()
+		if err != nil && !failing {
+			p.log.Error(err, "couldn't read cgroup pressure, not shedding connections until it can be read again")
+		}
+
+		failing = err != nil
+		reasons := checkShed(cfg, loads)
+
+		switch {
+		case len(reasons) != 0 && !shedding:
+			atomic.StoreInt32(&p.shedding, 1)
+			p.log.Info("shedding new connections", "event", "shedding", "reasons", reasons)
+			p.notifyStatus("shedding new connections: " + strings.Join(reasons, ", "))
+
+			shedding = true
+		case len(reasons) == 0 && shedding:
+			atomic.StoreInt32(&p.shedding, 0)
+			p.log.Info("accepting new connections again", "event", "accepting",
+				"shed", atomic.LoadInt64(&p.stats.shed))
+			p.notifyStatus(fmt.Sprintf("running version %d", p.generation().version))
+
+			shedding = false
+		}
+	}
+}
+
+// checkShed returns descriptions of the thresholds of cfg that loads exceed.
+func checkShed(cfg shedConfig, loads []cgroupLoad) []string {
+	var reasons []string
+
+	for _, load := range loads {
+		if cfg.memoryPressure > 0 && load.memoryPressure >= float64(cfg.memoryPressure) {
+			reasons = append(reasons, fmt.Sprintf("memory pressure %.0f%% in %s", load.memoryPressure, load.path))
+		}
+
+		if cfg.pidsUsage > 0 && load.pidsUsage >= int64(cfg.pidsUsage) {
+			reasons = append(reasons, fmt.Sprintf("%d%% of tasks used in %s", load.pidsUsage, load.path))
+		}
+	}
+
+	return reasons
+}
+
+// readCgroupLoads returns the load of the cgroup of the process and all its parents up to the root.
+func readCgroupLoads() ([]cgroupLoad, error) {
+	path, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	var loads []cgroupLoad
+
+	for {
+		load, err := readCgroupLoad(path)
+		if err != nil {
+			return nil, err
+		}
+
+		loads = append(loads, load)
+
+		if path == "/" {
+			return loads, nil
+		}
+
+		path = filepath.Dir(path)
+	}
+}
+
+// ownCgroup returns the path of the cgroup v2 the process is in.
+func ownCgroup() (string, error) {
+	file, err := os.Open(procSelfCgroup)
+	if err != nil {
+		return "", fmt.Errorf("read own cgroup: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path := strings.TrimPrefix(scanner.Text(), "0::"); path != scanner.Text() {
+			return filepath.Clean(path), nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read own cgroup: %w", err)
+	}
+
+	return "", errNoUnifiedCgroup
+}
+
+// readCgroupLoad reads the load of the cgroup at path. Controllers that are not enabled for it are left unknown.
+func readCgroupLoad(path string) (cgroupLoad, error) {
+	load := cgroupLoad{path: path, memoryPressure: unknownLoad, pidsUsage: unknownLoad}
+	dir := filepath.Join(cgroupRoot, path)
+
+	pressure, err := os.ReadFile(filepath.Join(dir, "memory.pressure"))
+
+	switch {
+	case err == nil:
+		if load.memoryPressure, err = parsePressure(string(pressure)); err != nil {
+			return load, fmt.Errorf("memory pressure of %s: %w", path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return load, fmt.Errorf("read memory pressure: %w", err)
+	}
+
+	current, err := readCgroupValue(dir, "pids.current")
+	if err != nil || current == unknownLoad {
+		return load, err
+	}
+
+	limit, err := readCgroupValue(dir, "pids.max")
+	if err != nil || limit <= 0 {
+		return load, err
+	}
+
+	load.pidsUsage = current * percent / limit
+
+	return load, nil
+}
+
+// parsePressure returns the avg10 value of the some line of a pressure stall information file.
+func parsePressure(content string) (float64, error) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" || !strings.HasPrefix(fields[1], "avg10=") {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse avg10: %w", err)
+		}
+
+		return value, nil
+	}
+
+	return 0, errPressureFormat
+}
+
+// readCgroupValue reads the number in the file name of the cgroup directory dir. unknownLoad is returned if the
+// file does not exist or contains max.
+func readCgroupValue(dir, name string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return unknownLoad, nil
+	case err != nil:
+		return 0, fmt.Errorf("read %s: %w", name, err)
+	}
+
+	value := strings.TrimSpace(string(content))
+	if value == "max" {
+		return unknownLoad, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", name, err)
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,339 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dev.eqrx.net/tcpto6"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// soakWarmup is the number of connections bridged before the baseline is taken, so pools and lazily started
+	// goroutines exist already.
+	soakWarmup = 100
+	// soakConnTimeout bounds each connection, so one that hangs fails the run instead of blocking it.
+	soakConnTimeout = 30 * time.Second
+	// soakPollInterval is the time between two looks at the resources of the process.
+	soakPollInterval = 100 * time.Millisecond
+	// soakHeapSlack is how much the heap may grow over the baseline without counting as leaked.
+	soakHeapSlack = 16 << 20
+)
+
+// Connections of the soak test end in different ways to run through the different paths of the proxy.
+const (
+	// soakEcho sends the payload and reads it back.
+	soakEcho = iota
+	// soakAbortRead sends the payload and closes before reading anything.
+	soakAbortRead
+	// soakAbortWrite closes right after connecting.
+	soakAbortWrite
+	// soakKinds is the number of ways a connection ends.
+	soakKinds
+)
+
+var (
+	soakConns       = flag.Int("soak.conns", 10000, "number of connections the soak test churns through the proxy")
+	soakConcurrency = flag.Int("soak.concurrency", 64, "number of connections the soak test opens at the same time")
+	soakPayload     = flag.Int("soak.payload", 16<<10, "bytes echoed on each connection of the soak test")
+	soakSettle      = flag.Duration("soak.settle", 10*time.Second, "time resources get to return to their baseline")
+)
+
+var (
+	// errLeak is raised if resources did not return to their baseline after all connections were done.
+	errLeak = errors.New("resources were not released")
+	// errEchoMismatch is raised if the backend did not echo what was sent through the proxy.
+	errEchoMismatch = errors.New("echo does not match payload")
+)
+
+// soakCounts are the resources of the process that must return to their baseline once all connections are done.
+type soakCounts struct {
+	goroutines int
+	fds        int
+	heap       uint64
+}
+
+// exceeds returns descriptions of the counts that are above those of baseline.
+func (c soakCounts) exceeds(baseline soakCounts) []string {
+	var leaks []string
+
+	if c.goroutines > baseline.goroutines {
+		leaks = append(leaks, fmt.Sprintf("%d goroutines instead of %d", c.goroutines, baseline.goroutines))
+	}
+
+	if c.fds > baseline.fds {
+		leaks = append(leaks, fmt.Sprintf("%d file descriptors instead of %d", c.fds, baseline.fds))
+	}
+
+	if c.heap > baseline.heap+soakHeapSlack {
+		leaks = append(leaks, fmt.Sprintf("%d bytes of heap instead of %d", c.heap, baseline.heap))
+	}
+
+	return leaks
+}
+
+// takeCounts collects garbage and returns the resources the process uses.
+func takeCounts() (soakCounts, error) {
+	runtime.GC()
+
+	var mem runtime.MemStats
+
+	runtime.ReadMemStats(&mem)
+
+	fds, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return soakCounts{}, fmt.Errorf("count file descriptors: %w", err)
+	}
+
+	return soakCounts{goroutines: runtime.NumGoroutine(), fds: len(fds), heap: mem.HeapAlloc}, nil
+}
+
+// TestSoak churns connections through a proxy running in the test to an echo backend, once over TCP and once over
+// unix sockets, and fails if goroutines, file descriptors or heap do not return to the baseline taken after a warmup.
+func TestSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test skipped in short mode")
+	}
+
+	for _, network := range []string{"tcp", "unix"} {
+		network := network
+
+		t.Run(network, func(t *testing.T) { soak(t, network) })
+	}
+}
+
+// soak runs the soak test with the proxy and the backend listening on network.
+func soak(t *testing.T, network string) {
+	dir := t.TempDir()
+
+	backend := soakListen(t, network, "[::1]:0", filepath.Join(dir, "backend"))
+	frontend := soakListen(t, network, "127.0.0.1:0", filepath.Join(dir, "proxy"))
+
+	go serveEcho(backend)
+
+	destination := backend.Addr().String()
+	if network == "unix" {
+		destination = "unix:" + destination
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxied := make(chan error, 1)
+
+	go func() { proxied <- tcpto6.RunWithListener(ctx, logr.Discard(), frontend, destination) }()
+
+	dial := func() (net.Conn, error) { return net.Dial(network, frontend.Addr().String()) }
+
+	if err := churn(dial, soakWarmup, *soakConcurrency, *soakPayload); err != nil {
+		t.Fatalf("warmup: %v", err)
+	}
+
+	baseline, err := waitStable(*soakSettle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("baseline: %d goroutines, %d fds, %d bytes of heap", baseline.goroutines, baseline.fds, baseline.heap)
+
+	started := time.Now()
+
+	if err := churn(dial, *soakConns, *soakConcurrency, *soakPayload); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("churned %d connections in %s", *soakConns, time.Since(started).Round(time.Millisecond))
+
+	counts, leaks, err := waitBaseline(baseline, *soakSettle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leaks) != 0 {
+		_ = pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+
+		t.Fatalf("%v: %v", errLeak, leaks)
+	}
+
+	t.Logf("back at baseline: %d goroutines, %d fds, %d bytes of heap", counts.goroutines, counts.fds, counts.heap)
+
+	cancel()
+
+	if err := <-proxied; err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+}
+
+// soakListen listens on network, at path for unix sockets and at address otherwise. The listener is closed when the
+// test ends.
+func soakListen(t *testing.T, network, address, path string) net.Listener {
+	t.Helper()
+
+	if network == "unix" {
+		address = path
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return listener
+}
+
+// serveEcho sends everything received on connections accepted from listener back until listener is closed.
+func serveEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// churn opens count connections with dial, concurrency at a time, and ends them in all ways the soak test knows. It
+// returns the first error of a connection that was supposed to echo its payload.
+func churn(dial func() (net.Conn, error), count, concurrency, size int) error {
+	payload := bytes.Repeat([]byte("tcp4to6 "), size/len("tcp4to6 ")+1)[:size]
+
+	var (
+		next     int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := atomic.AddInt64(&next, 1) - 1; i < int64(count); i = atomic.AddInt64(&next, 1) - 1 {
+				if err := soakConn(dial, int(i%soakKinds), payload); err != nil {
+					errOnce.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// soakConn opens a connection with dial and ends it as kind says. Only connections of kind soakEcho report errors,
+// the others are expected to fail somewhere.
+func soakConn(dial func() (net.Conn, error), kind int, payload []byte) error {
+	conn, err := dial()
+	if err != nil {
+		return fmt.Errorf("dial proxy: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(soakConnTimeout)); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	switch kind {
+	case soakAbortWrite:
+		return nil
+	case soakAbortRead:
+		_, _ = conn.Write(payload)
+
+		return nil
+	}
+
+	if _, err := conn.Write(payload); err != nil {
+		return fmt.Errorf("send payload: %w", err)
+	}
+
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		return fmt.Errorf("read echo: %w", err)
+	}
+
+	if !bytes.Equal(echo, payload) {
+		return errEchoMismatch
+	}
+
+	return nil
+}
+
+// waitStable waits up to settle until the goroutines and file descriptors stopped changing and returns the counts
+// then.
+func waitStable(settle time.Duration) (soakCounts, error) {
+	last, err := takeCounts()
+	if err != nil {
+		return last, err
+	}
+
+	for deadline := time.Now().Add(settle); time.Now().Before(deadline); {
+		time.Sleep(soakPollInterval)
+
+		counts, err := takeCounts()
+		if err != nil {
+			return counts, err
+		}
+
+		if counts.goroutines == last.goroutines && counts.fds == last.fds {
+			return counts, nil
+		}
+
+		last = counts
+	}
+
+	return last, nil
+}
+
+// waitBaseline waits up to settle for the resources of the process to return to baseline. It returns the last counts
+// and how they still exceed baseline.
+func waitBaseline(baseline soakCounts, settle time.Duration) (soakCounts, []string, error) {
+	for deadline := time.Now().Add(settle); ; {
+		counts, err := takeCounts()
+		if err != nil {
+			return counts, nil, err
+		}
+
+		leaks := counts.exceeds(baseline)
+		if len(leaks) == 0 || !time.Now().Before(deadline) {
+			return counts, leaks, nil
+		}
+
+		time.Sleep(soakPollInterval)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"net"
+	"strings"
+)
+
+// listenFDNamesEnvName is the name of the environment variable systemd passes the FileDescriptorName= of the sockets
+// in, separated by colons.
+const listenFDNamesEnvName = "LISTEN_FDNAMES"
+
+// keepSocketNames returns a lookupFunc like lookup that keeps returning the value listenFDNamesEnvName had when
+// keepSocketNames was called. Taking the sockets from systemd removes it from the environment, but reloads still need
+// it to find the destination of the socket.
+func keepSocketNames(lookup lookupFunc) lookupFunc {
+	names, ok := lookup(listenFDNamesEnvName)
+
+	return func(name string) (string, bool) {
+		if name == listenFDNamesEnvName {
+			return names, ok
+		}
+
+		return lookup(name)
+	}
+}
+
+// socketEnvName returns the name of the environment variable with the destination of the socket passed by systemd
+// with name, like TCPTO6_DEST_WEB_443 for a socket named web-443. Socket units name their sockets after themselves
+// unless FileDescriptorName= says otherwise, so tcp4to6@web-443.socket results in the same name. Empty if the socket
+// is not named.
+func socketEnvName(name string) string {
+	name = strings.TrimSuffix(name, ".socket")
+	if at := strings.IndexByte(name, '@'); at != -1 {
+		name = name[at+1:]
+	}
+
+	// systemd names sockets without FileDescriptorName= that are not taken from a socket unit like this.
+	if name = unescapeUnitName(name); name == "" || name == "unknown" || name == "connection" {
+		return ""
+	}
+
+	return SocketDestinationEnvPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// namedSocket is the name of a socket passed by systemd and the environment variable with its destination.
+type namedSocket struct {
+	name, envName string
+}
+
+// namedSockets returns the distinct names of the sockets passed by systemd in order, together with the environment
+// variables with their destinations, and if all sockets are named. Sockets of a unit with several listen addresses
+// share its name.
+func namedSockets(lookup lookupFunc) ([]namedSocket, bool) {
+	names, ok := lookup(listenFDNamesEnvName)
+	if !ok || names == "" {
+		return nil, false
+	}
+
+	var sockets []namedSocket
+
+	seen, allNamed := map[string]bool{}, true
+
+	for _, name := range strings.Split(names, ":") {
+		envName := socketEnvName(name)
+		if envName == "" {
+			allNamed = false
+
+			continue
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			sockets = append(sockets, namedSocket{name: name, envName: envName})
+		}
+	}
+
+	return sockets, allNamed
+}
+
+// socketDestinations maps the names of sockets passed by systemd to the destination of connections accepted on them.
+type socketDestinations map[string]string
+
+// socketAddr is the address a named socket is bound to.
+type socketAddr struct {
+	addr net.Addr
+	name string
+}
+
+// socketAddrs tells which named socket a connection was accepted on by its local address.
+type socketAddrs []socketAddr
+
+// newSocketAddrs returns the socketAddrs of listeners, whose names are at the same index in names. Listeners without
+// name are left out.
+func newSocketAddrs(listeners []net.Listener, names []string) socketAddrs {
+	var addrs socketAddrs
+
+	for i, listener := range listeners {
+		if i < len(names) && names[i] != "" {
+			addrs = append(addrs, socketAddr{addr: listener.Addr(), name: names[i]})
+		}
+	}
+
+	return addrs
+}
+
+// nameOf returns the name of the socket a connection with the local address local was accepted on. A TCP socket
+// bound to the unspecified address matches all addresses with its port, but one bound to the address itself is
+// preferred. Empty if no socket matches.
+func (a socketAddrs) nameOf(local net.Addr) string {
+	var wildcard string
+
+	for _, socket := range a {
+		socketTCP, isTCP := socket.addr.(*net.TCPAddr)
+		localTCP, ok := local.(*net.TCPAddr)
+
+		switch {
+		case !isTCP || !ok:
+			if socket.addr.Network() == local.Network() && socket.addr.String() == local.String() {
+				return socket.name
+			}
+		case socketTCP.Port != localTCP.Port:
+		case socketTCP.IP.Equal(localTCP.IP):
+			return socket.name
+		case socketTCP.IP.IsUnspecified() && wildcard == "":
+			wildcard = socket.name
+		}
+	}
+
+	return wildcard
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// maxHopLimit is the largest hop limit or TTL an IP packet can have.
+const maxHopLimit = 255
+
+var (
+	// errHopLimit is raised if a hop limit is out of range.
+	errHopLimit = errors.New("must be between 1 and 255")
+	// errDialNetwork is raised if backends are to be dialed with a network that is not supported.
+	errDialNetwork = errors.New("must be tcp, tcp4, tcp6 or unix")
+)
+
+// socketOptions are applied to the socket of a single TCP connection.
+type socketOptions struct {
+	// flowLabel is sent as IPv6 flow label unless zero.
+	flowLabel uint32
+	// hopLimit is the unicast hop limit or TTL unless zero.
+	hopLimit int
+	// mss4 and mss6 are the MSS IPv4 and IPv6 connections are clamped to unless zero.
+	mss4, mss6 int
+	// source is the local address IPv6 connections are sent from unless nil.
+	source net.IP
+}
+
+// checkDialNetwork fails if network can not be used to dial backends.
+func checkDialNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", errDialNetwork, network)
+	}
+}
+
+// splitNetwork returns the network addr starts with, like unix in unix:/run/web.sock, and the address without it.
+// network and addr are returned if addr does not start with a network checkDialNetwork accepts.
+func splitNetwork(network, addr string) (string, string) {
+	if colon := strings.IndexByte(addr, ':'); colon > 0 && checkDialNetwork(addr[:colon]) == nil {
+		return addr[:colon], addr[colon+1:]
+	}
+
+	return network, addr
+}
+
+// control applies o to the socket c of network before it is connected. It is meant to be used as
+// net.Dialer.Control.
+func (o socketOptions) control(network, _ string, c syscall.RawConn) error {
+	var err error
+
+	if controlErr := c.Control(func(fd uintptr) { err = o.apply(int(fd), network == "tcp6") }); controlErr != nil {
+		return fmt.Errorf("raw socket: %w", controlErr)
+	}
+
+	return err
+}
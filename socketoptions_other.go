@@ -0,0 +1,35 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !unix
+
+package tcpto6
+
+import "errors"
+
+// errHopLimitUnsupported indicates that the hop limit can not be set on this platform.
+var errHopLimitUnsupported = errors.New("setting the hop limit is only supported on unix")
+
+// apply fails if o sets the hop limit, which is only supported on unix, and sets the MSS otherwise.
+func (o socketOptions) apply(fd int, ipv6 bool) error {
+	if o.hopLimit != 0 {
+		return errHopLimitUnsupported
+	}
+
+	mss := o.mss4
+	if ipv6 {
+		mss = o.mss6
+	}
+
+	return setMSS(fd, mss)
+}
@@ -0,0 +1,39 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package tcpto6
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// apply sets the options of o that the net package can not set itself on the socket fd, which is an IPv6 one if ipv6
+// is set and an IPv4 one otherwise.
+func (o socketOptions) apply(fd int, ipv6 bool) error {
+	level, hopLimit, mss := unix.IPPROTO_IP, unix.IP_TTL, o.mss4
+	if ipv6 {
+		level, hopLimit, mss = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, o.mss6
+	}
+
+	if o.hopLimit != 0 {
+		if err := unix.SetsockoptInt(fd, level, hopLimit, o.hopLimit); err != nil {
+			return fmt.Errorf("set hop limit: %w", err)
+		}
+	}
+
+	return setMSS(fd, mss)
+}
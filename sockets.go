@@ -0,0 +1,266 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+var (
+	// errLaunchdUnsupported is raised if launchd sockets are requested on a platform without launchd.
+	errLaunchdUnsupported = errors.New("launchd socket activation is only supported on darwin with cgo")
+	// errNoListenAddrs is raised if the listen addresses are set but empty.
+	errNoListenAddrs = errors.New("no listen addresses")
+)
+
+// SocketProvider supplies the listeners tcp4to6 accepts connections from.
+type SocketProvider interface {
+	// Listeners returns the listeners. The caller takes ownership and closes them.
+	Listeners() ([]net.Listener, error)
+}
+
+// namedSocketProvider is implemented by SocketProviders that know the names of their sockets, which select the
+// destination of connections accepted on them.
+type namedSocketProvider interface {
+	// namedListeners returns the listeners like Listeners and their names at the same index.
+	namedListeners() ([]net.Listener, []string, error)
+}
+
+// SystemdSockets provides the sockets passed via systemd socket activation. It is what Run uses by default. Connected
+// sockets, as passed by socket units with Accept=yes, are handled like ForwardedConn.
+type SystemdSockets struct{}
+
+// Listeners returns the sockets passed by systemd.
+func (s SystemdSockets) Listeners() ([]net.Listener, error) {
+	listeners, _, err := s.namedListeners()
+
+	return listeners, err
+}
+
+// namedListeners returns the sockets passed by systemd and their FileDescriptorName=.
+func (SystemdSockets) namedListeners() ([]net.Listener, []string, error) {
+	files := activation.Files(true)
+	listeners := make([]net.Listener, 0, len(files))
+	names := make([]string, 0, len(files))
+
+	for _, file := range files {
+		var (
+			fileListeners []net.Listener
+			err           error
+		)
+
+		switch {
+		case isVsock(file):
+			var listener net.Listener
+
+			listener, err = vsockFileListener(file)
+			fileListeners = []net.Listener{listener}
+		case isListening(file):
+			var listener net.Listener
+
+			listener, err = net.FileListener(file)
+			_ = file.Close()
+			fileListeners = []net.Listener{listener}
+		default:
+			fileListeners, err = ForwardedConn{File: file}.Listeners()
+		}
+
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+
+			return nil, nil, fmt.Errorf("systemd sockets: %w", err)
+		}
+
+		for _, listener := range fileListeners {
+			listeners = append(listeners, listener)
+			names = append(names, file.Name())
+		}
+	}
+
+	return listeners, names, nil
+}
+
+// StaticBind provides a socket by binding to a fixed address, for running without a service manager.
+type StaticBind struct {
+	// Network is passed to net.Listen, e.g. tcp or tcp4. vsock binds a vsock socket to an address of the form
+	// cid:port, with any as cid for all CIDs of the machine. sctp, sctp4 and sctp6 bind a one-to-one SCTP socket.
+	Network string
+	// Address is passed to net.Listen, e.g. 0.0.0.0:443.
+	Address string
+	// Ports, if set, binds the host of Address on each of these ports instead of the port of Address. Connections are
+	// routed by their local port then, see Config.
+	Ports []int
+	// BothFamilies binds a tcp4 socket to 0.0.0.0 and a tcp6 socket restricted to IPv6 to [::] for each port instead
+	// of binding Network and the host of Address. Both are served as one, sharing limits and metrics.
+	BothFamilies bool
+	// Rebind, on linux, follows a TCP address of a single host as it is assigned to and removed from its interface,
+	// e.g. by DHCP or PPPoE. Binding waits for the address instead of failing, the socket is closed when it is removed
+	// and bound again once it is back.
+	Rebind bool
+}
+
+// bothFamilies is the number of sockets bound per port by StaticBind.BothFamilies.
+const bothFamilies = 2
+
+// staticAddr is a network and address StaticBind binds to.
+type staticAddr struct {
+	network, address string
+}
+
+// Listeners binds to the configured addresses. If one of them fails, those bound already are closed.
+func (b StaticBind) Listeners() ([]net.Listener, error) {
+	addrs, err := b.addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	listen := listenStatic
+	if b.Rebind {
+		listen = listenRebinding
+	}
+
+	return bindAll(addrs, listen)
+}
+
+// bindAll binds to each of addrs with listen. If one of them fails, those bound already are closed.
+func bindAll(addrs []staticAddr, listen func(network, address string) (net.Listener, error)) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+
+	for _, addr := range addrs {
+		listener, err := listen(addr.network, addr.address)
+		if err != nil {
+			for _, bound := range listeners {
+				_ = bound.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// addrs returns the networks and addresses b binds to.
+func (b StaticBind) addrs() ([]staticAddr, error) {
+	if len(b.Ports) == 0 && !b.BothFamilies {
+		return []staticAddr{{network: b.Network, address: b.Address}}, nil
+	}
+
+	host, port, err := net.SplitHostPort(b.Address)
+	if err != nil {
+		return nil, fmt.Errorf("bind: %w", err)
+	}
+
+	ports := []string{port}
+
+	if len(b.Ports) != 0 {
+		ports = make([]string, len(b.Ports))
+		for i, port := range b.Ports {
+			ports[i] = strconv.Itoa(port)
+		}
+	}
+
+	addrs := make([]staticAddr, 0, bothFamilies*len(ports))
+
+	for _, port := range ports {
+		if b.BothFamilies {
+			addrs = append(addrs, staticAddr{network: "tcp4", address: net.JoinHostPort("0.0.0.0", port)},
+				staticAddr{network: "tcp6", address: net.JoinHostPort("::", port)})
+		} else {
+			addrs = append(addrs, staticAddr{network: b.Network, address: net.JoinHostPort(host, port)})
+		}
+	}
+
+	return addrs, nil
+}
+
+// listenAddrs provides the sockets bound to the addresses of ListenAddrEnvName.
+type listenAddrs []staticAddr
+
+// Listeners binds to the addresses. If one of them fails, those bound already are closed.
+func (a listenAddrs) Listeners() ([]net.Listener, error) {
+	return bindAll(a, listenStatic)
+}
+
+// parseListenAddrs parses value as whitespace separated addresses to bind to, each optionally prefixed by its
+// network like tcp6:[::]:443. Addresses without prefix are bound with tcp.
+func parseListenAddrs(value string) (listenAddrs, error) {
+	var addrs listenAddrs
+
+	for _, field := range strings.Fields(value) {
+		addr := staticAddr{network: "tcp", address: field}
+
+		if colon := strings.IndexByte(field, ':'); colon > 0 {
+			switch network := field[:colon]; network {
+			case "tcp", "tcp4", "tcp6", "unix", vsockNetwork, sctpNetwork, sctpNetwork + "4", sctpNetwork + "6":
+				addr = staticAddr{network: network, address: field[colon+1:]}
+			}
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	if len(addrs) == 0 {
+		return nil, errNoListenAddrs
+	}
+
+	return addrs, nil
+}
+
+// listenStatic binds to address on network.
+func listenStatic(network, address string) (net.Listener, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+
+	switch {
+	case network == vsockNetwork:
+		listener, err = listenVsock(address)
+	case strings.HasPrefix(network, sctpNetwork):
+		listener, err = listenSCTP(network, address)
+	default:
+		listener, err = net.Listen(network, address)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("bind: %w", err)
+	}
+
+	return listener, nil
+}
+
+// LaunchdSockets provides the sockets launchd passes to a job on macOS.
+type LaunchdSockets struct {
+	// Name is the key of the socket in the Sockets dictionary of the launchd job.
+	Name string
+}
+
+// FixedListeners provides listeners that were created beforehand, e.g. by tests.
+type FixedListeners []net.Listener
+
+// Listeners returns l.
+func (l FixedListeners) Listeners() ([]net.Listener, error) {
+	return l, nil
+}
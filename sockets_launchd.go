@@ -0,0 +1,70 @@
+//go:build darwin && cgo
+// +build darwin,cgo
+
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// launchdSupported tells that LaunchdSockets can be used.
+const launchdSupported = true
+
+// Listeners asks launchd for the sockets of the job.
+func (s LaunchdSockets) Listeners() ([]net.Listener, error) {
+	name := C.CString(s.Name)
+	defer C.free(unsafe.Pointer(name))
+
+	var (
+		fds   *C.int
+		count C.size_t
+	)
+
+	if res := C.launch_activate_socket(name, &fds, &count); res != 0 {
+		return nil, fmt.Errorf("launchd sockets: %w", syscall.Errno(res))
+	}
+	defer C.free(unsafe.Pointer(fds))
+
+	listeners := make([]net.Listener, 0, int(count))
+
+	for _, fd := range unsafe.Slice(fds, int(count)) {
+		file := os.NewFile(uintptr(fd), s.Name)
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+
+			return nil, fmt.Errorf("launchd sockets: %w", err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
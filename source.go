@@ -0,0 +1,170 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// errNoSourceAddress is raised if the source interface has no address IPv6 backends can be dialed from.
+var errNoSourceAddress = errors.New("no usable global IPv6 address")
+
+// ulaPrefix is the prefix of unique local IPv6 addresses, fc00::/7.
+var ulaPrefix = net.IPNet{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)}
+
+// sourceCandidate is an IPv6 address of an interface that backends can be dialed from.
+type sourceCandidate struct {
+	ip net.IP
+	// preferred is how long the address stays preferred. Zero if the platform does not tell.
+	preferred time.Duration
+}
+
+// selectSource returns the address backends are dialed from out of candidates. Global addresses win over unique local
+// ones, then the one that stays preferred the longest, which is the one of the newest prefix after the ISP rotated it.
+// Nil if there are no candidates.
+func selectSource(candidates []sourceCandidate) net.IP {
+	var best *sourceCandidate
+
+	for i := range candidates {
+		candidate := &candidates[i]
+
+		switch {
+		case best == nil:
+		case ulaPrefix.Contains(candidate.ip) != ulaPrefix.Contains(best.ip):
+			if ulaPrefix.Contains(candidate.ip) {
+				continue
+			}
+		case candidate.preferred <= best.preferred:
+			continue
+		}
+
+		best = candidate
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	return best.ip
+}
+
+// sourceTracker selects the addresses IPv6 backends are dialed from, per interface. Selections are cached until the
+// addresses of the host change, so a new prefix is used from the next connection on. Without a way to watch for
+// changes, the address is selected anew for each connection.
+type sourceTracker struct {
+	once sync.Once
+	// watch signals changes to addresses. Nil if they are not watched.
+	watch *addressWatch
+	mtx   sync.Mutex
+	// cached maps interface names to their selected address. Nil while changes are not watched.
+	cached map[string]net.IP
+	// changes counts the changes seen, so selections made while one happened are not cached.
+	changes uint64
+}
+
+// newSourceTracker creates a sourceTracker. Changes are watched from its first use on.
+func newSourceTracker() *sourceTracker {
+	return &sourceTracker{}
+}
+
+// address returns the address backends are dialed from via the interface called name.
+func (t *sourceTracker) address(name string) (net.IP, error) {
+	t.once.Do(t.start)
+
+	t.mtx.Lock()
+	ip, ok := t.cached[name]
+	changes := t.changes
+	t.mtx.Unlock()
+
+	if ok {
+		return ip, nil
+	}
+
+	candidates, err := sourceCandidates(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip = selectSource(candidates); ip == nil {
+		return nil, fmt.Errorf("%w on %s", errNoSourceAddress, name)
+	}
+
+	t.mtx.Lock()
+	if t.cached != nil && t.changes == changes {
+		t.cached[name] = ip
+	}
+	t.mtx.Unlock()
+
+	return ip, nil
+}
+
+// start watches for address changes if the platform supports it.
+func (t *sourceTracker) start() {
+	watch, err := watchAddresses()
+	if err != nil {
+		return
+	}
+
+	t.watch, t.cached = watch, map[string]net.IP{}
+
+	go t.follow()
+}
+
+// follow drops the cached selections after each change. Caching stops once the watch ends.
+func (t *sourceTracker) follow() {
+	for range t.watch.changed {
+		t.mtx.Lock()
+		t.cached = map[string]net.IP{}
+		t.changes++
+		t.mtx.Unlock()
+	}
+
+	t.mtx.Lock()
+	t.cached = nil
+	t.mtx.Unlock()
+}
+
+// Close stops watching for address changes. Addresses are selected for each connection afterwards.
+func (t *sourceTracker) Close() error {
+	t.once.Do(func() {})
+
+	if t.watch == nil {
+		return nil
+	}
+
+	return t.watch.Close()
+}
+
+// withSource returns opts with the source address set as configured by cfg if addr is a global IPv6 address.
+func (p *proxy) withSource(cfg dialConfig, addr string, opts socketOptions) (socketOptions, error) {
+	if cfg.sourceInterface == "" {
+		return opts, nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil || !ip.IsGlobalUnicast() {
+		return opts, nil
+	}
+
+	var err error
+	if opts.source, err = p.sources.address(cfg.sourceInterface); err != nil {
+		return opts, fmt.Errorf("source address: %w", err)
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// unusableSourceFlags are the flags of addresses that connections can not or should not be sent from.
+const unusableSourceFlags = unix.IFA_F_TENTATIVE | unix.IFA_F_DADFAILED | unix.IFA_F_DEPRECATED
+
+// infiniteLifetime is the lifetime netlink reports for addresses that do not expire.
+const infiniteLifetime = math.MaxUint32
+
+// sourceCandidates lists the global IPv6 addresses of the interface called name via netlink, leaving out those that
+// are deprecated or still checked for duplicates.
+func sourceCandidates(name string) ([]sourceCandidate, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("source interface: %w", err)
+	}
+
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_INET6)
+	if err != nil {
+		return nil, fmt.Errorf("list addresses: %w", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("parse addresses: %w", err)
+	}
+
+	var candidates []sourceCandidate
+
+	for i := range msgs {
+		msg := &msgs[i]
+		if msg.Header.Type != syscall.RTM_NEWADDR || len(msg.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+
+		info := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+		if int(info.Index) != iface.Index || info.Scope != unix.RT_SCOPE_UNIVERSE {
+			continue
+		}
+
+		if candidate, ok := parseSourceCandidate(msg, uint32(info.Flags)); ok {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates, nil
+}
+
+// parseSourceCandidate reads the address of msg and how long it stays preferred. flags are those of the message
+// header, which are replaced by the extended ones if present. Unusable addresses are reported as not ok.
+func parseSourceCandidate(msg *syscall.NetlinkMessage, flags uint32) (sourceCandidate, bool) {
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		return sourceCandidate{}, false
+	}
+
+	candidate := sourceCandidate{preferred: time.Duration(math.MaxInt64)}
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.IFA_ADDRESS:
+			if len(attr.Value) == net.IPv6len {
+				candidate.ip = append(net.IP(nil), attr.Value...)
+			}
+		case unix.IFA_FLAGS:
+			if len(attr.Value) >= 4 {
+				flags = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+			}
+		case unix.IFA_CACHEINFO:
+			if len(attr.Value) >= unix.SizeofIfaCacheinfo {
+				info := (*unix.IfaCacheinfo)(unsafe.Pointer(&attr.Value[0]))
+				if info.Prefered != infiniteLifetime {
+					candidate.preferred = time.Duration(info.Prefered) * time.Second
+				}
+			}
+		}
+	}
+
+	return candidate, candidate.ip != nil && flags&unusableSourceFlags == 0
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// spliceChunk is the most bytes a single splice moves, the default capacity of a pipe.
+const spliceChunk = 1 << 16
+
+// spliceWriter is where spliceStreams moves data to: a TCP connection and the counters of the countingStreams that
+// wrapped it.
+type spliceWriter struct {
+	conn     *net.TCPConn
+	counters []*int64
+	// writing holds the time in UnixNano the write in progress started on clock, like countingStream.writing. May be
+	// nil.
+	writing *int64
+	clock   Clock
+}
+
+// wrote counts n bytes that were written to conn.
+func (w spliceWriter) wrote(n int64) {
+	for _, counter := range w.counters {
+		atomic.AddInt64(counter, n)
+	}
+}
+
+// startWrite records that a write started, if anybody is interested.
+func (w spliceWriter) startWrite() {
+	if w.writing != nil {
+		atomic.StoreInt64(w.writing, w.clock.Now().UnixNano())
+	}
+}
+
+// endWrite records that the write in progress is done.
+func (w spliceWriter) endWrite() {
+	if w.writing != nil {
+		atomic.StoreInt64(w.writing, 0)
+	}
+}
+
+// spliceStreams copies from src to dst with splice(2) if both are TCP connections, possibly wrapped by countingStream,
+// so the data does not pass through user space. Bytes are counted as countingStream would. ok is false, with nothing
+// copied, if the streams do not allow this or the platform does not support it. io.Copy has to be used then.
+func spliceStreams(dst io.Writer, src io.Reader) (written int64, ok bool, err error) {
+	writer := spliceWriter{}
+
+	for unwrapped := false; !unwrapped; {
+		switch stream := dst.(type) {
+		case countingStream:
+			writer.counters = append(writer.counters, stream.counters...)
+			if stream.writing != nil {
+				writer.writing, writer.clock = stream.writing, stream.clock
+			}
+
+			dst = stream.ReadWriteCloser
+		case *net.TCPConn:
+			writer.conn = stream
+			unwrapped = true
+		default:
+			return 0, false, nil
+		}
+	}
+
+	if counting, isCounting := src.(countingStream); isCounting {
+		src = counting.ReadWriteCloser
+	}
+
+	reader, isTCP := src.(*net.TCPConn)
+	if !isTCP {
+		return 0, false, nil
+	}
+
+	return spliceTCP(writer, reader)
+}
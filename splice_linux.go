@@ -0,0 +1,105 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceTCP moves data from src to dst through a pipe with splice(2) until src ends or an operation fails. Waiting for
+// the sockets is left to the runtime poller, so deadlines and closing the connections work as usual. ok is false if
+// the pipe could not be created.
+func spliceTCP(dst spliceWriter, src *net.TCPConn) (written int64, ok bool, err error) {
+	var pipe [2]int
+	if err := unix.Pipe2(pipe[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+
+	defer func() {
+		_ = unix.Close(pipe[0])
+		_ = unix.Close(pipe[1])
+	}()
+
+	rawSrc, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	rawDst, err := dst.conn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	for {
+		var (
+			buffered  int64
+			spliceErr error
+		)
+
+		if err := rawSrc.Read(func(fd uintptr) bool {
+			buffered, spliceErr = unix.Splice(int(fd), nil, pipe[1], nil, spliceChunk,
+				unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+
+			return !errors.Is(spliceErr, unix.EAGAIN)
+		}); err != nil {
+			return written, true, spliceError("read", src, err)
+		}
+
+		switch {
+		case spliceErr != nil:
+			return written, true, spliceError("read", src, os.NewSyscallError("splice", spliceErr))
+		case buffered == 0:
+			return written, true, nil
+		}
+
+		dst.startWrite()
+
+		for buffered > 0 {
+			var moved int64
+
+			if err := rawDst.Write(func(fd uintptr) bool {
+				moved, spliceErr = unix.Splice(pipe[0], nil, int(fd), nil, int(buffered),
+					unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+
+				return !errors.Is(spliceErr, unix.EAGAIN)
+			}); err != nil {
+				dst.endWrite()
+
+				return written, true, spliceError("write", dst.conn, err)
+			}
+
+			if spliceErr != nil {
+				dst.endWrite()
+
+				return written, true, spliceError("write", dst.conn, os.NewSyscallError("splice", spliceErr))
+			}
+
+			buffered -= moved
+			written += moved
+			dst.wrote(moved)
+		}
+
+		dst.endWrite()
+	}
+}
+
+// spliceError wraps err, which occurred when op, read or write, was done on conn, like the net package does, so close
+// reasons tell the same as with io.Copy.
+func spliceError(op string, conn *net.TCPConn, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: err}
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"dev.eqrx.net/tcpto6"
+	"github.com/go-logr/logr"
+)
+
+// benchmarkChunk is the number of bytes written to the bridge per benchmark iteration.
+const benchmarkChunk = 64 << 10
+
+// tcpPair returns both ends of a TCP connection over the loopback interface.
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	b.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	conn := <-accepted
+	if conn == nil {
+		b.Fatal("accept failed")
+	}
+
+	b.Cleanup(func() {
+		_ = dialed.Close()
+		_ = conn.Close()
+	})
+
+	return dialed, conn
+}
+
+// benchmarkBridge measures the throughput of BridgeStreams with opts from a client to a backend, both connected over
+// TCP.
+func benchmarkBridge(b *testing.B, opts ...tcpto6.BridgeOption) {
+	b.Helper()
+
+	client, src := tcpPair(b)
+	dst, backend := tcpPair(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bridged := make(chan error, 1)
+
+	go func() { bridged <- tcpto6.BridgeStreams(ctx, logr.Discard(), dst, src, opts...) }()
+
+	received := make(chan error, 1)
+
+	go func() {
+		_, err := io.CopyN(io.Discard, backend, int64(b.N)*benchmarkChunk)
+		received <- err
+	}()
+
+	chunk := make([]byte, benchmarkChunk)
+
+	b.SetBytes(benchmarkChunk)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+
+	b.StopTimer()
+
+	_ = client.Close()
+	_ = backend.Close()
+
+	<-bridged
+}
+
+// BenchmarkBridgeSplice measures bridging TCP connections with splice(2), which falls back to the userspace copy on
+// platforms other than linux.
+func BenchmarkBridgeSplice(b *testing.B) {
+	benchmarkBridge(b, tcpto6.WithSplice())
+}
+
+// BenchmarkBridgeCopy measures bridging TCP connections with the userspace copy.
+func BenchmarkBridgeCopy(b *testing.B) {
+	benchmarkBridge(b)
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats holds counters that are updated for all connections of a proxy. All fields but labeled are accessed
+// atomically.
+type stats struct {
+	// accepted is the number of accepted connections.
+	accepted int64
+	// handshakeFailures is the number of connections that failed or timed out before they could be bridged.
+	handshakeFailures int64
+	// acceptRestarts is the number of times accepting was restarted after a recoverable error.
+	acceptRestarts int64
+	// shed is the number of connections that were closed right after accepting because of resource pressure.
+	shed int64
+	// denied is the number of connections that were closed right after accepting because their client is not admitted.
+	denied int64
+	// probes is the number of connections recognized as health probes. They are not part of the other counters.
+	probes int64
+	// dials is the number of connections whose backend was dialed.
+	dials int64
+	// dialFailures is the number of connections that could not be bridged because dialing the backend failed.
+	dialFailures int64
+	// received is the number of bytes read from clients and written to backends.
+	received int64
+	// sent is the number of bytes read from backends and written to clients.
+	sent int64
+	// listenQueueLength is the number of connections waiting in the listen queue when it was last sampled.
+	listenQueueLength int64
+	// listenQueueCapacity is the number of connections the listen queue can hold.
+	listenQueueCapacity int64
+	// listenOverflows is the number of connections the kernel dropped since the start because listen queues were
+	// full. It covers all listeners of the network namespace.
+	listenOverflows int64
+	// listenDrops is the number of connections the kernel dropped since the start before they could be accepted,
+	// including overflows. It covers all listeners of the network namespace.
+	listenDrops int64
+	// labeled breaks the traffic down by the labels of the connections.
+	labeled labeledStats
+}
+
+// labeledCounters hold the traffic of finished connections with the same labels.
+type labeledCounters struct {
+	Labels        Labels `json:"labels"`
+	Connections   int64  `json:"connections"`
+	BytesReceived int64  `json:"bytesReceived"`
+	BytesSent     int64  `json:"bytesSent"`
+}
+
+// labeledStats accumulates the traffic of finished connections per distinct set of labels. Connections without
+// labels are not tracked. Traffic is accounted when a connection finishes.
+type labeledStats struct {
+	mtx      sync.Mutex
+	counters map[string]labeledCounters
+}
+
+// add accounts the traffic of the finished connection snap.
+func (s *labeledStats) add(snap connSnapshot) {
+	if len(snap.labels) == 0 {
+		return
+	}
+
+	key := snap.labels.key()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.counters == nil {
+		s.counters = map[string]labeledCounters{}
+	}
+
+	counters := s.counters[key]
+	counters.Labels = snap.labels
+	counters.Connections++
+	counters.BytesReceived += snap.received
+	counters.BytesSent += snap.sent
+	s.counters[key] = counters
+}
+
+// snapshot returns a copy of the counters keyed by Labels.key.
+func (s *labeledStats) snapshot() map[string]labeledCounters {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	counters := make(map[string]labeledCounters, len(s.counters))
+	for key, value := range s.counters {
+		counters[key] = value
+	}
+
+	return counters
+}
+
+// statsSnapshot is a copy of stats at a point in time.
+type statsSnapshot struct {
+	taken             time.Time
+	accepted          int64
+	handshakeFailures int64
+	acceptRestarts    int64
+	shed              int64
+	denied            int64
+	probes            int64
+	dials             int64
+	dialFailures      int64
+	received          int64
+	sent              int64
+	listenQueue       listenQueue
+	listenOverflows   listenOverflows
+	labeled           map[string]labeledCounters
+}
+
+// labeledDeltas returns the labeled counters of s minus those of earlier. Label sets without change are left out.
+func (s statsSnapshot) labeledDeltas(earlier statsSnapshot) []labeledCounters {
+	keys := make([]string, 0, len(s.labeled))
+	for key := range s.labeled {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var deltas []labeledCounters
+
+	for _, key := range keys {
+		current, previous := s.labeled[key], earlier.labeled[key]
+		if current.Connections == previous.Connections {
+			continue
+		}
+
+		deltas = append(deltas, labeledCounters{
+			Labels:        current.Labels,
+			Connections:   current.Connections - previous.Connections,
+			BytesReceived: current.BytesReceived - previous.BytesReceived,
+			BytesSent:     current.BytesSent - previous.BytesSent,
+		})
+	}
+
+	return deltas
+}
+
+// snapshot returns the current values of all counters, taken at now.
+func (s *stats) snapshot(now time.Time) statsSnapshot {
+	return statsSnapshot{
+		taken:             now,
+		accepted:          atomic.LoadInt64(&s.accepted),
+		handshakeFailures: atomic.LoadInt64(&s.handshakeFailures),
+		acceptRestarts:    atomic.LoadInt64(&s.acceptRestarts),
+		shed:              atomic.LoadInt64(&s.shed),
+		denied:            atomic.LoadInt64(&s.denied),
+		probes:            atomic.LoadInt64(&s.probes),
+		dials:             atomic.LoadInt64(&s.dials),
+		dialFailures:      atomic.LoadInt64(&s.dialFailures),
+		received:          atomic.LoadInt64(&s.received),
+		sent:              atomic.LoadInt64(&s.sent),
+		listenQueue: listenQueue{
+			length:   uint32(atomic.LoadInt64(&s.listenQueueLength)),
+			capacity: uint32(atomic.LoadInt64(&s.listenQueueCapacity)),
+		},
+		listenOverflows: listenOverflows{
+			overflows: atomic.LoadInt64(&s.listenOverflows),
+			drops:     atomic.LoadInt64(&s.listenDrops),
+		},
+		labeled: s.labeled.snapshot(),
+	}
+}
+
+// logSummaries logs a summary of the traffic since the last summary each interval until ctx is canceled.
+func (p *proxy) logSummaries(ctx context.Context, interval time.Duration) {
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := p.stats.snapshot(p.clock.Now())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		current := p.stats.snapshot(p.clock.Now())
+		seconds := current.taken.Sub(last.taken).Seconds()
+
+		log := p.log
+		if addr := p.externalAddress(); addr != "" {
+			log = log.WithValues("externalAddress", addr)
+		}
+
+		log.Info("summary",
+			"active", p.conns.len(),
+			"holding", p.hold.len(),
+			"acceptsPerSecond", float64(current.accepted-last.accepted)/seconds,
+			"handshakeFailures", current.handshakeFailures-last.handshakeFailures,
+			"acceptRestarts", current.acceptRestarts-last.acceptRestarts,
+			"shed", current.shed-last.shed,
+			"denied", current.denied-last.denied,
+			"probes", current.probes-last.probes,
+			"dialFailures", current.dialFailures-last.dialFailures,
+			"receivedBytesPerSecond", float64(current.received-last.received)/seconds,
+			"sentBytesPerSecond", float64(current.sent-last.sent)/seconds,
+			"listenQueueLength", current.listenQueue.length,
+			"listenOverflows", current.listenOverflows.overflows-last.listenOverflows.overflows,
+			"listenDrops", current.listenOverflows.drops-last.listenOverflows.drops,
+		)
+
+		last = current
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// stdioNetwork is the network of the addresses of connections made of standard input and output.
+const stdioNetwork = "stdio"
+
+// Stdio provides a single connection made of standard input and output, for supervisors that start a process per
+// connection like inetd, tcpserver, s6 or runit, or the ProxyCommand of SSH. If In is a connected socket, as passed by
+// inetd and tcpserver, it is served like ForwardedConn. Otherwise In and Out are pipes and the addresses of the client
+// and the local side are taken from the UCSPI variables TCPREMOTEIP, TCPREMOTEPORT, TCPLOCALIP and TCPLOCALPORT if
+// set. tcp4to6 stops once the connection is done.
+type Stdio struct {
+	// In is read from. os.Stdin if nil. Unless it is a socket, it is closed right away and a duplicate of it is used
+	// instead, which is closed once the connection is done.
+	In *os.File
+	// Out is written to. os.Stdout if nil. It is closed and duplicated like In.
+	Out *os.File
+}
+
+// Listeners returns a listener that hands out the connection once.
+func (s Stdio) Listeners() ([]net.Listener, error) {
+	in, out := s.In, s.Out
+	if in == nil {
+		in = os.Stdin
+	}
+
+	if out == nil {
+		out = os.Stdout
+	}
+
+	if isSocket(in) {
+		return ForwardedConn{File: in}.Listeners()
+	}
+
+	conn, err := newStdioConn(in, out, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return []net.Listener{newConnListener(conn)}, nil
+}
+
+// stdioAddr is the address of a side of a connection made of standard input and output.
+type stdioAddr string
+
+// Network returns stdio.
+func (stdioAddr) Network() string {
+	return stdioNetwork
+}
+
+// String returns the side the address belongs to.
+func (a stdioAddr) String() string {
+	return string(a)
+}
+
+// ucspiAddr returns the address the UCSPI variables with prefix, TCPREMOTE or TCPLOCAL, name. fallback is returned if
+// they are not set or invalid.
+func ucspiAddr(lookup func(string) (string, bool), prefix string, fallback net.Addr) net.Addr {
+	if proto, _ := lookup("PROTO"); proto != "TCP" {
+		return fallback
+	}
+
+	host, _ := lookup(prefix + "IP")
+	portValue, _ := lookup(prefix + "PORT")
+
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portValue)
+
+	if ip == nil || err != nil {
+		return fallback
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// stdioConn is a net.Conn made of a file to read from and one to write to. Both are set to non-blocking mode, so
+// deadlines apply and closing interrupts pending reads and writes. Close sets them back to blocking mode, since
+// other processes may share them.
+type stdioConn struct {
+	in, out       *os.File
+	local, remote net.Addr
+}
+
+// newStdioConn creates a stdioConn that reads from in and writes to out. The addresses are taken from the UCSPI
+// variables lookup returns if they are set.
+func newStdioConn(in, out *os.File, lookup func(string) (string, bool)) (*stdioConn, error) {
+	pollableIn, err := pollable(in)
+	if err != nil {
+		return nil, fmt.Errorf("stdin: %w", err)
+	}
+
+	pollableOut, err := pollable(out)
+	if err != nil {
+		_ = pollableIn.Close()
+
+		return nil, fmt.Errorf("stdout: %w", err)
+	}
+
+	return &stdioConn{
+		in: pollableIn, out: pollableOut,
+		local:  ucspiAddr(lookup, "TCPLOCAL", stdioAddr("local")),
+		remote: ucspiAddr(lookup, "TCPREMOTE", stdioAddr("remote")),
+	}, nil
+}
+
+// Read reads from the input file. The end of input is reported as io.EOF as is.
+func (c *stdioConn) Read(p []byte) (int, error) {
+	n, err := c.in.Read(p)
+	if errors.Is(err, io.EOF) {
+		return n, io.EOF
+	}
+
+	if err != nil {
+		return n, fmt.Errorf("read stdin: %w", err)
+	}
+
+	return n, nil
+}
+
+// Write writes to the output file.
+func (c *stdioConn) Write(p []byte) (int, error) {
+	n, err := c.out.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("write stdout: %w", err)
+	}
+
+	return n, nil
+}
+
+// CloseWrite closes the output file, which tells the other side that nothing more is sent.
+func (c *stdioConn) CloseWrite() error {
+	return closeBlocking(c.out)
+}
+
+// Close closes both files.
+func (c *stdioConn) Close() error {
+	inErr, outErr := closeBlocking(c.in), closeBlocking(c.out)
+
+	return errors.Join(inErr, outErr)
+}
+
+// LocalAddr returns the address from TCPLOCALIP and TCPLOCALPORT or local.
+func (c *stdioConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address from TCPREMOTEIP and TCPREMOTEPORT or remote.
+func (c *stdioConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the deadline of reading and writing.
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+// SetReadDeadline sets the deadline of reading.
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	if err := c.in.SetReadDeadline(t); err != nil {
+		return fmt.Errorf("set stdin deadline: %w", err)
+	}
+
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of writing.
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	if err := c.out.SetWriteDeadline(t); err != nil {
+		return fmt.Errorf("set stdout deadline: %w", err)
+	}
+
+	return nil
+}
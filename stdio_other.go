@@ -0,0 +1,44 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !unix
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errStdioUnsupported indicates that standard input and output can not be served on this platform.
+var errStdioUnsupported = errors.New("serving standard input and output is only supported on unix")
+
+// isSocket reports false since sockets can only be told apart on unix.
+func isSocket(*os.File) bool {
+	return false
+}
+
+// pollable fails since files can only be switched to non-blocking mode on unix.
+func pollable(*os.File) (*os.File, error) {
+	return nil, errStdioUnsupported
+}
+
+// closeBlocking closes file. Closing it twice is no error.
+func closeBlocking(file *os.File) error {
+	if err := file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("close %s: %w", file.Name(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// isSocket tells if file is a socket.
+func isSocket(file *os.File) bool {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var stat unix.Stat_t
+
+	statErr := raw.Control(func(fd uintptr) {
+		err = unix.Fstat(int(fd), &stat)
+	})
+
+	return statErr == nil && err == nil && stat.Mode&unix.S_IFMT == unix.S_IFSOCK
+}
+
+// pollable duplicates the file descriptor of file, sets it to non-blocking mode and returns a new *os.File for the
+// duplicate, which the runtime poller then handles. file is closed, so the duplicate is the only descriptor left in
+// this process and closing it is seen by the other side.
+func pollable(file *os.File) (*os.File, error) {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("raw file: %w", err)
+	}
+
+	var (
+		duplicate = -1
+		setErr    error
+	)
+
+	if err := raw.Control(func(fd uintptr) {
+		if duplicate, setErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0); setErr == nil {
+			setErr = unix.SetNonblock(duplicate, true)
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("raw file: %w", err)
+	}
+
+	if setErr != nil {
+		if duplicate >= 0 {
+			_ = unix.Close(duplicate)
+		}
+
+		return nil, fmt.Errorf("duplicate non-blocking: %w", setErr)
+	}
+
+	pollableFile := os.NewFile(uintptr(duplicate), file.Name())
+
+	if err := file.Close(); err != nil {
+		_ = pollableFile.Close()
+
+		return nil, fmt.Errorf("close %s: %w", file.Name(), err)
+	}
+
+	return pollableFile, nil
+}
+
+// closeBlocking sets file back to blocking mode and closes it. Closing it twice is no error.
+func closeBlocking(file *os.File) error {
+	if raw, err := file.SyscallConn(); err == nil {
+		_ = raw.Control(func(fd uintptr) { _ = unix.SetNonblock(int(fd), false) })
+	}
+
+	if err := file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("close %s: %w", file.Name(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+)
+
+// BridgeInfo describes the streams BridgeStreams is about to bridge to a BridgeHook.
+type BridgeInfo struct {
+	// Client and Backend are the addresses of the streams towards the client and the backend. Both addresses are nil
+	// if not known.
+	Client  StreamAddrs
+	Backend StreamAddrs
+}
+
+// BridgeHook is called by BridgeStreams before anything is copied. Returning an error rejects the streams, which are
+// closed then.
+type BridgeHook func(ctx context.Context, info BridgeInfo) error
+
+// Transformer wraps the source of a direction, like a decompressing or rewriting reader. What it returns is copied
+// instead of what is read from the stream.
+type Transformer func(source io.Reader) io.Reader
+
+// WithBridgeHook adds hook to the hooks BridgeStreams calls before copying. Hooks are called in the order they were
+// added.
+func WithBridgeHook(hook BridgeHook) BridgeOption {
+	return func(opts *bridgeOptions) { opts.hooks = append(opts.hooks, hook) }
+}
+
+// WithTransformer adds transformer to the ones the data copied in direction passes. Transformers added later wrap
+// those added earlier.
+func WithTransformer(direction CopyDirection, transformer Transformer) BridgeOption {
+	return func(opts *bridgeOptions) {
+		opts.transformers[direction] = append(opts.transformers[direction], transformer)
+	}
+}
+
+// WithBandwidthLimit limits the bytes per second BridgeStreams writes in both directions together to rate. The
+// streams of a Bridge share the limit, those in higher priority classes given by WithPriority being served first.
+// Once the context of BridgeStreams is canceled, writes are not limited any more so the streams can flush.
+func WithBandwidthLimit(rate int64) BridgeOption {
+	return func(opts *bridgeOptions) { opts.bandwidthLimit = rate }
+}
+
+// WithPriority puts the streams into the priority class priority of the bandwidth limit. Defaults to 0.
+func WithPriority(priority int) BridgeOption {
+	return func(opts *bridgeOptions) { opts.priority = priority }
+}
+
+// WithCounters makes BridgeStreams add the bytes written to the backend to toBackend and those written to the client
+// to toClient as they are written. Both are accessed atomically and may be nil.
+func WithCounters(toBackend, toClient *int64) BridgeOption {
+	return func(opts *bridgeOptions) {
+		for direction, counter := range [bridgeDirections]*int64{ToBackend: toBackend, ToClient: toClient} {
+			if counter != nil {
+				opts.counters[direction] = append(opts.counters[direction], counter)
+			}
+		}
+	}
+}
+
+// withLimiter makes BridgeStreams use limiter instead of creating one.
+func withLimiter(limiter *bandwidthLimiter) BridgeOption {
+	return func(opts *bridgeOptions) { opts.limiter = limiter }
+}
+
+// writing wraps stream, which data is copied to in direction, so that writes are limited and counted as configured.
+func (o bridgeOptions) writing(ctx context.Context, direction CopyDirection, stream io.ReadWriteCloser,
+) io.ReadWriteCloser {
+	if len(o.counters[direction]) != 0 {
+		stream = countingStream{ReadWriteCloser: stream, counters: o.counters[direction]}
+	}
+
+	if o.limiter != nil {
+		stream = limitedStream{ReadWriteCloser: stream, done: ctx.Done(), limiter: o.limiter, priority: o.priority}
+	}
+
+	return stream
+}
+
+// transform returns source wrapped by the transformers of direction.
+func (o bridgeOptions) transform(direction CopyDirection, source io.Reader) io.Reader {
+	for _, transformer := range o.transformers[direction] {
+		source = transformer(source)
+	}
+
+	return source
+}
+
+// Bridge bridges pairs of streams that are not necessarily sockets, like SSH channels, pipes or TLS connections, with
+// the machinery tcp4to6 uses for its connections. All pairs share the options of the Bridge, including its bandwidth
+// limit, and are counted together. Create it with NewBridge and close it once it is not needed anymore.
+type Bridge struct {
+	log     logr.Logger
+	opts    []BridgeOption
+	traffic trafficCounters
+	// stop stops the bandwidth limiter.
+	stop context.CancelFunc
+}
+
+// NewBridge creates a Bridge that logs to log and bridges all pairs with opts.
+func NewBridge(log logr.Logger, opts ...BridgeOption) *Bridge {
+	bridge := &Bridge{log: log, stop: func() {}}
+	bridge.opts = append(opts[:len(opts):len(opts)], WithCounters(&bridge.traffic.received, &bridge.traffic.sent))
+
+	options := bridgeOptions{clock: systemClock{}, linger: HalfCloseUntilDone}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.bandwidthLimit > 0 {
+		var ctx context.Context
+
+		ctx, bridge.stop = context.WithCancel(context.Background())
+		limiter := newBandwidthLimiter(options.bandwidthLimit)
+		bridge.opts = append(bridge.opts, withLimiter(limiter))
+
+		go limiter.run(ctx, options.clock)
+	}
+
+	return bridge
+}
+
+// Bridge bridges dst, the stream towards the backend, and src, the one towards the client, like BridgeStreams with
+// the options of b followed by opts.
+func (b *Bridge) Bridge(ctx context.Context, dst, src io.ReadWriteCloser, opts ...BridgeOption) error {
+	atomic.AddInt64(&b.traffic.connections, 1)
+
+	return BridgeStreams(ctx, b.log, dst, src, append(b.opts[:len(b.opts):len(b.opts)], opts...)...)
+}
+
+// Stats returns the number of pairs b bridged and the bytes it copied so far, those of pairs still being bridged
+// included.
+func (b *Bridge) Stats() TrafficStats {
+	return TrafficStats{
+		Connections:   atomic.LoadInt64(&b.traffic.connections),
+		BytesReceived: atomic.LoadInt64(&b.traffic.received),
+		BytesSent:     atomic.LoadInt64(&b.traffic.sent),
+	}
+}
+
+// Close stops the bandwidth limiter of b. Pairs that are still bridged with a bandwidth limit stall until their context
+// is canceled, so it is called once they are done. It always returns nil.
+func (b *Bridge) Close() error {
+	b.stop()
+
+	return nil
+}
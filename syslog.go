@@ -0,0 +1,313 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+)
+
+const (
+	// syslogTimeFormat is the RFC 5424 timestamp format. The RFC allows at most six fractional digits.
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+	// syslogDialTimeout limits how long connecting to the syslog server may take.
+	syslogDialTimeout = 5 * time.Second
+	// syslogFacilityDaemon is the facility used if none is configured.
+	syslogFacilityDaemon = 3
+	// syslogSeverityError is the severity of error messages.
+	syslogSeverityError = 3
+	// syslogSeverityInfo is the severity of informational messages.
+	syslogSeverityInfo = 6
+	// syslogSeverityDebug is the severity of verbose informational messages.
+	syslogSeverityDebug = 7
+	// syslogMsgIDAccess is the MSGID of access log entries.
+	syslogMsgIDAccess = "access"
+	// syslogMsgIDLog is the MSGID of operational log messages.
+	syslogMsgIDLog = "log"
+	// syslogFacilityFactor is what the facility is multiplied with before the severity is added to form the PRI.
+	syslogFacilityFactor = 8
+	// syslogAddrParts is the number of parts a syslog address consists of: network and address.
+	syslogAddrParts = 2
+)
+
+var (
+	// errSyslogAddr is internally raised if the syslog address can not be understood.
+	errSyslogAddr = errors.New("syslog address must have the form network://address")
+	// errSyslogNetwork is internally raised if the syslog address uses an unsupported network.
+	errSyslogNetwork = errors.New("unsupported syslog network")
+	// errSyslogFacility is internally raised if the syslog facility is not known.
+	errSyslogFacility = errors.New("unknown syslog facility")
+	// errSyslogCA is internally raised if the syslog CA file does not contain any certificates.
+	errSyslogCA = errors.New("no certificates found in syslog CA file")
+)
+
+// syslogConfig describes where and how syslog messages are sent.
+type syslogConfig struct {
+	// network is one of unixgram, unix, udp, tcp or tls. Empty if syslog is disabled.
+	network string
+	// addr is the address of the syslog server in the given network.
+	addr string
+	// facility is the numerical syslog facility messages are sent with.
+	facility int
+	// appName is sent as APP-NAME with each message.
+	appName string
+	// caFile is the path to a PEM file with the certificates used to verify the server when network is tls.
+	// The system roots are used if empty.
+	caFile string
+}
+
+// parseAddr parses addr in the form network://address into cfg.
+func (cfg *syslogConfig) parseAddr(addr string) error {
+	parts := strings.SplitN(addr, "://", syslogAddrParts)
+	if len(parts) != syslogAddrParts || parts[1] == "" {
+		return errSyslogAddr
+	}
+
+	switch parts[0] {
+	case "unixgram", "unix", "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("%w: %s", errSyslogNetwork, parts[0])
+	}
+
+	cfg.network, cfg.addr = parts[0], parts[1]
+
+	return nil
+}
+
+// parseFacility sets the facility of cfg to the code of the facility called name.
+func (cfg *syslogConfig) parseFacility(name string) error {
+	codes := map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+		"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+
+	code, ok := codes[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", errSyslogFacility, name)
+	}
+
+	cfg.facility = code
+
+	return nil
+}
+
+// syslogClient sends RFC 5424 messages to a syslog server. Messages are sent one per datagram for datagram networks
+// and with octet counting framing (RFC 6587) for stream networks. The connection is established on first use and
+// reestablished once if sending fails.
+type syslogClient struct {
+	cfg      syslogConfig
+	hostname string
+	procID   string
+	mtx      sync.Mutex
+	conn     net.Conn
+}
+
+// newSyslogClient creates a syslogClient for cfg. It does not connect yet.
+func newSyslogClient(cfg syslogConfig) *syslogClient {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &syslogClient{cfg: cfg, hostname: hostname, procID: strconv.Itoa(os.Getpid())}
+}
+
+// dial connects to the syslog server.
+func (c *syslogClient) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+
+	if c.cfg.network != "tls" {
+		conn, err := dialer.Dial(c.cfg.network, c.cfg.addr)
+		if err != nil {
+			return nil, fmt.Errorf("dial syslog: %w", err)
+		}
+
+		return conn, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.cfg.caFile != "" {
+		pem, err := os.ReadFile(c.cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read syslog CA file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errSyslogCA
+		}
+	}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", c.cfg.addr, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("dial syslog: %w", err)
+	}
+
+	return conn, nil
+}
+
+// format renders msg as RFC 5424 message with the given severity and msgID, framed for the configured network.
+func (c *syslogClient) format(severity int, msgID string, msg []byte) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %s %s - ", c.cfg.facility*syslogFacilityFactor+severity,
+		time.Now().Format(syslogTimeFormat), c.hostname, c.cfg.appName, c.procID, msgID)
+	buf.Write(bytes.TrimRight(msg, "\n"))
+
+	switch c.cfg.network {
+	case "tcp", "tls", "unix":
+		return append([]byte(strconv.Itoa(buf.Len())+" "), buf.Bytes()...)
+	default:
+		return buf.Bytes()
+	}
+}
+
+// send sends msg with the given severity and msgID.
+func (c *syslogClient) send(severity int, msgID string, msg []byte) error {
+	frame := c.format(severity, msgID, msg)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var err error
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.conn == nil {
+			if c.conn, err = c.dial(); err != nil {
+				continue
+			}
+		}
+
+		if _, err = c.conn.Write(frame); err == nil {
+			return nil
+		}
+
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+
+	return fmt.Errorf("send syslog message: %w", err)
+}
+
+// Close closes the connection to the syslog server if there is one.
+func (c *syslogClient) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+
+	if err != nil {
+		return fmt.Errorf("close syslog connection: %w", err)
+	}
+
+	return nil
+}
+
+// syslogWriter is an io.Writer that sends each call to Write as one syslog message.
+type syslogWriter struct {
+	client   *syslogClient
+	severity int
+	msgID    string
+}
+
+// Write sends p as a single syslog message.
+func (w syslogWriter) Write(p []byte) (int, error) {
+	if err := w.client.send(w.severity, w.msgID, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// syslogSink is a logr.LogSink that sends log messages to a syslogClient. Errors are sent with severity error,
+// info messages with severity info or debug if their verbosity is greater than zero. Messages that can not be sent
+// are dropped since there is nobody left to tell.
+type syslogSink struct {
+	client    *syslogClient
+	formatter funcr.Formatter
+}
+
+// newSyslogSink creates a syslogSink that sends to client.
+func newSyslogSink(client *syslogClient) *syslogSink {
+	return &syslogSink{client: client, formatter: funcr.NewFormatter(funcr.Options{})}
+}
+
+// Init implements logr.LogSink.
+func (s *syslogSink) Init(info logr.RuntimeInfo) {
+	s.formatter.Init(info)
+}
+
+// Enabled implements logr.LogSink.
+func (s *syslogSink) Enabled(level int) bool {
+	return s.formatter.Enabled(level)
+}
+
+// Info implements logr.LogSink.
+func (s *syslogSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	severity := syslogSeverityInfo
+	if level > 0 {
+		severity = syslogSeverityDebug
+	}
+
+	_ = s.client.send(severity, syslogMsgIDLog, joinPrefix(s.formatter.FormatInfo(level, msg, keysAndValues)))
+}
+
+// Error implements logr.LogSink.
+func (s *syslogSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	_ = s.client.send(syslogSeverityError, syslogMsgIDLog, joinPrefix(s.formatter.FormatError(err, msg, keysAndValues)))
+}
+
+// WithValues implements logr.LogSink.
+func (s *syslogSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	clone := *s
+	clone.formatter.AddValues(keysAndValues)
+
+	return &clone
+}
+
+// WithName implements logr.LogSink.
+func (s *syslogSink) WithName(name string) logr.LogSink {
+	clone := *s
+	clone.formatter.AddName(name)
+
+	return &clone
+}
+
+// joinPrefix joins the outputs of funcr.Formatter.FormatInfo and FormatError to a single message.
+func joinPrefix(prefix, args string) []byte {
+	if prefix == "" {
+		return []byte(args)
+	}
+
+	return []byte(prefix + ": " + args)
+}
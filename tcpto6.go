@@ -12,7 +12,8 @@
 // If not, see <https://www.gnu.org/licenses/>.
 
 // Package tcpto6 provides an program that takes a net.Listener from systemd and accepts connections from it.
-// For each accepted connection it dials to a predefined tcp6 address and bridges the connection if the dial succeeds.
+// For each accepted connection it dials to a predefined address, tcp6 unless configured otherwise, and bridges the
+// connection if the dial succeeds.
 package tcpto6
 
 import (
@@ -22,144 +23,879 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"dev.eqrx.net/rungroup"
-	"github.com/coreos/go-systemd/v22/activation"
 	"github.com/go-logr/logr"
 )
 
-// ToAddrEnvName is the name of the environment variable that contains the address that should be dialed for accepted
-// connections. Must be in a format that net.Dial understands.
-const ToAddrEnvName = "TCPTO6_DESTINATION_ADDR"
-
 var (
-	// errEnvMissing is internally raised if an env var is missing.
-	errEnvMissing = errors.New("environment variable is not set")
-	// errUnexpectedSocketAmount is internally raised if systemd passed more or less then 1 sockets to us.
-	errUnexpectedSocketAmount = errors.New("systemd passed unexpected number of sockets")
+	// errUnexpectedSocketAmount is internally raised if the socket provider passed no sockets to us or several that can
+	// not be served together.
+	errUnexpectedSocketAmount = errors.New("socket provider passed unexpected number of sockets")
 )
 
-// Run fetches the listening socket from systemd, the target address from the env var and calls handleListener
-// with them. It closes the listener when the given context ctx is canceled.
+// proxy holds the state that is shared between all connections of a Run.
+type proxy struct {
+	// lastID is the id of the last accepted connection. Accessed atomically.
+	lastID uint64
+	// color is the color of the destinations new connections are sent to. Accessed atomically.
+	color int32
+	stats stats
+	log   logr.Logger
+	// cfg is the configuration the proxy was started with. Settings that can be reloaded are taken from the current
+	// generation instead.
+	cfg       Config
+	opts      options
+	accessLog *accessLog
+	// journal records the connections that open and close. Nil if disabled.
+	journal *journal
+	// anonymizer decides how client addresses are shown.
+	anonymizer *anonymizer
+	// reverse looks up the names of clients for the access log. Nil if disabled or if clients are anonymized.
+	reverse *reverseResolver
+	closers []io.Closer
+	conns   *connTable
+	control *controlServer
+	// gen holds the current *generation.
+	gen atomic.Value
+	// reloads receives reload requests from the control socket. The outcome is sent to the passed channel.
+	reloads chan chan error
+	status  reloadStatus
+	// limiter limits the bandwidth of all bridged connections. Nil if there is no limit.
+	limiter *bandwidthLimiter
+	// dialLimiter limits the dials in flight per destination. Nil if there is no limit.
+	dialLimiter *dialLimiter
+	// hold keeps track of connections that are held while their backend is unreachable.
+	hold *holdQueue
+	// resolver resolves the host names of destinations.
+	resolver *resolver
+	// webhook sends connection events to an HTTP endpoint. Nil if disabled.
+	webhook *webhook
+	// publisher publishes connection events to a NATS or MQTT broker. Nil if disabled.
+	publisher *eventPublisher
+	// shedding is 1 while new connections are shed because of resource pressure. Accessed atomically.
+	shedding int32
+	// draining is 1 once Proxy.Drain was called. Accessed atomically.
+	draining int32
+	// stopAccepting closes the listener of the run. It may be called several times.
+	stopAccepting func() error
+	// gate pauses accepting new connections.
+	gate acceptGate
+	// standby pauses accepting new connections while another instance is the leader.
+	standby acceptGate
+	// leaderUntil is the time in unix nanoseconds until which the leader accepts connections without having verified
+	// its lock again. Accessed atomically.
+	leaderUntil int64
+	// mappings holds the mappings enabled or disabled on the control socket.
+	mappings mappingSwitch
+	// clock tells the time for timeouts and backoffs.
+	clock Clock
+	// externalAddr holds the address the listener is reachable at through the port mapping of the NAT gateway as
+	// string. Empty while there is none.
+	externalAddr atomic.Value
+	// sources selects the addresses IPv6 backends are dialed from if a source interface is configured.
+	sources *sourceTracker
+	// build describes how the running binary was built.
+	build buildInfo
+	// metrics are the instruments measurements are reported with.
+	metrics proxyMetrics
+	// exposition holds the measurements served by the metrics endpoint. Nil if it is disabled.
+	exposition *exposition
+	// mappingTraffic counts the traffic by the local port connections were accepted on.
+	mappingTraffic trafficTable
+	// backendTraffic counts the traffic by the backend connections were bridged to.
+	backendTraffic trafficTable
+}
+
+// newProxy creates a proxy for cfg and opts and opens the files and connections it needs to log. If syslog is
+// configured, operational log messages are sent there in addition to log. Log messages carry the instance name, if
+// known.
+func newProxy(log logr.Logger, cfg Config, opts options) (*proxy, error) {
+	clock := opts.clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	prx := &proxy{
+		log:      log,
+		cfg:      cfg,
+		opts:     opts,
+		conns:    newConnTable(),
+		reloads:  make(chan chan error),
+		resolver: newResolver(opts.resolver, clock),
+		hold:     newHoldQueue(cfg.holdQueueSize),
+		clock:    clock,
+		sources:  newSourceTracker(),
+		build:    readBuildInfo(),
+	}
+
+	metrics := opts.metrics
+	if cfg.metricsAddr != "" {
+		prx.exposition = &exposition{}
+
+		metrics = prx.exposition
+		if opts.metrics != nil {
+			metrics = teeMetrics{opts.metrics, prx.exposition}
+		}
+	}
+
+	prx.metrics = newProxyMetrics(metrics)
+
+	prx.closers = append(prx.closers, prx.sources)
+
+	for _, cache := range opts.hookCaches {
+		cache.clock = clock
+	}
+
+	var err error
+	if prx.anonymizer, err = newAnonymizer(cfg.anonymize, clock); err != nil {
+		return nil, err
+	}
+
+	var accessWriters []io.Writer
+
+	if cfg.syslog.network != "" {
+		client := newSyslogClient(cfg.syslog)
+		prx.log = logr.New(teeSink{log.GetSink(), newSyslogSink(client)})
+		prx.closers = append(prx.closers, client)
+		accessWriters = append(accessWriters,
+			syslogWriter{client: client, severity: syslogSeverityInfo, msgID: syslogMsgIDAccess})
+	}
+
+	if cfg.instance != "" {
+		prx.log = prx.log.WithValues(instanceLabel, cfg.instance)
+	}
+
+	if cfg.accessLog.path != "" {
+		file, err := openRotatingFile(prx.log.WithName("accesslog"), cfg.accessLog, clock)
+		if err != nil {
+			_ = prx.close()
+
+			return nil, fmt.Errorf("access log: %w", err)
+		}
+
+		prx.closers = append(prx.closers, file)
+		accessWriters = append(accessWriters, file)
+	}
+
+	if cfg.journal.path != "" {
+		if prx.journal, err = openJournal(prx.log.WithName("journal"), cfg.journal, cfg.instance, prx.clock); err != nil {
+			_ = prx.close()
+
+			return nil, fmt.Errorf("journal: %w", err)
+		}
+
+		prx.closers = append(prx.closers, prx.journal)
+	}
+
+	if len(accessWriters) != 0 {
+		prx.accessLog = &accessLog{w: io.MultiWriter(accessWriters...)}
+
+		if cfg.reverseDNS && cfg.anonymize == anonymizeOff {
+			prx.reverse = newReverseResolver(opts.resolver, clock)
+		}
+	}
+
+	if cfg.bandwidthLimit > 0 {
+		prx.limiter = newBandwidthLimiter(cfg.bandwidthLimit)
+	}
+
+	if cfg.dialConcurrency > 0 {
+		prx.dialLimiter = newDialLimiter(cfg.dialConcurrency, prx.clock)
+	}
+
+	if cfg.webhook.url != "" {
+		prx.webhook = newWebhook(prx.log.WithName("webhook"), cfg.webhook, cfg.instance, prx.clock)
+	}
+
+	if cfg.broker.protocol != "" {
+		prx.publisher = newEventPublisher(prx.log.WithName("events"), cfg.broker, cfg.instance, prx.clock)
+	}
+
+	gen, err := newGeneration(prx, cfg, nil)
+	if err != nil {
+		_ = prx.close()
+
+		return nil, err
+	}
+
+	prx.gen.Store(gen)
+
+	prx.control = newControlServer(prx.log.WithName("control"))
+	prx.control.register("top", topCommand(prx.conns, prx.clock))
+	prx.control.register("conns", connsCommand(prx.conns))
+	prx.control.register("traffic", trafficCommand(prx))
+	prx.control.register("reload", reloadCommand(prx))
+	prx.control.register("config", configCommand(prx))
+	prx.control.register("version", versionCommand(prx))
+	prx.control.register("switch", switchCommand(prx))
+	prx.control.register("pause", pauseCommand(prx))
+	prx.control.register("resume", resumeCommand(prx))
+	prx.control.register("leader", leaderCommand(prx))
+	prx.control.register("disable", mappingCommand(prx, "disable", true))
+	prx.control.register("enable", mappingCommand(prx, "enable", false))
+
+	return prx, nil
+}
+
+// close releases all resources acquired by newProxy in the reverse order they were acquired, so the operational log
+// goes last and can still be written to while the others close. The errors of all that failed are joined.
+func (p *proxy) close() error {
+	errs := make([]error, 0, len(p.closers))
+
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		errs = append(errs, p.closers[i].Close())
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("close proxy: %w", err)
+	}
+
+	return nil
+}
+
+// Run fetches the listening socket from systemd, the configuration from the env vars and calls handleListener
+// with them. It closes the listener when the given context ctx is canceled. WithSocketProvider makes Run take the
+// socket from somewhere else, as does setting ForwardedFDEnvName or ListenAddrEnvName.
 //
 // The source code repository contains the directory /init with an example .service and .socket file.
-func Run(ctx context.Context, log logr.Logger) error {
-	toAddr, ok := os.LookupEnv(ToAddrEnvName)
-	if !ok {
-		return fmt.Errorf("%w: %s", errEnvMissing, ToAddrEnvName)
+func Run(ctx context.Context, log logr.Logger, opts ...Option) error {
+	cfg, err := LoadConfig(settingsLookup(collectOptions(opts).settings, os.LookupEnv))
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	return RunWithConfig(ctx, log, cfg, opts...)
+}
+
+// RunWithConfig is like Run but takes the configuration from cfg instead of the env vars.
+func RunWithConfig(ctx context.Context, log logr.Logger, cfg Config, opts ...Option) error {
+	runOpts := collectOptions(opts)
+
+	if cfg.lockFile != "" {
+		lock, err := lockInstance(cfg.lockFile)
+		if err != nil {
+			return fmt.Errorf("instance lock: %w", err)
+		}
+
+		defer lock.Close()
+	}
+
+	provider := runOpts.sockets
+
+	switch {
+	case provider != nil:
+	case cfg.forwardedFD != noForwardedFD:
+		provider = ForwardedConn{File: os.NewFile(uintptr(cfg.forwardedFD), "forwarded")}
+	case len(cfg.listenAddrs) != 0:
+		provider = cfg.listenAddrs
+	default:
+		provider = SystemdSockets{}
+	}
+
+	var (
+		listeners []net.Listener
+		err       error
+	)
+
+	if named, ok := provider.(namedSocketProvider); ok {
+		var names []string
+
+		listeners, names, err = named.namedListeners()
+		runOpts.socketAddrs = newSocketAddrs(listeners, names)
+	} else {
+		listeners, err = provider.Listeners()
 	}
 
-	listeners, err := activation.Listeners()
 	if err != nil {
-		return fmt.Errorf("systemd sockets: %w", err)
+		return fmt.Errorf("sockets: %w", err)
+	}
+
+	listener, err := groupListeners(log, listeners, len(cfg.portDestinations) != 0 || len(cfg.socketDestinations) != 0)
+	if err != nil {
+		return err
+	}
+
+	return run(ctx, log, listener, cfg, runOpts)
+}
+
+// RunWithListener forwards connections accepted from listener to destination without involving systemd or env vars.
+// All other settings have their default values. The listener is closed when RunWithListener returns.
+func RunWithListener(ctx context.Context, log logr.Logger, listener net.Listener, destination string,
+	opts ...Option,
+) error {
+	return run(ctx, log, listener, NewConfig(destination), collectOptions(opts))
+}
+
+// run serves listener with cfg until ctx is canceled or a background task fails and closes listener. Shutdown closes
+// the listener and lets the connections flush and close, stops the background tasks after that and closes the
+// resources of the proxy last. The errors of all these steps are joined.
+func run(ctx context.Context, log logr.Logger, listener net.Listener, cfg Config, runOpts options) error {
+	for _, member := range listenerMembers(listener) {
+		if err := cfg.expectListen.check(member.Addr()); err != nil {
+			_ = listener.Close()
+
+			return fmt.Errorf("listener: %w", err)
+		}
+	}
+
+	prx, err := newProxy(log, cfg, runOpts)
+	if err != nil {
+		_ = listener.Close()
+
+		return err
+	}
+
+	var controlListener net.Listener
+
+	if cfg.controlSocket != "" {
+		if controlListener, err = listenControl(cfg.controlSocket); err != nil {
+			_ = prx.close()
+			_ = listener.Close()
+
+			return err
+		}
+	}
+
+	var metricsListener net.Listener
+
+	if cfg.metricsAddr != "" {
+		if metricsListener, err = listenMetrics(cfg.metricsAddr); err != nil {
+			_ = prx.close()
+			_ = listener.Close()
+
+			if controlListener != nil {
+				_ = controlListener.Close()
+			}
+
+			return err
+		}
+	}
+
+	var closeOnce sync.Once
+
+	prx.stopAccepting = func() (err error) {
+		closeOnce.Do(func() { err = listener.Close() })
+
+		return err
+	}
+
+	if runOpts.proxy != nil {
+		if err := runOpts.proxy.attach(prx); err != nil {
+			_ = prx.close()
+			_ = listener.Close()
+
+			if controlListener != nil {
+				_ = controlListener.Close()
+			}
+
+			if metricsListener != nil {
+				_ = metricsListener.Close()
+			}
+
+			return err
+		}
+	}
+
+	runCtx, stopRun := context.WithCancel(ctx)
+	defer stopRun()
+
+	// Background tasks keep going until all connections are done, so e.g. the bandwidth limiter keeps serving them
+	// while they flush and the webhook still gets their close events.
+	tasksCtx, stopTasks := context.WithCancel(context.Background())
+	defer stopTasks()
+
+	group, tasks := rungroup.New(runCtx), rungroup.New(tasksCtx)
+
+	task := func(fn func(ctx context.Context) error, opts ...rungroup.Option) {
+		tasks.Go(func(ctx context.Context) error {
+			err := fn(ctx)
+			if err != nil {
+				stopRun()
+			}
+
+			return err
+		}, opts...)
+	}
+
+	if cfg.leader.enabled() {
+		prx.standby.pause()
+
+		group.Go(func(ctx context.Context) error {
+			prx.elect(ctx, cfg.leader)
+
+			return nil
+		}, rungroup.NoCancelOnSuccess)
+	}
+
+	serveListener(group, prx.stopAccepting, func(ctx context.Context) error {
+		if err := prx.handleListener(ctx, group, listener); err != nil || atomic.LoadInt32(&prx.draining) == 0 {
+			return err
+		}
+
+		// The listener was closed by Drain, connections keep going until the run is stopped.
+		<-ctx.Done()
+
+		return nil
+	})
+
+	if controlListener != nil {
+		serveListener(group, controlListener.Close, func(context.Context) error {
+			return prx.control.serve(group, controlListener)
+		})
+	}
+
+	if metricsListener != nil {
+		group.Go(func(ctx context.Context) error {
+			return prx.exposition.serve(ctx, metricsListener)
+		}, rungroup.NoCancelOnSuccess)
+	}
+
+	if prx.journal != nil {
+		task(func(ctx context.Context) error {
+			prx.journal.run(ctx, prx.log.WithName("journal"), cfg.journal.syncInterval)
+
+			return nil
+		})
+	}
+
+	if cfg.summaryInterval > 0 {
+		task(func(ctx context.Context) error {
+			prx.logSummaries(ctx, cfg.summaryInterval)
+
+			return nil
+		})
+	}
+
+	if cfg.health.enabled() {
+		task(func(ctx context.Context) error {
+			return prx.watchHealth(ctx, cfg.health)
+		})
+	}
+
+	if cfg.shed.enabled() {
+		task(func(ctx context.Context) error {
+			prx.watchShed(ctx, cfg.shed)
+
+			return nil
+		})
+	}
+
+	if prx.limiter != nil {
+		task(func(ctx context.Context) error {
+			prx.limiter.run(ctx, prx.clock)
+
+			return nil
+		})
+	}
+
+	if cfg.dnsRegister.enabled() {
+		group.Go(func(ctx context.Context) error {
+			prx.registerDNS(ctx, cfg.dnsRegister, listener)
+
+			return nil
+		}, rungroup.NoCancelOnSuccess)
+	}
+
+	if cfg.mdns.enabled() {
+		group.Go(func(ctx context.Context) error {
+			prx.advertiseMDNS(ctx, cfg.mdns, listener)
+
+			return nil
+		}, rungroup.NoCancelOnSuccess)
+	}
+
+	if cfg.portMapping.enabled() {
+		group.Go(func(ctx context.Context) error {
+			prx.mapPorts(ctx, cfg.portMapping, listener)
+
+			return nil
+		}, rungroup.NoCancelOnSuccess)
+	}
+
+	if cfg.listenCheckInterval > 0 && tcpListener(listener) {
+		group.Go(func(ctx context.Context) error {
+			prx.watchListenQueue(ctx, listener, cfg.listenCheckInterval)
+
+			return nil
+		}, rungroup.NoCancelOnSuccess)
+	}
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	defer signal.Stop(reloads)
+
+	task(func(ctx context.Context) error {
+		prx.maintain(ctx, reloads)
+
+		return nil
+	})
+
+	if cfg.push.url != "" {
+		task(func(ctx context.Context) error {
+			prx.pushMetrics(ctx, cfg.push)
+
+			return nil
+		})
+	}
+
+	if prx.webhook != nil {
+		task(func(ctx context.Context) error {
+			prx.webhook.run(ctx)
+
+			return nil
+		})
 	}
 
-	if len(listeners) != 1 {
-		return fmt.Errorf("%w: %v", errUnexpectedSocketAmount, listeners)
+	if prx.publisher != nil {
+		task(func(ctx context.Context) error {
+			prx.publisher.run(ctx)
+
+			return nil
+		})
 	}
 
-	listener := listeners[0]
+	if err = group.Wait(); err != nil {
+		err = fmt.Errorf("listening group: %w", err)
+	}
+
+	stopTasks()
+
+	tasksErr := tasks.Wait()
+	if tasksErr != nil {
+		tasksErr = fmt.Errorf("background tasks: %w", tasksErr)
+	}
 
-	group := rungroup.New(ctx)
+	return errors.Join(err, tasksErr, prx.close())
+}
 
-	group.Go(func(context.Context) error { return handleListener(group, log, toAddr, listener) })
+// serveListener dispatches serve into group and closes the listener served by it with closeListener when the group
+// is asked to stop. This causes the goroutine blocked in accept to return.
+func serveListener(group *rungroup.Group, closeListener func() error, serve func(ctx context.Context) error) {
+	group.Go(serve)
 
-	// Close the listener when the group is asked to stop. This will cause the goroutine blocked in accept to return.
 	group.Go(func(ctx context.Context) error {
 		<-ctx.Done()
-		if err := listener.Close(); err != nil {
+		if err := closeListener(); err != nil {
 			return fmt.Errorf("close listener: %w", err)
 		}
 
 		return nil
 	})
+}
 
-	if err := group.Wait(); err != nil {
-		return fmt.Errorf("listening group: %w", err)
-	}
-
-	return nil
+// finishNotifier is implemented by listeners that want to know when connections they handed out are done.
+type finishNotifier interface {
+	finished()
 }
 
-// handleListener accepts from the given listener until it is closed. Closing the listener causes the method to return
-// with nil. If accept returns any error other than net.ErrClosed error, it is returned. For each accepted
-// connection a routine will be dispatched in the given rungroup group with NoCancelOnSuccess set and tasked
-// to call handleConn.
-func handleListener(group *rungroup.Group, log logr.Logger, toAddr string, l net.Listener) error {
+// handleListener accepts from the given listener until it is closed or ctx is canceled, which causes the method to
+// return with nil. While accepting is paused or another instance is the leader, the listener is left alone. After
+// recoverable errors, like running out of file descriptors, accepting is restarted with a growing delay and the
+// restart is counted. Any other error is returned. While connections are shed, accepted connections not exempt from
+// limits are closed right away. Otherwise a routine will be dispatched for each of them in the given rungroup group
+// with NoCancelOnSuccess set and tasked to call handleConn.
+func (p *proxy) handleListener(ctx context.Context, group *rungroup.Group, l net.Listener) error {
+	notifier, _ := l.(finishNotifier)
+
+	var backoff acceptBackoff
+
 	for {
+		if !p.gate.wait(ctx) || !p.standby.wait(ctx) {
+			return nil
+		}
+
 		from, err := l.Accept()
 
 		switch {
 		case err == nil:
+			backoff.reset()
 		case errors.Is(err, net.ErrClosed):
 			return nil
+		case recoverableAccept(err):
+			delay := backoff.next()
+
+			atomic.AddInt64(&p.stats.acceptRestarts, 1)
+			p.metrics.acceptRestarts.Add(1)
+			p.log.Error(err, "couldn't accept new connection, restarting accept loop", "delay", delay.String())
+			if !sleepUnlessDone(ctx, p.clock, delay) {
+				return nil
+			}
+
+			continue
 		default:
 			return fmt.Errorf("accept new connection: %w", err)
 		}
 
+		p.fenceLeader()
+
+		// Accept was most likely already waiting when accepting was paused, so the connection waits for the resume.
+		if !p.gate.wait(ctx) || !p.standby.wait(ctx) {
+			_ = from.Close()
+
+			if notifier != nil {
+				notifier.finished()
+			}
+
+			return nil
+		}
+
+		if p.rejectClient(from) {
+			if notifier != nil {
+				notifier.finished()
+			}
+
+			continue
+		}
+
+		if atomic.LoadInt32(&p.shedding) != 0 && !p.generation().cfg.limitExempt.contains(from.RemoteAddr()) {
+			atomic.AddInt64(&p.stats.shed, 1)
+			p.metrics.shed.Add(1)
+			_ = from.Close()
+
+			if notifier != nil {
+				notifier.finished()
+			}
+
+			continue
+		}
+
 		group.Go(func(ctx context.Context) error {
-			handleConn(ctx, log, from, toAddr)
+			p.handleConn(ctx, from)
+
+			if notifier != nil {
+				notifier.finished()
+			}
 
 			return nil
 		}, rungroup.NoCancelOnSuccess)
 	}
 }
 
-// handleConn tries to dial a tcp6 to the net.Dial compatible address toAddr once. If this succeeds, the given net.Conn
-// src read and write channels get bridged to the write and read channels of the dialed connection respectively.
-// Errors are logged using the logger log.
-func handleConn(ctx context.Context, log logr.Logger, src net.Conn, dstAddr string) {
-	dst, err := (&net.Dialer{}).DialContext(ctx, "tcp6", dstAddr)
+// handleConn runs the handshake steps on src and tries to dial the destination address as often as
+// configured. Unless a handshake step decided otherwise, the destination is the one configured for the local port. If
+// all attempts fail, the client is told so as configured.
+// If this succeeds, the given net.Conn src read and write channels get bridged to the write and read channels of the
+// dialed connection respectively. Errors are logged using the logger of the proxy. An access log entry is written
+// when the connection is done. The connection sticks to the generation that is current when handleConn is called.
+func (p *proxy) handleConn(ctx context.Context, src net.Conn) {
+	gen := p.generation()
+	local := src.LocalAddr()
+	conn := newConnection(atomic.AddUint64(&p.lastID, 1), src,
+		gen.cfg.destinationOf(local, p.opts.socketAddrs.nameOf(local)), p.clock)
+	conn.shownClient = p.anonymizer.addr(conn.client)
+	conn.limitExempt = gen.cfg.limitExempt.contains(conn.client)
+	p.conns.add(conn)
+
+	if p.cfg.instance != "" {
+		conn.addLabels(Labels{instanceLabel: p.cfg.instance})
+	}
+
+	mappingCounters := p.mappingTraffic.get(mappingOf(conn.local))
+	atomic.AddInt64(&mappingCounters.connections, 1)
+	atomic.AddInt64(&p.stats.accepted, 1)
+	p.metrics.accepted.Add(1)
+	p.metrics.active.Add(1)
+
+	if p.webhook != nil || p.publisher != nil || p.journal != nil {
+		entry := conn.accessEntry()
+		p.notifyConn(connEvent{Event: connEventOpen, accessEntry: entry})
+		p.journalConn(connEventOpen, entry)
+	}
+
+	if p.reverse != nil {
+		p.reverse.prefetch(conn.client)
+	}
+
+	defer p.finishConn(gen, conn)
+
+	if p.rejectDisabled(gen, conn, src) {
+		return
+	}
+
+	accepted := src
+
+	src, err := gen.handshake(ctx, conn, src)
 	if err != nil {
-		log.Error(err, "couldn't connect to dstAddr. closing accepted connection")
+		atomic.AddInt64(&p.stats.handshakeFailures, 1)
+		p.metrics.handshakeFailures.Add(1)
+		p.reject(conn, src, err, "handshake failed. closing accepted connection")
 
-		if err := src.Close(); err != nil {
-			log.Error(err, "couldn't close accepted connection")
-		}
+		return
+	}
+
+	if conn.destination == "" {
+		p.reject(conn, src, fmt.Errorf("%w %s", errNoDestination, conn.local), "no destination. closing accepted connection")
+
+		return
+	}
+
+	conn.setState(connStateDialing)
+	atomic.AddInt64(&p.stats.dials, 1)
+
+	dialStarted := p.clock.Now()
+
+	dst, attempts, err := p.dial(ctx, gen.cfg.dial, conn)
+	if err != nil {
+		atomic.AddInt64(&p.stats.dialFailures, 1)
+		p.metrics.dialFailures.Add(1)
+		p.metrics.dialDuration.Observe(p.clock.Now().Sub(dialStarted).Seconds(), metricResultFailed)
+		p.dialFailed(ctx, gen, conn, accepted, src, attempts)
+		p.reject(conn, src, err, "couldn't connect to dstAddr. closing accepted connection")
+
+		return
+	}
+
+	p.metrics.dialDuration.Observe(p.clock.Now().Sub(dialStarted).Seconds(), metricResultReached)
+	conn.setBackend(dst.RemoteAddr().String())
+	conn.setState(connStateBridging)
+
+	backendCounters := p.backendTraffic.get(dst.RemoteAddr().String())
+	atomic.AddInt64(&backendCounters.connections, 1)
+
+	// A replayStream counts the traffic of the backend itself, since the backend may change.
+	backend := dst
+	toBackendCounters := []*int64{&conn.received, &p.stats.received, &mappingCounters.received}
+	toClientCounters := []*int64{&conn.sent, &p.stats.sent, &mappingCounters.sent}
+
+	if gen.cfg.replay.size > 0 {
+		backend = p.newReplayStream(ctx, gen.cfg.dial, gen.cfg.replay, conn, dst, backendCounters)
 	} else {
-		bridgeStreams(ctx, log, dst, src)
+		toBackendCounters = append(toBackendCounters, &backendCounters.received)
+		toClientCounters = append(toClientCounters, &backendCounters.sent)
+	}
+
+	var toBackend, toClient io.ReadWriteCloser = countingStream{
+		ReadWriteCloser: backend,
+		counters:        toBackendCounters,
+		writing:         &conn.writing[writingToBackend],
+		clock:           p.clock,
+	}, countingStream{
+		ReadWriteCloser: src,
+		counters:        toClientCounters,
+		writing:         &conn.writing[writingToClient],
+		clock:           p.clock,
+	}
+
+	if p.limiter != nil && !conn.limitExempt {
+		priority := gen.cfg.priorityPorts.priorityOf(conn)
+		toBackend = limitedStream{ReadWriteCloser: toBackend, done: ctx.Done(), limiter: p.limiter, priority: priority}
+		toClient = limitedStream{ReadWriteCloser: toClient, done: ctx.Done(), limiter: p.limiter, priority: priority}
+	}
+
+	if gen.cfg.stuckThreshold > 0 {
+		done := make(chan struct{})
+		defer close(done)
+
+		go p.watchStuck(done, gen.cfg.stuckThreshold, conn, toBackend, toClient, backend, src)
+	}
+
+	if gen.cfg.peerProbeInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+
+		go p.probeQuietPeers(done, gen.cfg.peerProbeInterval, conn, backend, conn.accepted)
+	}
+
+	bridgeOpts := []BridgeOption{
+		WithShutdownGrace(gen.cfg.shutdownGrace), WithCloseOrder(gen.cfg.closeOrder), WithReadAhead(gen.cfg.readAhead),
+		WithBufferSizes(gen.cfg.copyBufferMin, gen.cfg.copyBufferMax), WithHalfClose(gen.cfg.halfCloseLinger),
+		WithConns(backend, src), WithBridgeClock(p.clock),
+	}
+
+	if gen.cfg.splice {
+		bridgeOpts = append(bridgeOpts, WithSplice())
+	}
+
+	if sampleLatency(conn.id, gen.cfg.copyLatencySample) {
+		bridgeOpts = append(bridgeOpts, WithCopyLatency(p.metrics.observeCopyLatency))
+	}
+
+	conn.err = BridgeStreams(ctx, p.anonymizer.logger(p.log, conn.client), toBackend, toClient, bridgeOpts...)
+
+	if reason, peer := closeReason(conn.err); reason == closeReasonKeepalive || reason == closeReasonRetransmit {
+		p.log.Info("peer stopped responding, closed bridge", "id", conn.id, "peer", peer, "closeReason", reason)
 	}
 }
 
-// bridgeStreams copies all data between the streams to and from until an operations returns an error. This error is
-// then logged and both interfaces are closed.
-func bridgeStreams(ctx context.Context, log logr.Logger, dst, src io.ReadWriteCloser) {
-	group := rungroup.New(ctx)
+// reject records err as the reason conn could not be bridged, logs it with msg and closes src.
+func (p *proxy) reject(conn *connection, src net.Conn, err error, msg string) {
+	conn.err = err
 
-	group.Go(func(context.Context) error {
-		if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Error(err, "copy from->to failed")
-		}
+	p.log.Error(p.anonymizer.scrubErr(err, conn.client), msg)
 
-		return nil
-	})
-	group.Go(func(context.Context) error {
-		if _, err := io.Copy(src, dst); err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Error(err, "copy from<-to failed")
-		}
+	if err := src.Close(); err != nil {
+		p.log.Error(err, "couldn't close accepted connection")
+	}
+}
 
-		return nil
-	})
-	group.Go(func(ctx context.Context) error {
-		<-ctx.Done()
+// finishConn removes conn from the connection table, accounts its traffic by labels, writes its access log entry and
+// journal record and sends the close event. Health probes as configured by gen are only counted as such and not
+// written to the access log.
+func (p *proxy) finishConn(gen *generation, conn *connection) {
+	p.conns.remove(conn)
 
-		if err := dst.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Error(err, "could not close from stream")
-		}
+	probe := isProbe(gen.cfg.probeClients, conn)
+	if probe {
+		p.countProbe(conn)
+	} else {
+		p.stats.labeled.add(conn.snapshot())
+	}
 
-		return nil
-	})
-	group.Go(func(ctx context.Context) error {
-		<-ctx.Done()
+	p.metrics.finished(conn, probe)
 
-		if err := src.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Error(err, "could not close to stream")
-		}
+	if p.accessLog == nil && p.webhook == nil && p.publisher == nil && p.journal == nil {
+		return
+	}
 
-		return nil
-	})
+	entry := conn.accessEntry()
+	entry.Error = p.anonymizer.scrub(entry.Error, conn.client)
+
+	if p.reverse != nil {
+		entry.ClientName = p.reverse.name(conn.client)
+	}
+
+	p.notifyConn(connEvent{Event: connEventClose, accessEntry: entry})
+	p.journalConn(connEventClose, entry)
+
+	if p.accessLog == nil || probe {
+		return
+	}
+
+	if err := p.accessLog.write(entry); err != nil {
+		p.log.Error(err, "couldn't write access log entry")
+	}
+}
+
+// journalConn records event, connEventOpen or connEventClose, for the connection of entry in the journal, if it is
+// enabled.
+func (p *proxy) journalConn(event string, entry accessEntry) {
+	if p.journal == nil {
+		return
+	}
+
+	record := p.journal.closed
+	if event == connEventOpen {
+		record = p.journal.opened
+	}
+
+	if err := record(entry); err != nil {
+		p.log.Error(err, "couldn't write journal record")
+	}
+}
+
+// notifyConn passes event to the webhook and the event broker, if they are configured.
+func (p *proxy) notifyConn(event connEvent) {
+	if p.webhook != nil {
+		p.webhook.notify(event)
+	}
 
-	if err := group.Wait(); err != nil {
-		panic("did not expect errors")
+	if p.publisher != nil {
+		p.publisher.notify(event)
 	}
 }
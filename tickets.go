@@ -0,0 +1,124 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// ticketKeyLen is the length of a session ticket key.
+	ticketKeyLen = 32
+	// ticketKeyRotation is the time after which generated session ticket keys are replaced.
+	ticketKeyRotation = 24 * time.Hour
+	// ticketKeysKept is the number of generated session ticket keys that are accepted for resumption, including the
+	// one used for new tickets.
+	ticketKeysKept = 3
+)
+
+// errTicketKeyFile is raised if a session ticket key file has an invalid length.
+var errTicketKeyFile = errors.New("session ticket key file must contain a non zero multiple of 32 bytes")
+
+// ticketKeys manages the session ticket keys of a tls.Config. The keys are either generated and rotated in process
+// or read from a file that may be shared with other instances. In both cases they stay the same as long as the
+// process runs or the file does not change, so clients can resume sessions.
+type ticketKeys struct {
+	config *tls.Config
+	// path is the file the keys are read from. Keys are generated if empty.
+	path string
+	// modTime is the modification time of the file when it was read.
+	modTime time.Time
+	// keys are the keys in use, the first one encrypts new tickets.
+	keys [][ticketKeyLen]byte
+	// rotated is the time the first generated key was created.
+	rotated time.Time
+	// clock tells when generated keys are due.
+	clock Clock
+}
+
+// newTicketKeys sets up session ticket keys for config from the file at path or by generating them, which are rotated
+// on clock.
+func newTicketKeys(config *tls.Config, path string, clock Clock) (*ticketKeys, error) {
+	keys := &ticketKeys{config: config, path: path, clock: clock}
+
+	return keys, keys.update()
+}
+
+// rebind moves the keys over to config. It is used to keep keys when config is replaced.
+func (t *ticketKeys) rebind(config *tls.Config) {
+	t.config = config
+	t.config.SetSessionTicketKeys(t.keys)
+}
+
+// update reads the key file again if it changed or rotates generated keys if they are due.
+func (t *ticketKeys) update() error {
+	if t.path == "" {
+		return t.rotate()
+	}
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return fmt.Errorf("stat session ticket key file: %w", err)
+	}
+
+	if t.keys != nil && info.ModTime().Equal(t.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("read session ticket key file: %w", err)
+	}
+
+	if len(data) == 0 || len(data)%ticketKeyLen != 0 {
+		return errTicketKeyFile
+	}
+
+	keys := make([][ticketKeyLen]byte, len(data)/ticketKeyLen)
+	for i := range keys {
+		copy(keys[i][:], data[i*ticketKeyLen:])
+	}
+
+	t.keys, t.modTime = keys, info.ModTime()
+	t.config.SetSessionTicketKeys(keys)
+
+	return nil
+}
+
+// rotate generates a new key if the current one is due, keeping the newest older ones for resumption.
+func (t *ticketKeys) rotate() error {
+	if t.keys != nil && t.clock.Now().Sub(t.rotated) < ticketKeyRotation {
+		return nil
+	}
+
+	var key [ticketKeyLen]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("generate session ticket key: %w", err)
+	}
+
+	t.keys = append([][ticketKeyLen]byte{key}, t.keys...)
+	if len(t.keys) > ticketKeysKept {
+		t.keys = t.keys[:ticketKeysKept]
+	}
+
+	t.rotated = t.clock.Now()
+	t.config.SetSessionTicketKeys(t.keys)
+
+	return nil
+}
@@ -0,0 +1,400 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Specificities of sniRoute patterns, see sniRoute.specificity.
+const (
+	sniSpecificityNone = iota
+	sniSpecificityAny
+	sniSpecificityWildcard
+	sniSpecificityExact
+)
+
+// tlsMode describes what happens with TLS connections that match a sniRoute.
+type tlsMode int
+
+const (
+	// tlsPassthrough forwards the raw TLS stream to the backend.
+	tlsPassthrough tlsMode = iota
+	// tlsTerminate decrypts the TLS stream and forwards the plaintext to the backend.
+	tlsTerminate
+	// tlsReencrypt decrypts the TLS stream and forwards it over a new TLS connection to the backend.
+	tlsReencrypt
+)
+
+const (
+	// sniRouteParts is the number of parts an SNI route consists of: pattern and target.
+	sniRouteParts = 2
+	// sniTargetParts is the number of parts the target of an SNI route consists of: mode and address.
+	sniTargetParts = 2
+	// certificateParts is the number of parts a certificate configuration consists of: certificate and key file.
+	certificateParts = 2
+)
+
+var (
+	// errSNIRoute is raised if an SNI route can not be parsed.
+	errSNIRoute = errors.New("SNI route must have the form pattern=mode:address")
+	// errTLSMode is raised if an SNI route uses an unknown mode.
+	errTLSMode = errors.New("unknown TLS mode")
+	// errCertificate is raised if a certificate configuration can not be parsed.
+	errCertificate = errors.New("certificate must have the form certfile:keyfile")
+	// errNoCertificates is raised if TLS connections should be terminated but no certificates are configured.
+	errNoCertificates = errors.New("terminating TLS requires certificates")
+	// errBackendCA is raised if the backend CA file does not contain any certificates.
+	errBackendCA = errors.New("no certificates found in backend CA file")
+)
+
+// sniRoute maps TLS connections requesting a server name to a backend.
+type sniRoute struct {
+	// pattern is matched against the server name. It is either a host name, a wildcard like *.example.com matching
+	// exactly one additional label, or * matching everything including connections without SNI.
+	pattern string
+	// protocol restricts the route to connections using the given ALPN protocol. Passthrough routes apply if the
+	// client offers the protocol, other routes if it is negotiated during termination. Empty for the fallback route of
+	// a pattern that applies regardless of ALPN.
+	protocol string
+	// mode describes how the connection is forwarded.
+	mode tlsMode
+	// addr is the backend address the connection is forwarded to.
+	addr string
+}
+
+// matches reports if the route applies to serverName.
+func (r sniRoute) matches(serverName string) bool {
+	switch {
+	case r.pattern == "*":
+		return true
+	case strings.HasPrefix(r.pattern, "*."):
+		dot := strings.IndexByte(serverName, '.')
+
+		return dot > 0 && strings.EqualFold(serverName[dot:], r.pattern[1:])
+	default:
+		return strings.EqualFold(serverName, r.pattern)
+	}
+}
+
+// specificity ranks how specific the pattern of the route is. Exact names win over wildcards, which win over *.
+func (r sniRoute) specificity() int {
+	switch {
+	case r.pattern == "*":
+		return sniSpecificityAny
+	case strings.HasPrefix(r.pattern, "*."):
+		return sniSpecificityWildcard
+	default:
+		return sniSpecificityExact
+	}
+}
+
+// labels returns the labels attached to connections taking the route.
+func (r sniRoute) labels() Labels {
+	name := r.pattern
+	if r.protocol != "" {
+		name += "/" + r.protocol
+	}
+
+	return Labels{"route": name}
+}
+
+// sniRoutes is a table of sniRoute values.
+type sniRoutes []sniRoute
+
+// parseSNIRoutes parses whitespace separated routes in the form pattern[/protocol]=mode:address. Mode is one of
+// passthrough, terminate or reencrypt.
+func parseSNIRoutes(value string) (sniRoutes, error) {
+	var routes sniRoutes
+
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, "=", sniRouteParts)
+		if len(parts) != sniRouteParts {
+			return nil, fmt.Errorf("%w: %s", errSNIRoute, field)
+		}
+
+		target := strings.SplitN(parts[1], ":", sniTargetParts)
+		if len(target) != sniTargetParts || parts[0] == "" || target[1] == "" {
+			return nil, fmt.Errorf("%w: %s", errSNIRoute, field)
+		}
+
+		route := sniRoute{pattern: strings.ToLower(parts[0]), addr: target[1]}
+
+		if slash := strings.IndexByte(route.pattern, '/'); slash >= 0 {
+			route.pattern, route.protocol = route.pattern[:slash], parts[0][slash+1:]
+			if route.pattern == "" || route.protocol == "" {
+				return nil, fmt.Errorf("%w: %s", errSNIRoute, field)
+			}
+		}
+
+		switch target[0] {
+		case "passthrough":
+			route.mode = tlsPassthrough
+		case "terminate":
+			route.mode = tlsTerminate
+		case "reencrypt":
+			route.mode = tlsReencrypt
+		default:
+			return nil, fmt.Errorf("%w: %s", errTLSMode, target[0])
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// candidates returns all routes sharing the most specific pattern that matches serverName.
+func (r sniRoutes) candidates(serverName string) sniRoutes {
+	var best sniRoutes
+
+	bestRank := sniSpecificityNone
+
+	for _, route := range r {
+		if !route.matches(serverName) {
+			continue
+		}
+
+		switch rank := route.specificity(); {
+		case rank > bestRank:
+			best, bestRank = sniRoutes{route}, rank
+		case rank == bestRank && route.pattern == best[0].pattern:
+			best = append(best, route)
+		}
+	}
+
+	return best
+}
+
+// lookup returns the first route for the ALPN protocol. The fallback route is looked up with an empty protocol.
+func (r sniRoutes) lookup(protocol string) (sniRoute, bool) {
+	for _, route := range r {
+		if route.protocol == protocol {
+			return route, true
+		}
+	}
+
+	return sniRoute{}, false
+}
+
+// terminates reports if any route terminates TLS.
+func (r sniRoutes) terminates() bool {
+	for _, route := range r {
+		if route.mode != tlsPassthrough {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tlsConfig describes how TLS connections are routed and terminated.
+type tlsConfig struct {
+	// routes decide per server name where and how TLS connections are forwarded. SNI routing is disabled if empty.
+	routes sniRoutes
+	// certificates are pairs of certificate and key files used to terminate TLS.
+	certificates [][2]string
+	// backendCAFile is the path to a PEM file with the certificates used to verify backends when reencrypting.
+	// The system roots are used if empty.
+	backendCAFile string
+	// reloadInterval is the time between checks of the certificate files for changes.
+	reloadInterval time.Duration
+	// ocspStapling enables fetching OCSP responses and stapling them to handshakes.
+	ocspStapling bool
+	// ticketKeyFile is the path to a file with session ticket keys. Keys are generated if empty.
+	ticketKeyFile string
+}
+
+// parseCertificates parses whitespace separated pairs of certificate and key files in the form certfile:keyfile.
+func (cfg *tlsConfig) parseCertificates(value string) error {
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, ":", certificateParts)
+		if len(parts) != certificateParts || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("%w: %s", errCertificate, field)
+		}
+
+		cfg.certificates = append(cfg.certificates, [2]string{parts[0], parts[1]})
+	}
+
+	return nil
+}
+
+// tlsRouter is the handshake step that routes connections by the server name of their TLS ClientHello.
+type tlsRouter struct {
+	log          logr.Logger
+	routes       sniRoutes
+	serverConfig *tls.Config
+	backendRoots *x509.CertPool
+	// certs serve the certificates for terminating routes. Nil if no route terminates.
+	certs *certStore
+	// tickets manage the session ticket keys of serverConfig. Nil if no route terminates.
+	tickets *ticketKeys
+}
+
+// newTLSRouter loads the certificates of cfg and creates a tlsRouter for its routes. If previous is not nil, its
+// session ticket keys are kept as long as they come from the same source, so sessions can be resumed after reloads.
+// Generated session ticket keys are rotated on clock.
+func newTLSRouter(log logr.Logger, cfg tlsConfig, previous *tlsRouter, clock Clock) (*tlsRouter, error) {
+	router := &tlsRouter{log: log, routes: cfg.routes}
+
+	if !cfg.routes.terminates() {
+		return router, nil
+	}
+
+	if len(cfg.certificates) == 0 {
+		return nil, errNoCertificates
+	}
+
+	certs, err := newCertStore(log, cfg.certificates, cfg.ocspStapling)
+	if err != nil {
+		return nil, err
+	}
+
+	router.certs = certs
+	router.serverConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}
+
+	// Keys are always set explicitly. Otherwise each clone of serverConfig would generate its own and sessions could
+	// never be resumed.
+	if previous != nil && previous.tickets != nil && previous.tickets.path == cfg.ticketKeyFile {
+		router.tickets = previous.tickets
+		router.tickets.rebind(router.serverConfig)
+	} else if router.tickets, err = newTicketKeys(router.serverConfig, cfg.ticketKeyFile, clock); err != nil {
+		return nil, err
+	}
+
+	if cfg.backendCAFile != "" {
+		pem, err := os.ReadFile(cfg.backendCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read backend CA file: %w", err)
+		}
+
+		router.backendRoots = x509.NewCertPool()
+		if !router.backendRoots.AppendCertsFromPEM(pem) {
+			return nil, errBackendCA
+		}
+	}
+
+	return router, nil
+}
+
+// update checks the certificates and session ticket keys of terminating routes for changes.
+func (r *tlsRouter) update(ctx context.Context) {
+	if r.certs == nil {
+		return
+	}
+
+	r.certs.updateAll(ctx)
+
+	if err := r.tickets.update(); err != nil {
+		r.log.Error(err, "couldn't update session ticket keys, keeping the old ones")
+	}
+}
+
+// handshake peeks at the ClientHello of src and applies the matching route to conn. Connections that do not start
+// with a TLS handshake or do not match any route keep the default destination. Connections that should be
+// terminated are returned as TLS server connection with a completed handshake.
+//
+// Among the routes of the most specific matching pattern, passthrough routes for a protocol the client offers via
+// ALPN win. Otherwise the connection is terminated if the client offers a protocol of a terminating route or the
+// fallback route terminates; only the protocols of terminating routes are offered then and the negotiated one picks
+// the route.
+func (r *tlsRouter) handshake(ctx context.Context, conn *connection, src net.Conn) (net.Conn, error) {
+	hello, peeked, err := peekClientHello(src)
+	src = newReplayConn(src, peeked)
+
+	switch {
+	case errors.Is(err, errNotTLS):
+		return src, nil
+	case err != nil:
+		return src, fmt.Errorf("peek TLS ClientHello: %w", err)
+	}
+
+	conn.clientTLS = true
+	conn.setServerName(hello.serverName)
+	conn.setFingerprints(hello.ja3(), hello.ja4())
+
+	candidates := r.routes.candidates(hello.serverName)
+
+	var protocols []string
+
+	for _, protocol := range hello.alpn {
+		route, ok := candidates.lookup(protocol)
+
+		switch {
+		case !ok:
+		case route.mode == tlsPassthrough:
+			conn.destination = route.addr
+			conn.addLabels(route.labels())
+
+			return src, nil
+		default:
+			protocols = append(protocols, protocol)
+		}
+	}
+
+	fallback, hasFallback := candidates.lookup("")
+
+	if len(protocols) == 0 && (!hasFallback || fallback.mode == tlsPassthrough) {
+		if hasFallback {
+			conn.destination = fallback.addr
+			conn.addLabels(fallback.labels())
+		}
+
+		return src, nil
+	}
+
+	config := r.serverConfig.Clone()
+	config.NextProtos = protocols
+
+	server := tls.Server(src, config)
+	if err := server.HandshakeContext(ctx); err != nil {
+		return server, fmt.Errorf("TLS handshake: %w", err)
+	}
+
+	negotiated := server.ConnectionState().NegotiatedProtocol
+	route := fallback
+
+	if negotiated != "" {
+		route, _ = candidates.lookup(negotiated)
+	}
+
+	conn.destination = route.addr
+	conn.addLabels(route.labels())
+
+	if route.mode == tlsReencrypt {
+		serverName := hello.serverName
+		if serverName == "" {
+			_, addr := splitNetwork("", splitAlternatives("", route.addr)[0])
+			serverName, _, _ = net.SplitHostPort(addr)
+		}
+
+		conn.backendTLS = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName, RootCAs: r.backendRoots}
+
+		if negotiated != "" {
+			conn.backendTLS.NextProtos = []string{negotiated}
+		}
+	}
+
+	return server, nil
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// topSampleInterval is the interval over which the throughput of connections is measured by the top command.
+	topSampleInterval = time.Second
+	// topDefaultCount is the number of connections shown by the top command if not specified otherwise.
+	topDefaultCount = 10
+	// topMaxArgs is the number of arguments the top command takes at most: sort order and count.
+	topMaxArgs = 2
+	// topUsage documents the arguments of the top command.
+	topUsage = "top [rate|bytes] [count]"
+)
+
+// topEntry is a connection as shown by the top command.
+type topEntry struct {
+	connSnapshot
+	// rate is the throughput of the connection in bytes per second during the sample interval. Zero if not sampled.
+	rate int64
+	// sampled is set if the connection was open during the whole sample interval. Connections opened meanwhile have
+	// no rate since their bytes would be counted as if they were transferred within the interval.
+	sampled bool
+}
+
+// topCommand returns the control command that lists the connections with the highest throughput or total amount
+// of transferred bytes. The throughput is measured by sampling the byte counters of all connections twice,
+// topSampleInterval apart on clock. Connections opened in between have no rate yet and are listed last by rate.
+func topCommand(table *connTable, clock Clock) controlCommand {
+	return controlCommand{
+		usage: topUsage,
+		help:  "show connections with the highest throughput or most transferred bytes",
+		run: func(ctx context.Context, w io.Writer, args []string) error {
+			byRate, count, err := parseTopArgs(args)
+			if err != nil {
+				return err
+			}
+
+			before := map[uint64]int64{}
+			for _, snap := range table.snapshot() {
+				before[snap.id] = snap.total()
+			}
+
+			if !sleepUnlessDone(ctx, clock, topSampleInterval) {
+				return fmt.Errorf("sample connections: %w", ctx.Err())
+			}
+
+			snaps := table.snapshot()
+			entries := make([]topEntry, len(snaps))
+
+			for i, snap := range snaps {
+				entries[i] = topEntry{connSnapshot: snap}
+
+				if total, ok := before[snap.id]; ok {
+					entries[i].rate = int64(float64(snap.total()-total) / topSampleInterval.Seconds())
+					entries[i].sampled = true
+				}
+			}
+
+			sort.SliceStable(entries, func(i, j int) bool {
+				if byRate {
+					if entries[i].sampled != entries[j].sampled {
+						return entries[i].sampled
+					}
+
+					return entries[i].rate > entries[j].rate
+				}
+
+				return entries[i].total() > entries[j].total()
+			})
+
+			if len(entries) > count {
+				entries = entries[:count]
+			}
+
+			return writeTop(w, entries)
+		},
+	}
+}
+
+// parseTopArgs parses the arguments of the top command.
+func parseTopArgs(args []string) (byRate bool, count int, err error) {
+	byRate, count = true, topDefaultCount
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "rate":
+		case "bytes":
+			byRate = false
+		default:
+			return false, 0, fmt.Errorf("%w: %s", errUsage, topUsage)
+		}
+	}
+
+	if len(args) > 1 {
+		if count, err = strconv.Atoi(args[1]); err != nil || count < 1 {
+			return false, 0, fmt.Errorf("%w: %s", errUsage, topUsage)
+		}
+	}
+
+	if len(args) > topMaxArgs {
+		return false, 0, fmt.Errorf("%w: %s", errUsage, topUsage)
+	}
+
+	return byRate, count, nil
+}
+
+// writeTop writes entries as table to w.
+func writeTop(w io.Writer, entries []topEntry) error {
+	table := tabwriter.NewWriter(w, 0, 0, tablePadding, ' ', 0)
+
+	fmt.Fprintln(table, "ID\tCLIENT\tBACKEND\tAGE\tRECEIVED\tSENT\tRATE")
+
+	for _, entry := range entries {
+		rate := "-"
+		if entry.sampled {
+			rate = fmt.Sprintf("%d/s", entry.rate)
+		}
+
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", entry.id, entry.client, entry.backend,
+			entry.age.Round(time.Second), entry.received, entry.sent, rate)
+	}
+
+	if err := table.Flush(); err != nil {
+		return fmt.Errorf("write top: %w", err)
+	}
+
+	return nil
+}
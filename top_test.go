@@ -0,0 +1,66 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTopRateOnlyForSampledConnections(t *testing.T) {
+	clock := NewManualClock(time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC))
+	table := newConnTable()
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 51234}
+	sampled := &connection{id: 1, local: addr, clock: clock, started: clock.Now()}
+	opened := &connection{id: 2, local: addr, clock: clock}
+
+	table.add(sampled)
+
+	var out bytes.Buffer
+
+	done := make(chan error, 1)
+
+	go func() { done <- topCommand(table, clock).run(context.Background(), &out, []string{"rate"}) }()
+
+	waitForTimers(t, clock, 1)
+
+	opened.started = clock.Now()
+	atomic.StoreInt64(&opened.received, 1<<20)
+	atomic.StoreInt64(&sampled.received, 1000)
+	table.add(opened)
+
+	clock.Advance(topSampleInterval)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("top printed %q", out.String())
+	}
+
+	if fields := strings.Fields(lines[1]); fields[0] != "1" || fields[len(fields)-1] != "1000/s" {
+		t.Errorf("top listed %q first instead of the sampled connection", lines[1])
+	}
+
+	if fields := strings.Fields(lines[2]); fields[0] != "2" || fields[len(fields)-1] != "-" {
+		t.Errorf("top listed %q last instead of the connection opened while sampling", lines[2])
+	}
+}
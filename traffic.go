@@ -0,0 +1,204 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// trafficUsage documents the arguments of the traffic command.
+const trafficUsage = "traffic [json]"
+
+// TrafficStats is the traffic of all connections of a mapping or a backend since the run started. Bytes are counted
+// as they are written, so connections that are still open are included with what they transferred so far.
+type TrafficStats struct {
+	// Connections is the number of connections.
+	Connections int64 `json:"connections"`
+	// BytesReceived is the number of bytes read from clients and written to backends.
+	BytesReceived int64 `json:"bytesReceived"`
+	// BytesSent is the number of bytes read from backends and written to clients.
+	BytesSent int64 `json:"bytesSent"`
+}
+
+// Stats are the counters of a run since it started. They include health probes.
+type Stats struct {
+	// Accepted is the number of accepted connections.
+	Accepted int64 `json:"accepted"`
+	// Active is the number of connections that are currently handled.
+	Active int `json:"active"`
+	// BytesReceived is the number of bytes read from clients and written to backends.
+	BytesReceived int64 `json:"bytesReceived"`
+	// BytesSent is the number of bytes read from backends and written to clients.
+	BytesSent int64 `json:"bytesSent"`
+	// Mappings is the traffic by the local port connections were accepted on, or by the local address of listeners
+	// without ports like unix sockets.
+	Mappings map[string]TrafficStats `json:"mappings"`
+	// Backends is the traffic by the address of the backend connections were bridged to. Connections that did not
+	// reach a backend are not part of it.
+	Backends map[string]TrafficStats `json:"backends"`
+}
+
+// Stats returns the counters of the run p is attached to.
+func (p *Proxy) Stats() (Stats, error) {
+	select {
+	case <-p.started:
+		return p.prx.trafficStats(), nil
+	default:
+		return Stats{}, errNotStarted
+	}
+}
+
+// trafficCounters count the traffic of a mapping or a backend. All fields are accessed atomically.
+type trafficCounters struct {
+	connections int64
+	received    int64
+	sent        int64
+}
+
+// trafficTable holds trafficCounters by key. Counters are never removed, so pointers to them stay valid.
+type trafficTable struct {
+	mtx      sync.Mutex
+	counters map[string]*trafficCounters
+}
+
+// get returns the counters of key, creating them if needed.
+func (t *trafficTable) get(key string) *trafficCounters {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.counters == nil {
+		t.counters = map[string]*trafficCounters{}
+	}
+
+	counters, ok := t.counters[key]
+	if !ok {
+		counters = &trafficCounters{}
+		t.counters[key] = counters
+	}
+
+	return counters
+}
+
+// snapshot returns the current values of all counters by key.
+func (t *trafficTable) snapshot() map[string]TrafficStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	stats := make(map[string]TrafficStats, len(t.counters))
+	for key, counters := range t.counters {
+		stats[key] = TrafficStats{
+			Connections:   atomic.LoadInt64(&counters.connections),
+			BytesReceived: atomic.LoadInt64(&counters.received),
+			BytesSent:     atomic.LoadInt64(&counters.sent),
+		}
+	}
+
+	return stats
+}
+
+// mappingOf returns the key the traffic of connections accepted on local is accounted under: the port for TCP
+// addresses and the address itself otherwise. Empty if local is nil.
+func mappingOf(local net.Addr) string {
+	if local == nil {
+		return ""
+	}
+
+	if tcpAddr, ok := local.(*net.TCPAddr); ok {
+		return strconv.Itoa(tcpAddr.Port)
+	}
+
+	return local.String()
+}
+
+// trafficStats returns the counters of p as Stats. The totals are the sums over all mappings.
+func (p *proxy) trafficStats() Stats {
+	stats := Stats{
+		Active:   p.conns.len(),
+		Mappings: p.mappingTraffic.snapshot(),
+		Backends: p.backendTraffic.snapshot(),
+	}
+
+	for _, traffic := range stats.Mappings {
+		stats.Accepted += traffic.Connections
+		stats.BytesReceived += traffic.BytesReceived
+		stats.BytesSent += traffic.BytesSent
+	}
+
+	return stats
+}
+
+// trafficCommand returns the control command that shows the traffic by mapping and backend.
+func trafficCommand(p *proxy) controlCommand {
+	return controlCommand{
+		usage: trafficUsage,
+		help:  "show the traffic since the start by local port and backend as table or JSON",
+		run: func(_ context.Context, w io.Writer, args []string) error {
+			if len(args) > 1 || (len(args) == 1 && args[0] != "json") {
+				return fmt.Errorf("%w: %s", errUsage, trafficUsage)
+			}
+
+			stats := p.trafficStats()
+
+			if len(args) == 1 {
+				if err := json.NewEncoder(w).Encode(stats); err != nil {
+					return fmt.Errorf("write traffic: %w", err)
+				}
+
+				return nil
+			}
+
+			return writeTraffic(w, stats)
+		},
+	}
+}
+
+// writeTraffic writes the traffic of stats by mapping and backend as table to w.
+func writeTraffic(w io.Writer, stats Stats) error {
+	table := tabwriter.NewWriter(w, 0, 0, tablePadding, ' ', 0)
+
+	fmt.Fprintln(table, "KIND\tKEY\tCONNECTIONS\tRECEIVED\tSENT")
+
+	for _, kind := range []struct {
+		name  string
+		stats map[string]TrafficStats
+	}{{"mapping", stats.Mappings}, {"backend", stats.Backends}} {
+		keys := make([]string, 0, len(kind.stats))
+		for key := range kind.stats {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			traffic := kind.stats[key]
+			fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\n", kind.name, key, traffic.Connections, traffic.BytesReceived,
+				traffic.BytesSent)
+		}
+	}
+
+	if err := table.Flush(); err != nil {
+		return fmt.Errorf("write traffic: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// defaultUnitBinary is the path of the tcp4to6 binary in generated units if not given otherwise.
+const defaultUnitBinary = "/usr/bin/tcp4to6"
+
+var (
+	// errUnitName is raised if units are to be generated without a name.
+	errUnitName = errors.New("unit name must not be empty")
+	// errUnitListen is raised if units are to be generated without listen addresses.
+	errUnitListen = errors.New("socket unit needs at least one listen address")
+)
+
+// addressFamilies are the address families that may end up in RestrictAddressFamilies=, in the order they are listed.
+var addressFamilies = []string{"AF_UNIX", "AF_INET", "AF_INET6", "AF_VSOCK"}
+
+// UnitSpec describes the systemd units GenerateUnits emits. Everything else is derived from the Config.
+type UnitSpec struct {
+	// Name is the name of both units without suffix, like tcp4to6-web.
+	Name string
+	// Listen are the addresses the socket unit listens on, in the syntax of ListenStream=, like [::]:443.
+	Listen []string
+	// Binary is the path of the tcp4to6 binary. defaultUnitBinary if empty.
+	Binary string
+	// EnvironmentFile is the file the service reads its environment variables from. Empty if there is none.
+	EnvironmentFile string
+}
+
+// Units are the contents of a socket and a service unit that belong together.
+type Units struct {
+	Socket  string
+	Service string
+}
+
+// unitData is what the unit templates are executed with.
+type unitData struct {
+	UnitSpec
+	// ConfigFile is the value of ConfigFileEnvName the configuration was read with. Empty if it was not set.
+	ConfigFile string
+	// AddressFamilies is the value of RestrictAddressFamilies=.
+	AddressFamilies string
+	// WritablePaths are the directories the service needs to write to despite ProtectSystem=strict.
+	WritablePaths []string
+}
+
+// unitHeader starts generated units.
+const unitHeader = "# Generated by tcp4to6 units, regenerate instead of editing.\n"
+
+// socketUnitTemplate is the template of generated socket units.
+var socketUnitTemplate = template.Must(template.New("socket").Parse(unitHeader + `[Unit]
+Description=tcp4to6 socket {{.Name}}
+
+[Socket]
+{{- range .Listen}}
+ListenStream={{.}}
+{{- end}}
+{{- if gt (len .Listen) 1}}
+BindIPv6Only=ipv6-only
+{{- end}}
+
+[Install]
+WantedBy=sockets.target
+`))
+
+// serviceUnitTemplate is the template of generated service units. The hardening is the one of init/tcpto6@.service.
+var serviceUnitTemplate = template.Must(template.New("service").Parse(unitHeader + `[Unit]
+Description=tcp4to6 {{.Name}}
+Requires={{.Name}}.socket
+After={{.Name}}.socket
+
+[Service]
+Type=simple
+ExecStart={{.Binary}}
+ExecReload=/bin/kill -HUP $MAINPID
+NotifyAccess=main
+DynamicUser=true
+{{- if .EnvironmentFile}}
+EnvironmentFile={{.EnvironmentFile}}
+{{- end}}
+{{- if .ConfigFile}}
+Environment=TCPTO6_CONFIG_FILE={{.ConfigFile}}
+{{- end}}
+{{- if .WritablePaths}}
+ReadWritePaths={{range $i, $path := .WritablePaths}}{{if $i}} {{end}}{{$path}}{{end}}
+{{- end}}
+CapabilityBoundingSet=
+LockPersonality=true
+MemoryDenyWriteExecute=true
+MountFlags=private
+NoNewPrivileges=true
+PrivateDevices=true
+PrivateTmp=true
+PrivateUsers=true
+ProcSubset=pid
+ProtectClock=true
+ProtectControlGroups=true
+ProtectHome=true
+ProtectHostname=true
+ProtectKernelLogs=true
+ProtectKernelModules=true
+ProtectKernelTunables=true
+ProtectProc=invisible
+ProtectSystem=strict
+RemoveIPC=true
+RestrictAddressFamilies={{.AddressFamilies}}
+RestrictNamespaces=true
+RestrictRealtime=true
+RestrictSUIDSGID=true
+SecureBits=noroot-locked
+SystemCallArchitectures=native
+SystemCallFilter=@signal @process @ipc @basic-io @network-io @io-event @file-system splice
+UMask=0077
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// GenerateUnits returns a socket and a service unit named after spec that run tcp4to6 with cfg. The service is locked
+// down like init/tcpto6@.service, but only allows the address families cfg needs to reach its destinations, syslog,
+// push and authorization endpoints, and may write to the directories of the access log and control socket. Generating
+// the units from the same configuration the service runs with keeps both in sync.
+func GenerateUnits(cfg Config, spec UnitSpec) (Units, error) {
+	if spec.Name == "" {
+		return Units{}, errUnitName
+	}
+
+	if len(spec.Listen) == 0 {
+		return Units{}, errUnitListen
+	}
+
+	if spec.Binary == "" {
+		spec.Binary = defaultUnitBinary
+	}
+
+	data := unitData{UnitSpec: spec, AddressFamilies: strings.Join(cfg.addressFamilies(), " ")}
+
+	if cfg.lookup != nil {
+		data.ConfigFile, _ = cfg.lookup(ConfigFileEnvName)
+	}
+
+	paths := []string{cfg.accessLog.path, cfg.journal.path, cfg.controlSocket, cfg.lockFile, cfg.leader.lockFile}
+
+	for _, path := range paths {
+		if path != "" && !strings.HasPrefix(path, "@") {
+			data.WritablePaths = append(data.WritablePaths, filepath.Dir(path))
+		}
+	}
+
+	var socket, service strings.Builder
+
+	if err := socketUnitTemplate.Execute(&socket, data); err != nil {
+		return Units{}, fmt.Errorf("socket unit: %w", err)
+	}
+
+	if err := serviceUnitTemplate.Execute(&service, data); err != nil {
+		return Units{}, fmt.Errorf("service unit: %w", err)
+	}
+
+	return Units{Socket: socket.String(), Service: service.String()}, nil
+}
+
+// addressFamilies returns the address families tcp4to6 needs to create sockets of when running with c. AF_UNIX is
+// always included since notifications to systemd are sent over a unix socket.
+func (c Config) addressFamilies() []string {
+	needed := map[string]bool{"AF_UNIX": true}
+
+	for _, destination := range c.destinations() {
+		for _, alternative := range splitAlternatives(c.dial.network, destination) {
+			for _, family := range destinationFamilies(c.dial.network, alternative) {
+				needed[family] = true
+			}
+		}
+	}
+
+	syslogIP := c.syslog.network != "" && c.syslog.network != "unix" && c.syslog.network != "unixgram"
+
+	remote := c.push.url != "" || c.webhook.url != "" || c.broker.protocol != "" || c.extAuthz.url != "" ||
+		c.dnsRegister.enabled() || c.mdns.enabled() || c.portMapping.enabled()
+
+	if syslogIP || remote || c.tls.ocspStapling || c.metricsAddr != "" {
+		needed["AF_INET"], needed["AF_INET6"] = true, true
+	}
+
+	families := make([]string, 0, len(needed))
+
+	for _, family := range addressFamilies {
+		if needed[family] {
+			families = append(families, family)
+		}
+	}
+
+	return families
+}
+
+// destinations returns all addresses connections may be forwarded to with c.
+func (c Config) destinations() []string {
+	var destinations []string
+
+	if c.toAddr != "" {
+		destinations = append(destinations, c.toAddr)
+	}
+
+	for _, destination := range c.portDestinations {
+		destinations = append(destinations, destination)
+	}
+
+	for _, destination := range c.socketDestinations {
+		destinations = append(destinations, destination)
+	}
+
+	for _, route := range c.tls.routes {
+		destinations = append(destinations, route.addr)
+	}
+
+	for _, green := range c.greenDestinations {
+		destinations = append(destinations, green)
+	}
+
+	destinations = append(destinations, c.replay.destinations...)
+
+	if c.policy != nil {
+		for _, rule := range c.policy.rules {
+			if rule.action == policyRoute {
+				destinations = append(destinations, rule.destination)
+			}
+		}
+	}
+
+	sort.Strings(destinations)
+
+	return destinations
+}
+
+// destinationFamilies returns the address families needed to dial addr, which is dialed with network unless its
+// prefix names another one. Host names need both IP families since the name servers may be reached by either.
+func destinationFamilies(network, addr string) []string {
+	switch {
+	case strings.HasPrefix(addr, vsockPrefix):
+		return []string{"AF_VSOCK"}
+	case strings.HasPrefix(addr, sctpPrefix):
+		return []string{"AF_INET", "AF_INET6"}
+	}
+
+	network, addr = splitNetwork(network, addr)
+
+	switch network {
+	case "unix":
+		return []string{"AF_UNIX"}
+	case "tcp4", "tcp6":
+		if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) != nil {
+			if network == "tcp4" {
+				return []string{"AF_INET"}
+			}
+
+			return []string{"AF_INET6"}
+		}
+	}
+
+	return []string{"AF_INET", "AF_INET6"}
+}
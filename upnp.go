@@ -0,0 +1,340 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ssdpSearch searches for internet gateway devices. Responses are unicast back to the sender.
+	ssdpSearch = "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	// ssdpWait is how long responses to a search are waited for.
+	ssdpWait = 3 * time.Second
+	// upnpMaxResponse is the size of the buffer SSDP responses are read into.
+	upnpMaxResponse = 2048
+	// upnpMaxBody is the number of bytes read from device descriptions and SOAP responses at most.
+	upnpMaxBody = 1 << 20
+	// upnpDescription is the description of port mappings shown by the gateway.
+	upnpDescription = "tcp4to6"
+)
+
+var (
+	// ssdpGroup is the multicast group SSDP searches are sent to.
+	ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	// upnpServiceTypes are the services of internet gateway devices that manage port mappings, in order of preference.
+	upnpServiceTypes = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:2",
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	}
+)
+
+var (
+	// errNoGatewayDevice is raised if no internet gateway device responded to the search.
+	errNoGatewayDevice = errors.New("no UPnP internet gateway device found")
+	// errNoPortMappingService is raised if the gateway device has no service that manages port mappings.
+	errNoPortMappingService = errors.New("UPnP gateway has no WANIPConnection or WANPPPConnection service")
+	// errUPnPStatus is raised if the gateway responds to a request with a non 2xx status.
+	errUPnPStatus = errors.New("UPnP gateway responded with unexpected status")
+)
+
+// upnpDevice is a device in the description of an internet gateway device. Port mapping services are part of an
+// embedded device.
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// upnpService is a service of a device.
+type upnpService struct {
+	Type       string `xml:"serviceType"`
+	ControlURL string `xml:"controlURL"`
+}
+
+// find returns the first service of d or its embedded devices of type.
+func (d upnpDevice) find(serviceType string) (upnpService, bool) {
+	for _, service := range d.Services {
+		if service.Type == serviceType {
+			return service, true
+		}
+	}
+
+	for _, device := range d.Devices {
+		if service, ok := device.find(serviceType); ok {
+			return service, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+// upnpMapper requests port mappings from a UPnP internet gateway device. The gateway is discovered with SSDP on the
+// first request and kept while it answers.
+type upnpMapper struct {
+	client http.Client
+	// control is the URL of the port mapping service. Empty until the gateway was discovered.
+	control string
+	// service is the type of the port mapping service.
+	service string
+	// local is the address of this host as seen by the gateway, which mappings point to.
+	local string
+}
+
+// mapPort adds the mapping and asks for the external address of the gateway.
+func (m *upnpMapper) mapPort(ctx context.Context, internal, external int, lifetime time.Duration,
+) (string, time.Duration, error) {
+	if m.control == "" {
+		if err := m.discover(ctx); err != nil {
+			return "", 0, err
+		}
+	}
+
+	_, err := m.call(ctx, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", "TCP"},
+		{"NewInternalPort", strconv.Itoa(internal)},
+		{"NewInternalClient", m.local},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", upnpDescription},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+	if err != nil {
+		// The gateway may have restarted with another address, so it is searched again next time.
+		m.control = ""
+
+		return "", 0, err
+	}
+
+	response, err := m.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	ip := net.ParseIP(soapValue(response, "NewExternalIPAddress"))
+	if ip == nil {
+		return "", 0, fmt.Errorf("%w: no external address", errUPnPStatus)
+	}
+
+	return joinExternal(ip, external), lifetime, nil
+}
+
+// unmapPort deletes the mapping.
+func (m *upnpMapper) unmapPort(ctx context.Context, _, external int) error {
+	if m.control == "" {
+		return nil
+	}
+
+	_, err := m.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", "TCP"},
+	})
+
+	return err
+}
+
+// discover searches for an internet gateway device and reads the control URL of its port mapping service from its
+// description.
+func (m *upnpMapper) discover(ctx context.Context) error {
+	location, err := searchGateway(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return fmt.Errorf("create description request: %w", err)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get gateway description: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s", errUPnPStatus, resp.Status)
+	}
+
+	var description struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, upnpMaxBody)).Decode(&description); err != nil {
+		return fmt.Errorf("decode gateway description: %w", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("parse gateway location: %w", err)
+	}
+
+	if description.URLBase != "" {
+		if base, err = url.Parse(description.URLBase); err != nil {
+			return fmt.Errorf("parse gateway URL base: %w", err)
+		}
+	}
+
+	for _, serviceType := range upnpServiceTypes {
+		service, ok := description.Device.find(serviceType)
+		if !ok {
+			continue
+		}
+
+		control, err := base.Parse(service.ControlURL)
+		if err != nil {
+			return fmt.Errorf("parse control URL: %w", err)
+		}
+
+		// The address this host reaches the gateway from is the one mappings must point to.
+		var dialer net.Dialer
+
+		conn, err := dialer.DialContext(ctx, "udp4", net.JoinHostPort(control.Hostname(), strconv.Itoa(ssdpGroup.Port)))
+		if err != nil {
+			return fmt.Errorf("find own address: %w", err)
+		}
+
+		m.local = addrIP(conn.LocalAddr()).String()
+		_ = conn.Close()
+
+		m.control, m.service = control.String(), serviceType
+
+		return nil
+	}
+
+	return errNoPortMappingService
+}
+
+// call invokes action of the port mapping service with the arguments in order and returns the response body.
+func (m *upnpMapper) call(ctx context.Context, action string, args [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, m.service)
+
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		_ = xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.control, &body)
+	if err != nil {
+		return nil, fmt.Errorf("create %s request: %w", action, err)
+	}
+
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+m.service+"#"+action+`"`)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	response, err := io.ReadAll(io.LimitReader(resp.Body, upnpMaxBody))
+	if err != nil {
+		return nil, fmt.Errorf("read %s response: %w", action, err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		if description := soapValue(response, "errorDescription"); description != "" {
+			return nil, fmt.Errorf("%w: %s: %s", errUPnPStatus, action, description)
+		}
+
+		return nil, fmt.Errorf("%w: %s: %s", errUPnPStatus, action, resp.Status)
+	}
+
+	return response, nil
+}
+
+// soapValue returns the text of the first element called name in the SOAP document body. Empty if there is none.
+func soapValue(body []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var value string
+
+			_ = decoder.DecodeElement(&value, &start)
+
+			return strings.TrimSpace(value)
+		}
+	}
+}
+
+// searchGateway sends an SSDP search for internet gateway devices and returns the location of the description of
+// the first one that responds.
+func searchGateway(ctx context.Context) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", fmt.Errorf("search UPnP gateway: %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(ssdpWait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	_ = conn.SetDeadline(deadline)
+
+	if _, err := conn.WriteToUDP([]byte(ssdpSearch), ssdpGroup); err != nil {
+		return "", fmt.Errorf("search UPnP gateway: %w", err)
+	}
+
+	buf := make([]byte, upnpMaxResponse)
+
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", errNoGatewayDevice
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+
+		_ = resp.Body.Close()
+
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// vsockPrefix starts addresses of vsock destinations like vsock:2:8080.
+	vsockPrefix = "vsock:"
+	// vsockNetwork is the network name of vsock addresses.
+	vsockNetwork = "vsock"
+	// vsockCIDAny is the CID that binds to all CIDs of the machine.
+	vsockCIDAny = ^uint32(0)
+	// vsockAddrParts is the number of parts of a cid:port address.
+	vsockAddrParts = 2
+)
+
+var (
+	// errVsockAddr is raised if a vsock address can not be parsed.
+	errVsockAddr = errors.New("invalid vsock address, expected cid:port")
+	// errVsockUnsupported is raised if vsock is used on a platform that does not support it.
+	errVsockUnsupported = errors.New("vsock is only supported on linux")
+)
+
+// vsockAddr is the address of a vsock socket. It implements net.Addr.
+type vsockAddr struct {
+	// cid is the context id of the machine, 2 for the host.
+	cid uint32
+	// port is the port on the machine.
+	port uint32
+}
+
+// Network returns vsock.
+func (vsockAddr) Network() string {
+	return vsockNetwork
+}
+
+// String returns the address in the form vsock:cid:port.
+func (a vsockAddr) String() string {
+	return vsockPrefix + strconv.FormatUint(uint64(a.cid), 10) + ":" + strconv.FormatUint(uint64(a.port), 10)
+}
+
+// parseVsockAddr parses addresses of the form cid:port. The cid any stands for all CIDs of the machine.
+func parseVsockAddr(value string) (vsockAddr, error) {
+	parts := strings.SplitN(value, ":", vsockAddrParts)
+	if len(parts) != vsockAddrParts {
+		return vsockAddr{}, fmt.Errorf("%w: %s", errVsockAddr, value)
+	}
+
+	addr := vsockAddr{cid: vsockCIDAny}
+
+	if parts[0] != "any" {
+		cid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return vsockAddr{}, fmt.Errorf("%w: %s", errVsockAddr, value)
+		}
+
+		addr.cid = uint32(cid)
+	}
+
+	port, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return vsockAddr{}, fmt.Errorf("%w: %s", errVsockAddr, value)
+	}
+
+	addr.port = uint32(port)
+
+	return addr, nil
+}
@@ -0,0 +1,276 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockConn is a connected vsock socket. The net package can not wrap vsock sockets, so it is built on a pollable
+// os.File, which provides reads, writes and deadlines.
+type vsockConn struct {
+	*os.File
+	local, remote vsockAddr
+}
+
+// Read reads from the socket, reporting a closed socket as net.ErrClosed like connections of the net package do.
+func (c *vsockConn) Read(p []byte) (int, error) {
+	n, err := c.File.Read(p)
+
+	return n, vsockError(err)
+}
+
+// Write writes to the socket, reporting a closed socket as net.ErrClosed like connections of the net package do.
+func (c *vsockConn) Write(p []byte) (int, error) {
+	n, err := c.File.Write(p)
+
+	return n, vsockError(err)
+}
+
+// Close closes the socket.
+func (c *vsockConn) Close() error {
+	return vsockError(c.File.Close())
+}
+
+// CloseWrite shuts down the writing side of the socket.
+func (c *vsockConn) CloseWrite() error {
+	return vsockControl(c.File, func(fd int) error { return unix.Shutdown(fd, unix.SHUT_WR) })
+}
+
+// LocalAddr returns the local address of the socket.
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// vsockError translates errors of closed files to net.ErrClosed, which is what callers of net.Conn check for.
+func vsockError(err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("vsock: %w", net.ErrClosed)
+	}
+
+	return err
+}
+
+// vsockControl calls fn with the file descriptor of file.
+func vsockControl(file *os.File, fn func(fd int) error) error {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("raw vsock: %w", err)
+	}
+
+	var fnErr error
+
+	if err := raw.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return vsockError(err)
+	}
+
+	return fnErr
+}
+
+// newVsockFile turns fd, a non-blocking vsock socket, into a pollable os.File.
+func newVsockFile(fd int) *os.File {
+	return os.NewFile(uintptr(fd), vsockNetwork)
+}
+
+// vsockSockaddr returns the address of sa. The zero address is returned for addresses that are not vsock ones.
+func vsockSockaddr(sa unix.Sockaddr) vsockAddr {
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		return vsockAddr{cid: vm.CID, port: vm.Port}
+	}
+
+	return vsockAddr{}
+}
+
+// dialVsock connects to addr, a cid:port address.
+func dialVsock(ctx context.Context, addr string) (net.Conn, error) {
+	remote, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock socket: %w", err)
+	}
+
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: remote.cid, Port: remote.port})
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("vsock connect: %w", err)
+	}
+
+	file := newVsockFile(fd)
+
+	if err != nil {
+		if err := awaitConnect(ctx, file); err != nil {
+			_ = file.Close()
+
+			return nil, fmt.Errorf("vsock %w", err)
+		}
+	}
+
+	conn := &vsockConn{File: file, remote: remote}
+
+	_ = vsockControl(file, func(fd int) error {
+		sa, err := unix.Getsockname(fd)
+		if err == nil {
+			conn.local = vsockSockaddr(sa)
+		}
+
+		return err
+	})
+
+	return conn, nil
+}
+
+// vsockListener accepts connections from a listening vsock socket.
+type vsockListener struct {
+	file *os.File
+	addr vsockAddr
+	// closed is set to 1 by Close. Accessed atomically.
+	closed int32
+}
+
+// listenVsock binds to addr, a cid:port address, and listens on it.
+func listenVsock(addr string) (net.Listener, error) {
+	local, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock socket: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: local.cid, Port: local.port}); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("vsock bind: %w", err)
+	}
+
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("vsock listen: %w", err)
+	}
+
+	return &vsockListener{file: newVsockFile(fd), addr: local}, nil
+}
+
+// isVsock tells if file is a vsock socket.
+func isVsock(file *os.File) bool {
+	return vsockControl(file, func(fd int) error {
+		sa, err := unix.Getsockname(fd)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := sa.(*unix.SockaddrVM); !ok {
+			return errVsockUnsupported
+		}
+
+		return nil
+	}) == nil
+}
+
+// vsockFileListener creates a vsockListener for file, a listening vsock socket passed by systemd. file is closed.
+func vsockFileListener(file *os.File) (net.Listener, error) {
+	defer file.Close()
+
+	listener := &vsockListener{}
+
+	err := vsockControl(file, func(fd int) error {
+		dup, err := unix.Dup(fd)
+		if err != nil {
+			return fmt.Errorf("dup: %w", err)
+		}
+
+		unix.CloseOnExec(dup)
+
+		if err := unix.SetNonblock(dup, true); err != nil {
+			_ = unix.Close(dup)
+
+			return fmt.Errorf("set nonblock: %w", err)
+		}
+
+		if sa, err := unix.Getsockname(dup); err == nil {
+			listener.addr = vsockSockaddr(sa)
+		}
+
+		listener.file = newVsockFile(dup)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vsock listener: %w", err)
+	}
+
+	return listener, nil
+}
+
+// Accept waits for and returns the next connection.
+func (l *vsockListener) Accept() (net.Conn, error) {
+	raw, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("raw vsock: %w", vsockError(err))
+	}
+
+	var (
+		fd        int
+		sa        unix.Sockaddr
+		acceptErr error
+	)
+
+	err = raw.Read(func(listenFD uintptr) bool {
+		fd, sa, acceptErr = unix.Accept4(int(listenFD), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+
+		return !errors.Is(acceptErr, unix.EAGAIN)
+	})
+
+	switch {
+	case err != nil && atomic.LoadInt32(&l.closed) != 0:
+		return nil, fmt.Errorf("vsock accept: %w", net.ErrClosed)
+	case err != nil:
+		return nil, fmt.Errorf("vsock accept: %w", vsockError(err))
+	case acceptErr != nil:
+		return nil, fmt.Errorf("vsock accept: %w", acceptErr)
+	}
+
+	return &vsockConn{File: newVsockFile(fd), local: l.addr, remote: vsockSockaddr(sa)}, nil
+}
+
+// Close stops listening. Pending calls of Accept return net.ErrClosed.
+func (l *vsockListener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+
+	return vsockError(l.file.Close())
+}
+
+// Addr returns the address the listener is bound to.
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
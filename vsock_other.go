@@ -0,0 +1,42 @@
+//go:build !linux
+// +build !linux
+
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+package tcpto6
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// dialVsock fails since vsock is only supported on linux.
+func dialVsock(context.Context, string) (net.Conn, error) {
+	return nil, errVsockUnsupported
+}
+
+// listenVsock fails since vsock is only supported on linux.
+func listenVsock(string) (net.Listener, error) {
+	return nil, errVsockUnsupported
+}
+
+// isVsock returns false since vsock is only supported on linux.
+func isVsock(*os.File) bool {
+	return false
+}
+
+// vsockFileListener fails since vsock is only supported on linux.
+func vsockFileListener(*os.File) (net.Listener, error) {
+	return nil, errVsockUnsupported
+}
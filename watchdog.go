@@ -0,0 +1,74 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// writingToBackend and writingToClient index connection.writing.
+	writingToBackend, writingToClient = 0, 1
+	// stuckChecksPerThreshold is how often writes are checked within the stuck threshold.
+	stuckChecksPerThreshold = 4
+)
+
+// watchStuck closes dst and src, the streams towards the backend and client of conn, once a write to either of them did
+// not complete within threshold. That happens if a peer stopped reading without closing its connection, like a
+// half-dead one without keepalive, which would otherwise keep the bridge around forever. Idle connections are not
+// affected since no write is in progress. The state of dstSocket and srcSocket, the connections below the streams, is
+// logged to tell what happened. watchStuck returns when done is closed.
+func (p *proxy) watchStuck(done <-chan struct{}, threshold time.Duration, conn *connection, dst, src io.Closer,
+	dstSocket, srcSocket net.Conn,
+) {
+	interval := threshold / stuckChecksPerThreshold
+	if interval <= 0 {
+		interval = threshold
+	}
+
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+
+		for direction, peer := range [...]string{writingToBackend: "backend", writingToClient: "client"} {
+			started := atomic.LoadInt64(&conn.writing[direction])
+			if started == 0 {
+				continue
+			}
+
+			stuckFor := p.clock.Now().Sub(time.Unix(0, started))
+			if stuckFor < threshold {
+				continue
+			}
+
+			p.log.Info("write did not complete in time, closing stuck bridge", "id", conn.id, "stuckPeer", peer,
+				"stuckFor", stuckFor.Round(time.Millisecond).String(),
+				"clientSocket", socketState(srcSocket), "backendSocket", socketState(dstSocket))
+
+			_ = dst.Close()
+			_ = src.Close()
+
+			return
+		}
+	}
+}
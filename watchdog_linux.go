@@ -0,0 +1,62 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpStates are the names of the TCP states of linux, indexed by their number.
+var tcpStates = []string{
+	"", "established", "syn-sent", "syn-recv", "fin-wait1", "fin-wait2", "time-wait", "close", "close-wait",
+	"last-ack", "listen", "closing",
+}
+
+// socketState describes the TCP state of conn as reported by TCP_INFO, like how much data the peer did not
+// acknowledge yet and how often it was retransmitted. Empty if conn is not a TCP connection.
+func socketState(conn net.Conn) string {
+	sysConn, ok := currentSocket(conn).(syscall.Conn)
+	if !ok {
+		return ""
+	}
+
+	raw, err := sysConn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	var info *unix.TCPInfo
+
+	_ = raw.Control(func(fd uintptr) {
+		info, _ = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+
+	if info == nil {
+		return ""
+	}
+
+	state := fmt.Sprint(info.State)
+	if int(info.State) < len(tcpStates) {
+		state = tcpStates[info.State]
+	}
+
+	return fmt.Sprintf("state=%s unacked=%d retransmits=%d backoff=%d rtt=%s lastAck=%s", state, info.Unacked,
+		info.Retransmits, info.Backoff, time.Duration(info.Rtt)*time.Microsecond,
+		time.Duration(info.Last_ack_recv)*time.Millisecond)
+}
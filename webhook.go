@@ -0,0 +1,208 @@
+// Copyright (C) 2021 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tcpto6
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// connEventOpen is the event sent when a connection was accepted.
+	connEventOpen = "open"
+	// connEventClose is the event sent when a connection is done.
+	connEventClose = "close"
+	// webhookQueueSize is the number of events that may wait to be sent. Further events are dropped.
+	webhookQueueSize = 4096
+	// webhookRetryDelay is the time waited before the first retry of a batch. It doubles with each further one.
+	webhookRetryDelay = time.Second
+	// webhookFlushTimeout is the time the last batch may take to be sent on shutdown.
+	webhookFlushTimeout = 5 * time.Second
+)
+
+// errWebhookStatus is raised if the webhook responds with a non 2xx status.
+var errWebhookStatus = errors.New("webhook responded with unexpected status")
+
+// webhookConfig describes where and how connection events are sent.
+type webhookConfig struct {
+	// url is the HTTP endpoint events are POSTed to. Empty if disabled.
+	url string
+	// token is sent as bearer token if not empty.
+	token string
+	// interval is the time events are collected for at most before they are sent.
+	interval time.Duration
+	// batchSize is the number of events that are sent right away once collected.
+	batchSize int
+	// attempts is the number of times a batch is tried to be sent.
+	attempts int
+}
+
+// connEvent tells that a connection was opened or closed. Open events carry what is known about the connection when
+// it was accepted, close events everything its access log entry does.
+type connEvent struct {
+	Event string `json:"event"`
+	accessEntry
+}
+
+// webhookBody is the JSON document POSTed to the webhook. Instance is the name of the tcp4to6 instance, if known.
+type webhookBody struct {
+	Instance string      `json:"instance,omitempty"`
+	Events   []connEvent `json:"events"`
+	// Dropped is the number of events that were lost since the last batch because too many were waiting or sending
+	// them failed.
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// webhook sends connection events to an HTTP endpoint in batches.
+type webhook struct {
+	cfg      webhookConfig
+	log      logr.Logger
+	instance string
+	client   *http.Client
+	clock    Clock
+	events   chan connEvent
+	// dropped is the number of events lost since the last batch was sent. Accessed atomically.
+	dropped int64
+}
+
+// newWebhook creates a webhook for cfg that waits between retries on clock. Events are sent once run is called.
+func newWebhook(log logr.Logger, cfg webhookConfig, instance string, clock Clock) *webhook {
+	return &webhook{
+		cfg:      cfg,
+		log:      log,
+		instance: instance,
+		client:   &http.Client{Timeout: cfg.interval},
+		clock:    clock,
+		events:   make(chan connEvent, webhookQueueSize),
+	}
+}
+
+// notify queues event to be sent. It never blocks, the event is dropped if too many are waiting already.
+func (w *webhook) notify(event connEvent) {
+	select {
+	case w.events <- event:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+}
+
+// run sends queued events until ctx is canceled. Events are sent once batchSize of them were collected or interval
+// passed. On shutdown, the events still queued are sent one last time.
+func (w *webhook) run(ctx context.Context) {
+	ticker := w.clock.NewTicker(w.cfg.interval)
+	defer ticker.Stop()
+
+	var batch []connEvent
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.flush(batch)
+
+			return
+		case event := <-w.events:
+			if batch = append(batch, event); len(batch) < w.cfg.batchSize {
+				continue
+			}
+		case <-ticker.C():
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		w.send(ctx, batch)
+		batch = nil
+	}
+}
+
+// flush sends batch together with all events that are still queued, bounded by webhookFlushTimeout.
+func (w *webhook) flush(batch []connEvent) {
+	for len(w.events) != 0 {
+		batch = append(batch, <-w.events)
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookFlushTimeout)
+	defer cancel()
+
+	w.send(ctx, batch)
+}
+
+// send POSTs batch to the webhook, trying as often as configured with growing delays in between. If all attempts
+// fail, the batch is logged and counted as lost.
+func (w *webhook) send(ctx context.Context, batch []connEvent) {
+	body := webhookBody{Instance: w.instance, Events: batch, Dropped: atomic.SwapInt64(&w.dropped, 0)}
+	delay := webhookRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(ctx, w.client, w.cfg, body)
+		if err == nil {
+			return
+		}
+
+		if attempt >= w.cfg.attempts || !sleepUnlessDone(ctx, w.clock, delay) {
+			atomic.AddInt64(&w.dropped, int64(len(batch))+body.Dropped)
+			w.log.Error(err, "couldn't send connection events to webhook", "events", len(batch), "attempts", attempt)
+
+			return
+		}
+
+		delay *= 2
+	}
+}
+
+// postWebhook sends body to the endpoint described by cfg.
+func postWebhook(ctx context.Context, client *http.Client, cfg webhookConfig, body webhookBody) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode webhook body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.url, bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if cfg.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", errWebhookStatus, resp.Status)
+	}
+
+	return nil
+}